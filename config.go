@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ghostec/tracer-server/tracerserver"
+	"gopkg.in/yaml.v2"
+)
+
+// Every flag can also be set in the config file, with dashes or
+// underscores, and in the environment as envPrefix followed by its name in
+// upper case, e.g. TRACER_MAX_DEPTH. The command line beats the
+// environment, which beats the file.
+const envPrefix = "TRACER_"
+
+// reloadable are the flags a SIGHUP applies, the others need a restart.
+var reloadable = map[string]bool{
+	"width":           true,
+	"height":          true,
+	"aspect-ratio":    true,
+	"spp":             true,
+	"max-depth":       true,
+	"frame-interval":  true,
+	"max-connections": true,
+	"log-level":       true,
+	"log-json":        true,
+}
+
+type configLoader struct {
+	// explicit are the flags given on the command line.
+	explicit map[string]bool
+}
+
+// newConfigLoader must be called right after flag.Parse, before any flag is
+// set from elsewhere.
+func newConfigLoader() *configLoader {
+	l := &configLoader{explicit: map[string]bool{}}
+	flag.Visit(func(f *flag.Flag) {
+		l.explicit[f.Name] = true
+	})
+	return l
+}
+
+// load resets every flag not given on the command line to its default and
+// applies path, if any, and the environment over it. It returns the flags
+// whose value changed.
+func (l *configLoader) load(path string) ([]string, error) {
+	values := map[string]string{}
+	if path != "" {
+		var err error
+		if values, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))); ok {
+			values[f.Name] = v
+		}
+	})
+
+	var changed []string
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || l.explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		v, ok := values[f.Name]
+		if !ok {
+			v = f.DefValue
+		}
+		old := f.Value.String()
+		if serr := flag.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("%s: %v", f.Name, serr)
+			return
+		}
+		if f.Value.String() != old {
+			changed = append(changed, f.Name)
+		}
+	})
+	return changed, err
+}
+
+// readConfigFile reads a flat YAML or TOML file, told apart by extension,
+// into flag values.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config: unknown format %q, want .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	values := map[string]string{}
+	for k, v := range raw {
+		name := strings.ReplaceAll(k, "_", "-")
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("config: unknown option %q", k)
+		}
+		switch v.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+			return nil, fmt.Errorf("config: %s must be a single value", k)
+		}
+		values[name] = fmt.Sprint(v)
+	}
+	return values, nil
+}
+
+// reloadableOptions are the reloadable flags as Server.Reload takes them.
+func reloadableOptions() tracerserver.Reloadable {
+	return tracerserver.Reloadable{
+		Width:           *width,
+		Height:          *height,
+		AspectRatio:     *aspectRatio,
+		SamplesPerPixel: *spp,
+		MaxDepth:        *maxDepth,
+		FrameInterval:   *frameIntervalFlag,
+		MaxConnections:  *maxConnections,
+		LogLevel:        *logLevelFlag,
+		LogJSON:         *logJSON,
+	}
+}
+
+// reloadOnHangup reloads the config file and environment into srv on every
+// SIGHUP.
+func reloadOnHangup(l *configLoader, srv *tracerserver.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		changed, err := l.load(*configFile)
+		if err == nil {
+			err = srv.Reload(reloadableOptions())
+		}
+		if err != nil {
+			log.Print("reload failed: ", err)
+			continue
+		}
+		for _, name := range changed {
+			if !reloadable[name] {
+				log.Printf("reload: %s changed, it takes a restart to apply", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracer.yaml")
+	if err := ioutil.WriteFile(path, []byte("max_depth: 7\nspp: 3\nwidth: 320\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Deferred first so it runs last, once the environment is back.
+	defer (&configLoader{explicit: map[string]bool{}}).load("")
+	os.Setenv(envPrefix+"SPP", "5")
+	defer os.Unsetenv(envPrefix + "SPP")
+
+	l := &configLoader{explicit: map[string]bool{"width": true}}
+	changed, err := l.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *maxDepth != 7 {
+		t.Errorf("max-depth from the file is %d, want 7", *maxDepth)
+	}
+	if *spp != 5 {
+		t.Errorf("spp is %d, want the environment's 5 over the file's", *spp)
+	}
+	if *width == 320 {
+		t.Error("width given on the command line was overridden by the file")
+	}
+	for _, name := range changed {
+		if !reloadable[name] {
+			t.Errorf("%s changed, but isn't reloadable", name)
+		}
+	}
+}
+
+func TestConfigLoadRejectsUnknownOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracer.toml")
+	if err := ioutil.WriteFile(path, []byte("colour = \"red\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&configLoader{explicit: map[string]bool{}}).load(path); err == nil {
+		t.Error("unknown option accepted")
+	}
+}
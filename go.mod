@@ -1,10 +1,16 @@
 module github.com/ghostec/tracer-server
 
-go 1.15
+go 1.16
 
 require (
-	github.com/ghostec/tracer v0.0.0-20210213213647-11e6154a58da // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/ghostec/tracer v0.0.0-20210213213647-11e6154a58da
+	github.com/gorilla/websocket v1.4.2
+	github.com/pion/webrtc/v3 v3.0.11
+	github.com/prometheus/client_golang v1.9.0
+	google.golang.org/grpc v1.35.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 replace github.com/ghostec/tracer => ../tracer
@@ -1,414 +1,177 @@
 package main
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"flag"
-	"image/png"
-	"io"
+	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
-	"github.com/ghostec/tracer"
-	"github.com/gorilla/websocket"
+	"github.com/ghostec/tracer-server/tracerserver"
 )
 
-var addr = flag.String("addr", "0.0.0.0:8080", "http service address")
-
-type renderer struct {
-	mu sync.Mutex
-
-	sceneFrame *tracer.Frame
-	guiFrame   *tracer.Frame
-	selected   *tracer.BVHNode
-	hovered    *tracer.BVHNode
-	scene      tracer.Hitter
-	camera     tracer.Camera
-	stop       chan bool
-	frameId    uint64
-}
-
-func newFrame() *tracer.Frame {
-	imageWidth := 500
-	imageHeight := int(float64(imageWidth) / (16.0 / 9.0))
-	return tracer.NewFrame(imageWidth, imageHeight, true)
-}
-
-func newRenderer() *renderer {
-	return &renderer{
-		sceneFrame: newFrame(),
-		guiFrame:   newFrame(),
-		stop:       make(chan bool, 1),
-	}
-}
+var (
+	defaults = tracerserver.DefaultOptions()
+
+	addr            = flag.String("addr", "0.0.0.0:8080", "http service address")
+	sceneFile       = flag.String("scene", "", "path to a JSON scene description")
+	watchScene      = flag.Bool("watch-scene", true, "reload the scene file into every session when it changes, keeping their cameras")
+	shared          = flag.Bool("shared", false, "attach all websocket clients to a single shared renderer session")
+	sessionTTL      = flag.Duration("session-ttl", defaults.SessionTTL, "how long a dropped websocket client can reconnect and resume its session, 0 closes sessions right away")
+	scenesDir       = flag.String("scenes-dir", defaults.ScenesDir, "directory named scenes are saved to and loaded from")
+	historyLen      = flag.Int("history", defaults.History, "undo steps kept per session, 0 disables undo")
+	frameHistoryLen = flag.Int("frame-history", defaults.FrameHistory, "frames kept per session to scrub back to, 0 disables the frame history")
+	frameHistoryGap = flag.Duration("frame-history-interval", defaults.FrameHistoryInterval, "time between the frames kept in the frame history")
+	envFile         = flag.String("environment", "", "equirectangular HDR, PNG or JPEG image to register as an environment and light new sessions with")
+	grpcAddr        = flag.String("grpc-addr", "", "gRPC service address, disabled if empty")
+	jobWorkers      = flag.Int("job-workers", defaults.JobWorkers, "number of render jobs (snapshots included) run concurrently")
+	renderWorkers   = flag.Int("render-workers", defaults.RenderWorkers, "number of goroutines rendering the tiles of interactive passes, shared by every session")
+	saveOnExit      = flag.String("save-on-exit", "", "scene name to save each session's scene and camera as on shutdown, disabled if empty")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "how long shutdown waits for connections to close")
+	transitionTime  = flag.Duration("camera-transition", defaults.CameraTransition, "how long switching to a camera preset animates the camera for, 0 to jump")
+	logLevelFlag    = flag.String("log-level", defaults.LogLevel, "least severe log lines written: debug, info, warn or error")
+	logJSON         = flag.Bool("log-json", false, "write log lines as JSON objects instead of text")
+	rateLimit       = flag.Float64("rate-limit", defaults.RateLimit, "scales the per connection websocket message rate limits, 0 disables them")
+	staticDir       = flag.String("static-dir", "", "serve the frontend from this directory instead of the one built in, to work on it without rebuilding")
+
+	configFile        = flag.String("config", "", "YAML or TOML file setting any of these flags, reloaded on SIGHUP")
+	width             = flag.Int("width", defaults.Width, "default frame width")
+	height            = flag.Int("height", defaults.Height, "default frame height, ignored when aspect-ratio is set")
+	aspectRatio       = flag.Float64("aspect-ratio", 0, "derive the default frame height from width, 0 to use height")
+	spp               = flag.Int("spp", defaults.SamplesPerPixel, "default samples per pixel per pass")
+	maxDepth          = flag.Int("max-depth", defaults.MaxDepth, "default maximum ray bounces")
+	frameIntervalFlag = flag.Duration("frame-interval", defaults.FrameInterval, "default time between frames sent to clients")
+	tlsCert           = flag.String("tls-cert", "", "TLS certificate file, serves HTTPS together with tls-key")
+	tlsKey            = flag.String("tls-key", "", "TLS private key file")
+	maxConnections    = flag.Int("max-connections", 0, "maximum concurrent websocket connections, 0 for no limit")
+	trustProxy        = flag.Bool("trust-proxy", false, "honour X-Forwarded-Host and -For, only set this behind a reverse proxy")
+	allowedOrigins    = flag.String("allowed-origins", "", "comma separated websocket origins allowed besides the server's own, * for any")
+	renderOnceOut     = flag.String("render-once", "", "render the scene to this .png or .exr file at the default settings, spp counting the whole render, and exit without serving")
+	debugEndpoints    = flag.Bool("debug", false, "serve net/http/pprof under /debug/pprof/ and renderer internals at /debug/render to admins")
+	bench             = flag.Bool("bench", false, "run the benchmark GET /benchmark runs with its defaults, print the JSON result and exit without serving")
+	authTokens        = flag.String("auth-tokens", "", "file of \"token role [name]\" lines, roles are viewer, editor and admin; anyone is an admin if empty")
+	webhooks          = flag.String("webhooks", "", "comma separated URLs every server event is POSTed to as JSON")
+	convergedAt       = flag.Float64("converged-threshold", defaults.ConvergedThreshold, "share of converged pixels a render fires the converged event at, 0 never fires it")
+)
 
-func (r *renderer) loadScene() error {
-	l := tracer.HitterList{
-		tracer.Sphere{Center: tracer.Point3{0, -100.5, -1}, Radius: 100, Material: tracer.Lambertian{Albedo: tracer.Color{0.8, 0.8, 0}}},
-		tracer.Sphere{Center: tracer.Point3{0, 0, -1}, Radius: 0.5, Material: tracer.Lambertian{Albedo: tracer.Color{0.1, 0.2, 0.5}}},
-		tracer.Sphere{Center: tracer.Point3{-1, 0, -1}, Radius: 0.5, Material: tracer.Dielectric{RefractiveIndex: 1.5}},
-		tracer.Sphere{Center: tracer.Point3{-1, 0, -1}, Radius: -0.48, Material: tracer.Dielectric{RefractiveIndex: 1.5}},
-		tracer.Sphere{Center: tracer.Point3{1, 0, -1}, Radius: 0.5, Material: tracer.Metal{Albedo: tracer.Color{0.8, 0.6, 0.2}}},
+func main() {
+	flag.Parse()
+	config := newConfigLoader()
+	if _, err := config.load(*configFile); err != nil {
+		log.Fatal(err)
 	}
-
-	bvh, err := tracer.NewBVHNode(l)
+	opts, err := options()
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-
-	cam := tracer.Camera{
-		AspectRatio: 16.0 / 9.0,
-		VFoV:        90,
-		LookFrom:    tracer.Point3{-0, 2, 1},
-		LookAt:      tracer.Point3{0, 0, -1},
-		VUp:         tracer.Vec3{0, 1, 0},
-	}
-
-	r.scene = bvh
-	r.camera = cam
-
-	return nil
-}
-
-func (r *renderer) render() {
-	r.mu.Lock()
-	frameId := r.frameId
-	r.mu.Unlock()
-
-	frame := newFrame()
-
-	tracer.Render(tracer.RenderSettings{
-		Frame:           frame,
-		Camera:          r.camera,
-		Hitter:          r.scene,
-		RayColorFunc:    tracer.RayColor,
-		AggColorFunc:    tracer.AvgSamples,
-		SamplesPerPixel: 1,
-		MaxDepth:        50,
-	}, r.stop)
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.frameId == frameId {
-		r.sceneFrame.Avg(frame)
+	srv, err := tracerserver.NewServer(opts)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func (r *renderer) renderGUI() {
-	r.mu.Lock()
-	frameId := r.frameId
-	r.mu.Unlock()
-
-	guiFrame := newFrame()
-
-	if r.hovered != nil {
-		hoveredBVH, err := tracer.NewBVHNode(tracer.HitterList{r.hovered.Left})
-		if err != nil {
-			panic(errors.New("placeholder"))
+	if *bench {
+		if err := srv.Benchmark(context.Background(), os.Stdout); err != nil {
+			log.Fatal("bench:", err)
 		}
-
-		edgesFrame := tracer.NewFrame(r.sceneFrame.Width(), r.sceneFrame.Height(), true)
-		tracer.Render(tracer.RenderSettings{
-			Frame:           edgesFrame,
-			Camera:          r.camera,
-			Hitter:          hoveredBVH,
-			RayColorFunc:    tracer.RayBVHID,
-			AggColorFunc:    tracer.EdgeSamples,
-			SamplesPerPixel: 1,
-		}, r.stop)
-		edgesFrame = tracer.ToEdgesFrame(edgesFrame, tracer.Color{255, 255, 0})
-		guiFrame.Blend(edgesFrame, 1.0, 1.0)
+		return
 	}
-
-	if r.selected != nil {
-		selectedBVH, err := tracer.NewBVHNode(tracer.HitterList{r.selected.Left})
-		if err != nil {
-			panic(errors.New("placeholder"))
+	if *renderOnceOut != "" {
+		if err := srv.RenderOnce(*renderOnceOut); err != nil {
+			log.Fatal("render-once:", err)
 		}
-
-		edgesFrame := tracer.NewFrame(r.sceneFrame.Width(), r.sceneFrame.Height(), true)
-		tracer.Render(tracer.RenderSettings{
-			Frame:           edgesFrame,
-			Camera:          r.camera,
-			Hitter:          selectedBVH,
-			RayColorFunc:    tracer.RayBVHID,
-			AggColorFunc:    tracer.EdgeSamples,
-			SamplesPerPixel: 1,
-		}, r.stop)
-		edgesFrame = tracer.ToEdgesFrame(edgesFrame, tracer.Color{255, 0, 0})
-		guiFrame.Blend(edgesFrame, 1.0, 1.0)
+		return
 	}
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	if r.frameId == frameId {
-		r.guiFrame = guiFrame
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("tls-cert and tls-key must be set together")
 	}
-}
-
-func (r *renderer) mousemove(x, y int) {
-	hr := r.scene.Hit(r.camera.GetRay(tracer.CameraCoordinatesFromPixel(y, x, r.sceneFrame.Width(), r.sceneFrame.Height())))
-
-	r.mu.Lock()
-	switch hr.Hit {
-	case true:
-		r.hovered = &hr.BVHNode
-	case false:
-		r.hovered = nil
+	if *sceneFile != "" && *watchScene {
+		if err := srv.WatchScene(*sceneFile); err != nil {
+			log.Fatal("watch-scene:", err)
+		}
 	}
-	r.mu.Unlock()
-
-	r.renderGUI()
-}
-
-func (r *renderer) mouseclick(x, y int) {
-	hr := r.scene.Hit(r.camera.GetRay(tracer.CameraCoordinatesFromPixel(y, x, r.sceneFrame.Width(), r.sceneFrame.Height())))
-
-	r.mu.Lock()
-	switch hr.Hit {
-	case true:
-		r.selected = &hr.BVHNode
-	case false:
-		r.selected = nil
+	if *grpcAddr != "" {
+		go func() {
+			if err := srv.ServeGRPC(*grpcAddr); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
-	r.mu.Unlock()
-
-	r.renderGUI()
-}
-
-func (r *renderer) reset() {
-	r.mu.Lock()
-	close(r.stop)
-	r.stop = make(chan bool, 1)
-	r.sceneFrame = newFrame()
-	r.guiFrame = newFrame()
-	r.frameId += 1
-	r.mu.Unlock()
-}
 
-func (r *renderer) Encode(w io.Writer) error {
-	frame := newFrame()
+	go reloadOnHangup(config, srv)
 
-	r.mu.Lock()
-	frame.Blend(r.guiFrame, 1.0, 1.0)
-	frame.Blend(r.sceneFrame, 1.0, 1.0)
-	r.mu.Unlock()
-
-	return png.Encode(w, tracer.NewPPM(frame))
-}
-
-var rendererObj = newRenderer()
-
-func main() {
-	flag.Parse()
-	tracer.DefaultRenderer.Start()
-	rendererObj.loadScene()
-	http.HandleFunc("/ws", ws)
-	http.HandleFunc("/frame.png", frame)
-	http.HandleFunc("/", home)
+	httpSrv := &http.Server{Addr: *addr, Handler: srv.Handler()}
+	stopped := make(chan struct{})
 	go func() {
-		for {
-			rendererObj.render()
+		log.Print("shutting down: ", waitForSignal())
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		httpDone := make(chan error, 1)
+		go func() {
+			httpDone <- httpSrv.Shutdown(ctx)
+		}()
+		srv.Shutdown(ctx)
+		if err := <-httpDone; err != nil {
+			log.Print("shutdown: closing http server failed: ", err)
 		}
+		close(stopped)
 	}()
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	if *tlsCert != "" {
+		err = httpSrv.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = httpSrv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
 
-func ws(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("upgrade:", err)
-		return
+// options are the flags as tracerserver.NewServer takes them.
+func options() (tracerserver.Options, error) {
+	opts := tracerserver.Options{
+		Environment:          *envFile,
+		Shared:               *shared,
+		SessionTTL:           *sessionTTL,
+		ScenesDir:            *scenesDir,
+		History:              *historyLen,
+		FrameHistory:         *frameHistoryLen,
+		FrameHistoryInterval: *frameHistoryGap,
+		JobWorkers:           *jobWorkers,
+		RenderWorkers:        *renderWorkers,
+		SaveOnExit:           *saveOnExit,
+		CameraTransition:     *transitionTime,
+		RateLimit:            *rateLimit,
+		StaticDir:            *staticDir,
+		Debug:                *debugEndpoints,
+		TrustProxy:           *trustProxy,
+		AllowedOrigins:       *allowedOrigins,
+		AuthTokens:           *authTokens,
+		ConvergedThreshold:   *convergedAt,
+		Reloadable:           reloadableOptions(),
 	}
-	defer c.Close()
-	c.EnableWriteCompression(true)
-
-	go func() {
-		for {
-			start := time.Now()
-			buf := bytes.NewBuffer(nil)
-			if err := rendererObj.Encode(buf); err != nil {
-				panic(err)
-			}
-			if err := c.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
-				panic(err)
-			}
-			elapsed := time.Now().Sub(start)
-			toSleep := math.Max(0.0, float64(200-elapsed.Milliseconds()))
-			time.Sleep(time.Duration(toSleep) * time.Millisecond)
+	for _, u := range strings.Split(*webhooks, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			opts.Webhooks = append(opts.Webhooks, u)
 		}
-	}()
-
-	for {
-		_, message, err := c.ReadMessage()
+	}
+	if *sceneFile != "" {
+		data, err := ioutil.ReadFile(*sceneFile)
 		if err != nil {
-			log.Println("read:", err)
-			break
-		}
-		// log.Printf("recv: %s", message)
-		msg := string(message)
-		switch {
-		case msg == "1":
-			rendererObj.camera.LookFrom[2] -= 0.5
-		case msg == "2":
-			rendererObj.camera.LookFrom[2] += 0.5
-		case msg == "3":
-			rendererObj.camera.LookFrom[0] -= 0.5
-		case msg == "4":
-			rendererObj.camera.LookFrom[0] += 0.5
-		case strings.HasPrefix(msg, "mousemove") || strings.HasPrefix(msg, "mouseclick"):
-			parts := strings.Split(msg, " ")
-			if len(parts) != 3 {
-				continue
-			}
-			x, err := strconv.Atoi(parts[1])
-			if err != nil {
-				continue
-			}
-			y, err := strconv.Atoi(parts[2])
-			if err != nil {
-				continue
-			}
-
-			switch parts[0] {
-			case "mousemove":
-				rendererObj.mousemove(x, y)
-			case "mouseclick":
-				rendererObj.mouseclick(x, y)
-			}
-			fallthrough
-		default:
-			continue
+			return tracerserver.Options{}, err
 		}
-		rendererObj.reset()
+		opts.Scene = data
 	}
+	return opts, nil
 }
 
-func frame(w http.ResponseWriter, r *http.Request) {
-	if err := rendererObj.Encode(w); err != nil {
-		log.Println("encode:", err)
-	}
+// waitForSignal blocks until SIGINT or SIGTERM.
+func waitForSignal() os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	return <-c
 }
-
-func home(w http.ResponseWriter, r *http.Request) {
-	homeTemplate.Execute(w, "ws://"+r.Host+"/ws")
-}
-
-var homeTemplate = template.Must(template.New("").Parse(`
-<!DOCTYPE html>
-<html>
-<head>
-<meta charset="utf-8">
-</head>
-<body>
-	<script>  
-		var ws;
-		ws = new WebSocket("{{.}}");
-		ws.onopen = function(evt) {
-			document.onkeypress = function (e) {
-				e = e || window.event;
-				switch (String.fromCharCode(e.keyCode)) {
-						case "w":
-								ws.send(1);
-								break;
-						case "s":
-								ws.send(2);
-								break;
-						case "a":
-								ws.send(3);
-								break;
-						case "d":
-								ws.send(4);
-								break;
-				}
-			};
-		}
-		ws.onclose = function(evt) {
-			ws = null;
-		}
-		ws.onmessage = function(evt) {
-			const blob = new Blob([evt.data], {type: 'image/png'});
-			const el = document.getElementById("image");
-			el.src = URL.createObjectURL(blob);    
-		}
-		ws.onerror = function(evt) {
-			console.log("ERROR: " + evt.data);
-		}
-
-		function refreshImage() {    
-			const timestamp = new Date().getTime();  
-			const el = document.getElementById("image");
-			const queryString = "?t=" + timestamp;
-			el.src = "frame.png" + queryString;    
-		}
-		
-		// setInterval(refreshImage, 1000);
-
-		function _onMouseMove(event) {
-			const { offsetX, offsetY } = event;
-			ws.send("mousemove " + offsetX + " " + offsetY);
-		}
-
-		function debounce(func, wait, immediate) {
-			var timeout;
-
-			return function executedFunction() {
-				var context = this;
-				var args = arguments;
-					
-				var later = function() {
-					timeout = null;
-					if (!immediate) func.apply(context, args);
-				};
-
-				var callNow = immediate && !timeout;
-			
-				clearTimeout(timeout);
-
-				timeout = setTimeout(later, wait);
-			
-				if (callNow) func.apply(context, args);
-			};
-		};
-
-		function throttle(func, delay) {
-			let timerId;
-
-			return function executedFunction() {
-				const context = this;
-				const args = arguments;
-
-				// If setTimeout is already scheduled, no need to do anything
-				if (timerId) {
-					return
-				}
-
-					func.apply(context, args);
-
-				// Schedule a setTimeout after delay seconds
-				timerId  =  setTimeout(function () { timerId = undefined; }, delay)
-			}
-		}
-
-		const	onMouseMove = throttle(_onMouseMove, 1000)
-
-		function onClick(event) {
-		  const rect = event.target.getBoundingClientRect()
-			const x = event.clientX - rect.left
-			const y = event.clientY - rect.top
-			ws.send("mouseclick " + x + " " + y);
-		}
-	</script>
-	<img id="image" onclick="onClick(event)" />
-</body>
-</html>
-`))
@@ -0,0 +1,101 @@
+package tracerserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// defaultAccumCache is how many accumulations a renderer keeps around after
+// moving on from them.
+const defaultAccumCache = 8
+
+// accumulation is what a generation had accumulated when it was reset.
+type accumulation struct {
+	key        uint64
+	scene      *tracer.Frame
+	passes     int
+	samples    *sampleStats
+	rays       int64
+	renderTime time.Duration
+	lastPass   time.Duration
+}
+
+// accumCache holds the accumulations of the last limit states rendered,
+// least recently used first, so going back to one of them, by undo or by
+// moving the camera back, picks up where it was left rather than starting
+// over.
+type accumCache struct {
+	limit   int
+	entries []accumulation
+}
+
+// put caches a, replacing whatever was cached for the same state.
+func (c *accumCache) put(a accumulation) {
+	if c.limit <= 0 {
+		return
+	}
+	c.take(a.key)
+	c.entries = append(c.entries, a)
+	if len(c.entries) > c.limit {
+		c.entries = c.entries[len(c.entries)-c.limit:]
+	}
+}
+
+// take removes and returns the accumulation cached for key. The frames go
+// with it, the generation restoring it accumulates into them.
+func (c *accumCache) take(key uint64) (accumulation, bool) {
+	for i, a := range c.entries {
+		if a.key == key {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			return a, true
+		}
+	}
+	return accumulation{}, false
+}
+
+// stateKeyLocked identifies what the scene frame is rendering: the camera,
+// the settings at the current scale, the scene's version and the shading.
+func (r *renderer) stateKeyLocked() uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v|%v|%d|%d|%d", r.camera, r.frameSettings(), r.sceneVersion, r.lesson, r.solo)
+	return h.Sum64()
+}
+
+// bumpSceneLocked gives the objects a new version, so accumulations of the
+// ones they replace aren't restored over them.
+func (r *renderer) bumpSceneLocked() {
+	r.versions++
+	r.sceneVersion = r.versions
+}
+
+// stashLocked caches what g accumulated.
+func (r *renderer) stashLocked(g *generation) {
+	if g.passes == 0 {
+		return
+	}
+	r.accum.put(accumulation{
+		key:        g.key,
+		scene:      g.scene,
+		passes:     g.passes,
+		samples:    g.samples,
+		rays:       g.rays,
+		renderTime: g.renderTime,
+		lastPass:   g.lastPass,
+	})
+}
+
+// restoreAccumLocked continues g from the accumulation cached for its
+// state, if there is one.
+func (r *renderer) restoreAccumLocked(g *generation) {
+	a, ok := r.accum.take(g.key)
+	if !ok {
+		accumCacheLookups.WithLabelValues("miss").Inc()
+		return
+	}
+	accumCacheLookups.WithLabelValues("hit").Inc()
+	g.scene, g.passes, g.samples = a.scene, a.passes, a.samples
+	g.rays, g.renderTime, g.lastPass = a.rays, a.renderTime, a.lastPass
+}
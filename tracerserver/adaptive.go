@@ -0,0 +1,223 @@
+package tracerserver
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// Adaptive sampling spends each pass's budget of SamplesPerPixel per pixel
+// where the estimate is still noisy. Every pixel first gets
+// adaptiveMinSamples, after that samples go to pixels in proportion to their
+// relative standard error, and pixels under adaptiveThreshold get none.
+const (
+	adaptiveMinSamples = 4
+	adaptiveMaxPerPass = 64
+	adaptiveThreshold  = 0.02
+	// adaptiveEpsilon keeps near black pixels, where any noise is a large
+	// relative error, from taking the whole budget.
+	adaptiveEpsilon = 0.01
+)
+
+// sampleStats accumulates per pixel sample sums, with luminance moments for
+// the variance.
+type sampleStats struct {
+	width, height int
+	sum           []tracer.Vec3
+	lum, lumSq    []float64
+	n             []int
+}
+
+func newSampleStats(width, height int) *sampleStats {
+	return &sampleStats{
+		width:  width,
+		height: height,
+		sum:    make([]tracer.Vec3, width*height),
+		lum:    make([]float64, width*height),
+		lumSq:  make([]float64, width*height),
+		n:      make([]int, width*height),
+	}
+}
+
+func luminance(c tracer.Color) float64 {
+	return 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+}
+
+func (s *sampleStats) add(i int, c tracer.Color) {
+	l := luminance(c)
+	s.sum[i] = s.sum[i].Add(c.Vec3())
+	s.lum[i] += l
+	s.lumSq[i] += l * l
+	s.n[i]++
+}
+
+// addFrame adds every pixel of f as one sample. Each pass's average has the
+// same expected value as a single sample, so the error estimate holds.
+func (s *sampleStats) addFrame(f *tracer.Frame) {
+	for row := 0; row < s.height; row++ {
+		for col := 0; col < s.width; col++ {
+			s.add(row*s.width+col, f.Get(row, col))
+		}
+	}
+}
+
+func (s *sampleStats) merge(o *sampleStats) {
+	for i, n := range o.n {
+		if n == 0 {
+			continue
+		}
+		s.sum[i] = s.sum[i].Add(o.sum[i])
+		s.lum[i] += o.lum[i]
+		s.lumSq[i] += o.lumSq[i]
+		s.n[i] += n
+	}
+}
+
+// relErr is pixel i's standard error relative to its mean luminance.
+func (s *sampleStats) relErr(i int) float64 {
+	n := float64(s.n[i])
+	if n < 2 {
+		return math.Inf(1)
+	}
+	mean := s.lum[i] / n
+	variance := math.Max(0, (s.lumSq[i]/n-mean*mean)*n/(n-1))
+	return math.Sqrt(variance/n) / (mean + adaptiveEpsilon)
+}
+
+func (s *sampleStats) converged(i int) bool {
+	return s.n[i] >= adaptiveMinSamples && s.relErr(i) <= adaptiveThreshold
+}
+
+// schedule returns how many samples each pixel gets this pass, and their
+// total.
+func (s *sampleStats) schedule(spp int) ([]int, int) {
+	counts := make([]int, len(s.n))
+	errs := make([]float64, len(s.n))
+	total, sum := 0, 0.0
+	for i, n := range s.n {
+		if n < adaptiveMinSamples {
+			counts[i] = minInt(adaptiveMinSamples-n, spp)
+			total += counts[i]
+			continue
+		}
+		if e := s.relErr(i); e > adaptiveThreshold {
+			errs[i] = e
+			sum += e
+		}
+	}
+
+	rest := len(s.n)*spp - total
+	if rest <= 0 || sum == 0 {
+		return counts, total
+	}
+	for i, e := range errs {
+		if e == 0 {
+			continue
+		}
+		want := float64(rest) * e / sum
+		c := int(want)
+		if rand.Float64() < want-float64(c) {
+			c++
+		}
+		c = minInt(c, adaptiveMaxPerPass)
+		counts[i] += c
+		total += c
+	}
+	return counts, total
+}
+
+func (s *sampleStats) convergence() convergencePayload {
+	converged, samples := 0, 0
+	for i, n := range s.n {
+		samples += n
+		if s.converged(i) {
+			converged++
+		}
+	}
+	return convergencePayload{
+		Converged:   float64(converged) / float64(len(s.n)),
+		MeanSamples: float64(samples) / float64(len(s.n)),
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// renderAdaptive is one adaptive pass over gen. Once every pixel converged
+// it waits for the next reset instead of spinning.
+func (r *renderer) renderAdaptive(gen *generation, camera tracer.Camera, scene tracer.Hitter, settings renderSettings, rayColorFunc tracer.RayColorFunc, maxDepth int) {
+	w, h := settings.Width, settings.Height
+
+	r.mu.Lock()
+	if gen.samples == nil || gen.samples.width != w || gen.samples.height != h {
+		gen.samples = newSampleStats(w, h)
+	}
+	counts, total := gen.samples.schedule(settings.SamplesPerPixel)
+	r.mu.Unlock()
+
+	if total == 0 {
+		<-gen.ctx.Done()
+		return
+	}
+
+	start := time.Now()
+	sampler := newPixelSampler(camera, scene, rayColorFunc, maxDepth, w, h)
+	pass := newSampleStats(w, h)
+	renderTiles.run(gen.ctx, interactiveTiles, image.Rect(0, 0, w, h), func(tile image.Rectangle) {
+		rnd := tileRand()
+		var i int
+		add := func(c tracer.Color) { pass.add(i, c) }
+		for row := tile.Min.Y; row < tile.Max.Y; row++ {
+			for col := tile.Min.X; col < tile.Max.X; col++ {
+				i = row*w + col
+				sampler.samplePixel(row, col, counts[i], rnd, add)
+			}
+		}
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if gen.ctx.Err() != nil {
+		return
+	}
+	gen.samples.merge(pass)
+	for i, n := range pass.n {
+		if n == 0 {
+			continue
+		}
+		acc := gen.samples
+		gen.scene.Set(i/w, i%w, tracer.Color(acc.sum[i].MulFloat(1/float64(acc.n[i]))))
+	}
+	gen.recordPassLocked(total, time.Since(start))
+	r.checkConvergedLocked(gen)
+}
+
+// checkConvergedLocked fires EventConverged the first time gen's converged
+// pixels reach Options.ConvergedThreshold.
+func (r *renderer) checkConvergedLocked(gen *generation) {
+	if options.ConvergedThreshold <= 0 || gen.converged || gen.samples == nil {
+		return
+	}
+	if c := gen.samples.convergence().Converged; c >= options.ConvergedThreshold {
+		gen.converged = true
+		hooks.emit(Event{Type: EventConverged, Session: r.session, Converged: c})
+	}
+}
+
+// convergence reports how far adaptive sampling got, false when it's off.
+func (r *renderer) convergence() (convergencePayload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.settings.Adaptive || r.gen.samples == nil {
+		return convergencePayload{}, false
+	}
+	return r.gen.samples.convergence(), true
+}
@@ -0,0 +1,172 @@
+package tracerserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/ghostec/tracer"
+)
+
+// animationDesc is the animation part of a jobRequest, keyframes rendered
+// at FPS, defaultAnimFPS if it's 0.
+type animationDesc struct {
+	Keyframes []keyframe `json:"keyframes"`
+	FPS       int        `json:"fps"`
+}
+
+func (a animationDesc) job(scene tracer.Hitter, rayColorFunc tracer.RayColorFunc, settings renderSettings) (*renderJob, error) {
+	t, err := newTimeline(a.Keyframes)
+	if err != nil {
+		return nil, err
+	}
+	fps := a.FPS
+	if fps == 0 {
+		fps = defaultAnimFPS
+	}
+	descs, err := t.frames(fps)
+	if err != nil {
+		return nil, err
+	}
+	return newAnimationJob(scene, cameras(descs), rayColorFunc, settings, fps), nil
+}
+
+// newAnimationJob is a job rendering a frame per camera, each at settings.
+func newAnimationJob(scene tracer.Hitter, cams []tracer.Camera, rayColorFunc tracer.RayColorFunc, settings renderSettings, fps int) *renderJob {
+	j := newRenderJob(scene, cams[0], rayColorFunc, settings)
+	for i := range cams {
+		cams[i].AspectRatio = j.camera.AspectRatio
+	}
+	j.cameras = cams
+	j.fps = fps
+	return j
+}
+
+// videoCodecs are the ffmpeg encoders of the video formats an animation
+// can be downloaded as.
+var videoCodecs = map[string][]string{
+	"mp4":  {"-c:v", "libx264", "-pix_fmt", "yuv420p"},
+	"webm": {"-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "30"},
+}
+
+// writeAnimationResult responds with a finished animation's frames, as a
+// zip of numbered PNGs or, with ?format=mp4 or webm, a video.
+func writeAnimationResult(w http.ResponseWriter, r *http.Request, j *renderJob) {
+	if j.err != nil {
+		http.Error(w, j.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, frames, ok := j.result()
+	if !ok {
+		http.Error(w, errResultGone.Error(), http.StatusGone)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	var (
+		buf         bytes.Buffer
+		contentType string
+		err         error
+	)
+	switch format {
+	case "", "zip":
+		contentType = "application/zip"
+		err = writeFrameZip(&buf, frames)
+	case "mp4", "webm":
+		contentType = "video/" + format
+		err = encodeVideo(&buf, frames, j.fps, format)
+	default:
+		http.Error(w, fmt.Sprintf("%v %q, want zip, mp4 or webm", errUnknownFormat, format), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errEncoderUnavailable):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	default:
+		requestLog(r).Error("animation failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j.release()
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+func frameName(i int) string {
+	return fmt.Sprintf("frame%05d.png", i)
+}
+
+func writeFrameZip(w io.Writer, frames []*tracer.Frame) error {
+	zw := zip.NewWriter(w)
+	for i, frame := range frames {
+		// PNGs are compressed already.
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: frameName(i), Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(f, tracer.NewPPM(frame)); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// encodeVideo shells out to ffmpeg with the frames written as PNGs to a
+// temp dir.
+func encodeVideo(w io.Writer, frames []*tracer.Frame, fps int, format string) error {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("%w: ffmpeg not found in PATH", errEncoderUnavailable)
+	}
+
+	dir, err := ioutil.TempDir("", "tracer-ffmpeg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for i, frame := range frames {
+		f, err := os.Create(filepath.Join(dir, frameName(i)))
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(f, tracer.NewPPM(frame)); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	out := filepath.Join(dir, "animation."+format)
+	args := []string{"-loglevel", "error", "-framerate", fmt.Sprint(fps), "-i", filepath.Join(dir, "frame%05d.png"),
+		// yuv420p needs even dimensions.
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2"}
+	args = append(append(args, videoCodecs[format]...), out)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, stderr.String())
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
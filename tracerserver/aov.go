@@ -0,0 +1,148 @@
+package tracerserver
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/ghostec/tracer"
+)
+
+// aovPasses are the auxiliary buffers that can be viewed or downloaded in
+// place of the beauty pass. They only depend on the primary hit, so one
+// sample per pixel is all they take, and they are cached until the next
+// reset.
+var aovPasses = map[string]tracer.RayColorFunc{
+	"depth":  aovDepth,
+	"normal": aovNormal,
+	"albedo": aovAlbedo,
+	"bvh_id": tracer.RayBVHID,
+}
+
+const beautyPass = "beauty"
+
+func aovNames() []string {
+	names := []string{beautyPass}
+	for name := range aovPasses {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// aovDepth is the hit distance, normalized per frame by normalizeDepth. A
+// miss is left at zero.
+func aovDepth(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+	hr := n.Hit(r)
+	if !hr.Hit {
+		return tracer.Color{}
+	}
+	d := hr.P.Vec3().Sub(r.Origin.Vec3()).Len()
+	return tracer.Color{d, d, d}
+}
+
+func aovNormal(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+	hr := n.Hit(r)
+	if !hr.Hit {
+		return tracer.Color{}
+	}
+	return tracer.Color(hr.Normal.Unit().Add(tracer.Vec3{1, 1, 1}).MulFloat(0.5))
+}
+
+func aovAlbedo(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+	hr := n.Hit(r)
+	if !hr.Hit {
+		return tracer.Color{}
+	}
+	switch m := hr.Material.(type) {
+	case tracer.Lambertian:
+		return m.Albedo
+	case tracer.Metal:
+		return m.Albedo
+	case textured:
+		return m.albedoAt(hr)
+	default:
+		return tracer.Color{1, 1, 1}
+	}
+}
+
+// normalizeDepth scales f so the farthest hit is 1.
+func normalizeDepth(f *tracer.Frame) {
+	max := 0.0
+	for row := 0; row < f.Height(); row++ {
+		for col := 0; col < f.Width(); col++ {
+			max = math.Max(max, f.Get(row, col)[0])
+		}
+	}
+	if max == 0 {
+		return
+	}
+	for row := 0; row < f.Height(); row++ {
+		for col := 0; col < f.Width(); col++ {
+			f.Set(row, col, tracer.Color(f.Get(row, col).Vec3().MulFloat(1/max)))
+		}
+	}
+}
+
+// aov returns pass rendered at the full resolution for the current
+// generation.
+func (r *renderer) aov(pass string) (*tracer.Frame, error) {
+	rayColorFunc, ok := aovPasses[pass]
+	if !ok {
+		return nil, fmt.Errorf("unknown pass %q, want one of %v", pass, aovNames())
+	}
+
+	r.mu.Lock()
+	gen, scene, settings := r.gen, clipped(r.scene, r.settings.Clip), r.settings
+	camera := gen.camera
+	if f, ok := gen.aovs[pass]; ok {
+		r.mu.Unlock()
+		return f, nil
+	}
+	r.mu.Unlock()
+
+	frame := newFrame(settings)
+	tracer.Render(tracer.RenderSettings{
+		Frame:           frame,
+		Camera:          camera,
+		Hitter:          scene,
+		RayColorFunc:    withProjection(rayColorFunc, camera, settings),
+		AggColorFunc:    tracer.AvgSamples,
+		SamplesPerPixel: 1,
+		MaxDepth:        1,
+	}, gen.stop)
+	if pass == "depth" {
+		normalizeDepth(frame)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A reset halfway through leaves a partial frame, worth showing once
+	// but not keeping.
+	if gen.ctx.Err() == nil {
+		if gen.aovs == nil {
+			gen.aovs = map[string]*tracer.Frame{}
+		}
+		gen.aovs[pass] = frame
+	}
+	return frame, nil
+}
+
+// passImage is Image for the beauty pass, without the GUI overlay unless
+// gui, and the bare AOV otherwise.
+func (r *renderer) passImage(pass string, gui bool) (image.Image, error) {
+	f, err := r.passFrame(pass, gui)
+	if err != nil {
+		return nil, err
+	}
+	return tracer.NewPPM(f), nil
+}
+
+// passFrame is passImage before it's quantized to 8 bits.
+func (r *renderer) passFrame(pass string, gui bool) (*tracer.Frame, error) {
+	if pass == "" || pass == beautyPass {
+		return r.composite(gui), nil
+	}
+	return r.aov(pass)
+}
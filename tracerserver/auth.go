@@ -0,0 +1,208 @@
+package tracerserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// role is what a token may do, each role can do everything the ones below
+// it can.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer streams frames.
+	roleViewer
+	// roleEditor drives the camera and edits the scene.
+	roleEditor
+	// roleAdmin manages jobs and settings.
+	roleAdmin
+)
+
+var roleNames = map[string]role{"viewer": roleViewer, "editor": roleEditor, "admin": roleAdmin}
+
+func (r role) String() string {
+	for name, v := range roleNames {
+		if v == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+type principal struct {
+	name string
+	role role
+}
+
+// authenticator maps API tokens to who holds them. Tokens are only kept
+// hashed.
+type authenticator struct {
+	tokens map[[sha256.Size]byte]principal
+}
+
+// auth is nil, and everyone is an admin, unless Options.AuthTokens is set.
+var auth *authenticator
+
+// loadTokens reads one token per line, as "token role [name]". Blank
+// lines and lines starting with # are skipped.
+func loadTokens(path string) (*authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &authenticator{tokens: map[[sha256.Size]byte]principal{}}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want \"token role [name]\"", path, line)
+		}
+		r, ok := roleNames[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown role %q", path, line, fields[1])
+		}
+		p := principal{name: fmt.Sprintf("token%d", line), role: r}
+		if len(fields) == 3 {
+			p.name = fields[2]
+		}
+		a.tokens[sha256.Sum256([]byte(fields[0]))] = p
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authenticator) lookup(token string) (principal, bool) {
+	if a == nil {
+		return principal{name: "anonymous", role: roleAdmin}, true
+	}
+	if token == "" {
+		return principal{}, false
+	}
+	p, ok := a.tokens[sha256.Sum256([]byte(token))]
+	return p, ok
+}
+
+// bearer returns the token of an "Authorization: Bearer" value.
+func bearer(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// requestToken takes the token from the Authorization header, or the token
+// query parameter since browsers can't set headers on websockets.
+func requestToken(r *http.Request) string {
+	if t := bearer(r.Header.Get("Authorization")); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (a *authenticator) authenticate(r *http.Request) (principal, bool) {
+	return a.lookup(requestToken(r))
+}
+
+// requireRole guards h with read for GET and HEAD requests and write for
+// anything else.
+func requireRole(read, write role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		need := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = read
+		}
+		p, ok := auth.authenticate(r)
+		switch {
+		case !ok:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tracer"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		case p.role < need:
+			http.Error(w, fmt.Sprintf("%s role required", need), http.StatusForbidden)
+		default:
+			h(w, r)
+		}
+	}
+}
+
+// messageRoles are the websocket messages that need a role other than
+// roleEditor.
+var messageRoles = map[string]role{
+	"stream_format":   roleViewer,
+	"view_pass":       roleViewer,
+	"frame_rate":      roleViewer,
+	"frame_history":   roleViewer,
+	"scrub":           roleViewer,
+	"lights":          roleViewer,
+	"settings":        roleAdmin,
+	"focus":           roleAdmin,
+	"timeline_render": roleAdmin,
+}
+
+func messageRole(typ string) role {
+	if r, ok := messageRoles[typ]; ok {
+		return r
+	}
+	return roleEditor
+}
+
+// grpcRoles are what each gRPC method needs.
+var grpcRoles = map[string]role{
+	"/tracer.Tracer/RenderStream": roleViewer,
+	"/tracer.Tracer/UpdateCamera": roleEditor,
+	"/tracer.Tracer/Pick":         roleEditor,
+	"/tracer.Tracer/SetScene":     roleEditor,
+}
+
+func authorizeGRPC(ctx context.Context, method string) error {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token = bearer(v[0])
+		}
+	}
+	p, ok := auth.lookup(token)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+	need, ok := grpcRoles[method]
+	if !ok {
+		need = roleAdmin
+	}
+	if p.role < need {
+		return status.Errorf(codes.PermissionDenied, "%s role required", need)
+	}
+	return nil
+}
+
+func unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := authorizeGRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := authorizeGRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
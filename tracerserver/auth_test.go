@@ -0,0 +1,55 @@
+package tracerserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	tokens := "# comment\nv viewer\ne editor alice\n"
+	if err := ioutil.WriteFile(path, []byte(tokens), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth = a
+	defer func() { auth = nil }()
+
+	h := requireRole(roleViewer, roleEditor, func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range []struct {
+		method, token string
+		want          int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "v", http.StatusOK},
+		{http.MethodPost, "v", http.StatusForbidden},
+		{http.MethodPost, "e", http.StatusOK},
+	} {
+		req := httptest.NewRequest(c.method, "/scene", nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s with token %q got %d, want %d", c.method, c.token, rec.Code, c.want)
+		}
+	}
+}
+
+func TestLoadTokensRejectsUnknownRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("t root\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTokens(path); err == nil {
+		t.Error("token with an unknown role accepted")
+	}
+}
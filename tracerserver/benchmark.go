@@ -0,0 +1,296 @@
+package tracerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// benchRendersPerGoroutine and benchEncodesPerGoroutine are the work
+	// each goroutine does per run, the runs differ only in how many do it.
+	benchRendersPerGoroutine = 4
+	benchEncodesPerGoroutine = 8
+	defaultBenchSamples      = 64
+	maxBenchSamples          = 4096
+	maxBenchGoroutines       = 256
+)
+
+var errBenchmarkRunning = errors.New("a benchmark is already running")
+
+// benchSettings are fixed, not taken from the configuration, so results
+// from different machines and builds compare.
+var benchSettings = func() renderSettings {
+	s := defaultSettings
+	s.Width, s.Height = 320, 180
+	s.SamplesPerPixel = 4
+	s.MaxDepth = 10
+	return s
+}()
+
+// benchScene is the generated random spheres scene, always the same one.
+func benchScene() (sceneDesc, error) {
+	count, seed := 100, int64(1)
+	desc, _, err := generateScene(generatePayload{Count: &count, Seed: &seed})
+	return desc, err
+}
+
+type benchRenderRun struct {
+	Goroutines    int     `json:"goroutines"`
+	Seconds       float64 `json:"seconds"`
+	Samples       int     `json:"samples"`
+	SamplesPerSec float64 `json:"samples_per_sec"`
+	// Speedup is SamplesPerSec over the single goroutine run's.
+	Speedup float64 `json:"speedup"`
+}
+
+type benchEncodeRun struct {
+	Format       string  `json:"format"`
+	Goroutines   int     `json:"goroutines"`
+	Frames       int     `json:"frames"`
+	FramesPerSec float64 `json:"frames_per_sec"`
+	MBPerSec     float64 `json:"mb_per_sec"`
+	Error        string  `json:"error,omitempty"`
+}
+
+type benchmarkResult struct {
+	GoVersion       string           `json:"go_version"`
+	GOOS            string           `json:"goos"`
+	GOARCH          string           `json:"goarch"`
+	NumCPU          int              `json:"num_cpu"`
+	GOMAXPROCS      int              `json:"gomaxprocs"`
+	Width           int              `json:"width"`
+	Height          int              `json:"height"`
+	SamplesPerPixel int              `json:"samples_per_pixel"`
+	MaxDepth        int              `json:"max_depth"`
+	Objects         int              `json:"objects"`
+	Render          []benchRenderRun `json:"render"`
+	// Samples is how many per pixel the job TimeToSamplesMS times
+	// accumulates.
+	Samples         int              `json:"samples"`
+	TimeToSamplesMS float64          `json:"time_to_samples_ms"`
+	Encode          []benchEncodeRun `json:"encode"`
+	TotalMS         float64          `json:"total_ms"`
+}
+
+// benchGoroutines are the goroutine counts runs are made with: powers of
+// two up to max, and max itself.
+func benchGoroutines(max int) []int {
+	var l []int
+	for n := 1; n < max; n *= 2 {
+		l = append(l, n)
+	}
+	return append(l, max)
+}
+
+// benchmarking keeps benchmarks from running concurrently and skewing
+// each other.
+var benchmarking = make(chan struct{}, 1)
+
+// runBenchmark renders benchScene at benchSettings from 1 to goroutines
+// goroutines at a time, times a job accumulating samples per pixel and
+// encodes the result in every format the same way.
+func runBenchmark(ctx context.Context, goroutines, samples int) (*benchmarkResult, error) {
+	select {
+	case benchmarking <- struct{}{}:
+		defer func() { <-benchmarking }()
+	default:
+		return nil, errBenchmarkRunning
+	}
+
+	desc, err := benchScene()
+	if err != nil {
+		return nil, err
+	}
+	bvh, cam, err := desc.Build()
+	if err != nil {
+		return nil, err
+	}
+	settings := benchSettings
+	cam.AspectRatio = settings.aspectRatio()
+	rayColorFunc := rayColorFor(settings)
+
+	start := time.Now()
+	res := &benchmarkResult{
+		GoVersion:       runtime.Version(),
+		GOOS:            runtime.GOOS,
+		GOARCH:          runtime.GOARCH,
+		NumCPU:          runtime.NumCPU(),
+		GOMAXPROCS:      runtime.GOMAXPROCS(0),
+		Width:           settings.Width,
+		Height:          settings.Height,
+		SamplesPerPixel: settings.SamplesPerPixel,
+		MaxDepth:        settings.MaxDepth,
+		Objects:         len(desc.Spheres) + len(desc.Triangles),
+		Samples:         samples,
+	}
+
+	stop := stopChan(ctx)
+	for _, n := range benchGoroutines(goroutines) {
+		run := benchRenderRun{Goroutines: n}
+		t := time.Now()
+		parallel(n, func() {
+			for i := 0; i < benchRendersPerGoroutine; i++ {
+				tracer.Render(tracer.RenderSettings{
+					Frame:           newFrame(settings),
+					Camera:          cam,
+					Hitter:          bvh,
+					RayColorFunc:    rayColorFunc,
+					AggColorFunc:    tracer.AvgSamples,
+					SamplesPerPixel: settings.SamplesPerPixel,
+					MaxDepth:        settings.MaxDepth,
+				}, stop)
+			}
+		})
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		run.Seconds = time.Since(t).Seconds()
+		run.Samples = n * benchRendersPerGoroutine * settings.Width * settings.Height * settings.SamplesPerPixel
+		run.SamplesPerSec = float64(run.Samples) / run.Seconds
+		run.Speedup = 1
+		if len(res.Render) > 0 {
+			run.Speedup = run.SamplesPerSec / res.Render[0].SamplesPerSec
+		}
+		res.Render = append(res.Render, run)
+	}
+
+	jobSettings := settings
+	jobSettings.SamplesPerPixel = samples
+	j := newRenderJob(bvh, cam, rayColorFunc, jobSettings)
+	go func() {
+		select {
+		case <-ctx.Done():
+			j.cancel()
+		case <-j.finished:
+		}
+	}()
+	t := time.Now()
+	j.run()
+	if j.err != nil {
+		return nil, j.err
+	}
+	res.TimeToSamplesMS = millis(time.Since(t))
+
+	img := tracer.NewPPM(j.frame)
+	for _, format := range []string{"png", "jpeg", "webp"} {
+		for _, n := range benchGoroutines(goroutines) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			res.Encode = append(res.Encode, benchEncode(img, format, n))
+		}
+	}
+	res.TotalMS = millis(time.Since(start))
+	return res, nil
+}
+
+func benchEncode(img image.Image, format string, goroutines int) benchEncodeRun {
+	run := benchEncodeRun{Format: format, Goroutines: goroutines}
+	enc, err := newEncoder(format, 0)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+
+	var (
+		mu    sync.Mutex
+		bytes int
+		first error
+	)
+	t := time.Now()
+	parallel(goroutines, func() {
+		w := &countingWriter{}
+		for i := 0; i < benchEncodesPerGoroutine; i++ {
+			if err := enc.Encode(w, img); err != nil {
+				mu.Lock()
+				first = err
+				mu.Unlock()
+				return
+			}
+		}
+		mu.Lock()
+		bytes += w.n
+		mu.Unlock()
+	})
+	if first != nil {
+		run.Error = first.Error()
+		return run
+	}
+	seconds := time.Since(t).Seconds()
+	run.Frames = goroutines * benchEncodesPerGoroutine
+	run.FramesPerSec = float64(run.Frames) / seconds
+	run.MBPerSec = float64(bytes) / 1e6 / seconds
+	return run
+}
+
+// parallel runs fn on n goroutines and waits for all of them.
+func parallel(n int, fn func()) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	wg.Wait()
+}
+
+type countingWriter struct{ n int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// parseBenchInt reads query parameter name, def if it's empty.
+func parseBenchInt(query url.Values, name string, def, max int) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d, got %q", name, max, v)
+	}
+	return n, nil
+}
+
+// benchmark serves GET /benchmark, responding with the benchmarkResult
+// once it's done. ?goroutines= defaults to GOMAXPROCS, ?samples= to
+// defaultBenchSamples.
+func benchmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	goroutines, err := parseBenchInt(r.URL.Query(), "goroutines", runtime.GOMAXPROCS(0), maxBenchGoroutines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, err := parseBenchInt(r.URL.Query(), "samples", defaultBenchSamples, maxBenchSamples)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := runBenchmark(r.Context(), goroutines, samples)
+	switch {
+	case errors.Is(err, errBenchmarkRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, res)
+	}
+}
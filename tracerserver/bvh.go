@@ -0,0 +1,105 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ghostec/tracer"
+)
+
+// bvhTreeNode is a BVH node or a leaf primitive, as served by /scene/tree.
+// IDs are assigned in pre-order and stay stable until the objects change.
+type bvhTreeNode struct {
+	ID       int            `json:"id"`
+	Min      [3]float64     `json:"min"`
+	Max      [3]float64     `json:"max"`
+	Object   *int           `json:"object,omitempty"`
+	Children []*bvhTreeNode `json:"children,omitempty"`
+
+	box tracer.AABB
+}
+
+func bvhTree(h tracer.Hitter, objects tracer.HitterList) *bvhTreeNode {
+	next := 0
+	var walk func(h tracer.Hitter) *bvhTreeNode
+	walk = func(h tracer.Hitter) *bvhTreeNode {
+		box := h.BoundingBox()
+		n := &bvhTreeNode{ID: next, Min: [3]float64(box.Min), Max: [3]float64(box.Max), box: box}
+		next++
+
+		var left, right tracer.Hitter
+		switch o := h.(type) {
+		case *tracer.BVHNode:
+			left, right = o.Left, o.Right
+		case tracer.BVHNode:
+			left, right = o.Left, o.Right
+		default:
+			idx := indexOf(objects, h)
+			n.Object = &idx
+			return n
+		}
+
+		n.Children = append(n.Children, walk(left))
+		// Leaves holding a single primitive point both sides at it.
+		if right != left {
+			n.Children = append(n.Children, walk(right))
+		}
+		return n
+	}
+	return walk(h)
+}
+
+func (n *bvhTreeNode) find(id int) *bvhTreeNode {
+	if n.ID == id {
+		return n
+	}
+	for _, c := range n.Children {
+		if found := c.find(id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (r *renderer) bvhTree() *bvhTreeNode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bvhTree(r.scene, r.objects)
+}
+
+// highlightNode outlines BVH node id's bounding box in the GUI frame, or
+// clears the outline if id is nil.
+func (r *renderer) highlightNode(id *int) error {
+	r.mu.Lock()
+	if id == nil {
+		r.highlight = nil
+	} else {
+		n := bvhTree(r.scene, r.objects).find(*id)
+		if n == nil {
+			r.mu.Unlock()
+			return fmt.Errorf("no BVH node %d", *id)
+		}
+		r.highlight = &n.box
+	}
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return nil
+}
+
+func sceneTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rend.bvhTree()); err != nil {
+		requestLog(r).Warn("writing scene tree failed", "err", err)
+	}
+}
@@ -0,0 +1,207 @@
+package tracerserver
+
+import (
+	"errors"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	orbitDegreesPerPixel = 0.3
+	maxPitchDegrees      = 89
+	minDollyDistance     = 0.05
+	fovStepDegrees       = 5
+	rollStepDegrees      = 5
+	minFoV, maxFoV       = 5, 170
+)
+
+// orbit rotates the camera around target by yaw and pitch degrees, keeping
+// its distance. Pitch is clamped short of the poles so VUp stays valid.
+func orbit(cam tracer.Camera, target tracer.Point3, yaw, pitch float64) tracer.Camera {
+	offset := cam.LookFrom.Vec3().Sub(target.Vec3())
+	radius := offset.Len()
+	if radius == 0 {
+		return cam
+	}
+
+	curYaw := math.Atan2(offset[0], offset[2])
+	curPitch := math.Asin(tracer.Clamp(offset[1]/radius, -1, 1))
+
+	newYaw := curYaw + tracer.DegreesToRadians(yaw)
+	limit := tracer.DegreesToRadians(maxPitchDegrees)
+	newPitch := tracer.Clamp(curPitch+tracer.DegreesToRadians(pitch), -limit, limit)
+
+	cam.LookFrom = tracer.Point3(target.Vec3().Add(tracer.Vec3{
+		radius * math.Cos(newPitch) * math.Sin(newYaw),
+		radius * math.Sin(newPitch),
+		radius * math.Cos(newPitch) * math.Cos(newYaw),
+	}))
+	cam.LookAt = target
+	return cam
+}
+
+// pan slides both LookFrom and LookAt in the view plane. dx and dy are in
+// pixels of a frame height pixels tall, scaled so the point under the cursor
+// at the LookAt distance follows it.
+func pan(cam tracer.Camera, dx, dy float64, height int) tracer.Camera {
+	w := cam.LookFrom.Vec3().Sub(cam.LookAt.Vec3())
+	dist := w.Len()
+	w = w.Unit()
+	u := cam.VUp.Cross(w).Unit()
+	v := w.Cross(u)
+
+	viewportHeight := 2 * math.Tan(tracer.DegreesToRadians(cam.VFoV)/2) * dist
+	perPixel := viewportHeight / float64(height)
+
+	delta := u.MulFloat(-dx * perPixel).Add(v.MulFloat(dy * perPixel))
+	cam.LookFrom = tracer.Point3(cam.LookFrom.Vec3().Add(delta))
+	cam.LookAt = tracer.Point3(cam.LookAt.Vec3().Add(delta))
+	return cam
+}
+
+// dolly moves LookFrom towards (amount > 0) or away from LookAt, by a
+// fraction of the current distance so it never passes through it.
+func dolly(cam tracer.Camera, amount float64) tracer.Camera {
+	offset := cam.LookFrom.Vec3().Sub(cam.LookAt.Vec3())
+	dist := math.Max(minDollyDistance, offset.Len()*math.Exp(-amount))
+	cam.LookFrom = tracer.Point3(cam.LookAt.Vec3().Add(offset.Unit().MulFloat(dist)))
+	return cam
+}
+
+// roll rotates VUp around the view direction by degrees.
+func roll(cam tracer.Camera, degrees float64) tracer.Camera {
+	axis := cam.LookAt.Vec3().Sub(cam.LookFrom.Vec3()).Unit()
+	theta := tracer.DegreesToRadians(degrees)
+	// Rodrigues' rotation formula.
+	up := cam.VUp
+	cam.VUp = up.MulFloat(math.Cos(theta)).
+		Add(axis.Cross(up).MulFloat(math.Sin(theta))).
+		Add(axis.MulFloat(axis.Dot(up) * (1 - math.Cos(theta))))
+	return cam
+}
+
+func zoom(cam tracer.Camera, degrees float64) tracer.Camera {
+	cam.VFoV = tracer.Clamp(cam.VFoV+degrees, minFoV, maxFoV)
+	return cam
+}
+
+var keyMoves = map[string]tracer.Vec3{
+	"forward": {0, 0, -1},
+	"back":    {0, 0, 1},
+	"left":    {-1, 0, 0},
+	"right":   {1, 0, 0},
+	"up":      {0, 1, 0},
+	"down":    {0, -1, 0},
+}
+
+var errUnknownKeyAction = errors.New("unknown camera key action")
+
+// keyCamera applies a keyboard camera action. Moves translate LookFrom
+// along the world axes by the configured step, times FastMultiplier when
+// fast is set.
+func (r *renderer) keyCamera(action string, fast bool) error {
+	return r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		step := r.settings.MoveStep
+		if fast {
+			step *= r.settings.FastMultiplier
+		}
+
+		if dir, ok := keyMoves[action]; ok {
+			r.recordLocked("camera")
+			cam.LookFrom = tracer.Point3(cam.LookFrom.Vec3().Add(dir.MulFloat(step)))
+			return cam, nil
+		}
+
+		switch action {
+		case "fov_in":
+			cam = zoom(cam, -fovStepDegrees)
+		case "fov_out":
+			cam = zoom(cam, fovStepDegrees)
+		case "roll_left":
+			cam = roll(cam, -rollStepDegrees)
+		case "roll_right":
+			cam = roll(cam, rollStepDegrees)
+		default:
+			return cam, errUnknownKeyAction
+		}
+		r.recordLocked("camera")
+		return cam, nil
+	})
+}
+
+// updateCamera is how the camera changes: fn is handed a copy of it and
+// returns what it becomes, then the reset that starts rendering it is
+// scheduled, all under r.mu. Renders take their generation's copy of the
+// camera, so a change lands at that reset and never partway through a
+// pass. fn runs locked, it may use the Locked methods.
+func (r *renderer) updateCamera(fn func(cam tracer.Camera) (tracer.Camera, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cam, err := fn(r.camera)
+	if err != nil {
+		return err
+	}
+	r.camera = cam
+	r.interactLocked()
+	return nil
+}
+
+func centroid(h tracer.Hitter) tracer.Point3 {
+	box := h.BoundingBox()
+	return tracer.Point3(box.Min.Vec3().Add(box.Max.Vec3()).MulFloat(0.5))
+}
+
+// orbitTargetLocked is the explicit orbit target if one was set, otherwise
+// the selected object's centroid, otherwise whatever the camera looks at.
+func (r *renderer) orbitTargetLocked() tracer.Point3 {
+	switch {
+	case r.orbitTarget != nil:
+		return *r.orbitTarget
+	case r.selected >= 0:
+		return centroid(r.objects[r.selected])
+	default:
+		return r.camera.LookAt
+	}
+}
+
+func (r *renderer) setOrbitTarget(target *tracer.Point3) {
+	r.mu.Lock()
+	r.orbitTarget = target
+	r.mu.Unlock()
+}
+
+// orbitCamera orbits by a pointer moving dx, dy pixels.
+func (r *renderer) orbitCamera(dx, dy float64) {
+	r.orbitCameraDegrees(-dx*orbitDegreesPerPixel, dy*orbitDegreesPerPixel)
+}
+
+func (r *renderer) orbitCameraDegrees(yaw, pitch float64) {
+	r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		r.recordLocked("camera")
+		return orbit(cam, r.orbitTargetLocked(), yaw, pitch), nil
+	})
+}
+
+func (r *renderer) panCamera(dx, dy float64) {
+	r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		r.recordLocked("camera")
+		return pan(cam, dx, dy, r.settings.Height), nil
+	})
+}
+
+func (r *renderer) dollyCamera(amount float64) {
+	r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		r.recordLocked("camera")
+		return dolly(cam, amount), nil
+	})
+}
+
+func (r *renderer) moveCamera(delta tracer.Vec3) {
+	r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		r.recordLocked("camera")
+		cam.LookFrom = tracer.Point3(cam.LookFrom.Vec3().Add(delta))
+		return cam, nil
+	})
+}
@@ -0,0 +1,94 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// clipMaxCrossings is how many cut away surfaces a ray goes through
+	// before it counts as a miss.
+	clipMaxCrossings = 32
+	// clipEpsilon steps past a cut away hit, so casting again doesn't find
+	// the same surface.
+	clipEpsilon = 1e-6
+)
+
+// clipPlane cuts away everything on the side of the plane through Point
+// that Normal points to, to look inside closed objects. A zero Normal
+// clips nothing.
+type clipPlane struct {
+	Point  [3]float64 `json:"point"`
+	Normal [3]float64 `json:"normal"`
+}
+
+func (p clipPlane) enabled() bool {
+	return p.Normal != [3]float64{}
+}
+
+func (p clipPlane) validate() error {
+	for _, v := range append(p.Point[:], p.Normal[:]...) {
+		if v < -1e6 || v > 1e6 {
+			return fmt.Errorf("clip point and normal must be within 1e6, got %v", v)
+		}
+	}
+	return nil
+}
+
+// clipped is scene without what p cuts away, scene itself if p is off.
+func clipped(scene tracer.Hitter, p clipPlane) tracer.Hitter {
+	if scene == nil || !p.enabled() {
+		return scene
+	}
+	return clippedHitter{Hitter: scene, point: tracer.Vec3(p.Point), normal: tracer.Vec3(p.Normal).Unit()}
+}
+
+// clippedHitter hits what's left of a Hitter after a clipPlane. A ray
+// hitting a surface that's cut away carries on from just past it.
+type clippedHitter struct {
+	tracer.Hitter
+	point, normal tracer.Vec3
+}
+
+func (c clippedHitter) Hit(r tracer.Ray) tracer.HitRecord {
+	travelled := 0.0
+	for i := 0; i < clipMaxCrossings; i++ {
+		hr := c.Hitter.Hit(r)
+		if !hr.Hit || hr.P.Vec3().Sub(c.point).Dot(c.normal) <= 0 {
+			hr.T += travelled
+			return hr
+		}
+		step := hr.T + clipEpsilon
+		travelled += step
+		r = tracer.Ray{Origin: r.At(step), Direction: r.Direction}
+	}
+	return tracer.HitRecord{T: math.Inf(1)}
+}
+
+// setClip moves the clipping plane, previewing at low resolution while it's
+// being dragged around like camera moves do.
+func (r *renderer) setClip(p clipPlane) (renderSettings, error) {
+	if err := p.validate(); err != nil {
+		return renderSettings{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settings.Clip = p
+	r.interactLocked()
+	return r.settings, nil
+}
+
+func handleClipPlane(c *client, raw json.RawMessage) error {
+	var p clipPlane
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	settings, err := c.session.renderer.setClip(p)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return c.send("settings", "", settings)
+}
@@ -0,0 +1,132 @@
+package tracerserver
+
+import (
+	"errors"
+)
+
+// Clients attached to the same renderer, as every client is in shared
+// mode, see each other's cursor, selection and camera through presence
+// messages, and their edits go through the renderer's command queue one at
+// a time.
+
+var errRendererClosed = errors.New("session closed")
+
+type command struct {
+	fn   func() error
+	done chan error
+}
+
+// runCommands executes queued commands in order until the renderer closes.
+func (r *renderer) runCommands() {
+	for {
+		select {
+		case cmd := <-r.commands:
+			cmd.done <- cmd.fn()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// do queues fn behind the edits other clients already sent and waits for
+// it to run.
+func (r *renderer) do(fn func() error) error {
+	cmd := command{fn: fn, done: make(chan error, 1)}
+	select {
+	case r.commands <- cmd:
+	case <-r.ctx.Done():
+		return errRendererClosed
+	}
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-r.ctx.Done():
+		return errRendererClosed
+	}
+}
+
+func (r *renderer) cameraDesc() cameraDesc {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return describeCamera(r.camera)
+}
+
+func (r *renderer) cameraState() cameraStatePayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return cameraStatePayload{
+		cameraDesc:  describeCamera(r.camera),
+		OrbitTarget: [3]float64(r.orbitTargetLocked()),
+	}
+}
+
+// presencePayload is what peers know of a client. Cursor is in frame
+// pixels, Selected the object the client last picked, -1 for none.
+type presencePayload struct {
+	Session  uint64      `json:"session"`
+	User     string      `json:"user"`
+	Cursor   *[2]int     `json:"cursor,omitempty"`
+	Selected int         `json:"selected"`
+	Camera   *cameraDesc `json:"camera,omitempty"`
+}
+
+type presenceLeavePayload struct {
+	Session uint64 `json:"session"`
+}
+
+// peers returns the other clients attached to c's renderer.
+func (r *clientRegistry) peers(c *client) []*client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var l []*client
+	for other := range r.clients {
+		if other != c && other.session.renderer == c.session.renderer {
+			l = append(l, other)
+		}
+	}
+	return l
+}
+
+func (c *client) presence() presencePayload {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	return c.present
+}
+
+// updatePresence applies update to c's presence and sends the result to
+// its peers. A peer that can't be written to is skipped, its own writer
+// notices the failure.
+func (c *client) updatePresence(update func(p *presencePayload)) {
+	c.pmu.Lock()
+	update(&c.present)
+	p := c.present
+	c.pmu.Unlock()
+
+	c.broadcast("presence", p)
+}
+
+func (c *client) broadcast(typ string, payload interface{}) {
+	for _, peer := range clients.peers(c) {
+		if err := peer.send(typ, "", payload); err != nil {
+			peer.log.Warn("broadcast failed", "type", typ, "err", err)
+		}
+	}
+}
+
+// cameraMoved shares the renderer's camera as moved by c.
+func (c *client) cameraMoved() {
+	cam := c.session.renderer.cameraDesc()
+	c.updatePresence(func(p *presencePayload) {
+		p.Camera = &cam
+	})
+}
+
+// sendPeers tells a client joining a renderer where everyone else is.
+func (c *client) sendPeers() error {
+	for _, peer := range clients.peers(c) {
+		if err := c.send("presence", "", peer.presence()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
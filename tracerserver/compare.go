@@ -0,0 +1,209 @@
+package tracerserver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+var errCompareSetting = errors.New("only samples_per_pixel, max_depth, environment, exposure, denoise, aperture and focus_distance can be compared")
+
+// comparison renders the scene a second time, with patch applied over the
+// renderer's settings, into the right of the frame. Split is where the
+// right side starts, as a fraction of the width.
+type comparison struct {
+	patch settingsPatch
+	split float64
+}
+
+// comparePayload turns the comparison on or off, Compared is only sent back
+// and holds the right side's settings in full.
+type comparePayload struct {
+	Enabled  bool            `json:"enabled"`
+	Settings settingsPatch   `json:"settings"`
+	Split    *float64        `json:"split"`
+	Compared *renderSettings `json:"compared,omitempty"`
+}
+
+type compareSplitPayload struct {
+	Split float64 `json:"split"`
+}
+
+// checkComparePatch refuses changes to what both sides have to share, the
+// resolution above all.
+func checkComparePatch(p settingsPatch) error {
+	if p.Width != nil || p.Height != nil || p.PreviewScale != nil || p.PreviewIdleMS != nil ||
+		p.MoveStep != nil || p.FastMultiplier != nil || p.Adaptive != nil || p.Projection != nil {
+		return errCompareSetting
+	}
+	return nil
+}
+
+// compareSettingsLocked are the settings of the right side, at the
+// resolution the frames are rendered at now.
+func (r *renderer) compareSettingsLocked() renderSettings {
+	s, err := r.frameSettings().apply(r.compare.patch)
+	if err != nil {
+		return r.frameSettings()
+	}
+	s.Adaptive = false
+	return s
+}
+
+func (r *renderer) comparePayloadLocked() comparePayload {
+	if r.compare == nil {
+		return comparePayload{}
+	}
+	split := r.compare.split
+	compared, _ := r.settings.apply(r.compare.patch)
+	return comparePayload{Enabled: true, Settings: r.compare.patch, Split: &split, Compared: &compared}
+}
+
+func (r *renderer) comparePayload() comparePayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.comparePayloadLocked()
+}
+
+// setCompare turns the comparison on with p, or off, and restarts
+// accumulation on both sides.
+func (r *renderer) setCompare(p comparePayload) (comparePayload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !p.Enabled {
+		r.compare = nil
+		r.resetLocked()
+		return r.comparePayloadLocked(), nil
+	}
+	if err := checkComparePatch(p.Settings); err != nil {
+		return comparePayload{}, err
+	}
+	if _, err := r.settings.apply(p.Settings); err != nil {
+		return comparePayload{}, err
+	}
+	c := &comparison{patch: p.Settings, split: 0.5}
+	if r.compare != nil {
+		c.split = r.compare.split
+	}
+	if p.Split != nil {
+		c.split = tracer.Clamp(*p.Split, 0, 1)
+	}
+	r.compare = c
+	r.resetLocked()
+	return r.comparePayloadLocked(), nil
+}
+
+// setCompareSplit moves the split line, both sides keep accumulating.
+func (r *renderer) setCompareSplit(split float64) (comparePayload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.compare == nil {
+		return comparePayload{}, errors.New("comparison is off")
+	}
+	r.compare.split = tracer.Clamp(split, 0, 1)
+	return r.comparePayloadLocked(), nil
+}
+
+// renderCompare renders one pass of the right side into gen.
+func (r *renderer) renderCompare(gen *generation, camera tracer.Camera, scene tracer.Hitter) {
+	r.mu.Lock()
+	if r.compare == nil {
+		r.mu.Unlock()
+		return
+	}
+	settings := r.compareSettingsLocked()
+	rayColorFunc, maxDepth := r.rayColorLocked(camera, settings)
+	r.mu.Unlock()
+	rayColorFunc = withLens(rayColorFunc, camera, settings)
+
+	frame := passFrames.get(settings)
+	defer passFrames.put(frame)
+	start := time.Now()
+	renderTiles.render(gen.ctx, tileRender{
+		frame:        frame,
+		camera:       camera,
+		scene:        scene,
+		rayColorFunc: rayColorFunc,
+		spp:          settings.SamplesPerPixel,
+		maxDepth:     maxDepth,
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gen.ctx.Err() != nil {
+		return
+	}
+	if gen.compare == nil || gen.compare.Width() != settings.Width || gen.compare.Height() != settings.Height {
+		gen.compare = newFrame(settings)
+		gen.comparePasses = 0
+	}
+	gen.compare.Avg(frame)
+	gen.comparePasses++
+	samplesTotal.Add(float64(settings.Width * settings.Height * settings.SamplesPerPixel))
+	renderSeconds.Observe(time.Since(start).Seconds())
+}
+
+// compareScene is the right side's frame, denoised if its settings ask for
+// it, and the split. It returns nil while the comparison is off or before
+// its first pass.
+func (r *renderer) compareScene() (*tracer.Frame, float64) {
+	r.mu.Lock()
+	if r.compare == nil || r.gen.compare == nil {
+		r.mu.Unlock()
+		return nil, 0
+	}
+	gen, split := r.gen, r.compare.split
+	settings, _ := r.settings.apply(r.compare.patch)
+	denoise, ok := denoisers[settings.Denoise]
+	if !ok {
+		f := gen.compare
+		r.mu.Unlock()
+		return f, split
+	}
+	if gen.compareDenoised != nil && gen.compareDenoisedAt == gen.comparePasses {
+		f := gen.compareDenoised
+		r.mu.Unlock()
+		return f, split
+	}
+	beauty, passes := copyFrame(gen.compare), gen.comparePasses
+	r.mu.Unlock()
+
+	var normal, albedo *tracer.Frame
+	if beauty.Width() == settings.Width && beauty.Height() == settings.Height {
+		normal, _ = r.aov("normal")
+		albedo, _ = r.aov("albedo")
+	}
+	f, err := denoise(beauty, normal, albedo)
+	if err != nil {
+		logOnce(settings.Denoise, "denoising failed", "denoiser", settings.Denoise, "err", err)
+		return beauty, split
+	}
+
+	r.mu.Lock()
+	gen.compareDenoised, gen.compareDenoisedAt = f, passes
+	r.mu.Unlock()
+	return f, split
+}
+
+// splitFrames takes the columns left of split from a and the rest from b,
+// with a line where they meet. Both are width x height.
+func splitFrames(a, b *tracer.Frame, split float64) *tracer.Frame {
+	width, height := a.Width(), a.Height()
+	at := int(split * float64(width))
+	f := tracer.NewFrame(width, height, true)
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			switch {
+			case col == at:
+				f.Set(row, col, tracer.Color{1, 1, 1})
+			case col < at:
+				f.Set(row, col, a.Get(row, col))
+			default:
+				f.Set(row, col, b.Get(row, col))
+			}
+		}
+	}
+	return f
+}
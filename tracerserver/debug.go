@@ -0,0 +1,172 @@
+package tracerserver
+
+import (
+	"image"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"unsafe"
+
+	"github.com/ghostec/tracer"
+)
+
+// colorBytes is what a tracer.Frame spends per pixel.
+const colorBytes = int64(unsafe.Sizeof(tracer.Color{}))
+
+// debugOnly serves h only with Options.Debug and only to admins.
+func debugOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !options.Debug {
+			http.NotFound(w, r)
+			return
+		}
+		requireRole(roleAdmin, roleAdmin, h)(w, r)
+	}
+}
+
+// mountDebug adds net/http/pprof and debugRender under /debug/ to mux,
+// rather than to http.DefaultServeMux the way importing pprof does.
+func mountDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", debugOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", debugOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", debugOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", debugOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", debugOnly(pprof.Trace))
+	mux.HandleFunc("/debug/render", debugOnly(debugRender))
+}
+
+type bufferDebug struct {
+	Name   string `json:"name"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func frameBuffer(name string, f *tracer.Frame) bufferDebug {
+	return bufferDebug{Name: name, Width: f.Width(), Height: f.Height(), Bytes: int64(f.Width()*f.Height()) * colorBytes}
+}
+
+// imageBytes is how much img holds on to, images the tracer makes being
+// backed by a tracer.Frame.
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.RGBA64:
+		return int64(len(img.Pix))
+	default:
+		b := img.Bounds()
+		return int64(b.Dx()*b.Dy()) * colorBytes
+	}
+}
+
+// rendererDebug is a renderer's internals. Bytes adds up its buffers and
+// frame history, what the session costs beyond the scene.
+type rendererDebug struct {
+	Sessions          []uint64      `json:"sessions"`
+	Closed            bool          `json:"closed"`
+	Paused            bool          `json:"paused"`
+	Generation        uint64        `json:"generation"`
+	GenerationStopped bool          `json:"generation_stopped"`
+	Passes            int           `json:"passes"`
+	PreviewScale      int           `json:"preview_scale"`
+	Objects           int           `json:"objects"`
+	Keyframes         int           `json:"keyframes"`
+	Playing           bool          `json:"playing"`
+	Comparing         bool          `json:"comparing"`
+	Buffers           []bufferDebug `json:"buffers"`
+	FrameHistory      int           `json:"frame_history"`
+	FrameHistoryBytes int64         `json:"frame_history_bytes"`
+	Bytes             int64         `json:"bytes"`
+}
+
+func (r *renderer) debugInfo() rendererDebug {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gen := r.gen
+	d := rendererDebug{
+		Closed:     r.ctx.Err() != nil,
+		Paused:     r.paused,
+		Generation: gen.id,
+		Passes:     gen.passes,
+		// 1 is full resolution, anything above a preview.
+		PreviewScale: r.scale,
+		Objects:      len(r.objects),
+		Keyframes:    len(r.timeline.keyframes),
+		Playing:      r.stopPlayback != nil,
+		Comparing:    r.compare != nil,
+		Buffers:      []bufferDebug{frameBuffer("scene", gen.scene), frameBuffer("gui", gen.gui)},
+	}
+	select {
+	case <-gen.stop:
+		d.GenerationStopped = true
+	default:
+	}
+	for name, f := range gen.aovs {
+		d.Buffers = append(d.Buffers, frameBuffer("aov:"+name, f))
+	}
+	for name, f := range map[string]*tracer.Frame{"denoised": gen.denoised, "compare": gen.compare, "compare_denoised": gen.compareDenoised} {
+		if f != nil {
+			d.Buffers = append(d.Buffers, frameBuffer(name, f))
+		}
+	}
+	if s := gen.samples; s != nil {
+		// sum, lum, lumSq and n per pixel.
+		perPixel := int64(unsafe.Sizeof(tracer.Vec3{})) + 2*8 + int64(unsafe.Sizeof(0))
+		d.Buffers = append(d.Buffers, bufferDebug{Name: "samples", Width: s.width, Height: s.height, Bytes: int64(s.width*s.height) * perPixel})
+	}
+	for _, f := range r.frames.frames {
+		d.FrameHistoryBytes += imageBytes(f.img)
+	}
+	d.FrameHistory = len(r.frames.frames)
+
+	d.Bytes = d.FrameHistoryBytes
+	for _, b := range d.Buffers {
+		d.Bytes += b.Bytes
+	}
+	return d
+}
+
+type debugRenderPayload struct {
+	Goroutines int             `json:"goroutines"`
+	HeapAlloc  uint64          `json:"heap_alloc"`
+	HeapSys    uint64          `json:"heap_sys"`
+	NumGC      uint32          `json:"num_gc"`
+	Jobs       int             `json:"jobs"`
+	Renderers  []rendererDebug `json:"renderers"`
+}
+
+// debugRender serves GET /debug/render, the runtime's and every live
+// renderer's state.
+func debugRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	p := debugRenderPayload{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		HeapSys:    mem.HeapSys,
+		NumGC:      mem.NumGC,
+		Jobs:       len(jobs.list()),
+		Renderers:  []rendererDebug{},
+	}
+
+	ids := map[*renderer][]uint64{}
+	var order []*renderer
+	for _, s := range sessions.list() {
+		if _, ok := ids[s.renderer]; !ok {
+			order = append(order, s.renderer)
+		}
+		ids[s.renderer] = append(ids[s.renderer], s.id)
+	}
+	for _, rend := range order {
+		d := rend.debugInfo()
+		d.Sessions = ids[rend]
+		p.Renderers = append(p.Renderers, d)
+	}
+	writeJSON(w, http.StatusOK, p)
+}
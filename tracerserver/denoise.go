@@ -0,0 +1,145 @@
+package tracerserver
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/ghostec/tracer"
+)
+
+// A denoiser filters the accumulated beauty frame before it is encoded.
+// normal and albedo are the matching AOVs, or nil when they aren't at the
+// beauty frame's resolution, as happens while previewing.
+type denoiser func(beauty, normal, albedo *tracer.Frame) (*tracer.Frame, error)
+
+// denoisers is extended by build tagged files, see denoise_oidn.go.
+var denoisers = map[string]denoiser{
+	"bilateral": bilateralDenoise,
+}
+
+func denoiserNames() []string {
+	names := []string{}
+	for name := range denoisers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const (
+	bilateralRadius = 3
+	sigmaSpatial    = 2.0
+	sigmaColor      = 0.3
+	sigmaNormal     = 0.2
+	sigmaAlbedo     = 0.1
+)
+
+func distSq(a, b tracer.Color) float64 {
+	return a.Vec3().Sub(b.Vec3()).LenSq()
+}
+
+// bilateralDenoise is a cross bilateral filter: neighbours are averaged in
+// by distance and color difference, and when the AOVs are there by normal
+// and albedo difference too, which keeps geometric and texture edges that
+// noise alone would blur.
+func bilateralDenoise(beauty, normal, albedo *tracer.Frame) (*tracer.Frame, error) {
+	w, h := beauty.Width(), beauty.Height()
+	out := tracer.NewFrame(w, h, true)
+
+	var spatial [2*bilateralRadius + 1][2*bilateralRadius + 1]float64
+	for dy := -bilateralRadius; dy <= bilateralRadius; dy++ {
+		for dx := -bilateralRadius; dx <= bilateralRadius; dx++ {
+			spatial[dy+bilateralRadius][dx+bilateralRadius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * sigmaSpatial * sigmaSpatial))
+		}
+	}
+
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			c := beauty.Get(row, col)
+			var sum tracer.Vec3
+			total := 0.0
+			for dy := -bilateralRadius; dy <= bilateralRadius; dy++ {
+				r := row + dy
+				if r < 0 || r >= h {
+					continue
+				}
+				for dx := -bilateralRadius; dx <= bilateralRadius; dx++ {
+					cc := col + dx
+					if cc < 0 || cc >= w {
+						continue
+					}
+					q := beauty.Get(r, cc)
+					e := distSq(c, q) / (2 * sigmaColor * sigmaColor)
+					if normal != nil {
+						e += distSq(normal.Get(row, col), normal.Get(r, cc)) / (2 * sigmaNormal * sigmaNormal)
+					}
+					if albedo != nil {
+						e += distSq(albedo.Get(row, col), albedo.Get(r, cc)) / (2 * sigmaAlbedo * sigmaAlbedo)
+					}
+					weight := spatial[dy+bilateralRadius][dx+bilateralRadius] * math.Exp(-e)
+					sum = sum.Add(q.Vec3().MulFloat(weight))
+					total += weight
+				}
+			}
+			out.Set(row, col, tracer.Color(sum.MulFloat(1/total)))
+		}
+	}
+	return out, nil
+}
+
+var logged sync.Map
+
+// logOnce warns msg the first time it's called with key, for errors that
+// would otherwise repeat every frame.
+func logOnce(key, msg string, kv ...interface{}) {
+	if _, dup := logged.LoadOrStore(key, true); !dup {
+		logs.Warn(msg, kv...)
+	}
+}
+
+func copyFrame(f *tracer.Frame) *tracer.Frame {
+	dst := tracer.NewFrame(f.Width(), f.Height(), true)
+	for row := 0; row < f.Height(); row++ {
+		for col := 0; col < f.Width(); col++ {
+			dst.Set(row, col, f.Get(row, col))
+		}
+	}
+	return dst
+}
+
+// denoisedScene returns the scene frame run through the configured
+// denoiser, nil if there is none. The result is cached until the next pass
+// lands.
+func (r *renderer) denoisedScene() *tracer.Frame {
+	r.mu.Lock()
+	gen, settings := r.gen, r.settings
+	denoise, ok := denoisers[settings.Denoise]
+	if !ok {
+		r.mu.Unlock()
+		return nil
+	}
+	if gen.denoised != nil && gen.denoisedAt == gen.passes {
+		f := gen.denoised
+		r.mu.Unlock()
+		return f
+	}
+	beauty, passes := copyFrame(gen.scene), gen.passes
+	r.mu.Unlock()
+
+	var normal, albedo *tracer.Frame
+	if beauty.Width() == settings.Width && beauty.Height() == settings.Height {
+		normal, _ = r.aov("normal")
+		albedo, _ = r.aov("albedo")
+	}
+	f, err := denoise(beauty, normal, albedo)
+	if err != nil {
+		logOnce(settings.Denoise, "denoising failed", "denoiser", settings.Denoise, "err", err)
+		return nil
+	}
+
+	r.mu.Lock()
+	gen.denoised, gen.denoisedAt = f, passes
+	r.mu.Unlock()
+	return f
+}
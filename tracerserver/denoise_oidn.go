@@ -0,0 +1,125 @@
+//go:build oidn
+// +build oidn
+
+package tracerserver
+
+// #cgo LDFLAGS: -lOpenImageDenoise
+// #include <stdlib.h>
+// #include <OpenImageDenoise/oidn.h>
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/ghostec/tracer"
+)
+
+// Building with -tags oidn adds Intel Open Image Denoise as the "oidn"
+// denoiser. It needs libOpenImageDenoise and its headers installed.
+func init() {
+	denoisers["oidn"] = oidnDenoise
+}
+
+var (
+	oidnOnce   sync.Once
+	oidnDevice C.OIDNDevice
+	// oidnMu serializes filters, a device isn't meant to be shared across
+	// threads.
+	oidnMu sync.Mutex
+)
+
+// oidnImage is a w by h RGB float image in C memory. OIDN holds on to
+// shared images from setting them until the filter executes, which cgo
+// doesn't allow for Go memory.
+type oidnImage struct {
+	ptr unsafe.Pointer
+	// floats is the C memory as a slice, for Go to fill in and read.
+	floats []float32
+}
+
+func newOIDNImage(w, h int) oidnImage {
+	n := w * h * 3
+	ptr := C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(float32(0))))
+	// Frames are at most 4096x4096, well within the array type.
+	return oidnImage{ptr: ptr, floats: (*[1 << 28]float32)(ptr)[:n:n]}
+}
+
+// frameOIDNImage copies f into C memory.
+func frameOIDNImage(f *tracer.Frame) oidnImage {
+	img := newOIDNImage(f.Width(), f.Height())
+	i := 0
+	for row := 0; row < f.Height(); row++ {
+		for col := 0; col < f.Width(); col++ {
+			c := f.Get(row, col)
+			img.floats[i], img.floats[i+1], img.floats[i+2] = float32(c[0]), float32(c[1]), float32(c[2])
+			i += 3
+		}
+	}
+	return img
+}
+
+func (img oidnImage) free() {
+	C.free(img.ptr)
+}
+
+func setImage(filter C.OIDNFilter, name string, img oidnImage, w, h int) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.oidnSetSharedFilterImage(filter, cname, img.ptr, C.OIDN_FORMAT_FLOAT3, C.size_t(w), C.size_t(h), 0, 0, 0)
+}
+
+func oidnDenoise(beauty, normal, albedo *tracer.Frame) (*tracer.Frame, error) {
+	oidnOnce.Do(func() {
+		oidnDevice = C.oidnNewDevice(C.OIDN_DEVICE_TYPE_DEFAULT)
+		C.oidnCommitDevice(oidnDevice)
+	})
+
+	oidnMu.Lock()
+	defer oidnMu.Unlock()
+
+	w, h := beauty.Width(), beauty.Height()
+	color, output := frameOIDNImage(beauty), newOIDNImage(w, h)
+	defer color.free()
+	defer output.free()
+
+	rt := C.CString("RT")
+	defer C.free(unsafe.Pointer(rt))
+	filter := C.oidnNewFilter(oidnDevice, rt)
+	defer C.oidnReleaseFilter(filter)
+
+	setImage(filter, "color", color, w, h)
+	setImage(filter, "output", output, w, h)
+	// OIDN only takes a normal buffer together with an albedo one.
+	if albedo != nil {
+		a := frameOIDNImage(albedo)
+		defer a.free()
+		setImage(filter, "albedo", a, w, h)
+		if normal != nil {
+			// The normal AOV is encoded for viewing, OIDN wants [-1, 1].
+			n := frameOIDNImage(normal)
+			defer n.free()
+			for i := range n.floats {
+				n.floats[i] = 2*n.floats[i] - 1
+			}
+			setImage(filter, "normal", n, w, h)
+		}
+	}
+	C.oidnCommitFilter(filter)
+	C.oidnExecuteFilter(filter)
+
+	var msg *C.char
+	if C.oidnGetDeviceError(oidnDevice, &msg) != C.OIDN_ERROR_NONE {
+		return nil, errors.New("oidn: " + C.GoString(msg))
+	}
+
+	out := tracer.NewFrame(w, h, true)
+	for row := 0; row < h; row++ {
+		for col := 0; col < w; col++ {
+			i := (row*w + col) * 3
+			out.Set(row, col, tracer.Color{float64(output.floats[i]), float64(output.floats[i+1]), float64(output.floats[i+2])})
+		}
+	}
+	return out, nil
+}
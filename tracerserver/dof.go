@@ -0,0 +1,70 @@
+package tracerserver
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+
+	"github.com/ghostec/tracer"
+)
+
+var errNothingToFocus = errors.New("nothing under the cursor to focus on")
+
+// focusDistance is how far in front of the camera the plane in focus is,
+// the distance to LookAt unless settings set one.
+func focusDistance(camera tracer.Camera, settings renderSettings) float64 {
+	if settings.FocusDistance > 0 {
+		return settings.FocusDistance
+	}
+	return camera.LookFrom.Vec3().Sub(camera.LookAt.Vec3()).Len()
+}
+
+// withLens turns camera into a thin lens settings.Aperture wide, focused
+// at focusDistance, in settings' projection. The tracer only knows pinhole
+// cameras, so each primary ray is moved to a random point on the lens and
+// pointed at where the pinhole ray crosses the focal plane. Bounces go to
+// rayColor untouched.
+func withLens(rayColor tracer.RayColorFunc, camera tracer.Camera, settings renderSettings) tracer.RayColorFunc {
+	if settings.Aperture <= 0 {
+		return withProjection(rayColor, camera, settings)
+	}
+	project := projectRay(camera, settings)
+	radius := settings.Aperture / 2
+	focus := focusDistance(camera, settings)
+	forward := camera.LookAt.Vec3().Sub(camera.LookFrom.Vec3()).Unit()
+	u := forward.Cross(camera.VUp).Unit()
+	v := u.Cross(forward)
+
+	return func(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+		if project != nil {
+			r = project(r)
+		}
+		along := r.Direction.Dot(forward)
+		if along <= 0 {
+			return rayColor(r, n, depth)
+		}
+		target := r.At(focus / along)
+		// Uniform over the disk.
+		rho, theta := radius*math.Sqrt(rand.Float64()), 2*math.Pi*rand.Float64()
+		origin := r.Origin.Vec3().Add(u.MulFloat(rho * math.Cos(theta))).Add(v.MulFloat(rho * math.Sin(theta)))
+		return rayColor(tracer.Ray{Origin: tracer.Point3(origin), Direction: target.Vec3().Sub(origin)}, n, depth)
+	}
+}
+
+// focusAt moves the focal plane to what's under (x, y) and returns the
+// updated settings.
+func (r *renderer) focusAt(x, y int) (renderSettings, error) {
+	hit := r.pickHit(x, y)
+	if hit.Point == nil {
+		return renderSettings{}, errNothingToFocus
+	}
+	// The hit is on the frame on screen, so like pickHit this measures from
+	// the generation's camera, not the one a transition is headed to.
+	r.mu.Lock()
+	camera := r.gen.camera
+	r.mu.Unlock()
+
+	forward := camera.LookAt.Vec3().Sub(camera.LookFrom.Vec3()).Unit()
+	d := tracer.Vec3(*hit.Point).Sub(camera.LookFrom.Vec3()).Dot(forward)
+	return r.updateSettings(settingsPatch{FocusDistance: &d})
+}
@@ -0,0 +1,176 @@
+package tracerserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ghostec/tracer"
+)
+
+var errNoSelection = errors.New("no object selected")
+
+func transformHitter(h tracer.Hitter, translate tracer.Vec3, scale float64) (tracer.Hitter, error) {
+	switch o := h.(type) {
+	case tracer.Sphere:
+		o.Center = tracer.Point3(o.Center.Vec3().Add(translate))
+		o.Radius *= scale
+		return o, nil
+	case triangle:
+		return o.transform(translate, scale), nil
+	default:
+		return nil, fmt.Errorf("can't transform %T", h)
+	}
+}
+
+func withMaterial(h tracer.Hitter, m tracer.Material) (tracer.Hitter, error) {
+	switch o := h.(type) {
+	case tracer.Sphere:
+		o.Material = m
+		return o, nil
+	case triangle:
+		o.Material = m
+		return o, nil
+	default:
+		return nil, fmt.Errorf("can't set material on %T", h)
+	}
+}
+
+// setObjectsLocked swaps in a new object list, and the names and tags lined
+// up with it, and restarts accumulation. The BVH is rebuilt from scratch,
+// which is cheap at the scene sizes we serve.
+func (r *renderer) setObjectsLocked(objects tracer.HitterList, meta []objectMeta) error {
+	return r.editObjectsLocked("objects", objects, meta)
+}
+
+// editObjectsLocked is setObjectsLocked recording the edit as kind.
+func (r *renderer) editObjectsLocked(kind string, objects tracer.HitterList, meta []objectMeta) error {
+	bvh, err := buildBVH(objects)
+	if err != nil {
+		return err
+	}
+	r.recordLocked(kind)
+	r.objects, r.meta = objects, meta
+	r.scene = bvh
+	r.bumpSceneLocked()
+	// Node IDs don't survive a rebuild.
+	r.highlight = nil
+	r.resetLocked()
+	return nil
+}
+
+// editSelected replaces the selected object with edit's result.
+func (r *renderer) editSelected(edit func(tracer.Hitter) (tracer.Hitter, error)) error {
+	r.mu.Lock()
+	if r.selected < 0 {
+		r.mu.Unlock()
+		return errNoSelection
+	}
+	h, err := edit(r.objects[r.selected])
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	objects := append(tracer.HitterList(nil), r.objects...)
+	objects[r.selected] = h
+	err = r.setObjectsLocked(objects, r.meta)
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
+
+// addObject appends h to the scene and selects it.
+func (r *renderer) addObject(h tracer.Hitter) error {
+	r.mu.Lock()
+	objects := append(append(tracer.HitterList(nil), r.objects...), h)
+	meta := append(append([]objectMeta(nil), r.meta...), objectMeta{})
+	err := r.setObjectsLocked(objects, meta)
+	if err == nil {
+		r.selectLocked(len(objects) - 1)
+		r.hovered = -1
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
+
+func (r *renderer) deleteSelected() error {
+	r.mu.Lock()
+	if r.selected < 0 {
+		r.mu.Unlock()
+		return errNoSelection
+	}
+	if len(r.objects) == 1 {
+		r.mu.Unlock()
+		return errors.New("can't delete the last object")
+	}
+	objects := append(tracer.HitterList(nil), r.objects[:r.selected]...)
+	objects = append(objects, r.objects[r.selected+1:]...)
+	meta := append([]objectMeta(nil), r.meta[:r.selected]...)
+	meta = append(meta, r.meta[r.selected+1:]...)
+	err := r.setObjectsLocked(objects, meta)
+	if err == nil {
+		switch {
+		case r.solo == r.selected:
+			r.solo = -1
+		case r.solo > r.selected:
+			r.solo--
+		}
+		r.selectLocked(-1)
+		r.hovered = -1
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
+
+// duplicateSelected adds a copy of the selected object moved by offset, or
+// next to the original along x if offset is nil, and selects the copy.
+func (r *renderer) duplicateSelected(offset *tracer.Vec3) error {
+	r.mu.Lock()
+	if r.selected < 0 {
+		r.mu.Unlock()
+		return errNoSelection
+	}
+	h := r.objects[r.selected]
+	r.mu.Unlock()
+
+	delta := tracer.Vec3{}
+	if offset != nil {
+		delta = *offset
+	} else {
+		box := h.BoundingBox()
+		delta[0] = box.Max.Vec3()[0] - box.Min.Vec3()[0]
+	}
+	dup, err := transformHitter(h, delta, 1)
+	if err != nil {
+		return err
+	}
+	return r.addObject(dup)
+}
+
+func (r *renderer) transformSelected(translate tracer.Vec3, scale float64) error {
+	if scale <= 0 {
+		return fmt.Errorf("scale must be positive, got %v", scale)
+	}
+	return r.editSelected(func(h tracer.Hitter) (tracer.Hitter, error) {
+		return transformHitter(h, translate, scale)
+	})
+}
+
+func (r *renderer) setSelectedMaterial(m tracer.Material) error {
+	return r.editSelected(func(h tracer.Hitter) (tracer.Hitter, error) {
+		return withMaterial(h, m)
+	})
+}
@@ -0,0 +1,82 @@
+package tracerserver
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+)
+
+type encoder interface {
+	Encode(w io.Writer, img image.Image) error
+	ContentType() string
+}
+
+type pngEncoder struct{}
+
+func (pngEncoder) Encode(w io.Writer, img image.Image) error {
+	enc := png.Encoder{BufferPool: pngBuffers}
+	return enc.Encode(w, img)
+}
+
+func (pngEncoder) ContentType() string { return "image/png" }
+
+type jpegEncoder struct {
+	quality int
+}
+
+func (e jpegEncoder) Encode(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: e.quality})
+}
+
+func (jpegEncoder) ContentType() string { return "image/jpeg" }
+
+// webpEncoder goes through libwebp's cwebp, Go has no WebP encoder. That
+// forks a process per image, too slow for streams, see newStreamEncoder.
+type webpEncoder struct {
+	quality int
+}
+
+func (e webpEncoder) Encode(w io.Writer, img image.Image) error {
+	return encodeExternal(w, img, "cwebp", func(in, out string) []string {
+		return []string{"-quiet", "-q", strconv.Itoa(e.quality), in, "-o", out}
+	})
+}
+
+func (webpEncoder) ContentType() string { return "image/webp" }
+
+const defaultQuality = 80
+
+// newEncoder returns the encoder for format, quality is ignored by PNG and
+// defaults to defaultQuality when 0.
+func newEncoder(format string, quality int) (encoder, error) {
+	if quality == 0 {
+		quality = defaultQuality
+	}
+	if quality < 1 || quality > 100 {
+		return nil, fmt.Errorf("quality must be between 1 and 100, got %d", quality)
+	}
+
+	switch format {
+	case "", "png":
+		return pngEncoder{}, nil
+	case "jpeg", "jpg":
+		return jpegEncoder{quality: quality}, nil
+	case "webp":
+		return webpEncoder{quality: quality}, nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnknownFormat, format)
+	}
+}
+
+// newStreamEncoder is newEncoder for streamed frames and tiles, which it
+// has to keep up with: WebP is only for exports and jobs.
+func newStreamEncoder(format string, quality int) (encoder, error) {
+	if format == "webp" {
+		return nil, errors.New("webp can't be streamed, only exported, want png or jpeg")
+	}
+	return newEncoder(format, quality)
+}
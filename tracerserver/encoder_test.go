@@ -0,0 +1,19 @@
+package tracerserver
+
+import "testing"
+
+func TestStreamEncoderRejectsWebP(t *testing.T) {
+	if _, err := newStreamEncoder("webp", 0); err == nil {
+		t.Error("webp accepted for streaming")
+	}
+	if _, err := newEncoder("webp", 0); err != nil {
+		t.Errorf("webp rejected for exports: %v", err)
+	}
+	enc, err := newStreamEncoder("jpeg", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc.ContentType() != "image/jpeg" {
+		t.Errorf("jpeg stream encodes %s", enc.ContentType())
+	}
+}
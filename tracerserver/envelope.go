@@ -0,0 +1,73 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// envelopeVersion is bumped whenever the envelope's layout changes.
+const envelopeVersion = 1
+
+// What an envelope carries: an encoded image, a dirty tile message (see
+// tileStreamer) or the GUI overlay PNG.
+const (
+	envelopeFrame byte = iota
+	envelopeTiles
+	envelopeOverlay
+)
+
+// historyPass is the pass scrubbed history frames are streamed as.
+const historyPass = "history"
+
+// frameStamp is what a streamed frame is of. Scrubbed history frames have
+// none, their pass tells them apart.
+type frameStamp struct {
+	generation      uint64
+	samplesPerPixel float64
+}
+
+func (r *renderer) frameStamp() frameStamp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return frameStamp{generation: r.gen.id, samplesPerPixel: r.samplesPerPixelLocked(r.gen)}
+}
+
+// envelope wraps a binary message for clients that asked for it in their
+// stream format, so they can drop frames of generations older than the
+// last reset, check the payload arrived whole and tell passes apart.
+// Each is big endian:
+//
+//	'E' | version u8 | kind u8 | generation u64 | samples_per_pixel f32 | crc32 u32 | pass_len u8 | pass | payload
+//
+// The CRC is IEEE, of the payload alone.
+type envelope struct {
+	buf              *bytes.Buffer
+	crcAt, payloadAt int
+}
+
+// beginEnvelope writes the header to w, up to where the payload starts.
+func beginEnvelope(w *bytes.Buffer, kind byte, stamp frameStamp, pass string) *envelope {
+	if len(pass) > math.MaxUint8 {
+		pass = pass[:math.MaxUint8]
+	}
+	w.WriteByte('E')
+	w.WriteByte(envelopeVersion)
+	w.WriteByte(kind)
+	binary.Write(w, binary.BigEndian, stamp.generation)
+	binary.Write(w, binary.BigEndian, float32(stamp.samplesPerPixel))
+	e := &envelope{buf: w, crcAt: w.Len()}
+	// The CRC is filled in once the payload is written.
+	binary.Write(w, binary.BigEndian, uint32(0))
+	w.WriteByte(byte(len(pass)))
+	w.WriteString(pass)
+	e.payloadAt = w.Len()
+	return e
+}
+
+// end fills in the CRC of the payload, the bytes written since the header.
+func (e *envelope) end() {
+	b := e.buf.Bytes()
+	binary.BigEndian.PutUint32(b[e.crcAt:], crc32.ChecksumIEEE(b[e.payloadAt:]))
+}
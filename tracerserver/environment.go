@@ -0,0 +1,213 @@
+package tracerserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghostec/tracer"
+)
+
+const maxEnvironmentUpload = 256 << 20
+
+// envMap is an equirectangular environment in linear RGB.
+type envMap struct {
+	pix           []float32
+	width, height int
+}
+
+func decodeEnvMap(r io.Reader) (*envMap, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); string(magic) == "#?" {
+		pix, w, h, err := decodeHDR(br)
+		if err != nil {
+			return nil, err
+		}
+		return &envMap{pix: pix, width: w, height: h}, nil
+	}
+
+	img, _, err := image.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	env := &envMap{pix: make([]float32, 0, b.Dx()*b.Dy()*3), width: b.Dx(), height: b.Dy()}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			// 8-bit images are gamma encoded, undo the gamma 2 the frames
+			// are written with.
+			for _, c := range []uint32{r, g, bl} {
+				v := float32(c) / 0xffff
+				env.pix = append(env.pix, v*v)
+			}
+		}
+	}
+	return env, nil
+}
+
+// lookup returns the environment's color in direction dir, +Y up and -Z at
+// the center of the image.
+func (e *envMap) lookup(dir tracer.Vec3) tracer.Color {
+	d := dir.Unit()
+	u := 0.5 + math.Atan2(d[0], -d[2])/(2*math.Pi)
+	v := math.Acos(tracer.Clamp(d[1], -1, 1)) / math.Pi
+	return e.at(u, v)
+}
+
+// at returns the color at u, v between 0 and 1, v 0 at the top.
+func (e *envMap) at(u, v float64) tracer.Color {
+	x := int(u * float64(e.width))
+	y := int(v * float64(e.height))
+	if x >= e.width {
+		x = e.width - 1
+	}
+	if y >= e.height {
+		y = e.height - 1
+	}
+	i := (y*e.width + x) * 3
+	return tracer.Color{float64(e.pix[i]), float64(e.pix[i+1]), float64(e.pix[i+2])}
+}
+
+// rayColorWith is tracer.RayColor with background instead of the built in
+// sky gradient.
+func rayColorWith(background func(tracer.Ray) tracer.Color, solo tracer.Hitter) tracer.RayColorFunc {
+	var rayColor tracer.RayColorFunc
+	rayColor = func(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+		if depth <= 0 {
+			return tracer.Color{}
+		}
+		hr := n.Hit(r)
+		if !hr.Hit {
+			return background(r)
+		}
+		if sr := hr.Material.Scatter(r, hr); sr.Scatter {
+			return tracer.Color(sr.Attenuation.Vec3().MulVec3(rayColor(sr.Ray, n, depth-1).Vec3()))
+		}
+		return emitted(hr, solo)
+	}
+	return rayColor
+}
+
+// rayColorFor is the shading settings ask for, outside of lessons.
+func rayColorFor(settings renderSettings) tracer.RayColorFunc {
+	return rayColorSolo(settings, nil)
+}
+
+// rayColorSolo is rayColorFor with every light but solo turned off, none
+// of them if solo is nil. tracer.RayColor doesn't know emissive materials,
+// so even the sky goes through rayColorWith. A registered ray_color
+// replaces all of it.
+func rayColorSolo(settings renderSettings, solo tracer.Hitter) tracer.RayColorFunc {
+	if f, ok := registeredRayColor(settings.RayColor); ok {
+		return f
+	}
+	env, ok := environments.get(settings.Environment)
+	if settings.Environment == "" || !ok {
+		return rayColorWith(skyColor, solo)
+	}
+	exposure := settings.Exposure
+	return rayColorWith(func(r tracer.Ray) tracer.Color {
+		return tracer.Color(env.lookup(r.Direction).Vec3().MulFloat(exposure))
+	}, solo)
+}
+
+type environmentRegistry struct {
+	mu   sync.Mutex
+	maps map[string]*envMap
+}
+
+var environments = &environmentRegistry{maps: map[string]*envMap{}}
+
+func (e *environmentRegistry) get(name string) (*envMap, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m, ok := e.maps[name]
+	return m, ok
+}
+
+func (e *environmentRegistry) set(name string, m *envMap) {
+	e.mu.Lock()
+	e.maps[name] = m
+	e.mu.Unlock()
+}
+
+// clear forgets every map, the Server's that registered them went away.
+func (e *environmentRegistry) clear() {
+	e.mu.Lock()
+	e.maps = map[string]*envMap{}
+	e.mu.Unlock()
+}
+
+func (e *environmentRegistry) names() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := []string{}
+	for name := range e.maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readEnvironmentFile decodes the image at path, to be registered under
+// its base name without the extension.
+func readEnvironmentFile(path string) (string, *envMap, error) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if !sceneNameRe.MatchString(name) {
+		return "", nil, fmt.Errorf("invalid environment name %q", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	m, err := decodeEnvMap(f)
+	if err != nil {
+		return "", nil, err
+	}
+	return name, m, nil
+}
+
+var errUnknownEnvironment = errors.New("unknown environment")
+
+// environmentsHandler serves GET /environments, the names settings can
+// select, and POST /environments/{name} with an HDR, PNG or JPEG body.
+func environmentsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/environments"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, environments.names())
+	case name != "" && r.Method == http.MethodPost:
+		if !sceneNameRe.MatchString(name) {
+			http.Error(w, fmt.Sprintf("invalid environment name %q", name), http.StatusBadRequest)
+			return
+		}
+		m, err := decodeEnvMap(http.MaxBytesReader(w, r.Body, maxEnvironmentUpload))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		environments.set(name, m)
+		// Sessions already lit by it would average the old and new maps.
+		for _, rend := range sessions.renderers() {
+			if rend.renderSettings().Environment == name {
+				rend.reset()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,73 @@
+package tracerserver
+
+import (
+	"math"
+	"time"
+)
+
+// What an ETA counts down to, the render target or adaptive sampling
+// converging.
+const (
+	etaTarget      = "target"
+	etaConvergence = "convergence"
+)
+
+// remainingSamples estimates how many more samples adaptive sampling takes
+// until every pixel converges. A pixel's relative error falls with the
+// square root of its samples, so one at error e after n samples needs about
+// n*(e/adaptiveThreshold)^2. False until every pixel has enough samples to
+// tell.
+func (s *sampleStats) remainingSamples() (float64, bool) {
+	remaining := 0.0
+	for i, n := range s.n {
+		if n < adaptiveMinSamples {
+			return 0, false
+		}
+		if e := s.relErr(i); e > adaptiveThreshold {
+			remaining += float64(n) * ((e*e)/(adaptiveThreshold*adaptiveThreshold) - 1)
+		}
+	}
+	return remaining, true
+}
+
+// etaLocked estimates how much longer gen renders before it stops, at the
+// rate it rendered so far: at the render target, or once adaptive sampling
+// converged, whichever comes first. By is what it stops at, false when it
+// never does or there's nothing to go by yet.
+func (r *renderer) etaLocked(gen *generation) (eta time.Duration, by string, ok bool) {
+	if gen.reached != nil {
+		return 0, etaTarget, true
+	}
+	consider := func(d time.Duration, reason string) {
+		if d < 0 {
+			d = 0
+		}
+		if !ok || d < eta {
+			eta, by, ok = d, reason, true
+		}
+	}
+
+	t := r.target
+	if t.Seconds > 0 {
+		consider(time.Duration(t.Seconds*float64(time.Second))-gen.renderTime, etaTarget)
+	}
+	if gen.rays == 0 || gen.renderTime <= 0 {
+		return eta, by, ok
+	}
+	raysPerSec := float64(gen.rays) / gen.renderTime.Seconds()
+	if t.SamplesPerPixel > 0 {
+		s := r.frameSettings()
+		rays := float64(t.SamplesPerPixel*s.Width*s.Height) - float64(gen.rays)
+		consider(secondsDuration(rays/raysPerSec), etaTarget)
+	}
+	if r.settings.Adaptive && gen.samples != nil {
+		if rays, known := gen.samples.remainingSamples(); known {
+			consider(secondsDuration(rays/raysPerSec), etaConvergence)
+		}
+	}
+	return eta, by, ok
+}
+
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(math.Min(s, math.MaxInt64/float64(time.Second)) * float64(time.Second))
+}
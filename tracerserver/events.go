@@ -0,0 +1,175 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// eventBuffer is how many events can wait for the hooks, or for a webhook,
+// before new ones are dropped.
+const eventBuffer = 256
+
+const webhookTimeout = 10 * time.Second
+
+// Event is something that happened in the Server, for the hooks registered
+// with Server.On and the webhooks in Options. Only the fields its type is
+// about are set.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Session uint64    `json:"session,omitempty"`
+	// User and Remote are who connected or disconnected.
+	User   string `json:"user,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// Selection is every object selected after an object_selected, empty
+	// when the selection was cleared.
+	Selection []int `json:"selection,omitempty"`
+	// Converged is the share of converged pixels that crossed
+	// Options.ConvergedThreshold.
+	Converged float64 `json:"converged,omitempty"`
+	// Job is the job that finished, or the snapshot a target_reached saved.
+	// Error is why the job failed if it did.
+	Job   uint64 `json:"job,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Event types.
+const (
+	EventSessionOpened      = "session_opened"
+	EventSessionClosed      = "session_closed"
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventSceneLoaded        = "scene_loaded"
+	EventObjectSelected     = "object_selected"
+	EventConverged          = "converged"
+	EventJobDone            = "job_done"
+	EventTargetReached      = "target_reached"
+)
+
+// hookRegistry calls the hooks for each event in the order they happened,
+// on a goroutine of its own so they can call back into the Server and
+// never hold up what emitted the event.
+type hookRegistry struct {
+	mu       sync.Mutex
+	hooks    map[string][]func(Event)
+	webhooks []*webhook
+	queue    chan Event
+}
+
+var hooks = newHookRegistry()
+
+func newHookRegistry() *hookRegistry {
+	h := &hookRegistry{hooks: map[string][]func(Event){}, queue: make(chan Event, eventBuffer)}
+	go h.dispatch()
+	return h
+}
+
+func (h *hookRegistry) on(typ string, fn func(Event)) {
+	h.mu.Lock()
+	h.hooks[typ] = append(h.hooks[typ], fn)
+	h.mu.Unlock()
+}
+
+func (h *hookRegistry) addWebhook(w *webhook) {
+	h.mu.Lock()
+	h.webhooks = append(h.webhooks, w)
+	h.mu.Unlock()
+	go w.run()
+}
+
+// clear drops the hooks and webhooks, which belong to the Server that
+// registered them. Webhooks still posting finish what they have queued.
+func (h *hookRegistry) clear() {
+	h.mu.Lock()
+	h.hooks, h.webhooks = map[string][]func(Event){}, nil
+	h.mu.Unlock()
+}
+
+func (h *hookRegistry) emit(e Event) {
+	e.Time = time.Now()
+	select {
+	case h.queue <- e:
+	default:
+		logs.Warn("event dropped, hooks are falling behind", "type", e.Type)
+	}
+	h.mu.Lock()
+	webhooks := h.webhooks
+	h.mu.Unlock()
+	for _, w := range webhooks {
+		w.send(e)
+	}
+}
+
+func (h *hookRegistry) dispatch() {
+	for e := range h.queue {
+		h.mu.Lock()
+		// on only ever appends, fns is safe to range over unlocked.
+		fns := h.hooks[e.Type]
+		h.mu.Unlock()
+		for _, fn := range fns {
+			fn(e)
+		}
+	}
+}
+
+// webhook POSTs every event to a URL as JSON. Each has its own queue, a
+// slow endpoint only holds up its own events.
+type webhook struct {
+	url   string
+	queue chan Event
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+func newWebhook(rawurl string) (*webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http or https URL", rawurl)
+	}
+	return &webhook{url: u.String(), queue: make(chan Event, eventBuffer)}, nil
+}
+
+func (w *webhook) send(e Event) {
+	select {
+	case w.queue <- e:
+	default:
+		logs.Warn("webhook event dropped, the endpoint is falling behind", "url", w.url, "type", e.Type)
+	}
+}
+
+func (w *webhook) run() {
+	for e := range w.queue {
+		if err := w.post(e); err != nil {
+			logs.Warn("webhook failed", "url", w.url, "type", e.Type, "err", err)
+		}
+	}
+}
+
+func (w *webhook) post(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// On calls fn with every event of type typ, one of the Event constants.
+func (s *Server) On(typ string, fn func(Event)) {
+	hooks.on(typ, fn)
+}
@@ -0,0 +1,147 @@
+package tracerserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/ghostec/tracer"
+)
+
+var (
+	errEncoderUnavailable = errors.New("encoder unavailable")
+	errUnknownFormat      = errors.New("unknown format")
+)
+
+// toRGBA64 converts the float accumulation buffer straight to 16 bits per
+// channel, applying the same gamma 2 the tracer uses for 8-bit output.
+func toRGBA64(frame *tracer.Frame) *image.RGBA64 {
+	img := image.NewRGBA64(image.Rect(0, 0, frame.Width(), frame.Height()))
+	for row := 0; row < frame.Height(); row++ {
+		for col := 0; col < frame.Width(); col++ {
+			c := frame.Get(row, col)
+			img.SetRGBA64(col, row, color.RGBA64{
+				R: to16(c[0]),
+				G: to16(c[1]),
+				B: to16(c[2]),
+				A: math.MaxUint16,
+			})
+		}
+	}
+	return img
+}
+
+func to16(v float64) uint16 {
+	return uint16(math.Round(tracer.Clamp(math.Sqrt(v), 0, 1) * math.MaxUint16))
+}
+
+// parseBitDepth reads a bit_depth parameter, 8 if it's empty.
+func parseBitDepth(v string) (int, error) {
+	switch v {
+	case "", "8":
+		return 8, nil
+	case "16":
+		return 16, nil
+	default:
+		return 0, fmt.Errorf("bit_depth must be 8 or 16, got %q", v)
+	}
+}
+
+// quantize gamma corrects frame to depth bits per channel.
+func quantize(frame *tracer.Frame, depth int) image.Image {
+	if depth == 16 {
+		return toRGBA64(frame)
+	}
+	return tracer.NewPPM(frame)
+}
+
+// encodeAVIF shells out to libavif's avifenc, there's no pure Go encoder.
+func encodeAVIF(w io.Writer, img image.Image) error {
+	return encodeExternal(w, img, "avifenc", func(in, out string) []string {
+		return []string{"--depth", "12", "--lossless", in, out}
+	})
+}
+
+// encodeExternal writes img as a PNG to a temp file, runs tool on it and
+// copies the tool's output file to w.
+func encodeExternal(w io.Writer, img image.Image, tool string, args func(in, out string) []string) error {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return fmt.Errorf("%w: %s not found in PATH", errEncoderUnavailable, tool)
+	}
+
+	dir, err := ioutil.TempDir("", "tracer-"+tool)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "frame.png"), filepath.Join(dir, "frame.out")
+
+	f, err := os.Create(in)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, args(in, out)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", tool, err, stderr.String())
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// linearFormat is a floating point format the accumulation buffer is
+// written in as is, keeping the range 8-bit output clips.
+type linearFormat struct {
+	contentType string
+	encode      func(w io.Writer, frame *tracer.Frame) error
+}
+
+var linearFormats = map[string]linearFormat{
+	"exr": {"image/x-exr", encodeEXR},
+	"hdr": {"image/vnd.radiance", encodeHDR},
+}
+
+func (r *renderer) Export(w io.Writer, format string) error {
+	r.mu.Lock()
+	frame := copyFrame(scaleFrame(r.gen.scene, r.settings.Width, r.settings.Height))
+	r.mu.Unlock()
+
+	switch format {
+	case "png16":
+		return png.Encode(w, toRGBA64(frame))
+	case "avif":
+		return encodeAVIF(w, toRGBA64(frame))
+	case "webp":
+		return webpEncoder{quality: defaultQuality}.Encode(w, quantize(frame, 8))
+	default:
+		if f, ok := linearFormats[format]; ok {
+			return f.encode(w, frame)
+		}
+		return errUnknownFormat
+	}
+}
@@ -0,0 +1,103 @@
+package tracerserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+// encodeEXR writes frame as an uncompressed scanline OpenEXR image with
+// 32-bit float R, G and B channels, linear like the accumulation buffer.
+func encodeEXR(w io.Writer, frame *tracer.Frame) error {
+	width, height := frame.Width(), frame.Height()
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+
+	var header []byte
+	u32 := func(v uint32) {
+		var b [4]byte
+		le.PutUint32(b[:], v)
+		header = append(header, b[:]...)
+	}
+	attr := func(name, typ string, size int) {
+		header = append(header, name...)
+		header = append(header, 0)
+		header = append(header, typ...)
+		header = append(header, 0)
+		u32(uint32(size))
+	}
+
+	u32(20000630) // magic
+	u32(2)        // version 2, single part scanline
+
+	// Channels are stored in alphabetical order.
+	channels := []string{"B", "G", "R"}
+	attr("channels", "chlist", len(channels)*18+1)
+	for _, c := range channels {
+		header = append(header, c...)
+		header = append(header, 0)
+		u32(2)                              // FLOAT
+		header = append(header, 0, 0, 0, 0) // pLinear and reserved
+		u32(1)                              // x sampling
+		u32(1)                              // y sampling
+	}
+	header = append(header, 0)
+
+	attr("compression", "compression", 1)
+	header = append(header, 0) // NO_COMPRESSION
+	for _, name := range []string{"dataWindow", "displayWindow"} {
+		attr(name, "box2i", 16)
+		u32(0)
+		u32(0)
+		u32(uint32(width - 1))
+		u32(uint32(height - 1))
+	}
+	attr("lineOrder", "lineOrder", 1)
+	header = append(header, 0) // INCREASING_Y
+	attr("pixelAspectRatio", "float", 4)
+	u32(math.Float32bits(1))
+	attr("screenWindowCenter", "v2f", 8)
+	u32(math.Float32bits(0))
+	u32(math.Float32bits(0))
+	attr("screenWindowWidth", "float", 4)
+	u32(math.Float32bits(1))
+	header = append(header, 0)
+
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	// The offset table points at each scanline block: its y, its size and
+	// the row's samples, channel by channel.
+	lineSize := width * len(channels) * 4
+	blockSize := 8 + lineSize
+	start := len(header) + height*8
+	var buf [8]byte
+	for y := 0; y < height; y++ {
+		le.PutUint64(buf[:], uint64(start+y*blockSize))
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+
+	line := make([]byte, blockSize)
+	for y := 0; y < height; y++ {
+		le.PutUint32(line[0:], uint32(y))
+		le.PutUint32(line[4:], uint32(lineSize))
+		for ci := range channels {
+			// B, G, R are channels 2, 1, 0 of a Color.
+			rgb := len(channels) - 1 - ci
+			off := 8 + ci*width*4
+			for x := 0; x < width; x++ {
+				le.PutUint32(line[off+x*4:], math.Float32bits(float32(frame.Get(y, x)[rgb])))
+			}
+		}
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,149 @@
+package tracerserver
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"time"
+)
+
+const (
+	defaultFrameHistory         = 12
+	defaultFrameHistoryInterval = 10 * time.Second
+)
+
+var errNoHistoryFrame = errors.New("no frame that old in the history")
+
+// historyFrame is the renderer's image as it was at a point in time.
+type historyFrame struct {
+	at         time.Time
+	generation uint64
+	passes     int
+	spp        float64
+	img        image.Image
+}
+
+type historyFramePayload struct {
+	Time            time.Time `json:"time"`
+	AgoMS           float64   `json:"ago_ms"`
+	Generation      uint64    `json:"generation"`
+	Passes          int       `json:"passes"`
+	SamplesPerPixel float64   `json:"samples_per_pixel"`
+}
+
+func (f historyFrame) payload() historyFramePayload {
+	return historyFramePayload{
+		Time:            f.at,
+		AgoMS:           millis(time.Since(f.at)),
+		Generation:      f.generation,
+		Passes:          f.passes,
+		SamplesPerPixel: f.spp,
+	}
+}
+
+// frameHistory is a ring of the last limit images, taken every interval.
+type frameHistory struct {
+	limit    int
+	interval time.Duration
+	frames   []historyFrame
+	next     int
+}
+
+func (h *frameHistory) push(f historyFrame) {
+	if len(h.frames) < h.limit {
+		h.frames = append(h.frames, f)
+		return
+	}
+	h.frames[h.next] = f
+	h.next = (h.next + 1) % h.limit
+}
+
+// ordered returns the frames oldest first.
+func (h *frameHistory) ordered() []historyFrame {
+	l := make([]historyFrame, 0, len(h.frames))
+	l = append(l, h.frames[h.next:]...)
+	return append(l, h.frames[:h.next]...)
+}
+
+// before returns the newest frame taken at or before t.
+func (h *frameHistory) before(t time.Time) (historyFrame, bool) {
+	l := h.ordered()
+	for i := len(l) - 1; i >= 0; i-- {
+		if !l[i].at.After(t) {
+			return l[i], true
+		}
+	}
+	return historyFrame{}, false
+}
+
+// recordFrames adds the image to the history every interval, unless
+// nothing was rendered since the last one.
+func (r *renderer) recordFrames() {
+	r.mu.Lock()
+	interval := r.frames.interval
+	r.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastGen uint64
+	lastPasses := -1
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		gen := r.gen
+		passes := gen.passes
+		r.mu.Unlock()
+		if passes == 0 || (gen.id == lastGen && passes == lastPasses) {
+			continue
+		}
+		lastGen, lastPasses = gen.id, passes
+
+		f := historyFrame{
+			at:         time.Now(),
+			generation: gen.id,
+			passes:     passes,
+			spp:        r.stats().SamplesPerPixel,
+			img:        r.Image(),
+		}
+		r.mu.Lock()
+		r.frames.push(f)
+		r.mu.Unlock()
+	}
+}
+
+func (r *renderer) frameHistory() []historyFramePayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := []historyFramePayload{}
+	for _, f := range r.frames.ordered() {
+		l = append(l, f.payload())
+	}
+	return l
+}
+
+// historyFrameAgo returns the newest frame in the history at least ago old.
+func (r *renderer) historyFrameAgo(ago time.Duration) (historyFrame, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.frames.before(time.Now().Add(-ago))
+	if !ok {
+		return historyFrame{}, fmt.Errorf("%w: %v", errNoHistoryFrame, ago)
+	}
+	return f, nil
+}
+
+// parseAgo reads how far back ?t= goes, as a Go duration that is usually
+// written negative, "-30s".
+func parseAgo(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Abs(float64(d))), nil
+}
@@ -0,0 +1,30 @@
+package tracerserver
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// embeddedStatic is the frontend: index.html, and the viewer's script and
+// styles it loads.
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+// frontend serves the frontend, from Options.StaticDir if it's set so edits
+// show on reload.
+func frontend() http.Handler {
+	var files fs.FS = os.DirFS(options.StaticDir)
+	if options.StaticDir == "" {
+		files, _ = fs.Sub(embeddedStatic, "static")
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Embedded files have no modification time to revalidate against,
+		// and a directory being worked on changes under the browser.
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
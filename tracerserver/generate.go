@@ -0,0 +1,163 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultGeneratedSpheres = 484
+	maxGeneratedSpheres     = 10000
+)
+
+// materialMix weighs how often each material kind is picked, the weights
+// don't have to add up to 1.
+type materialMix struct {
+	Lambertian float64 `json:"lambertian"`
+	Metal      float64 `json:"metal"`
+	Dielectric float64 `json:"dielectric"`
+}
+
+// generatePayload describes a "random spheres" scene: Count small spheres
+// with radii between MinRadius and MaxRadius scattered over a ground plane
+// around three big ones. The same Seed generates the same scene.
+type generatePayload struct {
+	Count     *int         `json:"count"`
+	MinRadius float64      `json:"min_radius"`
+	MaxRadius float64      `json:"max_radius"`
+	Materials *materialMix `json:"materials"`
+	Seed      *int64       `json:"seed"`
+}
+
+type generatedScenePayload struct {
+	Seed  int64     `json:"seed"`
+	Scene sceneDesc `json:"scene"`
+}
+
+// generateScene builds the scene p describes and returns the seed it used.
+func generateScene(p generatePayload) (sceneDesc, int64, error) {
+	count := defaultGeneratedSpheres
+	if p.Count != nil {
+		count = *p.Count
+	}
+	if p.MinRadius == 0 && p.MaxRadius == 0 {
+		p.MinRadius, p.MaxRadius = 0.2, 0.2
+	}
+	mix := materialMix{Lambertian: 0.8, Metal: 0.15, Dielectric: 0.05}
+	if p.Materials != nil {
+		mix = *p.Materials
+	}
+	total := mix.Lambertian + mix.Metal + mix.Dielectric
+	switch {
+	case count < 0 || count > maxGeneratedSpheres:
+		return sceneDesc{}, 0, fmt.Errorf("count must be between 0 and %d, got %d", maxGeneratedSpheres, count)
+	case p.MinRadius <= 0 || p.MaxRadius < p.MinRadius:
+		return sceneDesc{}, 0, fmt.Errorf("radii must satisfy 0 < min_radius <= max_radius, got %v and %v", p.MinRadius, p.MaxRadius)
+	case mix.Lambertian < 0 || mix.Metal < 0 || mix.Dielectric < 0 || total <= 0:
+		return sceneDesc{}, 0, fmt.Errorf("material weights must not be negative and not all 0, got %+v", mix)
+	}
+	seed := time.Now().UnixNano()
+	if p.Seed != nil {
+		seed = *p.Seed
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	// The classic scene is a 22x22 grid, bigger counts spread further out.
+	side := int(math.Ceil(math.Sqrt(float64(count))))
+	spacing := math.Max(1, 2.2*p.MaxRadius)
+	extent := math.Max(1, float64(side)*spacing/22)
+
+	big := []sphereDesc{
+		{Center: [3]float64{0, 1, 0}, Radius: 1, Material: materialDesc{Kind: "dielectric", RefractiveIndex: 1.5}},
+		{Center: [3]float64{-4, 1, 0}, Radius: 1, Material: materialDesc{Kind: "lambertian", Albedo: [3]float64{0.4, 0.2, 0.1}}},
+		{Center: [3]float64{4, 1, 0}, Radius: 1, Material: materialDesc{Kind: "metal", Albedo: [3]float64{0.7, 0.6, 0.5}}},
+	}
+	desc := sceneDesc{
+		Camera: cameraDesc{
+			VFoV:     20,
+			LookFrom: [3]float64{13 * extent, 2 * extent, 3 * extent},
+			VUp:      [3]float64{0, 1, 0},
+		},
+		Spheres: []sphereDesc{
+			{Center: [3]float64{0, -1000, 0}, Radius: 1000, Material: materialDesc{Kind: "lambertian", Albedo: [3]float64{0.5, 0.5, 0.5}}},
+		},
+	}
+
+	for i := 0; i < count; i++ {
+		radius := p.MinRadius + rnd.Float64()*(p.MaxRadius-p.MinRadius)
+		a := (float64(i%side) - float64(side)/2) * spacing
+		b := (float64(i/side) - float64(side)/2) * spacing
+		center := [3]float64{a + 0.9*spacing*rnd.Float64(), radius, b + 0.9*spacing*rnd.Float64()}
+		if overlaps(center, radius, big) {
+			continue
+		}
+		desc.Spheres = append(desc.Spheres, sphereDesc{Center: center, Radius: radius, Material: randomMaterial(rnd, mix, total)})
+	}
+	desc.Spheres = append(desc.Spheres, big...)
+	return desc, seed, nil
+}
+
+func overlaps(center [3]float64, radius float64, spheres []sphereDesc) bool {
+	for _, s := range spheres {
+		var d float64
+		for i := range center {
+			d += (center[i] - s.Center[i]) * (center[i] - s.Center[i])
+		}
+		if math.Sqrt(d) < radius+s.Radius {
+			return true
+		}
+	}
+	return false
+}
+
+func randomMaterial(rnd *rand.Rand, mix materialMix, total float64) materialDesc {
+	color := func(min float64) [3]float64 {
+		var c [3]float64
+		for i := range c {
+			c[i] = min + rnd.Float64()*(1-min)
+		}
+		return c
+	}
+	switch pick := rnd.Float64() * total; {
+	case pick < mix.Lambertian:
+		a, b := color(0), color(0)
+		return materialDesc{Kind: "lambertian", Albedo: [3]float64{a[0] * b[0], a[1] * b[1], a[2] * b[2]}}
+	case pick < mix.Lambertian+mix.Metal:
+		return materialDesc{Kind: "metal", Albedo: color(0.5), Fuzz: rnd.Float64() * 0.5}
+	default:
+		return materialDesc{Kind: "dielectric", RefractiveIndex: 1.5}
+	}
+}
+
+// generate serves POST /scene/generate, loading a generated scene into
+// every session like POST /scene and responding with it and its seed. An
+// empty body generates the classic scene.
+func generate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var p generatePayload
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	desc, seed, err := generateScene(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sessions.loadScene(desc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, generatedScenePayload{Seed: seed, Scene: desc})
+}
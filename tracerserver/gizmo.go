@@ -0,0 +1,167 @@
+package tracerserver
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// gizmoSize is how long the gizmo's arms are, as a fraction of the
+	// frame's height, whatever the distance to the selected object.
+	gizmoSize = 0.15
+	// gizmoPickRadius is how close, in frame pixels, a pointer has to be
+	// to an arm to grab it.
+	gizmoPickRadius = 8
+)
+
+// gizmoAxes name the gizmo's arms, along x, y and z.
+var gizmoAxes = []string{"x", "y", "z"}
+
+var gizmoColors = []tracer.Color{{255, 64, 64}, {64, 255, 64}, {64, 128, 255}}
+
+func gizmoAxis(name string) (int, error) {
+	for i, a := range gizmoAxes {
+		if a == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown axis %q, want one of %v", name, gizmoAxes)
+}
+
+// gizmoArms returns the ends of the gizmo's arms at center, sized to look
+// the same on screen at any distance, or false if center is behind the
+// camera.
+func gizmoArms(pr projector, center tracer.Point3) ([3]tracer.Point3, bool) {
+	var arms [3]tracer.Point3
+	z := pr.view(center)[2]
+	if pr.ortho > 0 {
+		z = pr.ortho
+	}
+	if z < nearPlane {
+		return arms, false
+	}
+	length := gizmoSize * 2 * z * pr.halfH
+	for axis := range arms {
+		var arm tracer.Vec3
+		arm[axis] = length
+		arms[axis] = tracer.Point3(center.Vec3().Add(arm))
+	}
+	return arms, true
+}
+
+// drawGizmo draws the translation gizmo's arms from center.
+func drawGizmo(f *tracer.Frame, pr projector, center tracer.Point3) {
+	arms, ok := gizmoArms(pr, center)
+	if !ok {
+		return
+	}
+	for axis, end := range arms {
+		pr.line(f, center, end, gizmoColors[axis])
+	}
+}
+
+// pickGizmo returns the arm of the gizmo at center closest to pixel (x, y),
+// "" if none is within gizmoPickRadius.
+func pickGizmo(pr projector, center tracer.Point3, x, y float64) string {
+	arms, ok := gizmoArms(pr, center)
+	if !ok {
+		return ""
+	}
+	x0, y0 := pr.pixel(pr.view(center))
+	picked, best := "", float64(gizmoPickRadius)
+	for axis, end := range arms {
+		c := pr.view(end)
+		if c[2] < nearPlane {
+			continue
+		}
+		x1, y1 := pr.pixel(c)
+		if d := segmentDistance(x, y, x0, y0, x1, y1); d <= best {
+			picked, best = gizmoAxes[axis], d
+		}
+	}
+	return picked
+}
+
+// segmentDistance is how far (x, y) is from the segment (x0, y0)-(x1, y1).
+func segmentDistance(x, y, x0, y0, x1, y1 float64) float64 {
+	dx, dy := x1-x0, y1-y0
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((x-x0)*dx+(y-y0)*dy)/l))
+	}
+	return math.Hypot(x-(x0+t*dx), y-(y0+t*dy))
+}
+
+// closestOnAxis returns t for the point center + t*dir closest to ray, or
+// false if the ray runs along the axis and no point is.
+func closestOnAxis(center tracer.Point3, dir tracer.Vec3, ray tracer.Ray) (float64, bool) {
+	w0 := center.Vec3().Sub(ray.Origin.Vec3())
+	a, b, c := dir.Dot(dir), dir.Dot(ray.Direction), ray.Direction.Dot(ray.Direction)
+	d, e := dir.Dot(w0), ray.Direction.Dot(w0)
+	denom := a*c - b*b
+	if denom < 1e-9*a*c {
+		return 0, false
+	}
+	return (b*e - c*d) / denom, true
+}
+
+// gizmoCenterLocked is where the gizmo sits, the selected object's
+// centroid, or false with nothing selected.
+func (r *renderer) gizmoCenterLocked() (tracer.Point3, bool) {
+	if r.selected < 0 {
+		return tracer.Point3{}, false
+	}
+	return centroid(r.objects[r.selected]), true
+}
+
+// pickGizmo returns the gizmo arm under (x, y), "" if there's none.
+func (r *renderer) pickGizmo(x, y float64) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	center, ok := r.gizmoCenterLocked()
+	if !ok {
+		return ""
+	}
+	return pickGizmo(newProjector(r.camera, r.settings), center, x, y)
+}
+
+// dragGizmo moves the selected object along axis by as much as a pointer
+// moving dx, dy pixels to (x, y) drags it, following the pointer's rays
+// rather than its pixels so the object stays under it in perspective.
+func (r *renderer) dragGizmo(axis string, x, y, dx, dy float64) error {
+	i, err := gizmoAxis(axis)
+	if err != nil {
+		return err
+	}
+	var dir tracer.Vec3
+	dir[i] = 1
+
+	r.mu.Lock()
+	center, ok := r.gizmoCenterLocked()
+	if !ok {
+		r.mu.Unlock()
+		return errNoSelection
+	}
+	pr := newProjector(r.camera, r.settings)
+	t0, ok0 := closestOnAxis(center, dir, pr.ray(x-dx, y-dy))
+	t1, ok1 := closestOnAxis(center, dir, pr.ray(x, y))
+	if !ok0 || !ok1 || t0 == t1 {
+		r.mu.Unlock()
+		return nil
+	}
+	h, err := transformHitter(r.objects[r.selected], dir.MulFloat(t1-t0), 1)
+	if err == nil {
+		objects := append(tracer.HitterList(nil), r.objects...)
+		objects[r.selected] = h
+		err = r.editObjectsLocked("gizmo", objects, r.meta)
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
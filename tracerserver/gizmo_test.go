@@ -0,0 +1,50 @@
+package tracerserver
+
+import (
+	"testing"
+
+	"github.com/ghostec/tracer"
+)
+
+func TestClosestOnAxis(t *testing.T) {
+	x := tracer.Vec3{1, 0, 0}
+	ray := tracer.Ray{Origin: tracer.Point3{2, 0, 5}, Direction: tracer.Vec3{0, 0, -1}}
+	if got, ok := closestOnAxis(tracer.Point3{}, x, ray); !ok || got != 2 {
+		t.Errorf("closest point on x to a ray through (2, 0) is at %v, %v, want 2", got, ok)
+	}
+	along := tracer.Ray{Origin: tracer.Point3{0, 1, 0}, Direction: x}
+	if _, ok := closestOnAxis(tracer.Point3{}, x, along); ok {
+		t.Error("ray along the axis has a closest point")
+	}
+}
+
+func TestDragGizmo(t *testing.T) {
+	renderTiles = newTilePool(1)
+	defer renderTiles.stop()
+	r := newRenderer()
+	defer r.cancel()
+	if err := r.loadScene(defaultScene); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	r.selectLocked(1)
+	before, _ := r.gizmoCenterLocked()
+	pr := newProjector(r.camera, r.settings)
+	x, y := pr.pixel(pr.view(before))
+	r.mu.Unlock()
+
+	if err := r.dragGizmo("x", x+20, y, 20, 0); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	after, _ := r.gizmoCenterLocked()
+	r.mu.Unlock()
+	if after[0] <= before[0] || after[1] != before[1] || after[2] != before[2] {
+		t.Errorf("dragging the x arm right moved %v to %v, want it along x only", before, after)
+	}
+
+	if err := r.dragGizmo("w", x, y, 1, 0); err == nil {
+		t.Error("dragging an unknown axis succeeded")
+	}
+}
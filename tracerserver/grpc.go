@@ -0,0 +1,261 @@
+package tracerserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/ghostec/tracer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service speaks JSON rather than protobuf: clients have to call
+// it with the "json" content subtype, application/grpc+json, and a codec
+// registered under that name, in Go grpc.CallContentSubtype("json").
+// Clients sending protobuf, grpcurl among them, are turned away. The
+// service and its messages are described in tracer.proto, whose JSON
+// mapping is what goes over the wire, so stubs generated from it work with
+// a protobuf JSON codec.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// renderStreamRequest attaches to Session, or opens a new session if it's 0.
+type renderStreamRequest struct {
+	Session uint64 `json:"session"`
+	Format  string `json:"format"`
+	Quality int    `json:"quality"`
+}
+
+type frameMessage struct {
+	Session     uint64 `json:"session"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// updateCameraRequest applies every field present, in the order they're
+// declared.
+type updateCameraRequest struct {
+	Session uint64      `json:"session"`
+	Move    *[3]float64 `json:"move"`
+	Orbit   *[2]float64 `json:"orbit"`
+	Pan     *[2]float64 `json:"pan"`
+	Dolly   *float64    `json:"dolly"`
+	Key     string      `json:"key"`
+	Fast    bool        `json:"fast"`
+}
+
+type pickRequest struct {
+	Session uint64 `json:"session"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Select  bool   `json:"select"`
+}
+
+// pickResponse is what's at the pixel picked, in the session picked in.
+type pickResponse struct {
+	Session uint64 `json:"session"`
+	Index   int    `json:"index"`
+}
+
+type setSceneRequest struct {
+	Scene sceneDesc `json:"scene"`
+}
+
+type empty struct{}
+
+type tracerService struct{}
+
+// grpcSession is the session id, any session if it's 0.
+func grpcSession(id uint64) (*session, error) {
+	var (
+		sess *session
+		ok   bool
+	)
+	if id == 0 {
+		sess, ok = sessions.any()
+	} else {
+		sess, ok = sessions.get(id)
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	return sess, nil
+}
+
+func (tracerService) RenderStream(req *renderStreamRequest, stream grpc.ServerStream) error {
+	var sess *session
+	if req.Session == 0 {
+		var err error
+		if sess, err = sessions.open(); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		defer sessions.close(sess)
+	} else {
+		var ok bool
+		if sess, ok = sessions.get(req.Session); !ok {
+			return status.Error(codes.NotFound, "session not found")
+		}
+	}
+
+	format := req.Format
+	if format == "" {
+		format = "png"
+	}
+	enc, err := newStreamEncoder(format, req.Quality)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if enc == nil {
+		return status.Error(codes.InvalidArgument, "format none has no frames to stream")
+	}
+
+	ticker := time.NewTicker(frameInterval())
+	defer ticker.Stop()
+
+	for {
+		var buf bytes.Buffer
+		if err := sess.renderer.Encode(&buf, enc); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := stream.SendMsg(&frameMessage{Session: sess.id, ContentType: enc.ContentType(), Data: buf.Bytes()}); err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-sess.renderer.done():
+			return status.Error(codes.Unavailable, "session closed")
+		case <-ticker.C:
+		}
+	}
+}
+
+func (tracerService) UpdateCamera(ctx context.Context, req *updateCameraRequest) (*empty, error) {
+	sess, err := grpcSession(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	rend := sess.renderer
+	if req.Move != nil {
+		rend.moveCamera(tracer.Vec3(*req.Move))
+	}
+	if req.Orbit != nil {
+		rend.orbitCamera(req.Orbit[0], req.Orbit[1])
+	}
+	if req.Pan != nil {
+		rend.panCamera(req.Pan[0], req.Pan[1])
+	}
+	if req.Dolly != nil {
+		rend.dollyCamera(*req.Dolly)
+	}
+	if req.Key != "" {
+		if err := rend.keyCamera(req.Key, req.Fast); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return &empty{}, nil
+}
+
+func (tracerService) Pick(ctx context.Context, req *pickRequest) (*pickResponse, error) {
+	sess, err := grpcSession(req.Session)
+	if err != nil {
+		return nil, err
+	}
+	if req.Select {
+		pick := sess.renderer.mouseclick(req.X, req.Y, false)
+		hooks.emit(Event{Type: EventObjectSelected, Session: sess.id, Selection: pick.Selection})
+		return &pickResponse{Session: sess.id, Index: pick.Object}, nil
+	}
+	return &pickResponse{Session: sess.id, Index: sess.renderer.pick(req.X, req.Y)}, nil
+}
+
+func (tracerService) SetScene(ctx context.Context, req *setSceneRequest) (*empty, error) {
+	if err := sessions.loadScene(req.Scene); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &empty{}, nil
+}
+
+type tracerServer interface {
+	RenderStream(*renderStreamRequest, grpc.ServerStream) error
+	UpdateCamera(context.Context, *updateCameraRequest) (*empty, error)
+	Pick(context.Context, *pickRequest) (*pickResponse, error)
+	SetScene(context.Context, *setSceneRequest) (*empty, error)
+}
+
+// unaryHandler adapts a typed unary method to grpc.MethodDesc's handler,
+// which is what protoc would otherwise generate.
+func unaryHandler(name string, newReq func() interface{}, call func(tracerServer, context.Context, interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newReq()
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(tracerServer), ctx, req)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/tracer.Tracer/" + name}, handler)
+		},
+	}
+}
+
+var tracerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tracer.Tracer",
+	HandlerType: (*tracerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("UpdateCamera", func() interface{} { return new(updateCameraRequest) }, func(s tracerServer, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.UpdateCamera(ctx, req.(*updateCameraRequest))
+		}),
+		unaryHandler("Pick", func() interface{} { return new(pickRequest) }, func(s tracerServer, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.Pick(ctx, req.(*pickRequest))
+		}),
+		unaryHandler("SetScene", func() interface{} { return new(setSceneRequest) }, func(s tracerServer, ctx context.Context, req interface{}) (interface{}, error) {
+			return s.SetScene(ctx, req.(*setSceneRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "RenderStream",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(renderStreamRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(tracerServer).RenderStream(req, stream)
+			},
+		},
+	},
+}
+
+func newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(unaryAuth), grpc.StreamInterceptor(streamAuth))
+	srv.RegisterService(&tracerServiceDesc, tracerService{})
+	return srv
+}
+
+func serveGRPC(srv *grpc.Server, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(lis)
+}
@@ -0,0 +1,25 @@
+package tracerserver
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPickResolvesSession(t *testing.T) {
+	renderTiles = newTilePool(1)
+	defer renderTiles.stop()
+	sessions = newSessionManager(false, 0, 0, 0, 0, defaultScene)
+	sess, err := sessions.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.close(sess)
+
+	res, err := tracerService{}.Pick(context.Background(), &pickRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Session != sess.id {
+		t.Errorf("pick in any session answered for session %d, want %d", res.Session, sess.id)
+	}
+}
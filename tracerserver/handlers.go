@@ -0,0 +1,184 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestRenderer resolves the ?session= query parameter, falling back to
+// the only live renderer when there's no ambiguity.
+func requestRenderer(w http.ResponseWriter, r *http.Request) (*renderer, bool) {
+	var (
+		sess *session
+		ok   bool
+	)
+	switch v := r.URL.Query().Get("session"); v {
+	case "":
+		sess, ok = sessions.any()
+	default:
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid session", http.StatusBadRequest)
+			return nil, false
+		}
+		sess, ok = sessions.get(id)
+	}
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return sess.renderer, true
+}
+
+// frame serves the current image as a PNG, 16 bits per channel with
+// ?bit_depth=16.
+func frame(w http.ResponseWriter, r *http.Request) {
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+	depth, err := parseBitDepth(r.URL.Query().Get("bit_depth"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var img image.Image
+	if t := r.URL.Query().Get("t"); t != "" {
+		// ?t=-30s is the frame history from 30 seconds ago.
+		if depth != 8 {
+			http.Error(w, "t: the frame history only keeps 8-bit frames", http.StatusBadRequest)
+			return
+		}
+		ago, err := parseAgo(t)
+		if err != nil {
+			http.Error(w, "t: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := rend.historyFrameAgo(ago)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Frame-Time", f.at.Format(time.RFC3339Nano))
+		img = f.img
+	} else {
+		f, err := rend.passFrame(r.URL.Query().Get("pass"), true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		img = quantize(f, depth)
+	}
+	if err := (pngEncoder{}).Encode(w, img); err != nil {
+		requestLog(r).Warn("encoding frame failed", "err", err)
+	}
+}
+
+func scene(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	desc, err := decodeScene(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sessions.loadScene(desc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func settings(w http.ResponseWriter, r *http.Request) {
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	var current renderSettings
+	switch r.Method {
+	case http.MethodGet:
+		current = rend.renderSettings()
+	case http.MethodPut:
+		p, err := decodeSettingsPatch(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if current, err = rend.updateSettings(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(current); err != nil {
+		requestLog(r).Warn("writing settings failed", "err", err)
+	}
+}
+
+// linearFrame serves the raw accumulation buffer in one of linearFormats,
+// without the GUI, denoising or gamma of /frame.png.
+func linearFrame(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rend, ok := requestRenderer(w, r)
+		if !ok {
+			return
+		}
+		buf := bytes.NewBuffer(nil)
+		if err := rend.Export(buf, format); err != nil {
+			requestLog(r).Error("export failed", "format", format, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", linearFormats[format].contentType)
+		w.Write(buf.Bytes())
+	}
+}
+
+func export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png16"
+	}
+
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	switch err := rend.Export(buf, format); {
+	case err == nil:
+	case err == errUnknownFormat:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errEncoderUnavailable):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	default:
+		requestLog(r).Error("export failed", "format", format, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "image/" + strings.TrimSuffix(format, "16")
+	if f, ok := linearFormats[format]; ok {
+		contentType = f.contentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,155 @@
+package tracerserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+// decodeHDR reads a Radiance RGBE (.hdr) image into linear float RGB,
+// row-major from the top. Both flat and run-length encoded scanlines are
+// supported.
+func decodeHDR(r io.Reader) (pix []float32, width, height int, err error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(magic, "#?") {
+		return nil, 0, 0, errors.New("hdr: not a Radiance file")
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("hdr: header: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return nil, 0, 0, fmt.Errorf("hdr: unsupported %s", line)
+		}
+	}
+	res, err := br.ReadString('\n')
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("hdr: resolution: %w", err)
+	}
+	if _, err := fmt.Sscanf(res, "-Y %d +X %d", &height, &width); err != nil {
+		return nil, 0, 0, fmt.Errorf("hdr: only -Y +X orientation is supported, got %q", strings.TrimSpace(res))
+	}
+	if width <= 0 || height <= 0 || width*height > 64<<20 {
+		return nil, 0, 0, fmt.Errorf("hdr: bad size %dx%d", width, height)
+	}
+
+	pix = make([]float32, 0, width*height*3)
+	scan := make([]byte, width*4)
+	for y := 0; y < height; y++ {
+		if err := readHDRScanline(br, scan, width); err != nil {
+			return nil, 0, 0, fmt.Errorf("hdr: row %d: %w", y, err)
+		}
+		for x := 0; x < width; x++ {
+			rgbe := scan[x*4 : x*4+4]
+			if rgbe[3] == 0 {
+				pix = append(pix, 0, 0, 0)
+				continue
+			}
+			f := math.Ldexp(1, int(rgbe[3])-(128+8))
+			pix = append(pix,
+				float32((float64(rgbe[0])+0.5)*f),
+				float32((float64(rgbe[1])+0.5)*f),
+				float32((float64(rgbe[2])+0.5)*f))
+		}
+	}
+	return pix, width, height, nil
+}
+
+// readHDRScanline fills scan with width RGBE pixels, interleaved.
+func readHDRScanline(br *bufio.Reader, scan []byte, width int) error {
+	head, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if width < 8 || width > 0x7fff || head[0] != 2 || head[1] != 2 || head[2]&0x80 != 0 {
+		_, err := io.ReadFull(br, scan)
+		return err
+	}
+	if int(head[2])<<8|int(head[3]) != width {
+		return errors.New("scanline width mismatch")
+	}
+	br.Discard(4)
+
+	// Run-length encoded scanlines store each channel separately.
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			n, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if n > 128 {
+				n -= 128
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+int(n) > width {
+					return errors.New("run overflows scanline")
+				}
+				for i := 0; i < int(n); i++ {
+					scan[(x+i)*4+c] = v
+				}
+				x += int(n)
+				continue
+			}
+			if n == 0 || x+int(n) > width {
+				return errors.New("bad run")
+			}
+			for i := 0; i < int(n); i++ {
+				v, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				scan[(x+i)*4+c] = v
+			}
+			x += int(n)
+		}
+	}
+	return nil
+}
+
+// encodeHDR writes frame as a Radiance RGBE image, linear like the
+// accumulation buffer. Scanlines are written flat, which every reader
+// accepts, rather than run-length encoded.
+func encodeHDR(w io.Writer, frame *tracer.Frame) error {
+	width, height := frame.Width(), frame.Height()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", height, width)
+
+	scan := make([]byte, width*4)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := frame.Get(y, x)
+			copy(scan[x*4:], rgbe(c[0], c[1], c[2]))
+		}
+		if _, err := bw.Write(scan); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// rgbe packs a linear color into shared exponent form, negatives clamped
+// to 0.
+func rgbe(r, g, b float64) []byte {
+	r, g, b = math.Max(r, 0), math.Max(g, 0), math.Max(b, 0)
+	v := math.Max(r, math.Max(g, b))
+	if v < 1e-32 {
+		return []byte{0, 0, 0, 0}
+	}
+	m, e := math.Frexp(v)
+	f := m * 256 / v
+	return []byte{byte(r * f), byte(g * f), byte(b * f), byte(e + 128)}
+}
@@ -0,0 +1,135 @@
+package tracerserver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// historyCoalesce is how close together camera changes or gizmo moves have
+// to be to count as one step, so a drag undoes in one go rather than pixel
+// by pixel.
+const historyCoalesce = 500 * time.Millisecond
+
+const defaultHistoryLimit = 100
+
+var (
+	errNothingToUndo = errors.New("nothing to undo")
+	errNothingToRedo = errors.New("nothing to redo")
+)
+
+type editState struct {
+	objects      tracer.HitterList
+	meta         []objectMeta
+	sceneVersion uint64
+	camera       tracer.Camera
+	// solo indexes objects, deleting one before it shifts it.
+	solo int
+}
+
+// history holds the states before each edit (past) and the ones undone
+// since the last edit (future), both bounded by limit.
+type history struct {
+	past, future []editState
+	limit        int
+
+	lastKind   string
+	lastRecord time.Time
+}
+
+func (h *history) push(s editState) {
+	h.past = append(h.past, s)
+	if len(h.past) > h.limit {
+		h.past = h.past[len(h.past)-h.limit:]
+	}
+}
+
+func (r *renderer) stateLocked() editState {
+	return editState{objects: r.objects, meta: r.meta, sceneVersion: r.sceneVersion, camera: r.camera, solo: r.solo}
+}
+
+// recordLocked saves the current state before an edit of kind. Camera edits
+// or gizmo moves following each other quickly are folded into one step.
+func (r *renderer) recordLocked(kind string) {
+	h := &r.history
+	if h.limit <= 0 {
+		return
+	}
+	now := time.Now()
+	coalesce := (kind == "camera" || kind == "gizmo") && h.lastKind == kind && now.Sub(h.lastRecord) < historyCoalesce
+	h.lastKind, h.lastRecord = kind, now
+	if coalesce {
+		return
+	}
+	h.push(r.stateLocked())
+	h.future = nil
+}
+
+// restoreLocked swaps s in. Selection is dropped if the object list doesn't
+// line up anymore. Accumulation picks up where it left off if s was rendered
+// recently enough to still be in the accumulation cache.
+func (r *renderer) restoreLocked(s editState) error {
+	bvh, err := buildBVH(s.objects)
+	if err != nil {
+		return err
+	}
+	if len(s.objects) != len(r.objects) {
+		r.selectLocked(-1)
+		r.hovered = -1
+	}
+	r.objects, r.meta, r.scene, r.sceneVersion = s.objects, s.meta, bvh, s.sceneVersion
+	r.solo = s.solo
+	r.camera = s.camera
+	r.camera.AspectRatio = r.settings.aspectRatio()
+	r.highlight = nil
+	r.history.lastKind = ""
+	r.resetLocked()
+	return nil
+}
+
+func (r *renderer) undo() error {
+	r.mu.Lock()
+	h := &r.history
+	if len(h.past) == 0 {
+		r.mu.Unlock()
+		return errNothingToUndo
+	}
+	prev := h.past[len(h.past)-1]
+	cur := r.stateLocked()
+	err := r.restoreLocked(prev)
+	if err == nil {
+		h.past = h.past[:len(h.past)-1]
+		h.future = append(h.future, cur)
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
+
+func (r *renderer) redo() error {
+	r.mu.Lock()
+	h := &r.history
+	if len(h.future) == 0 {
+		r.mu.Unlock()
+		return errNothingToRedo
+	}
+	next := h.future[len(h.future)-1]
+	cur := r.stateLocked()
+	err := r.restoreLocked(next)
+	if err == nil {
+		h.future = h.future[:len(h.future)-1]
+		h.push(cur)
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
@@ -0,0 +1,46 @@
+package tracerserver
+
+import "testing"
+
+func TestUndoDeleteRestoresSolo(t *testing.T) {
+	renderTiles = newTilePool(1)
+	defer renderTiles.stop()
+	r := newRenderer()
+	defer r.cancel()
+	if err := r.loadScene(defaultScene); err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []float64{-1, 1} {
+		h, err := lightDesc{Position: [3]float64{x, 2, -1}, Radius: 0.2, Color: [3]float64{1, 1, 1}, Intensity: 4}.Hitter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.addObject(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	soloed := len(defaultScene.Spheres) + 1
+
+	r.mu.Lock()
+	r.selectLocked(soloed)
+	r.mu.Unlock()
+	if err := r.soloSelectedLight(true); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.selectLocked(1)
+	r.mu.Unlock()
+	if err := r.deleteSelected(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lights().Solo; got != soloed-1 {
+		t.Fatalf("after deleting an object before it the solo light is %d, want %d", got, soloed-1)
+	}
+
+	if err := r.undo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lights().Solo; got != soloed {
+		t.Errorf("after undoing the delete the solo light is %d, want %d", got, soloed)
+	}
+}
@@ -0,0 +1,41 @@
+package tracerserver
+
+// Hovering casts a ray and redraws the GUI overlay, too slow to do in the
+// read loop for every pointer move. Each client has a worker doing it
+// instead, which only ever picks up the latest position, dropping those
+// that came in while it was busy.
+
+// hover queues p for c's hover worker, replacing whatever it hasn't got to
+// yet.
+func (c *client) hover(p pointerPayload) {
+	c.hmu.Lock()
+	c.hoverAt = &p
+	c.hmu.Unlock()
+	select {
+	case c.hoverWake <- struct{}{}:
+	default:
+	}
+}
+
+// hoverLoop hovers the positions hover queues and sends what's under them,
+// until done is closed.
+func (c *client) hoverLoop(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.hoverWake:
+		}
+		c.hmu.Lock()
+		p := c.hoverAt
+		c.hoverAt = nil
+		c.hmu.Unlock()
+		if p == nil {
+			continue
+		}
+		res := c.session.renderer.mousemove(p.X, p.Y)
+		if err := c.send("hover", "", res); err != nil {
+			c.log.Warn("sending hover failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package tracerserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// jobPassSamples is how many samples per pixel a job renders per pass.
+// Rendering in passes is what makes jobs cancellable and gives them
+// progress.
+const jobPassSamples = 16
+
+const maxQueuedJobs = 64
+
+// Finished jobs are kept for their results to be fetched for up to
+// finishedJobTTL, and no more than maxFinishedJobs of them, checked every
+// jobExpiryInterval.
+const (
+	finishedJobTTL    = time.Hour
+	maxFinishedJobs   = 64
+	jobExpiryInterval = time.Minute
+)
+
+var (
+	errJobNotFound = errors.New("job not found")
+	errQueueFull   = errors.New("too many jobs queued")
+	errResultGone  = errors.New("job result already fetched")
+)
+
+// renderJob is a one-shot, high sample count render of a fixed scene and
+// camera, run on the job workers rather than a session's render loop.
+type renderJob struct {
+	id       uint64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	scene        tracer.Hitter
+	camera       tracer.Camera
+	rayColorFunc tracer.RayColorFunc
+	settings     renderSettings
+	// cameras are set for an animation, one per frame, and replace camera.
+	cameras []tracer.Camera
+	fps     int
+	// output is the format of a single frame's result, one of
+	// linearFormats, "png16", "webp" or "" for an 8-bit PNG.
+	output string
+
+	mu     sync.Mutex
+	passes int
+	done   int
+	frame  *tracer.Frame
+	frames []*tracer.Frame
+	err    error
+	// finishedAt is when finished was closed. released is set once the
+	// result was fetched and its frames dropped.
+	finishedAt time.Time
+	released   bool
+}
+
+func newRenderJob(scene tracer.Hitter, camera tracer.Camera, rayColorFunc tracer.RayColorFunc, settings renderSettings) *renderJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	camera.AspectRatio = settings.aspectRatio()
+	return &renderJob{
+		ctx:          ctx,
+		cancel:       cancel,
+		finished:     make(chan struct{}),
+		scene:        clipped(scene, settings.Clip),
+		camera:       camera,
+		rayColorFunc: rayColorFunc,
+		settings:     settings,
+		passes:       (settings.SamplesPerPixel + jobPassSamples - 1) / jobPassSamples,
+	}
+}
+
+type jobStatus struct {
+	ID              uint64  `json:"id"`
+	State           string  `json:"state"`
+	Progress        float64 `json:"progress"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	SamplesPerPixel int     `json:"samples_per_pixel"`
+	Frames          int     `json:"frames,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+func (j *renderJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobStatus{
+		ID:              j.id,
+		State:           "queued",
+		Progress:        float64(j.done) / float64(j.passes*j.frameCount()),
+		Width:           j.settings.Width,
+		Height:          j.settings.Height,
+		SamplesPerPixel: j.settings.SamplesPerPixel,
+		Frames:          len(j.cameras),
+	}
+	select {
+	case <-j.finished:
+		s.State = "done"
+		if j.err != nil {
+			s.State, s.Error = "failed", j.err.Error()
+		}
+	default:
+		if j.done > 0 {
+			s.State = "rendering"
+		}
+	}
+	return s
+}
+
+func (j *renderJob) fail(err error) {
+	j.mu.Lock()
+	j.err = err
+	j.mu.Unlock()
+}
+
+// finish closes j.finished, noting when.
+func (j *renderJob) finish() {
+	j.mu.Lock()
+	j.finishedAt = time.Now()
+	j.mu.Unlock()
+	close(j.finished)
+}
+
+// finishedTime is when j finished, false if it hasn't.
+func (j *renderJob) finishedTime() (time.Time, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finishedAt, !j.finishedAt.IsZero()
+}
+
+// result is j's frame, or its frames for an animation, false once they
+// were released.
+func (j *renderJob) result() (*tracer.Frame, []*tracer.Frame, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.frame, j.frames, !j.released
+}
+
+// release drops the frames of j's result, once it's been fetched.
+func (j *renderJob) release() {
+	j.mu.Lock()
+	j.frame, j.frames, j.released = nil, nil, true
+	j.mu.Unlock()
+}
+
+func (j *renderJob) frameCount() int {
+	if j.cameras != nil {
+		return len(j.cameras)
+	}
+	return 1
+}
+
+func (j *renderJob) run() {
+	defer j.finish()
+
+	if j.cameras == nil {
+		frame, err := j.render(j.camera)
+		if err != nil {
+			j.fail(err)
+			return
+		}
+		j.mu.Lock()
+		j.frame = frame
+		j.mu.Unlock()
+		return
+	}
+
+	for _, camera := range j.cameras {
+		frame, err := j.render(camera)
+		if err != nil {
+			j.fail(err)
+			return
+		}
+		j.mu.Lock()
+		j.frames = append(j.frames, frame)
+		j.mu.Unlock()
+	}
+}
+
+// render renders one frame from camera in passes, stopping early if the
+// job is cancelled.
+func (j *renderJob) render(camera tracer.Camera) (*tracer.Frame, error) {
+	if err := j.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	per := (j.settings.SamplesPerPixel + j.passes - 1) / j.passes
+	acc := newFrame(j.settings)
+	rayColorFunc := withLens(j.rayColorFunc, camera, j.settings)
+
+	for i := 0; i < j.passes; i++ {
+		pass := newFrame(j.settings)
+		err := renderTiles.render(j.ctx, tileRender{
+			queue:        backgroundTiles,
+			frame:        pass,
+			camera:       camera,
+			scene:        j.scene,
+			rayColorFunc: rayColorFunc,
+			spp:          per,
+			maxDepth:     j.settings.MaxDepth,
+			aggColorFunc: aggColorFor(j.settings),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		acc.Avg(pass)
+		j.mu.Lock()
+		j.done++
+		j.mu.Unlock()
+	}
+	return acc, nil
+}
+
+// jobQueue runs render jobs on a fixed number of workers. They render
+// their tiles on renderTiles' background queue, so sessions keep most of
+// the render workers however many jobs run.
+type jobQueue struct {
+	mu     sync.Mutex
+	jobs   map[uint64]*renderJob
+	nextID uint64
+	queue  chan *renderJob
+	quit   chan struct{}
+}
+
+func newJobQueue(workers int) *jobQueue {
+	q := &jobQueue{jobs: map[uint64]*renderJob{}, queue: make(chan *renderJob, maxQueuedJobs), quit: make(chan struct{})}
+	go q.expireEvery(jobExpiryInterval)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case j := <-q.queue:
+					j.run()
+					hooks.emit(Event{Type: EventJobDone, Job: j.id, Error: j.status().Error})
+				case <-q.quit:
+					return
+				}
+			}
+		}()
+	}
+	return q
+}
+
+// stop cancels every job and ends the workers once the ones running
+// return.
+func (q *jobQueue) stop() {
+	q.cancelAll()
+	close(q.quit)
+}
+
+func (q *jobQueue) submit(j *renderJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The ID is set before a worker can pick the job up and read it.
+	q.nextID++
+	j.id = q.nextID
+	q.jobs[j.id] = j
+	select {
+	case q.queue <- j:
+	default:
+		delete(q.jobs, j.id)
+		q.nextID--
+		j.cancel()
+		return errQueueFull
+	}
+	return nil
+}
+
+func (q *jobQueue) get(id uint64) (*renderJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	return j, ok
+}
+
+func (q *jobQueue) list() []*renderJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l := make([]*renderJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		l = append(l, j)
+	}
+	sort.Slice(l, func(a, b int) bool { return l[a].id < l[b].id })
+	return l
+}
+
+// add keeps j, which already finished, for GET /snapshot?id= to serve.
+func (q *jobQueue) add(j *renderJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextID++
+	j.id = q.nextID
+	q.jobs[j.id] = j
+}
+
+func (q *jobQueue) expireEvery(d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			q.expire(now)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// expire forgets the jobs that finished over finishedJobTTL before now,
+// and the oldest of the rest beyond maxFinishedJobs, frames and all.
+func (q *jobQueue) expire(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	type finished struct {
+		j  *renderJob
+		at time.Time
+	}
+	var kept []finished
+	for id, j := range q.jobs {
+		at, ok := j.finishedTime()
+		switch {
+		case !ok:
+		case now.Sub(at) > finishedJobTTL:
+			delete(q.jobs, id)
+		default:
+			kept = append(kept, finished{j, at})
+		}
+	}
+	if len(kept) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(kept, func(a, b int) bool { return kept[a].at.Before(kept[b].at) })
+	for _, f := range kept[:len(kept)-maxFinishedJobs] {
+		delete(q.jobs, f.j.id)
+	}
+}
+
+// remove forgets j, cancelling it if it hasn't finished.
+func (q *jobQueue) remove(j *renderJob) {
+	q.mu.Lock()
+	delete(q.jobs, j.id)
+	q.mu.Unlock()
+	j.cancel()
+}
+
+// cancelAll cancels every job that hasn't finished.
+func (q *jobQueue) cancelAll() {
+	for _, j := range q.list() {
+		j.cancel()
+	}
+}
+
+var jobs *jobQueue
+
+// jobRequest is the body of POST /jobs. The scene defaults to the one new
+// sessions start from, camera overrides the scene's and settings is applied
+// over the defaults. With animation the job renders its frames instead.
+// Output picks the result's format, "png" by default, "png16" for 16 bits
+// per channel, "webp" or "exr" or "hdr" for the linear floating point
+// frame.
+type jobRequest struct {
+	Scene     *sceneDesc     `json:"scene"`
+	Camera    *cameraDesc    `json:"camera"`
+	Settings  settingsPatch  `json:"settings"`
+	Animation *animationDesc `json:"animation"`
+	Output    string         `json:"output"`
+}
+
+func decodeJobRequest(r io.Reader) (jobRequest, error) {
+	var req jobRequest
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return jobRequest{}, err
+	}
+	return req, nil
+}
+
+func (req jobRequest) job(scene sceneDesc) (*renderJob, error) {
+	if req.Scene != nil {
+		scene = *req.Scene
+	}
+	if req.Camera != nil {
+		scene.Camera = *req.Camera
+	}
+	bvh, cam, err := scene.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := currentDefaults()
+	if scene.Camera.AspectRatio != 0 && req.Settings.Height == nil {
+		settings = settings.withAspectRatio(cam.AspectRatio)
+	}
+	if settings, err = settings.apply(req.Settings); err != nil {
+		return nil, err
+	}
+	output := req.Output
+	if output == "png" {
+		output = ""
+	}
+	if _, ok := linearFormats[output]; output != "" && output != "png16" && output != "webp" && !ok {
+		return nil, fmt.Errorf("output: %v %q, want png, png16, webp, exr or hdr", errUnknownFormat, req.Output)
+	}
+	if req.Animation != nil {
+		if output != "" {
+			return nil, errors.New("output: animations are rendered to PNG frames")
+		}
+		return req.Animation.job(bvh, rayColorFor(settings), settings)
+	}
+	j := newRenderJob(bvh, cam, rayColorFor(settings), settings)
+	j.output = output
+	return j, nil
+}
+
+// jobsHandler serves the job queue:
+//
+//	POST   /jobs             enqueue a jobRequest
+//	GET    /jobs             list every job's status
+//	GET    /jobs/{id}        one job's status
+//	GET    /jobs/{id}/result the image in the requested output, once the
+//	                         job is done, or for an animation its frames,
+//	                         see writeAnimationResult
+//	DELETE /jobs/{id}        cancel and forget a job
+//
+// A result can be fetched once, after which its frames are dropped.
+// Finished jobs are forgotten after finishedJobTTL, or sooner when more
+// than maxFinishedJobs finish.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			l := []jobStatus{}
+			for _, j := range jobs.list() {
+				l = append(l, j.status())
+			}
+			writeJSON(w, http.StatusOK, l)
+		case http.MethodPost:
+			createJob(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "result") {
+		http.NotFound(w, r)
+		return
+	}
+	j, ok := jobs.get(id)
+	if !ok {
+		http.Error(w, errJobNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		select {
+		case <-j.finished:
+			if j.cameras != nil {
+				writeAnimationResult(w, r, j)
+			} else {
+				writeJobResult(w, j)
+			}
+		default:
+			writeJSON(w, http.StatusConflict, j.status())
+		}
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, j.status())
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		jobs.remove(j)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createJob(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeJobRequest(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := req.job(sessions.currentScene())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := jobs.submit(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j.status())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logs.Warn("writing json failed", "err", err)
+	}
+}
+
+// writeJobResult responds with a finished job's image, or its error.
+func writeJobResult(w http.ResponseWriter, j *renderJob) {
+	if j.err != nil {
+		http.Error(w, j.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	frame, _, ok := j.result()
+	if !ok {
+		http.Error(w, errResultGone.Error(), http.StatusGone)
+		return
+	}
+
+	var buf bytes.Buffer
+	contentType := "image/png"
+	var err error
+	if f, ok := linearFormats[j.output]; ok {
+		contentType = f.contentType
+		err = f.encode(&buf, frame)
+	} else if j.output == "png16" {
+		err = (pngEncoder{}).Encode(&buf, quantize(frame, 16))
+	} else if j.output == "webp" {
+		enc := webpEncoder{quality: defaultQuality}
+		contentType = enc.ContentType()
+		err = enc.Encode(&buf, quantize(frame, 8))
+	} else {
+		err = (pngEncoder{}).Encode(&buf, quantize(frame, 8))
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, errEncoderUnavailable):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	default:
+		logs.Error("encoding job result failed", "job", j.id, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	j.release()
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,63 @@
+package tracerserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+func TestSubmitAssignsIDs(t *testing.T) {
+	q := &jobQueue{jobs: map[uint64]*renderJob{}, queue: make(chan *renderJob, 1)}
+
+	j := newRenderJob(nil, tracer.Camera{}, nil, defaultSettings)
+	if err := q.submit(j); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-q.queue; got.id != 1 {
+		t.Errorf("queued job has ID %d, want 1", got.id)
+	}
+	if _, ok := q.get(1); !ok {
+		t.Error("submitted job isn't listed")
+	}
+
+	q.queue <- j
+	full := newRenderJob(nil, tracer.Camera{}, nil, defaultSettings)
+	if err := q.submit(full); err != errQueueFull {
+		t.Fatalf("submitting to a full queue got %v, want %v", err, errQueueFull)
+	}
+	if _, ok := q.get(2); ok || q.nextID != 1 {
+		t.Errorf("rejected job kept ID 2, next ID is %d", q.nextID)
+	}
+}
+
+func TestExpireFinishedJobs(t *testing.T) {
+	q := &jobQueue{jobs: map[uint64]*renderJob{}}
+	now := time.Now()
+
+	running := newRenderJob(nil, tracer.Camera{}, nil, defaultSettings)
+	running.id = 1000
+	q.jobs[running.id] = running
+	old := finishedJob(nil, defaultSettings)
+	q.add(old)
+	old.finishedAt = now.Add(-finishedJobTTL - time.Second)
+	for i := 0; i < maxFinishedJobs+1; i++ {
+		j := finishedJob(nil, defaultSettings)
+		q.add(j)
+		j.finishedAt = now.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	q.expire(now)
+	if _, ok := q.get(old.id); ok {
+		t.Error("job finished over finishedJobTTL ago kept")
+	}
+	if _, ok := q.get(old.id + 1); ok {
+		t.Error("oldest job beyond maxFinishedJobs kept")
+	}
+	if _, ok := q.get(running.id); !ok {
+		t.Error("unfinished job expired")
+	}
+	if n := len(q.list()); n != maxFinishedJobs+1 {
+		t.Errorf("%d jobs kept, want %d", n, maxFinishedJobs+1)
+	}
+}
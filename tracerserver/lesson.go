@@ -0,0 +1,107 @@
+package tracerserver
+
+import (
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+type lessonStage struct {
+	Name         string
+	Annotation   string
+	MaxDepth     int
+	RayColorFunc tracer.RayColorFunc
+}
+
+var lessonStages = []lessonStage{
+	{
+		Name:         "primary",
+		Annotation:   "Primary rays only: one ray per pixel from the camera, shaded by the surface normal at the first hit. No light is transported yet.",
+		MaxDepth:     1,
+		RayColorFunc: rayColorNormal,
+	},
+	{
+		Name:         "one-bounce",
+		Annotation:   "One bounce: each hit scatters a single ray, which only contributes if it escapes to the sky. Shadows and contact darkening appear.",
+		MaxDepth:     2,
+		RayColorFunc: tracer.RayColor,
+	},
+	{
+		Name:         "two-bounces",
+		Annotation:   "Two bounces: light can now reflect off one surface onto another, so the spheres pick up color from the ground and each other.",
+		MaxDepth:     3,
+		RayColorFunc: tracer.RayColor,
+	},
+	{
+		Name:         "uniform-sampling",
+		Annotation:   "Full depth with uniform hemisphere sampling: diffuse bounces ignore the cosine term when choosing directions, so the image converges to the same result but with visibly more noise.",
+		MaxDepth:     50,
+		RayColorFunc: rayColorUniform,
+	},
+	{
+		Name:         "importance-sampling",
+		Annotation:   "Full depth with cosine-weighted (importance) sampling, the tracer's default: directions are chosen proportionally to their contribution, which reduces noise at the same sample count.",
+		MaxDepth:     50,
+		RayColorFunc: tracer.RayColor,
+	},
+}
+
+type lessonInfoPayload struct {
+	Stage      int    `json:"stage"`
+	Stages     int    `json:"stages"`
+	Name       string `json:"name,omitempty"`
+	Annotation string `json:"annotation,omitempty"`
+}
+
+func lessonInfo(stage int) lessonInfoPayload {
+	if stage < 0 {
+		return lessonInfoPayload{Stage: -1, Stages: len(lessonStages)}
+	}
+	s := lessonStages[stage]
+	return lessonInfoPayload{
+		Stage:      stage,
+		Stages:     len(lessonStages),
+		Name:       s.Name,
+		Annotation: s.Annotation,
+	}
+}
+
+func rayColorNormal(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+	if hr := n.Hit(r); hr.Hit {
+		return tracer.Color(hr.Normal.Unit().Add(tracer.Vec3{1, 1, 1}).MulFloat(0.5))
+	}
+	return skyColor(r)
+}
+
+// rayColorUniform is tracer.RayColor with diffuse bounces sampled uniformly
+// over the hemisphere instead of cosine-weighted, to show what importance
+// sampling buys.
+func rayColorUniform(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+	if depth <= 0 {
+		return tracer.Color{}
+	}
+
+	hr := n.Hit(r)
+	if !hr.Hit {
+		return skyColor(r)
+	}
+
+	if l, ok := hr.Material.(tracer.Lambertian); ok {
+		dir := tracer.RandomInHemisphere(hr.Normal).Unit()
+		// pdf is 1/2π, the BRDF albedo/π, so the estimator weight is 2·cosθ.
+		weight := 2 * math.Max(0, dir.Dot(hr.Normal.Unit()))
+		incoming := rayColorUniform(tracer.Ray{Origin: hr.P, Direction: dir}, n, depth-1)
+		return tracer.Color(l.Albedo.Vec3().MulVec3(incoming.Vec3()).MulFloat(weight))
+	}
+
+	if sr := hr.Material.Scatter(r, hr); sr.Scatter {
+		return tracer.Color(sr.Attenuation.Vec3().MulVec3(rayColorUniform(sr.Ray, n, depth-1).Vec3()))
+	}
+	return tracer.Color{}
+}
+
+func skyColor(r tracer.Ray) tracer.Color {
+	unitDirection := r.Direction.Unit()
+	t := 0.5 * (unitDirection[1] + 1.0)
+	return tracer.Color(tracer.Vec3{1, 1, 1}.MulFloat(1.0 - t).Add(tracer.Vec3{0.5, 0.7, 1.0}.MulFloat(t)))
+}
@@ -0,0 +1,218 @@
+package tracerserver
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	defaultLightRadius    = 0.25
+	defaultLightIntensity = 4
+	maxLightIntensity     = 1000
+)
+
+var errNotALight = errors.New("selected object is not a light")
+
+// emissive is a material giving off Color scaled by Intensity and
+// scattering nothing. The tracer has no lights of its own, rayColorWith
+// adds what emissive surfaces give off.
+type emissive struct {
+	Color     tracer.Color
+	Intensity float64
+}
+
+func (e emissive) Scatter(r tracer.Ray, hr tracer.HitRecord) tracer.ScatterRecord {
+	return tracer.ScatterRecord{}
+}
+
+func (e emissive) emitted() tracer.Color {
+	return tracer.Color(e.Color.Vec3().MulFloat(e.Intensity))
+}
+
+// emitted is what the surface hr hit gives off, nothing unless it's
+// emissive and either solo is nil or it's the surface of solo.
+func emitted(hr tracer.HitRecord, solo tracer.Hitter) tracer.Color {
+	e, ok := hr.Material.(emissive)
+	if !ok || (solo != nil && hr.BVHNode.Left != solo) {
+		return tracer.Color{}
+	}
+	return e.emitted()
+}
+
+// lightDesc is a spherical light. Color is 0-1 per channel, Intensity
+// scales it.
+type lightDesc struct {
+	Position  [3]float64 `json:"position"`
+	Radius    float64    `json:"radius"`
+	Color     [3]float64 `json:"color"`
+	Intensity float64    `json:"intensity"`
+}
+
+func (d lightDesc) validate() error {
+	if d.Radius <= 0 {
+		return fmt.Errorf("radius must be positive, got %v", d.Radius)
+	}
+	return nil
+}
+
+func (d lightDesc) Hitter() (tracer.Hitter, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	return sphereDesc{
+		Center:   d.Position,
+		Radius:   d.Radius,
+		Material: materialDesc{Kind: "emissive", Albedo: d.Color, Intensity: d.Intensity},
+	}.Hitter()
+}
+
+// describeLight returns h as a light, if it's a sphere with an emissive
+// material.
+func describeLight(h tracer.Hitter) (lightDesc, bool) {
+	s, ok := h.(tracer.Sphere)
+	if !ok {
+		return lightDesc{}, false
+	}
+	e, ok := s.Material.(emissive)
+	if !ok {
+		return lightDesc{}, false
+	}
+	return lightDesc{
+		Position:  [3]float64(s.Center),
+		Radius:    s.Radius,
+		Color:     [3]float64(e.Color),
+		Intensity: e.Intensity,
+	}, true
+}
+
+// lightPatch edits the selected light, only the fields present are
+// changed.
+type lightPatch struct {
+	Position  *[3]float64 `json:"position"`
+	Radius    *float64    `json:"radius"`
+	Color     *[3]float64 `json:"color"`
+	Intensity *float64    `json:"intensity"`
+}
+
+func (p lightPatch) apply(d lightDesc) lightDesc {
+	if p.Position != nil {
+		d.Position = *p.Position
+	}
+	if p.Radius != nil {
+		d.Radius = *p.Radius
+	}
+	if p.Color != nil {
+		d.Color = *p.Color
+	}
+	if p.Intensity != nil {
+		d.Intensity = *p.Intensity
+	}
+	return d
+}
+
+// lightPayload is a light in the scene, Object its index.
+type lightPayload struct {
+	lightDesc
+	Object int `json:"object"`
+	// Enabled is false while another light is soloed.
+	Enabled bool `json:"enabled"`
+}
+
+type lightsPayload struct {
+	Lights []lightPayload `json:"lights"`
+	Solo   int            `json:"solo"`
+}
+
+// newLight is p over a white light a little above where the camera
+// looks.
+func (r *renderer) newLight(p lightPatch) lightDesc {
+	r.mu.Lock()
+	at := r.camera.LookAt
+	r.mu.Unlock()
+	return p.apply(lightDesc{
+		Position:  [3]float64{at[0], at[1] + 1, at[2]},
+		Radius:    defaultLightRadius,
+		Color:     [3]float64{1, 1, 1},
+		Intensity: defaultLightIntensity,
+	})
+}
+
+func (r *renderer) editSelectedLight(p lightPatch) error {
+	return r.editSelected(func(h tracer.Hitter) (tracer.Hitter, error) {
+		d, ok := describeLight(h)
+		if !ok {
+			return nil, errNotALight
+		}
+		return p.apply(d).Hitter()
+	})
+}
+
+// soloSelectedLight turns every light but the selected one off, or all of
+// them back on.
+func (r *renderer) soloSelectedLight(solo bool) error {
+	r.mu.Lock()
+	switch {
+	case !solo:
+		r.solo = -1
+	case r.selected < 0:
+		r.mu.Unlock()
+		return errNoSelection
+	default:
+		if _, ok := describeLight(r.objects[r.selected]); !ok {
+			r.mu.Unlock()
+			return errNotALight
+		}
+		r.solo = r.selected
+	}
+	r.resetLocked()
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return nil
+}
+
+// soloLocked is the soloed light, nil if none is.
+func (r *renderer) soloLocked() tracer.Hitter {
+	if r.solo < 0 || r.solo >= len(r.objects) {
+		return nil
+	}
+	if _, ok := describeLight(r.objects[r.solo]); !ok {
+		return nil
+	}
+	return r.objects[r.solo]
+}
+
+func (r *renderer) lights() lightsPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	solo := r.soloLocked()
+	p := lightsPayload{Lights: []lightPayload{}, Solo: -1}
+	if solo != nil {
+		p.Solo = r.solo
+	}
+	for i, h := range r.objects {
+		if d, ok := describeLight(h); ok {
+			p.Lights = append(p.Lights, lightPayload{lightDesc: d, Object: i, Enabled: solo == nil || i == r.solo})
+		}
+	}
+	return p
+}
+
+// drawLights marks each light with a cross reaching half its radius out of
+// it, grey while another light is soloed.
+func drawLights(f *tracer.Frame, pr projector, lights lightsPayload) {
+	for _, l := range lights.Lights {
+		color := tracer.Color{255, 200, 0}
+		if !l.Enabled {
+			color = tracer.Color{96, 96, 96}
+		}
+		c := tracer.Vec3(l.Position)
+		for axis := 0; axis < 3; axis++ {
+			var arm tracer.Vec3
+			arm[axis] = 1.5 * l.Radius
+			pr.line(f, tracer.Point3(c.Sub(arm)), tracer.Point3(c.Add(arm)), color)
+		}
+	}
+}
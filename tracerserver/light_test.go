@@ -0,0 +1,21 @@
+package tracerserver
+
+import "testing"
+
+func TestLightNeedsPositiveRadius(t *testing.T) {
+	for _, radius := range []float64{0, -1} {
+		if _, err := (lightDesc{Radius: radius, Intensity: 1}).Hitter(); err == nil {
+			t.Errorf("light with radius %v accepted", radius)
+		}
+	}
+
+	want := lightDesc{Position: [3]float64{1, 2, 3}, Radius: 0.5, Color: [3]float64{1, 0.5, 0}, Intensity: 4}
+	h, err := want.Hitter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := describeLight(h)
+	if !ok || got != want {
+		t.Errorf("light described as %+v, %v, want %+v", got, ok, want)
+	}
+}
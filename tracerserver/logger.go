@@ -0,0 +1,162 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log lines by severity, lines below the configured level
+// are dropped.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+}
+
+// logSink is where every logger derived from logs writes.
+type logSink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+}
+
+// logger writes leveled lines tagged with key value pairs, the way
+// log/slog does, which the go version this builds with predates. With
+// derives a logger adding pairs to every line, a connection's ID and
+// remote address say.
+type logger struct {
+	sink  *logSink
+	attrs []interface{}
+}
+
+var logs = &logger{sink: &logSink{w: os.Stderr, level: levelInfo}}
+
+// configureLogs sets the level and format, and sends what's still logged
+// through the standard log package, by libraries or log.Fatal, to logs as
+// errors.
+func configureLogs(level logLevel, asJSON bool) {
+	s := logs.sink
+	s.mu.Lock()
+	s.level, s.json = level, asJSON
+	s.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logs.Error(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+func (l *logger) With(kv ...interface{}) *logger {
+	return &logger{sink: l.sink, attrs: append(append([]interface{}(nil), l.attrs...), kv...)}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level logLevel, msg string, kv []interface{}) {
+	s := l.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level < s.level {
+		return
+	}
+
+	now := time.Now()
+	pairs := append(append([]interface{}(nil), l.attrs...), kv...)
+	if len(pairs)%2 == 1 {
+		pairs = append(pairs[:len(pairs)-1], "!BADKEY", pairs[len(pairs)-1])
+	}
+
+	var buf bytes.Buffer
+	if s.json {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i < len(pairs); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(pairs[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, logValue(pairs[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %s %s", now.Format("2006/01/02 15:04:05"), level, msg)
+		for i := 0; i < len(pairs); i += 2 {
+			fmt.Fprintf(&buf, " %v=%s", pairs[i], quoteLogValue(fmt.Sprint(logValue(pairs[i+1]))))
+		}
+		buf.WriteByte('\n')
+	}
+	s.w.Write(buf.Bytes())
+}
+
+// logValue is v as it's logged: errors, durations, signals and the like
+// as their text.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func quoteLogValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// requestLog tags lines about r with where it came from and what it asked
+// for.
+func requestLog(r *http.Request) *logger {
+	return logs.With("remote", proxy.remoteAddr(r), "method", r.Method, "path", r.URL.Path)
+}
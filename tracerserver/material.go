@@ -0,0 +1,80 @@
+package tracerserver
+
+import (
+	"fmt"
+
+	"github.com/ghostec/tracer"
+)
+
+type materialDesc struct {
+	Kind            string     `json:"kind"`
+	Albedo          [3]float64 `json:"albedo"`
+	Fuzz            float64    `json:"fuzz,omitempty"`
+	RefractiveIndex float64    `json:"refractive_index,omitempty"`
+	// Intensity scales an emissive material's albedo, the color it gives
+	// off.
+	Intensity float64 `json:"intensity,omitempty"`
+	// Texture varies a lambertian's albedo over its surface.
+	Texture *textureDesc `json:"texture,omitempty"`
+}
+
+func (d materialDesc) Material() (tracer.Material, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+
+	switch d.Kind {
+	case "lambertian":
+		if d.Texture != nil {
+			return d.Texture.material(tracer.Color(d.Albedo))
+		}
+		return tracer.Lambertian{Albedo: tracer.Color(d.Albedo)}, nil
+	case "metal":
+		return tracer.Metal{Albedo: tracer.Color(d.Albedo), Fuzz: d.Fuzz}, nil
+	case "dielectric":
+		return tracer.Dielectric{RefractiveIndex: d.RefractiveIndex}, nil
+	case "emissive":
+		return emissive{Color: tracer.Color(d.Albedo), Intensity: d.Intensity}, nil
+	default:
+		return nil, fmt.Errorf("unknown material kind %q", d.Kind)
+	}
+}
+
+func (d materialDesc) validate() error {
+	for _, c := range d.Albedo {
+		if c < 0 || c > 1 {
+			return fmt.Errorf("albedo components must be between 0 and 1, got %v", d.Albedo)
+		}
+	}
+	switch {
+	case d.Fuzz < 0 || d.Fuzz > 1:
+		return fmt.Errorf("fuzz must be between 0 and 1, got %v", d.Fuzz)
+	case d.Kind == "dielectric" && d.RefractiveIndex <= 0:
+		return fmt.Errorf("refractive_index must be positive, got %v", d.RefractiveIndex)
+	case d.Intensity < 0 || d.Intensity > maxLightIntensity:
+		return fmt.Errorf("intensity must be between 0 and %d, got %v", maxLightIntensity, d.Intensity)
+	case d.Texture != nil && d.Kind != "lambertian":
+		return fmt.Errorf("only lambertian materials take a texture, got %q", d.Kind)
+	case d.Texture != nil:
+		return d.Texture.validate()
+	}
+	return nil
+}
+
+func describeMaterial(m tracer.Material) (materialDesc, error) {
+	switch m := m.(type) {
+	case tracer.Lambertian:
+		return materialDesc{Kind: "lambertian", Albedo: [3]float64(m.Albedo)}, nil
+	case tracer.Metal:
+		return materialDesc{Kind: "metal", Albedo: [3]float64(m.Albedo), Fuzz: m.Fuzz}, nil
+	case tracer.Dielectric:
+		return materialDesc{Kind: "dielectric", RefractiveIndex: m.RefractiveIndex}, nil
+	case emissive:
+		return materialDesc{Kind: "emissive", Albedo: [3]float64(m.Color), Intensity: m.Intensity}, nil
+	case textured:
+		texture := m.desc
+		return materialDesc{Kind: "lambertian", Albedo: [3]float64(m.albedo), Texture: &texture}, nil
+	default:
+		return materialDesc{}, fmt.Errorf("can't describe material %T", m)
+	}
+}
@@ -0,0 +1,269 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// triangleMinT skips hits right at the ray origin, which would otherwise
+	// make scattered rays hit the triangle they left from.
+	triangleMinT = 0.001
+	// boxPadding keeps axis aligned triangles from having flat boxes.
+	boxPadding = 1e-4
+
+	maxMeshUpload = 64 << 20
+)
+
+var defaultMeshMaterial = materialDesc{Kind: "lambertian", Albedo: [3]float64{0.5, 0.5, 0.5}}
+
+// triangle is a tracer.Hitter the tracer doesn't ship. With Smooth set the
+// shading normal is interpolated from the vertex normals N.
+type triangle struct {
+	V        [3]tracer.Point3
+	N        [3]tracer.Vec3
+	Smooth   bool
+	Material tracer.Material
+}
+
+// Hit is Möller–Trumbore.
+func (tr triangle) Hit(ray tracer.Ray) tracer.HitRecord {
+	miss := tracer.HitRecord{T: math.Inf(1)}
+
+	v0 := tr.V[0].Vec3()
+	e1, e2 := tr.V[1].Vec3().Sub(v0), tr.V[2].Vec3().Sub(v0)
+	p := ray.Direction.Cross(e2)
+	det := e1.Dot(p)
+	if math.Abs(det) < 1e-12 {
+		return miss
+	}
+	inv := 1 / det
+	s := ray.Origin.Vec3().Sub(v0)
+	u := s.Dot(p) * inv
+	if u < 0 || u > 1 {
+		return miss
+	}
+	q := s.Cross(e1)
+	v := ray.Direction.Dot(q) * inv
+	if v < 0 || u+v > 1 {
+		return miss
+	}
+	t := e2.Dot(q) * inv
+	if t < triangleMinT {
+		return miss
+	}
+
+	outward := e1.Cross(e2).Unit()
+	if tr.Smooth {
+		outward = tr.N[0].MulFloat(1 - u - v).Add(tr.N[1].MulFloat(u)).Add(tr.N[2].MulFloat(v)).Unit()
+	}
+	hr := tracer.HitRecord{Hit: true, T: t, P: ray.At(t), Normal: outward, Material: tr.Material}
+	hr.FrontFace = ray.Direction.Dot(outward) < 0
+	if !hr.FrontFace {
+		hr.Normal = outward.Neg()
+	}
+	return hr
+}
+
+func (tr triangle) BoundingBox() tracer.AABB {
+	lo, hi := tr.V[0].Vec3(), tr.V[0].Vec3()
+	for _, p := range tr.V[1:] {
+		for axis := 0; axis < 3; axis++ {
+			lo[axis] = math.Min(lo[axis], p[axis])
+			hi[axis] = math.Max(hi[axis], p[axis])
+		}
+	}
+	pad := tracer.Vec3{boxPadding, boxPadding, boxPadding}
+	return tracer.AABB{Min: tracer.Point3(lo.Sub(pad)), Max: tracer.Point3(hi.Add(pad))}
+}
+
+// transform scales the triangle about its centroid, then translates it.
+func (tr triangle) transform(translate tracer.Vec3, scale float64) triangle {
+	c := tr.V[0].Vec3().Add(tr.V[1].Vec3()).Add(tr.V[2].Vec3()).MulFloat(1.0 / 3)
+	for i, p := range tr.V {
+		tr.V[i] = tracer.Point3(c.Add(p.Vec3().Sub(c).MulFloat(scale)).Add(translate))
+	}
+	return tr
+}
+
+// mesh is what the OBJ and PLY readers produce. Normals is either empty or
+// one per vertex.
+type mesh struct {
+	Vertices []tracer.Vec3
+	Normals  []tracer.Vec3
+	Faces    [][3]int
+}
+
+func (m mesh) validate() error {
+	if len(m.Faces) == 0 {
+		return errors.New("mesh has no faces")
+	}
+	if len(m.Normals) != 0 && len(m.Normals) != len(m.Vertices) {
+		return fmt.Errorf("mesh has %d normals for %d vertices", len(m.Normals), len(m.Vertices))
+	}
+	for i, f := range m.Faces {
+		for _, idx := range f {
+			if idx < 0 || idx >= len(m.Vertices) {
+				return fmt.Errorf("face %d: vertex %d out of range", i, idx)
+			}
+		}
+	}
+	return nil
+}
+
+// triangles scales the mesh about the origin and translates it.
+func (m mesh) triangles(mat tracer.Material, translate tracer.Vec3, scale float64) tracer.HitterList {
+	at := func(idx int) tracer.Point3 {
+		return tracer.Point3(m.Vertices[idx].MulFloat(scale).Add(translate))
+	}
+	l := make(tracer.HitterList, 0, len(m.Faces))
+	for _, f := range m.Faces {
+		tr := triangle{V: [3]tracer.Point3{at(f[0]), at(f[1]), at(f[2])}, Material: mat}
+		// Degenerate faces can't be hit and only bloat the BVH.
+		if tr.V[1].Vec3().Sub(tr.V[0].Vec3()).Cross(tr.V[2].Vec3().Sub(tr.V[0].Vec3())).NearZero() {
+			continue
+		}
+		if len(m.Normals) != 0 {
+			tr.Smooth = true
+			for i, idx := range f {
+				tr.N[i] = m.Normals[idx].Unit()
+			}
+		}
+		l = append(l, tr)
+	}
+	return l
+}
+
+func readMesh(format string, r io.Reader) (mesh, error) {
+	var (
+		m   mesh
+		err error
+	)
+	switch format {
+	case "obj":
+		m, err = readOBJ(r)
+	case "ply":
+		m, err = readPLY(r)
+	default:
+		return mesh{}, fmt.Errorf("unknown mesh format %q", format)
+	}
+	if err != nil {
+		return mesh{}, err
+	}
+	return m, m.validate()
+}
+
+func (r *renderer) addObjects(l tracer.HitterList) error {
+	r.mu.Lock()
+	objects := append(append(tracer.HitterList(nil), r.objects...), l...)
+	meta := append(append([]objectMeta(nil), r.meta...), make([]objectMeta, len(l))...)
+	err := r.setObjectsLocked(objects, meta)
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	r.renderGUI()
+	return nil
+}
+
+func parseVec3(s string) (tracer.Vec3, error) {
+	var v tracer.Vec3
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return v, fmt.Errorf("want x,y,z, got %q", s)
+	}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return v, err
+		}
+		v[i] = f
+	}
+	return v, nil
+}
+
+// meshes serves POST /scene/meshes, a multipart form with the OBJ or PLY
+// file in "mesh" and optionally "format" (defaults to the file extension),
+// "scale", "translate" as x,y,z and "material" as a material JSON object.
+func meshes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMeshUpload)
+	if err := r.ParseMultipartForm(maxMeshUpload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("mesh")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = strings.ToLower(strings.TrimPrefix(filepath.Ext(header.Filename), "."))
+	}
+
+	scale, translate := 1.0, tracer.Vec3{}
+	if v := r.FormValue("scale"); v != "" {
+		if scale, err = strconv.ParseFloat(v, 64); err != nil || scale <= 0 {
+			http.Error(w, fmt.Sprintf("scale must be a positive number, got %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("translate"); v != "" {
+		if translate, err = parseVec3(v); err != nil {
+			http.Error(w, "translate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	md := defaultMeshMaterial
+	if v := r.FormValue("material"); v != "" {
+		if err := json.Unmarshal([]byte(v), &md); err != nil {
+			http.Error(w, "material: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	mat, err := md.Material()
+	if err != nil {
+		http.Error(w, "material: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, err := readMesh(format, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l := m.triangles(mat, translate, scale)
+	if len(l) == 0 {
+		http.Error(w, "mesh has only degenerate faces", http.StatusBadRequest)
+		return
+	}
+	if err := rend.addObjects(l); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Triangles int `json:"triangles"`
+	}{len(l)})
+}
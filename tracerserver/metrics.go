@@ -0,0 +1,66 @@
+package tracerserver
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	samplesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tracer_samples_total",
+		Help: "Samples accumulated into interactive scene frames.",
+	})
+	renderSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tracer_render_seconds",
+		Help:    "Time to render one interactive pass, cancelled passes excluded.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+	encodeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tracer_encode_seconds",
+		Help:    "Time to encode a streamed frame.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"content_type"})
+	wsSendSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tracer_ws_send_seconds",
+		Help:    "Time to write one websocket message.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	wsBytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_ws_bytes_sent_total",
+		Help: "Bytes written to websocket clients, by session.",
+	}, []string{"session"})
+	wsConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tracer_ws_connections",
+		Help: "Open websocket connections.",
+	})
+	wsMessagesThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_ws_messages_throttled_total",
+		Help: "Websocket messages over their type's rate limit, deferred or rejected.",
+	}, []string{"type"})
+	renderWorkersGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tracer_render_workers",
+		Help: "Goroutines rendering tiles, see Options.RenderWorkers.",
+	})
+	tileBusySeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_tile_busy_seconds_total",
+		Help: "Time render workers spent on tiles, by queue. Its rate over tracer_render_workers is the queue's share of them.",
+	}, []string{"queue"})
+	poolGets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_pool_gets_total",
+		Help: "Frames and buffers taken from a pool, by pool.",
+	}, []string{"pool"})
+	poolAllocs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_pool_allocs_total",
+		Help: "Frames and buffers a pool had to allocate, having none to reuse, by pool.",
+	}, []string{"pool"})
+	accumCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tracer_accum_cache_lookups_total",
+		Help: "Accumulation restarts that looked for a cached accumulation of the same state, by result (hit or miss).",
+	}, []string{"result"})
+)
+
+func sessionLabel(s *session) string {
+	return strconv.FormatUint(s.id, 10)
+}
@@ -0,0 +1,114 @@
+package tracerserver
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// mjpeg serves GET /stream.mjpeg, the accumulating frame as a
+// multipart/x-mixed-replace JPEG stream for <img> tags, OBS or VLC.
+//
+// It attaches to ?session=, or the only session there is, and otherwise
+// opens one for as long as the stream lasts. ?fps=, ?quality= and ?pass=
+// work as they do on the websocket.
+func mjpeg(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	fps := defaultFPS()
+	if v := q.Get("fps"); v != "" {
+		var err error
+		if fps, err = strconv.Atoi(v); err == nil {
+			err = validateFPS(fps)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	quality := 0
+	if v := q.Get("quality"); v != "" {
+		var err error
+		if quality, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid quality", http.StatusBadRequest)
+			return
+		}
+	}
+	enc, err := newEncoder("jpeg", quality)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pass := q.Get("pass")
+	if _, ok := aovPasses[pass]; !ok && pass != "" && pass != beautyPass {
+		http.Error(w, fmt.Sprintf("unknown pass %q, want one of %v", pass, aovNames()), http.StatusBadRequest)
+		return
+	}
+
+	var rend *renderer
+	if q.Get("session") != "" {
+		var ok bool
+		if rend, ok = requestRenderer(w, r); !ok {
+			return
+		}
+	} else if sess, ok := sessions.any(); ok {
+		rend = sess.renderer
+	} else {
+		sess, err := sessions.open()
+		if err != nil {
+			requestLog(r).Error("opening session failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer sessions.close(sess)
+		rend = sess.renderer
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+
+	ticker := time.NewTicker(time.Second / time.Duration(fps))
+	defer ticker.Stop()
+
+	var buf bytes.Buffer
+	for {
+		img, err := rend.passImage(pass, true)
+		if err == nil {
+			buf.Reset()
+			err = enc.Encode(&buf, img)
+		}
+		if err != nil {
+			requestLog(r).Warn("mjpeg stream failed", "err", err)
+			return
+		}
+
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {enc.ContentType()},
+			"Content-Length": {strconv.Itoa(buf.Len())},
+		})
+		if err == nil {
+			_, err = part.Write(buf.Bytes())
+		}
+		if err != nil {
+			// The client went away.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-rend.done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
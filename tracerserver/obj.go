@@ -0,0 +1,135 @@
+package tracerserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+// readOBJ reads the geometry of a Wavefront OBJ file: v, vn and f records.
+// Polygons are fanned into triangles, everything else is ignored. Vertex
+// normals are kept only if every face corner has one.
+func readOBJ(r io.Reader) (mesh, error) {
+	var (
+		positions, normals []tracer.Vec3
+		corners            [][3][2]int
+		allNormals         = true
+	)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v", "vn":
+			if len(fields) < 4 {
+				return mesh{}, fmt.Errorf("obj: line %d: %s needs 3 coordinates", line, fields[0])
+			}
+			var v tracer.Vec3
+			for i := range v {
+				f, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return mesh{}, fmt.Errorf("obj: line %d: %w", line, err)
+				}
+				v[i] = f
+			}
+			if fields[0] == "v" {
+				positions = append(positions, v)
+			} else {
+				normals = append(normals, v)
+			}
+		case "f":
+			if len(fields) < 4 {
+				return mesh{}, fmt.Errorf("obj: line %d: face needs at least 3 vertices", line)
+			}
+			face := make([][2]int, 0, len(fields)-1)
+			for _, f := range fields[1:] {
+				c, err := objCorner(f, len(positions), len(normals))
+				if err != nil {
+					return mesh{}, fmt.Errorf("obj: line %d: %w", line, err)
+				}
+				if c[1] < 0 {
+					allNormals = false
+				}
+				face = append(face, c)
+			}
+			for i := 1; i+1 < len(face); i++ {
+				corners = append(corners, [3][2]int{face[0], face[i], face[i+1]})
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return mesh{}, fmt.Errorf("obj: %w", err)
+	}
+
+	if !allNormals {
+		m := mesh{Vertices: positions}
+		for _, c := range corners {
+			m.Faces = append(m.Faces, [3]int{c[0][0], c[1][0], c[2][0]})
+		}
+		return m, nil
+	}
+
+	// OBJ indexes positions and normals separately, a vertex here is each
+	// distinct pair of them.
+	var m mesh
+	index := map[[2]int]int{}
+	for _, c := range corners {
+		var f [3]int
+		for i, pair := range c {
+			idx, ok := index[pair]
+			if !ok {
+				idx = len(m.Vertices)
+				index[pair] = idx
+				m.Vertices = append(m.Vertices, positions[pair[0]])
+				m.Normals = append(m.Normals, normals[pair[1]])
+			}
+			f[i] = idx
+		}
+		m.Faces = append(m.Faces, f)
+	}
+	return m, nil
+}
+
+// objCorner parses a face corner, v, v/vt, v//vn or v/vt/vn, into zero
+// based position and normal indices. The normal index is -1 if missing.
+func objCorner(s string, nPositions, nNormals int) ([2]int, error) {
+	parts := strings.Split(s, "/")
+	v, err := objIndex(parts[0], nPositions)
+	if err != nil {
+		return [2]int{}, err
+	}
+	n := -1
+	if len(parts) == 3 && parts[2] != "" {
+		if n, err = objIndex(parts[2], nNormals); err != nil {
+			return [2]int{}, err
+		}
+	}
+	return [2]int{v, n}, nil
+}
+
+// objIndex resolves a one based, or negative and relative to the end,
+// index.
+func objIndex(s string, n int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case i > 0 && i <= n:
+		return i - 1, nil
+	case i < 0 && -i <= n:
+		return n + i, nil
+	default:
+		return 0, fmt.Errorf("index %d out of range", i)
+	}
+}
@@ -0,0 +1,176 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	maxObjectName = 128
+	maxObjectTags = 16
+	maxObjectTag  = 64
+)
+
+// objectMeta is what a scene object is called and tagged with. It has no
+// bearing on the render, the renderer keeps it lined up with its objects.
+type objectMeta struct {
+	Name string   `json:"name,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (m objectMeta) validate() error {
+	if utf8.RuneCountInString(m.Name) > maxObjectName {
+		return fmt.Errorf("name must be at most %d characters", maxObjectName)
+	}
+	if len(m.Tags) > maxObjectTags {
+		return fmt.Errorf("at most %d tags, got %d", maxObjectTags, len(m.Tags))
+	}
+	for _, t := range m.Tags {
+		if t == "" || utf8.RuneCountInString(t) > maxObjectTag {
+			return fmt.Errorf("tags must be 1 to %d characters, got %q", maxObjectTag, t)
+		}
+	}
+	return nil
+}
+
+// outlinerEntry is an object as listed by /scene/objects. ID is its index,
+// what pick results and select_object refer to it by.
+type outlinerEntry struct {
+	ID int `json:"id"`
+	objectMeta
+	Type     string        `json:"type"`
+	Material *materialDesc `json:"material,omitempty"`
+	Bounds   boundsDesc    `json:"bounds"`
+}
+
+type boundsDesc struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+// selectObjectPayload selects object ID, toggling it in the selection with
+// Add like select does.
+type selectObjectPayload struct {
+	ID  int  `json:"id"`
+	Add bool `json:"add"`
+}
+
+// nameObjectPayload replaces object ID's name and tags.
+type nameObjectPayload struct {
+	ID int `json:"id"`
+	objectMeta
+}
+
+func describeObject(id int, h tracer.Hitter, meta objectMeta) outlinerEntry {
+	box := h.BoundingBox()
+	e := outlinerEntry{
+		ID:         id,
+		objectMeta: meta,
+		Bounds:     boundsDesc{Min: [3]float64(box.Min), Max: [3]float64(box.Max)},
+	}
+	var m tracer.Material
+	switch o := h.(type) {
+	case tracer.Sphere:
+		e.Type, m = "sphere", o.Material
+	case triangle:
+		e.Type, m = "triangle", o.Material
+	default:
+		e.Type = fmt.Sprintf("%T", h)
+	}
+	if d, err := describeMaterial(m); m != nil && err == nil {
+		e.Material = &d
+	}
+	return e
+}
+
+func (r *renderer) outliner() []outlinerEntry {
+	r.mu.Lock()
+	objects, meta := r.objects, r.meta
+	r.mu.Unlock()
+
+	entries := make([]outlinerEntry, len(objects))
+	for i, h := range objects {
+		entries[i] = describeObject(i, h, meta[i])
+	}
+	return entries
+}
+
+// selectObject selects object id as if it was clicked on.
+func (r *renderer) selectObject(id int, add bool) (pickResultPayload, error) {
+	r.mu.Lock()
+	if id < 0 || id >= len(r.objects) {
+		r.mu.Unlock()
+		return pickResultPayload{}, fmt.Errorf("no object %d", id)
+	}
+	if add {
+		r.toggleSelectedLocked(id)
+	} else {
+		r.selectLocked(id)
+	}
+	res := pickResultPayload{Object: r.selected, Selection: r.selectionLocked()}
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return res, nil
+}
+
+// nameObject sets object id's name and tags, as an edit that can be undone.
+func (r *renderer) nameObject(id int, m objectMeta) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id < 0 || id >= len(r.objects) {
+		return fmt.Errorf("no object %d", id)
+	}
+	r.recordLocked("name")
+	meta := append([]objectMeta(nil), r.meta...)
+	meta[id] = m
+	r.meta = meta
+	return nil
+}
+
+func sceneObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rend.outliner()); err != nil {
+		requestLog(r).Warn("writing scene objects failed", "err", err)
+	}
+}
+
+func handleSelectObject(c *client, raw json.RawMessage) error {
+	var p selectObjectPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	pick, err := c.session.renderer.selectObject(p.ID, p.Add)
+	if err != nil {
+		return editError(err)
+	}
+	c.updatePresence(func(pr *presencePayload) {
+		pr.Selected = pick.Object
+	})
+	hooks.emit(Event{Type: EventObjectSelected, Session: c.session.id, Selection: pick.Selection})
+	return c.send("pick", "", pick)
+}
+
+func handleNameObject(c *client, raw json.RawMessage) error {
+	var p nameObjectPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	return editError(c.session.renderer.nameObject(p.ID, p.objectMeta))
+}
@@ -0,0 +1,195 @@
+package tracerserver
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+// nearPlane is how far in front of the camera overlay lines are clipped.
+const nearPlane = 0.01
+
+// projector maps world points to pixels of a width x height frame as seen
+// through cam, matching the rays tracer.Camera casts.
+type projector struct {
+	origin        tracer.Vec3
+	u, v, w       tracer.Vec3
+	halfW, halfH  float64
+	width, height int
+	// ortho is the LookAt distance orthographic views are sized at, 0 in
+	// perspective.
+	ortho float64
+}
+
+func newProjector(cam tracer.Camera, settings renderSettings) projector {
+	w := cam.LookFrom.Vec3().Sub(cam.LookAt.Vec3()).Unit()
+	u := cam.VUp.Cross(w).Unit()
+	halfH := math.Tan(tracer.DegreesToRadians(cam.VFoV) / 2)
+	var ortho float64
+	if settings.Projection == projectionOrthographic {
+		ortho = cam.LookFrom.Vec3().Sub(cam.LookAt.Vec3()).Len()
+	}
+	return projector{
+		origin: cam.LookFrom.Vec3(),
+		u:      u,
+		v:      w.Cross(u),
+		w:      w,
+		halfW:  halfH * cam.AspectRatio,
+		halfH:  halfH,
+		width:  settings.Width,
+		height: settings.Height,
+		ortho:  ortho,
+	}
+}
+
+// view returns p in camera space, z being the distance in front of the
+// camera.
+func (pr projector) view(p tracer.Point3) tracer.Vec3 {
+	d := p.Vec3().Sub(pr.origin)
+	return tracer.Vec3{d.Dot(pr.u), d.Dot(pr.v), -d.Dot(pr.w)}
+}
+
+func (pr projector) pixel(c tracer.Vec3) (col, row float64) {
+	z := c[2]
+	if pr.ortho > 0 {
+		z = pr.ortho
+	}
+	x := c[0] / (z * pr.halfW)
+	y := c[1] / (z * pr.halfH)
+	return (x + 1) / 2 * float64(pr.width), (1 - y) / 2 * float64(pr.height)
+}
+
+// ray is the ray through the pixel at col, row, the inverse of pixel.
+func (pr projector) ray(col, row float64) tracer.Ray {
+	x := 2*col/float64(pr.width) - 1
+	y := 1 - 2*row/float64(pr.height)
+	offset := pr.u.MulFloat(x * pr.halfW).Add(pr.v.MulFloat(y * pr.halfH))
+	if pr.ortho > 0 {
+		origin := pr.origin.Add(offset.MulFloat(pr.ortho))
+		return tracer.Ray{Origin: tracer.Point3(origin), Direction: pr.w.MulFloat(-1)}
+	}
+	return tracer.Ray{Origin: tracer.Point3(pr.origin), Direction: offset.Sub(pr.w)}
+}
+
+// line draws the world space segment a-b into f, clipped to the near plane.
+func (pr projector) line(f *tracer.Frame, a, b tracer.Point3, color tracer.Color) {
+	ca, cb := pr.view(a), pr.view(b)
+	if ca[2] < nearPlane && cb[2] < nearPlane {
+		return
+	}
+	if ca[2] < nearPlane {
+		ca, cb = cb, ca
+	}
+	if cb[2] < nearPlane {
+		t := (ca[2] - nearPlane) / (ca[2] - cb[2])
+		cb = ca.Add(cb.Sub(ca).MulFloat(t))
+	}
+	x0, y0 := pr.pixel(ca)
+	x1, y1 := pr.pixel(cb)
+	drawLine(f, x0, y0, x1, y1, color)
+}
+
+// box draws the edges of b.
+func (pr projector) box(f *tracer.Frame, b tracer.AABB, color tracer.Color) {
+	lo, hi := b.Min.Vec3(), b.Max.Vec3()
+	corner := func(i int) tracer.Point3 {
+		c := lo
+		for axis := 0; axis < 3; axis++ {
+			if i&(1<<axis) != 0 {
+				c[axis] = hi[axis]
+			}
+		}
+		return tracer.Point3(c)
+	}
+	for i := 0; i < 8; i++ {
+		for axis := 0; axis < 3; axis++ {
+			if j := i | 1<<axis; j != i {
+				pr.line(f, corner(i), corner(j), color)
+			}
+		}
+	}
+}
+
+// drawLine rasterizes a line in pixel coordinates, skipping the parts that
+// fall outside f.
+func drawLine(f *tracer.Frame, x0, y0, x1, y1 float64, color tracer.Color) {
+	steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))))
+	// Lines that are mostly off screen would take forever to walk.
+	steps = int(math.Min(float64(steps), float64(4*(f.Width()+f.Height()))))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		col, row := int(x0+(x1-x0)*t), int(y0+(y1-y0)*t)
+		if row < 0 || row >= f.Height() || col < 0 || col >= f.Width() {
+			continue
+		}
+		f.Set(row, col, color)
+	}
+}
+
+// guiFrame is the GUI overlay as last drawn. It's replaced rather than
+// drawn into, so a different frame means the overlay changed.
+func (r *renderer) guiFrame() *tracer.Frame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gen.gui
+}
+
+// overlayImage is f with what's black, where nothing was drawn, left
+// transparent. GUI frames are drawn in 0-255 colors, not the linear ones
+// renders are.
+func overlayImage(f *tracer.Frame) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, f.Width(), f.Height()))
+	for row := 0; row < f.Height(); row++ {
+		for col := 0; col < f.Width(); col++ {
+			c := f.Get(row, col)
+			if c[0] <= 0 && c[1] <= 0 && c[2] <= 0 {
+				continue
+			}
+			img.SetNRGBA(col, row, color.NRGBA{R: to8(c[0]), G: to8(c[1]), B: to8(c[2]), A: 255})
+		}
+	}
+	return img
+}
+
+func to8(v float64) uint8 {
+	return uint8(math.Round(tracer.Clamp(v, 0, 255)))
+}
+
+// encodeOverlay returns the overlay message for the renderer's GUI frame,
+// in a buffer from encodeBuffers, if the client asked for the overlay on
+// its own and it changed since the last one, nil otherwise. The message is
+// an 'O' followed by a PNG, or the PNG in an envelope.
+func (c *client) encodeOverlay(rend *renderer) (*bytes.Buffer, error) {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+
+	if !c.format.Overlay || c.encoder == nil {
+		return nil, nil
+	}
+	gui := rend.guiFrame()
+	if gui == c.overlay {
+		return nil, nil
+	}
+	buf := encodeBuffers.get()
+	var env *envelope
+	if c.format.Envelope {
+		env = beginEnvelope(buf, envelopeOverlay, rend.frameStamp(), "gui")
+	} else {
+		buf.WriteByte('O')
+	}
+	if err := (pngEncoder{}).Encode(buf, overlayImage(gui)); err != nil {
+		encodeBuffers.put(buf)
+		return nil, err
+	}
+	if env != nil {
+		env.end()
+	}
+	c.overlay = gui
+	return buf, nil
+}
@@ -0,0 +1,21 @@
+package tracerserver
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/ghostec/tracer"
+)
+
+func TestOverlayImageKeepsGUIColors(t *testing.T) {
+	f := tracer.NewFrame(3, 1, true)
+	f.Set(0, 0, gizmoColors[0])
+	f.Set(0, 1, tracer.Color{96, 96, 96})
+
+	img := overlayImage(f)
+	for col, want := range []color.NRGBA{{255, 64, 64, 255}, {96, 96, 96, 255}, {}} {
+		if got := img.NRGBAAt(col, 0); got != want {
+			t.Errorf("pixel %d is %v, want %v", col, got, want)
+		}
+	}
+}
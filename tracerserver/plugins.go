@@ -0,0 +1,120 @@
+package tracerserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ghostec/tracer"
+)
+
+// colorFuncs are the ray color and aggregation functions the ray_color and
+// agg_color settings pick by name, the tracer's own to begin with. Embedders
+// add theirs with RegisterRayColor and RegisterAggColor before serving.
+var colorFuncs = struct {
+	mu        sync.Mutex
+	rayColors map[string]tracer.RayColorFunc
+	aggColors map[string]tracer.AggColorFunc
+}{
+	rayColors: map[string]tracer.RayColorFunc{
+		"tracer": tracer.RayColor,
+		"bvh_id": tracer.RayBVHID,
+	},
+	aggColors: map[string]tracer.AggColorFunc{
+		"avg":   tracer.AvgSamples,
+		"edges": tracer.EdgeSamples,
+	},
+}
+
+// RegisterRayColor makes f selectable as the ray_color setting name. Like
+// the standard library's registries it panics if f is nil or name is taken.
+func RegisterRayColor(name string, f tracer.RayColorFunc) {
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	if f == nil {
+		panic("RegisterRayColor: nil func for " + name)
+	}
+	if _, dup := colorFuncs.rayColors[name]; dup || name == "" {
+		panic(fmt.Sprintf("RegisterRayColor: name %q taken", name))
+	}
+	colorFuncs.rayColors[name] = f
+}
+
+// RegisterAggColor makes f selectable as the agg_color setting name, see
+// RegisterRayColor.
+func RegisterAggColor(name string, f tracer.AggColorFunc) {
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	if f == nil {
+		panic("RegisterAggColor: nil func for " + name)
+	}
+	if _, dup := colorFuncs.aggColors[name]; dup || name == "" {
+		panic(fmt.Sprintf("RegisterAggColor: name %q taken", name))
+	}
+	colorFuncs.aggColors[name] = f
+}
+
+func registeredRayColor(name string) (tracer.RayColorFunc, bool) {
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	f, ok := colorFuncs.rayColors[name]
+	return f, ok
+}
+
+// registeredAggColor is the aggregation registered as name, nil for "" as
+// the tile pool averages samples itself.
+func registeredAggColor(name string) (tracer.AggColorFunc, bool) {
+	if name == "" {
+		return nil, true
+	}
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	f, ok := colorFuncs.aggColors[name]
+	return f, ok
+}
+
+func rayColorNames() []string {
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	names := []string{}
+	for name := range colorFuncs.rayColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func aggColorNames() []string {
+	colorFuncs.mu.Lock()
+	defer colorFuncs.mu.Unlock()
+	names := []string{}
+	for name := range colorFuncs.aggColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// aggColorFor is the aggregation settings ask for, nil to average.
+func aggColorFor(settings renderSettings) tracer.AggColorFunc {
+	f, _ := registeredAggColor(settings.AggColor)
+	return f
+}
+
+// renderAggregated renders t with tracer.Render, for aggregations the tile
+// pool can't do: it only knows how to average.
+func renderAggregated(ctx context.Context, t tileRender, agg tracer.AggColorFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tracer.Render(tracer.RenderSettings{
+		Frame:           t.frame,
+		Camera:          t.camera,
+		Hitter:          t.scene,
+		RayColorFunc:    t.rayColorFunc,
+		AggColorFunc:    agg,
+		SamplesPerPixel: t.spp,
+		MaxDepth:        t.maxDepth,
+	}, stopChan(ctx))
+	return ctx.Err()
+}
@@ -0,0 +1,224 @@
+package tracerserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+type plyProperty struct {
+	name      string
+	typ       string
+	list      bool
+	countType string
+}
+
+type plyElement struct {
+	name  string
+	count int
+	props []plyProperty
+}
+
+var plySizes = map[string]int{
+	"char": 1, "int8": 1, "uchar": 1, "uint8": 1,
+	"short": 2, "int16": 2, "ushort": 2, "uint16": 2,
+	"int": 4, "int32": 4, "uint": 4, "uint32": 4,
+	"float": 4, "float32": 4, "double": 8, "float64": 8,
+}
+
+// plyValues reads the scalars of a PLY body one at a time, whatever the
+// encoding.
+type plyValues struct {
+	r     *bufio.Reader
+	order binary.ByteOrder // nil for ascii
+	words *bufio.Scanner
+	buf   [8]byte
+}
+
+func (v *plyValues) next(typ string) (float64, error) {
+	if v.order == nil {
+		if !v.words.Scan() {
+			if err := v.words.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		return strconv.ParseFloat(v.words.Text(), 64)
+	}
+
+	b := v.buf[:plySizes[typ]]
+	if _, err := io.ReadFull(v.r, b); err != nil {
+		return 0, err
+	}
+	switch typ {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(v.order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(v.order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(v.order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(v.order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(v.order.Uint32(b))), nil
+	default:
+		return math.Float64frombits(v.order.Uint64(b)), nil
+	}
+}
+
+func readPLYHeader(r *bufio.Reader) (format string, elements []plyElement, err error) {
+	line := func() (string, error) {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(s), nil
+	}
+
+	if s, err := line(); err != nil || s != "ply" {
+		return "", nil, errors.New("not a PLY file")
+	}
+	for {
+		s, err := line()
+		if err != nil {
+			return "", nil, err
+		}
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "end_header":
+			if format == "" {
+				return "", nil, errors.New("missing format")
+			}
+			return format, elements, nil
+		case "format":
+			if len(fields) < 2 {
+				return "", nil, errors.New("bad format line")
+			}
+			format = fields[1]
+		case "element":
+			if len(fields) != 3 {
+				return "", nil, fmt.Errorf("bad element line %q", s)
+			}
+			n, err := strconv.Atoi(fields[2])
+			if err != nil || n < 0 {
+				return "", nil, fmt.Errorf("bad element count %q", fields[2])
+			}
+			elements = append(elements, plyElement{name: fields[1], count: n})
+		case "property":
+			if len(elements) == 0 {
+				return "", nil, errors.New("property before any element")
+			}
+			var p plyProperty
+			switch {
+			case len(fields) == 5 && fields[1] == "list":
+				p = plyProperty{name: fields[4], typ: fields[3], list: true, countType: fields[2]}
+			case len(fields) == 3:
+				p = plyProperty{name: fields[2], typ: fields[1]}
+			default:
+				return "", nil, fmt.Errorf("bad property line %q", s)
+			}
+			if plySizes[p.typ] == 0 || (p.list && plySizes[p.countType] == 0) {
+				return "", nil, fmt.Errorf("unknown property type in %q", s)
+			}
+			e := &elements[len(elements)-1]
+			e.props = append(e.props, p)
+		}
+	}
+}
+
+// readPLY reads vertex positions and normals (x, y, z, nx, ny, nz) and
+// faces (vertex_indices or vertex_index) from an ascii or binary PLY file.
+// Polygons are fanned into triangles.
+func readPLY(r io.Reader) (mesh, error) {
+	br := bufio.NewReader(r)
+	format, elements, err := readPLYHeader(br)
+	if err != nil {
+		return mesh{}, fmt.Errorf("ply: %w", err)
+	}
+
+	values := &plyValues{r: br}
+	switch format {
+	case "ascii":
+		values.words = bufio.NewScanner(br)
+		values.words.Split(bufio.ScanWords)
+	case "binary_little_endian":
+		values.order = binary.LittleEndian
+	case "binary_big_endian":
+		values.order = binary.BigEndian
+	default:
+		return mesh{}, fmt.Errorf("ply: unknown format %q", format)
+	}
+
+	var m mesh
+	hasNormals := false
+	for _, e := range elements {
+		for i := 0; i < e.count; i++ {
+			var (
+				pos, normal tracer.Vec3
+				face        []int
+			)
+			for _, p := range e.props {
+				if p.list {
+					n, err := values.next(p.countType)
+					if err != nil {
+						return mesh{}, fmt.Errorf("ply: %s %d: %w", e.name, i, err)
+					}
+					list := make([]int, int(n))
+					for j := range list {
+						f, err := values.next(p.typ)
+						if err != nil {
+							return mesh{}, fmt.Errorf("ply: %s %d: %w", e.name, i, err)
+						}
+						list[j] = int(f)
+					}
+					if p.name == "vertex_indices" || p.name == "vertex_index" {
+						face = list
+					}
+					continue
+				}
+				f, err := values.next(p.typ)
+				if err != nil {
+					return mesh{}, fmt.Errorf("ply: %s %d: %w", e.name, i, err)
+				}
+				if e.name != "vertex" {
+					continue
+				}
+				switch p.name {
+				case "x", "y", "z":
+					pos[p.name[0]-'x'] = f
+				case "nx", "ny", "nz":
+					normal[p.name[1]-'x'] = f
+					hasNormals = true
+				}
+			}
+
+			switch e.name {
+			case "vertex":
+				m.Vertices = append(m.Vertices, pos)
+				m.Normals = append(m.Normals, normal)
+			case "face":
+				for j := 1; j+1 < len(face); j++ {
+					m.Faces = append(m.Faces, [3]int{face[0], face[j], face[j+1]})
+				}
+			}
+		}
+	}
+	if !hasNormals {
+		m.Normals = nil
+	}
+	return m, nil
+}
@@ -0,0 +1,84 @@
+package tracerserver
+
+import (
+	"bytes"
+	"image/png"
+	"sync"
+
+	"github.com/ghostec/tracer"
+)
+
+// Full frames and encoded images are big enough at higher resolutions that
+// allocating them per pass and per streamed frame keeps the GC busy. The
+// pools below hand them back out instead, tracer_pool_gets_total against
+// tracer_pool_allocs_total shows how many allocations they save.
+
+var (
+	passFrames    = &framePool{name: "pass_frame"}
+	encodeBuffers = &bufferPool{name: "encode_buffer"}
+	pngBuffers    = &pngBufferPool{name: "png_buffer"}
+)
+
+// framePool reuses frames of one resolution, frames of any other are
+// dropped. Frames come back with whatever was last rendered into them, for
+// tracer.Render to overwrite.
+type framePool struct {
+	name string
+	pool sync.Pool
+}
+
+func (p *framePool) get(s renderSettings) *tracer.Frame {
+	poolGets.WithLabelValues(p.name).Inc()
+	if f, ok := p.pool.Get().(*tracer.Frame); ok && f.Width() == s.Width && f.Height() == s.Height {
+		return f
+	}
+	poolAllocs.WithLabelValues(p.name).Inc()
+	return newFrame(s)
+}
+
+func (p *framePool) put(f *tracer.Frame) {
+	p.pool.Put(f)
+}
+
+type bufferPool struct {
+	name string
+	pool sync.Pool
+}
+
+// get returns an empty buffer.
+func (p *bufferPool) get() *bytes.Buffer {
+	poolGets.WithLabelValues(p.name).Inc()
+	if b, ok := p.pool.Get().(*bytes.Buffer); ok {
+		b.Reset()
+		return b
+	}
+	poolAllocs.WithLabelValues(p.name).Inc()
+	return new(bytes.Buffer)
+}
+
+// put takes b back, once nothing reads its bytes anymore.
+func (p *bufferPool) put(b *bytes.Buffer) {
+	if b != nil {
+		p.pool.Put(b)
+	}
+}
+
+// pngBufferPool keeps the PNG encoder's deflate state and row buffers
+// between frames, see png.EncoderBufferPool.
+type pngBufferPool struct {
+	name string
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	poolGets.WithLabelValues(p.name).Inc()
+	if b, ok := p.pool.Get().(*png.EncoderBuffer); ok {
+		return b
+	}
+	poolAllocs.WithLabelValues(p.name).Inc()
+	return nil
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
@@ -0,0 +1,189 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCameraTransition = 30 * time.Second
+
+var errPresetNotFound = errors.New("camera preset not found")
+
+// cameraPreset is a named camera clients can switch to.
+type cameraPreset struct {
+	Name   string     `json:"name"`
+	Camera cameraDesc `json:"camera"`
+}
+
+// presetStore keeps the camera presets, shared by every session, for as
+// long as the server runs.
+type presetStore struct {
+	mu      sync.Mutex
+	presets map[string]cameraDesc
+}
+
+var cameraPresets = &presetStore{presets: map[string]cameraDesc{}}
+
+func (s *presetStore) save(p cameraPreset) {
+	s.mu.Lock()
+	s.presets[p.Name] = p.Camera
+	s.mu.Unlock()
+}
+
+func (s *presetStore) get(name string) (cameraPreset, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cam, ok := s.presets[name]
+	return cameraPreset{Name: name, Camera: cam}, ok
+}
+
+func (s *presetStore) remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.presets[name]
+	delete(s.presets, name)
+	return ok
+}
+
+func (s *presetStore) list() []cameraPreset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make([]cameraPreset, 0, len(s.presets))
+	for name, cam := range s.presets {
+		l = append(l, cameraPreset{Name: name, Camera: cam})
+	}
+	sort.Slice(l, func(a, b int) bool { return l[a].Name < l[b].Name })
+	return l
+}
+
+// easeInOut is smoothstep, the camera starts and stops gently.
+func easeInOut(u float64) float64 {
+	return u * u * (3 - 2*u)
+}
+
+// transitionCamera moves the camera to cam over d, eased, streaming the
+// preview on the way. A d of 0 jumps there.
+func (r *renderer) transitionCamera(cam cameraDesc, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recordLocked("camera")
+	if d <= 0 {
+		r.stopPlaybackLocked()
+		go r.do(func() error {
+			r.setCamera(cam)
+			return nil
+		})
+		return
+	}
+	t := timeline{keyframes: []keyframe{
+		{Time: 0, Camera: describeCamera(r.camera)},
+		{Time: d.Seconds(), Camera: cam},
+	}}
+	r.playLocked(t, false, easeInOut, nil)
+}
+
+// parseTransition reads a transition duration, defaulting to
+// Options.CameraTransition.
+func parseTransition(v string) (time.Duration, error) {
+	if v == "" {
+		return options.CameraTransition, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d > maxCameraTransition {
+		return 0, fmt.Errorf("must be between 0 and %v", maxCameraTransition)
+	}
+	return d, nil
+}
+
+// camerasHandler serves the camera presets:
+//
+//	GET    /cameras              list the presets
+//	POST   /cameras              save a cameraPreset, the session's camera if it has none
+//	GET    /cameras/{name}       one preset
+//	DELETE /cameras/{name}       forget a preset
+//	POST   /cameras/{name}/apply move the session's camera to it over ?duration=
+func camerasHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cameras"), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, cameraPresets.list())
+		case http.MethodPost:
+			saveCameraPreset(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "apply") {
+		http.NotFound(w, r)
+		return
+	}
+	p, ok := cameraPresets.get(parts[0])
+	if !ok {
+		http.Error(w, errPresetNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		d, err := parseTransition(r.URL.Query().Get("duration"))
+		if err != nil {
+			http.Error(w, "duration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rend, ok := requestRenderer(w, r)
+		if !ok {
+			return
+		}
+		rend.transitionCamera(p.Camera, d)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, p)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		cameraPresets.remove(p.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func saveCameraPreset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string      `json:"name"`
+		Camera *cameraDesc `json:"camera"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !sceneNameRe.MatchString(req.Name) {
+		http.Error(w, fmt.Sprintf("invalid preset name %q", req.Name), http.StatusBadRequest)
+		return
+	}
+	p := cameraPreset{Name: req.Name}
+	if req.Camera != nil {
+		p.Camera = *req.Camera
+	} else {
+		rend, ok := requestRenderer(w, r)
+		if !ok {
+			return
+		}
+		p.Camera = rend.cameraDesc()
+	}
+	cameraPresets.save(p)
+	writeJSON(w, http.StatusCreated, p)
+}
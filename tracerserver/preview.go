@@ -0,0 +1,78 @@
+package tracerserver
+
+import (
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// interact drops the renderer to the preview resolution and restarts
+// accumulation there. render promotes back to full resolution once no input
+// arrived for PreviewIdleMS.
+//
+// Input closer together than a frame interval restarts accumulation once:
+// the first right away, the rest when the interval is up or the next pass
+// starts, whichever is first.
+func (r *renderer) interact() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactLocked()
+}
+
+func (r *renderer) interactLocked() {
+	r.lastInput = time.Now()
+	r.scale = r.settings.PreviewScale
+	wait := frameInterval() - r.lastInput.Sub(r.lastReset)
+	if wait <= 0 {
+		r.resetLocked()
+		return
+	}
+	if !r.resetPending {
+		r.resetPending = true
+		time.AfterFunc(wait, r.flushReset)
+	}
+}
+
+// flushReset makes the reset interact put off, if nothing did already.
+func (r *renderer) flushReset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resetPending && r.ctx.Err() == nil {
+		r.resetLocked()
+	}
+}
+
+func (r *renderer) promoteLocked() {
+	if r.scale <= 1 {
+		return
+	}
+	if time.Since(r.lastInput) < time.Duration(r.settings.PreviewIdleMS)*time.Millisecond {
+		return
+	}
+	r.scale = 1
+	r.resetLocked()
+}
+
+// frameSettings are the settings the scene frame is currently rendered at.
+func (r *renderer) frameSettings() renderSettings {
+	if r.scale <= 1 {
+		return r.settings
+	}
+	return r.settings.scaled(r.scale)
+}
+
+// scaleFrame upsamples src to width x height with nearest neighbour
+// filtering, which is all a preview needs.
+func scaleFrame(src *tracer.Frame, width, height int) *tracer.Frame {
+	if src.Width() == width && src.Height() == height {
+		return src
+	}
+	dst := tracer.NewFrame(width, height, true)
+	for row := 0; row < height; row++ {
+		srcRow := row * src.Height() / height
+		for col := 0; col < width; col++ {
+			dst.Set(row, col, src.Get(srcRow, col*src.Width()/width))
+		}
+	}
+	return dst
+}
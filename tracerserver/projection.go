@@ -0,0 +1,128 @@
+package tracerserver
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	projectionPerspective  = "perspective"
+	projectionOrthographic = "orthographic"
+)
+
+// projectRay maps the pinhole rays tracer.Camera casts to settings'
+// projection, or returns nil for perspective, which needs nothing. An
+// orthographic view is as big as the perspective one is at the LookAt
+// distance, so dollying still zooms.
+func projectRay(camera tracer.Camera, settings renderSettings) func(tracer.Ray) tracer.Ray {
+	if settings.Stereo {
+		return stereoRay(camera, settings)
+	}
+	if settings.Projection != projectionOrthographic {
+		return nil
+	}
+	forward := camera.LookAt.Vec3().Sub(camera.LookFrom.Vec3())
+	dist := forward.Len()
+	forward = forward.Unit()
+	return func(r tracer.Ray) tracer.Ray {
+		along := r.Direction.Dot(forward)
+		if along <= 0 {
+			return r
+		}
+		origin := r.At(dist / along).Vec3().Sub(forward.MulFloat(dist))
+		return tracer.Ray{Origin: tracer.Point3(origin), Direction: forward}
+	}
+}
+
+// stereoRay maps the pinhole rays for the whole frame to the left eye's
+// in its left half and the right eye's in its right half. The eyes look
+// the same way, InterocularDistance apart, and see as far up and down as
+// the camera does but only half as far across, their half of the frame
+// being half as wide.
+func stereoRay(camera tracer.Camera, settings renderSettings) func(tracer.Ray) tracer.Ray {
+	forward := camera.LookAt.Vec3().Sub(camera.LookFrom.Vec3()).Unit()
+	right := forward.Cross(camera.VUp).Unit()
+	up := right.Cross(forward)
+	// The frame's half width at unit distance, each eye's is half that.
+	halfWidth := math.Tan(tracer.DegreesToRadians(camera.VFoV)/2) * camera.AspectRatio
+	offset := settings.InterocularDistance / 2
+	return func(r tracer.Ray) tracer.Ray {
+		along := r.Direction.Dot(forward)
+		if along <= 0 {
+			return r
+		}
+		x, y := r.Direction.Dot(right)/along, r.Direction.Dot(up)/along
+		eye := -offset
+		if x < 0 {
+			x += halfWidth / 2
+		} else {
+			x -= halfWidth / 2
+			eye = offset
+		}
+		origin := r.Origin.Vec3().Add(right.MulFloat(eye))
+		dir := forward.Add(right.MulFloat(x)).Add(up.MulFloat(y))
+		return tracer.Ray{Origin: tracer.Point3(origin), Direction: dir}
+	}
+}
+
+// pixelRay is the primary ray through pixel (x, y) in settings'
+// projection.
+func pixelRay(camera tracer.Camera, settings renderSettings, x, y int) tracer.Ray {
+	ray := camera.GetRay(tracer.CameraCoordinatesFromPixel(y, x, settings.Width, settings.Height))
+	if project := projectRay(camera, settings); project != nil {
+		ray = project(ray)
+	}
+	return ray
+}
+
+// withProjection makes rayColor see primary rays in settings' projection.
+func withProjection(rayColor tracer.RayColorFunc, camera tracer.Camera, settings renderSettings) tracer.RayColorFunc {
+	project := projectRay(camera, settings)
+	if project == nil {
+		return rayColor
+	}
+	return func(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+		return rayColor(project(r), n, depth)
+	}
+}
+
+// viewDirections are where the canned views look from, relative to the
+// target, and which way is up in them.
+var viewDirections = map[string][2]tracer.Vec3{
+	"top":       {{0, 1, 0}, {0, 0, -1}},
+	"bottom":    {{0, -1, 0}, {0, 0, 1}},
+	"front":     {{0, 0, 1}, {0, 1, 0}},
+	"back":      {{0, 0, -1}, {0, 1, 0}},
+	"right":     {{1, 0, 0}, {0, 1, 0}},
+	"left":      {{-1, 0, 0}, {0, 1, 0}},
+	"isometric": {{1, 1, 1}, {0, 1, 0}},
+}
+
+func viewNames() []string {
+	return []string{"top", "bottom", "front", "back", "right", "left", "isometric"}
+}
+
+// viewCamera is the camera looking at the selected object, or the scene's
+// centroid, from the canned view name, keeping its distance and field of
+// view.
+func (r *renderer) viewCamera(name string) (cameraDesc, error) {
+	dir, ok := viewDirections[name]
+	if !ok {
+		return cameraDesc{}, fmt.Errorf("unknown view %q, want one of %v", name, viewNames())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	target := centroid(r.scene)
+	if r.selected >= 0 {
+		target = centroid(r.objects[r.selected])
+	}
+	dist := math.Max(minDollyDistance, r.camera.LookFrom.Vec3().Sub(target.Vec3()).Len())
+	cam := r.camera
+	cam.LookFrom = tracer.Point3(target.Vec3().Add(dir[0].Unit().MulFloat(dist)))
+	cam.LookAt = target
+	cam.VUp = dir[1]
+	return describeCamera(cam), nil
+}
@@ -0,0 +1,407 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const protocolVersion = 1
+
+// message is the envelope for everything sent over the websocket in either
+// direction, other than binary frames.
+type message struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *protocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func errBadPayload(err error) *protocolError {
+	return &protocolError{Code: "bad_payload", Message: err.Error()}
+}
+
+type cameraMovePayload struct {
+	Delta [3]float64 `json:"delta"`
+}
+
+// dragPayload is a relative pointer movement. With no modifier it orbits,
+// shift pans and ctrl or alt dollies. Button 1 (middle) pans and button 2
+// (right) dollies regardless of modifiers.
+type dragPayload struct {
+	DX     float64 `json:"dx"`
+	DY     float64 `json:"dy"`
+	Button int     `json:"button"`
+	Shift  bool    `json:"shift"`
+	Ctrl   bool    `json:"ctrl"`
+	Alt    bool    `json:"alt"`
+}
+
+type wheelPayload struct {
+	Delta float64 `json:"delta"`
+}
+
+// orbitPayload, panPayload and dollyPayload move the camera by deltas
+// in their own units rather than by pointer pixels and buttons, for touch
+// gestures. Yaw and Pitch are degrees, DX and DY frame pixels. Dolly
+// divides the distance to LookAt by e^Amount, by the ratio a pinch spread
+// by for Amount its logarithm.
+type orbitPayload struct {
+	Yaw   float64 `json:"yaw"`
+	Pitch float64 `json:"pitch"`
+}
+
+type panPayload struct {
+	DX float64 `json:"dx"`
+	DY float64 `json:"dy"`
+}
+
+type dollyPayload struct {
+	Amount float64 `json:"amount"`
+}
+
+type orbitTargetPayload struct {
+	Target *[3]float64 `json:"target"`
+}
+
+type cameraKeyPayload struct {
+	Action string `json:"action"`
+	Fast   bool   `json:"fast"`
+}
+
+type pointerPayload struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// selectPayload picks the object at X, Y. Add toggles it in the selection
+// instead of making it the only selected object.
+type selectPayload struct {
+	pointerPayload
+	Add bool `json:"add"`
+}
+
+// marqueePayload selects the objects inside the rectangle between two
+// corners in frame pixels, adding them to the selection with Add.
+type marqueePayload struct {
+	X0  int  `json:"x0"`
+	Y0  int  `json:"y0"`
+	X1  int  `json:"x1"`
+	Y1  int  `json:"y1"`
+	Add bool `json:"add"`
+}
+
+// gizmoPickPayload answers a gizmo_pick with the arm of the translation
+// gizmo under the pointer, "" if there's none.
+type gizmoPickPayload struct {
+	Axis string `json:"axis"`
+}
+
+// gizmoDragPayload moves the selected object along the gizmo's Axis by a
+// pointer moving DX, DY frame pixels to X, Y.
+type gizmoDragPayload struct {
+	Axis string  `json:"axis"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	DX   float64 `json:"dx"`
+	DY   float64 `json:"dy"`
+}
+
+type transformPayload struct {
+	Translate [3]float64 `json:"translate"`
+	Scale     *float64   `json:"scale"`
+}
+
+type setMaterialPayload struct {
+	Material materialDesc `json:"material"`
+}
+
+type viewPassPayload struct {
+	Pass string `json:"pass"`
+}
+
+type addObjectPayload struct {
+	Sphere sphereDesc `json:"sphere"`
+}
+
+type duplicateObjectPayload struct {
+	Offset *[3]float64 `json:"offset"`
+}
+
+// streamFormatPayload picks how frames are streamed. With Overlay the GUI
+// overlay is left out of them and sent as its own transparent PNG, see
+// encodeOverlay, whenever it changes. With Envelope every binary message
+// comes wrapped in an envelope.
+type streamFormatPayload struct {
+	Format   string `json:"format"`
+	Quality  int    `json:"quality,omitempty"`
+	Tiles    bool   `json:"tiles,omitempty"`
+	TileSize int    `json:"tile_size,omitempty"`
+	Overlay  bool   `json:"overlay,omitempty"`
+	Envelope bool   `json:"envelope,omitempty"`
+}
+
+type streamFormatInfoPayload struct {
+	Format      string `json:"format"`
+	Quality     int    `json:"quality,omitempty"`
+	Tiles       bool   `json:"tiles"`
+	TileSize    int    `json:"tile_size,omitempty"`
+	Overlay     bool   `json:"overlay"`
+	Envelope    bool   `json:"envelope"`
+	ContentType string `json:"content_type"`
+}
+
+type frameInfoPayload struct {
+	ContentType string  `json:"content_type"`
+	Bytes       int     `json:"bytes"`
+	EncodeMS    float64 `json:"encode_ms"`
+	Tiles       int     `json:"tiles,omitempty"`
+}
+
+// convergencePayload is sent while adaptive sampling is on. Converged is the
+// fraction of pixels under the noise threshold.
+type convergencePayload struct {
+	Converged   float64 `json:"converged"`
+	MeanSamples float64 `json:"mean_samples"`
+}
+
+// statsPayload describes the current accumulation. Rays only count camera
+// rays, not bounces. ETAMS is how long until accumulation stops at what
+// ETABy names, unset when it isn't going to or it's too early to tell.
+type statsPayload struct {
+	Passes          int      `json:"passes"`
+	Rays            int64    `json:"rays"`
+	SamplesPerPixel float64  `json:"samples_per_pixel"`
+	RaysPerSec      float64  `json:"rays_per_sec"`
+	SinceResetMS    float64  `json:"since_reset_ms"`
+	RenderMS        float64  `json:"render_ms"`
+	Convergence     float64  `json:"convergence"`
+	ETAMS           *float64 `json:"eta_ms,omitempty"`
+	ETABy           string   `json:"eta_by,omitempty"`
+}
+
+// cameraStatePayload is where the camera is, sent on connect and whenever
+// it changes. OrbitTarget is the point orbiting turns around.
+type cameraStatePayload struct {
+	cameraDesc
+	OrbitTarget [3]float64 `json:"orbit_target"`
+}
+
+type frameRatePayload struct {
+	FPS int `json:"fps"`
+}
+
+// keyframePayload records the camera at Time seconds, a second after the
+// last keyframe if it's omitted.
+type keyframePayload struct {
+	Time *float64 `json:"time"`
+}
+
+type deleteKeyframePayload struct {
+	Index int `json:"index"`
+}
+
+type timelinePlayPayload struct {
+	Playing bool `json:"playing"`
+	Loop    bool `json:"loop"`
+}
+
+// timelineRenderPayload submits a job rendering the timeline at FPS,
+// settings applied over the session's.
+type timelineRenderPayload struct {
+	FPS      int           `json:"fps"`
+	Settings settingsPatch `json:"settings"`
+}
+
+// recordPayload starts or stops recording the frames. IntervalMS is the
+// time between captured frames, 1/FPS if it's 0, which a longer interval
+// turns into a timelapse.
+type recordPayload struct {
+	Recording  bool   `json:"recording"`
+	Format     string `json:"format"`
+	FPS        int    `json:"fps"`
+	IntervalMS int    `json:"interval_ms"`
+}
+
+type saveCameraPayload struct {
+	Name string `json:"name"`
+}
+
+// cameraPresetPayload moves the camera to the preset Name over DurationMS,
+// Options.CameraTransition if it's omitted.
+type cameraPresetPayload struct {
+	Name       string   `json:"name"`
+	DurationMS *float64 `json:"duration_ms"`
+}
+
+// viewPayload moves the camera to one of viewDirections, around the
+// selection or the scene.
+type viewPayload struct {
+	Name string `json:"name"`
+}
+
+type soloLightPayload struct {
+	Solo bool `json:"solo"`
+}
+
+type scrubPayload struct {
+	AgoMS *float64 `json:"ago_ms"`
+}
+
+type scrubResultPayload struct {
+	Live  bool                 `json:"live"`
+	Frame *historyFramePayload `json:"frame,omitempty"`
+}
+
+type lessonPayload struct {
+	Stage int `json:"stage"`
+}
+
+// pickResultPayload answers a select or marquee. Object is -1 on a miss,
+// with the other fields left out.
+type pickResultPayload struct {
+	Object   int           `json:"object"`
+	Point    *[3]float64   `json:"point,omitempty"`
+	Normal   *[3]float64   `json:"normal,omitempty"`
+	Distance float64       `json:"distance,omitempty"`
+	Material *materialDesc `json:"material,omitempty"`
+	// Selection is every selected object, Object the last of them after a
+	// select or marquee.
+	Selection []int `json:"selection"`
+}
+
+type highlightNodePayload struct {
+	ID *int `json:"id"`
+}
+
+type pausePayload struct {
+	Paused bool `json:"paused"`
+}
+
+// sessionPayload identifies the client's session. Reconnecting with
+// ?resume=Token within Options.SessionTTL resumes it, Resumed tells it did.
+type sessionPayload struct {
+	ID      uint64 `json:"id"`
+	Token   string `json:"token,omitempty"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+func encodeMessage(typ, id string, payload interface{}) ([]byte, error) {
+	m := message{Version: protocolVersion, Type: typ, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		m.Payload = raw
+	}
+	return json.Marshal(m)
+}
+
+func decodeMessage(data []byte) (message, error) {
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return message{}, &protocolError{Code: "bad_message", Message: err.Error()}
+	}
+	if m.Version != 0 && m.Version != protocolVersion {
+		return message{}, &protocolError{Code: "unsupported_version", Message: fmt.Sprintf("protocol version %d not supported, want %d", m.Version, protocolVersion)}
+	}
+	if m.Type == "" {
+		return message{}, &protocolError{Code: "bad_message", Message: "missing type"}
+	}
+	return m, nil
+}
+
+func decodePayload(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return errBadPayload(fmt.Errorf("missing payload"))
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errBadPayload(err)
+	}
+	return nil
+}
+
+func isLegacyMessage(data []byte) bool {
+	return len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] != '{'
+}
+
+// legacyMessage translates the pre-JSON text commands ("1".."4",
+// "mousemove x y", "mouseclick x y", "lesson ...") into protocol messages.
+// TODO: remove after the next release.
+func legacyMessage(msg string, lessonStage int) (message, error) {
+	payload := func(typ string, v interface{}) (message, error) {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return message{}, err
+		}
+		return message{Version: protocolVersion, Type: typ, Payload: raw}, nil
+	}
+
+	switch {
+	case msg == "1":
+		return payload("camera_move", cameraMovePayload{Delta: [3]float64{0, 0, -0.5}})
+	case msg == "2":
+		return payload("camera_move", cameraMovePayload{Delta: [3]float64{0, 0, 0.5}})
+	case msg == "3":
+		return payload("camera_move", cameraMovePayload{Delta: [3]float64{-0.5, 0, 0}})
+	case msg == "4":
+		return payload("camera_move", cameraMovePayload{Delta: [3]float64{0.5, 0, 0}})
+	case strings.HasPrefix(msg, "lesson "):
+		stage := lessonStage
+		switch arg := strings.TrimPrefix(msg, "lesson "); arg {
+		case "on":
+			stage = 0
+		case "off":
+			stage = -1
+		case "next":
+			if stage < len(lessonStages)-1 {
+				stage++
+			}
+		case "prev":
+			if stage > 0 {
+				stage--
+			}
+		default:
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return message{}, errBadPayload(err)
+			}
+			stage = n
+		}
+		return payload("lesson", lessonPayload{Stage: stage})
+	case strings.HasPrefix(msg, "mousemove") || strings.HasPrefix(msg, "mouseclick"):
+		parts := strings.Split(msg, " ")
+		if len(parts) != 3 {
+			return message{}, &protocolError{Code: "bad_message", Message: "expected \"" + parts[0] + " x y\""}
+		}
+		x, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return message{}, errBadPayload(err)
+		}
+		y, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return message{}, errBadPayload(err)
+		}
+		typ := "hover"
+		if parts[0] == "mouseclick" {
+			typ = "select"
+		}
+		return payload(typ, pointerPayload{X: x, Y: y})
+	default:
+		return message{}, &protocolError{Code: "unknown_command", Message: fmt.Sprintf("unknown command %q", msg)}
+	}
+}
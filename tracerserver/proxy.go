@@ -0,0 +1,77 @@
+package tracerserver
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyConfig decides how far the server believes a request about where it
+// came from. The X-Forwarded-* headers are only honoured with trustProxy,
+// anyone can send them otherwise.
+type proxyConfig struct {
+	trustProxy bool
+	// origins are the websocket origins allowed besides the server's own,
+	// "*" allows any.
+	origins []string
+}
+
+var proxy proxyConfig
+
+func newProxyConfig(trust bool, origins string) proxyConfig {
+	c := proxyConfig{trustProxy: trust}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			c.origins = append(c.origins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return c
+}
+
+// forwarded returns the first value of a trusted X-Forwarded-* header, the
+// one the proxy closest to the client set.
+func (c proxyConfig) forwarded(r *http.Request, name string) string {
+	if !c.trustProxy {
+		return ""
+	}
+	v := r.Header.Get("X-Forwarded-" + name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+func (c proxyConfig) host(r *http.Request) string {
+	if host := c.forwarded(r, "Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// remoteAddr is the client's address, past the proxy if it's trusted.
+func (c proxyConfig) remoteAddr(r *http.Request) string {
+	if addr := c.forwarded(r, "For"); addr != "" {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// checkOrigin accepts requests without an Origin, which don't come from a
+// browser, ones from the host the client sees and the configured origins.
+func (c proxyConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range c.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, c.host(r))
+}
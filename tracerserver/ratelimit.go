@@ -0,0 +1,156 @@
+package tracerserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// messageLimit is how many messages of a type a connection may send per
+// second, Burst of them at once. Latest messages are state, not deltas, so
+// over the limit only the newest is kept and handled once the connection
+// may send again, instead of being rejected.
+type messageLimit struct {
+	Rate   float64
+	Burst  float64
+	Latest bool
+}
+
+// messageLimits throttle the messages that cast rays or redraw the GUI,
+// every other type gets defaultMessageLimit. Camera moves are deltas the
+// JS sends per pointer event, renderer.interact coalesces the resets they
+// cause.
+var messageLimits = map[string]messageLimit{
+	"hover":          {Rate: 30, Burst: 10, Latest: true},
+	"highlight_node": {Rate: 30, Burst: 10, Latest: true},
+	"compare_split":  {Rate: 30, Burst: 10, Latest: true},
+	"scrub":          {Rate: 30, Burst: 10, Latest: true},
+	"select":         {Rate: 10, Burst: 5},
+	"marquee":        {Rate: 10, Burst: 5},
+	"select_object":  {Rate: 10, Burst: 5},
+	"gizmo_pick":     {Rate: 10, Burst: 5},
+	"focus":          {Rate: 10, Burst: 5},
+	"inspect":        {Rate: 10, Burst: 5},
+	"camera_move":    {Rate: 120, Burst: 60},
+	"drag":           {Rate: 120, Burst: 60},
+	"wheel":          {Rate: 120, Burst: 60},
+	"camera_key":     {Rate: 120, Burst: 60},
+	"orbit":          {Rate: 120, Burst: 60},
+	"pan":            {Rate: 120, Burst: 60},
+	"dolly":          {Rate: 120, Burst: 60},
+	"gizmo_drag":     {Rate: 120, Burst: 60},
+}
+
+var defaultMessageLimit = messageLimit{Rate: 20, Burst: 40}
+
+// limitFor is typ's limit scaled by Options.RateLimit, false if there is
+// none.
+func limitFor(typ string) (messageLimit, bool) {
+	if options.RateLimit <= 0 {
+		return messageLimit{}, false
+	}
+	l, ok := messageLimits[typ]
+	if !ok {
+		l = defaultMessageLimit
+	}
+	l.Rate *= options.RateLimit
+	l.Burst *= options.RateLimit
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return l, true
+}
+
+type tokenBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+func newTokenBucket(l messageLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: l.Rate, burst: l.Burst, tokens: l.Burst, last: now}
+}
+
+// take takes a token if there is one and returns 0, or returns how long
+// until there is one.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// deferredMessage is the newest Latest message over its limit, handled
+// when timer fires.
+type deferredMessage struct {
+	m     message
+	timer *time.Timer
+}
+
+// throttle reports whether m may be handled now. If not, m is either kept
+// for later when its type's limit is Latest, or rejected with a
+// rate_limited error.
+func (c *client) throttle(m message) (bool, error) {
+	l, ok := limitFor(m.Type)
+	if !ok {
+		return true, nil
+	}
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	now := time.Now()
+	b, ok := c.limits[m.Type]
+	if !ok {
+		b = newTokenBucket(l, now)
+		c.limits[m.Type] = b
+	}
+	wait := b.take(now)
+	if wait == 0 {
+		return true, nil
+	}
+	wsMessagesThrottled.WithLabelValues(m.Type).Inc()
+	if !l.Latest {
+		return false, &protocolError{Code: "rate_limited", Message: fmt.Sprintf("%s: more than %g per second", m.Type, l.Rate)}
+	}
+	if d, ok := c.deferred[m.Type]; ok {
+		d.m = m
+		return false, nil
+	}
+	typ := m.Type
+	c.deferred[typ] = &deferredMessage{m: m, timer: time.AfterFunc(wait, func() { c.runDeferred(typ) })}
+	return false, nil
+}
+
+// runDeferred handles the message of type typ throttle kept, unless the
+// connection closed in the meantime.
+func (c *client) runDeferred(typ string) {
+	c.lmu.Lock()
+	d, ok := c.deferred[typ]
+	if !ok {
+		c.lmu.Unlock()
+		return
+	}
+	delete(c.deferred, typ)
+	if b, ok := c.limits[typ]; ok {
+		b.take(time.Now())
+	}
+	c.lmu.Unlock()
+
+	if err := c.dispatch(d.m); err != nil {
+		c.sendError(d.m.ID, err)
+	}
+}
+
+// stopDeferred drops the messages throttle kept, for when the connection
+// closes.
+func (c *client) stopDeferred() {
+	c.lmu.Lock()
+	defer c.lmu.Unlock()
+	for typ, d := range c.deferred {
+		d.timer.Stop()
+		delete(c.deferred, typ)
+	}
+}
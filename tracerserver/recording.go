@@ -0,0 +1,320 @@
+package tracerserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRecordingFPS  = 30
+	maxRecordingDuration = 30 * time.Minute
+)
+
+var errRecordingNotFound = errors.New("recording not found")
+
+// recording captures a renderer's frames into a video through an ffmpeg
+// pipe. Frames are taken every interval and played back at fps, so a slow
+// interval makes a timelapse of the accumulation.
+type recording struct {
+	id            uint64
+	format        string
+	path          string
+	width, height int
+	fps           int
+	interval      time.Duration
+	started       time.Time
+	cancel        context.CancelFunc
+	finished      chan struct{}
+
+	mu     sync.Mutex
+	frames int
+	ended  time.Time
+	err    error
+}
+
+type recordingStatus struct {
+	ID         uint64  `json:"id"`
+	State      string  `json:"state"`
+	Format     string  `json:"format"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FPS        int     `json:"fps"`
+	IntervalMS float64 `json:"interval_ms"`
+	Frames     int     `json:"frames"`
+	ElapsedMS  float64 `json:"elapsed_ms"`
+	URL        string  `json:"url"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func (rec *recording) status() recordingStatus {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	s := recordingStatus{
+		ID:         rec.id,
+		State:      "recording",
+		Format:     rec.format,
+		Width:      rec.width,
+		Height:     rec.height,
+		FPS:        rec.fps,
+		IntervalMS: millis(rec.interval),
+		Frames:     rec.frames,
+		ElapsedMS:  millis(time.Since(rec.started)),
+		URL:        fmt.Sprintf("/recordings/%d", rec.id),
+	}
+	select {
+	case <-rec.finished:
+		s.State = "done"
+		s.ElapsedMS = millis(rec.ended.Sub(rec.started))
+		if rec.err != nil {
+			s.State, s.Error = "failed", rec.err.Error()
+		}
+	default:
+	}
+	return s
+}
+
+// stop ends the capture and waits for ffmpeg to write the file.
+func (rec *recording) stop() {
+	rec.cancel()
+	<-rec.finished
+}
+
+// capture feeds frames to ffmpeg until ctx is done, the renderer closes or
+// maxRecordingDuration passes.
+func (rec *recording) capture(ctx context.Context, rend *renderer, cmd *exec.Cmd, stdin io.WriteCloser, stderr *bytes.Buffer) {
+	defer close(rec.finished)
+
+	ticker := time.NewTicker(rec.interval)
+	defer ticker.Stop()
+
+	var err error
+loop:
+	for {
+		img := fitRGBA(rend.Image(), rec.width, rec.height)
+		if _, err = stdin.Write(img.Pix); err != nil {
+			break
+		}
+		rec.mu.Lock()
+		rec.frames++
+		rec.mu.Unlock()
+
+		if time.Since(rec.started) >= maxRecordingDuration {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-rend.done():
+			break loop
+		case <-ticker.C:
+		}
+	}
+
+	stdin.Close()
+	if werr := cmd.Wait(); werr != nil {
+		err = fmt.Errorf("ffmpeg: %v: %s", werr, stderr.String())
+	}
+	if err != nil {
+		logs.Error("recording failed", "recording", rec.id, "err", err)
+	}
+	rec.mu.Lock()
+	rec.ended = time.Now()
+	rec.err = err
+	rec.mu.Unlock()
+}
+
+// fitRGBA converts img to RGBA at width x height, nearest neighbour
+// scaling it if a preview or a settings change made it a different size.
+func fitRGBA(img image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	b := img.Bounds()
+	if b.Dx() == width && b.Dy() == height {
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*b.Dx()/width, b.Min.Y+y*b.Dy()/height))
+		}
+	}
+	return dst
+}
+
+// recordingStore keeps the recordings in a temp dir for as long as the
+// server runs.
+type recordingStore struct {
+	mu         sync.Mutex
+	dir        string
+	recordings map[uint64]*recording
+	nextID     uint64
+}
+
+var recordings = &recordingStore{recordings: map[uint64]*recording{}}
+
+// start records rend at its current frame size.
+func (s *recordingStore) start(rend *renderer, format string, fps int, interval time.Duration) (*recording, error) {
+	codec, ok := videoCodecs[format]
+	if !ok {
+		return nil, fmt.Errorf("%v %q, want mp4 or webm", errUnknownFormat, format)
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("%w: ffmpeg not found in PATH", errEncoderUnavailable)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dir == "" {
+		if s.dir, err = ioutil.TempDir("", "tracer-recordings"); err != nil {
+			return nil, err
+		}
+	}
+	s.nextID++
+	settings := rend.renderSettings()
+	rec := &recording{
+		id:       s.nextID,
+		format:   format,
+		path:     filepath.Join(s.dir, fmt.Sprintf("%d.%s", s.nextID, format)),
+		width:    settings.Width,
+		height:   settings.Height,
+		fps:      fps,
+		interval: interval,
+		started:  time.Now(),
+		finished: make(chan struct{}),
+	}
+
+	args := []string{"-loglevel", "error", "-f", "rawvideo", "-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", rec.width, rec.height), "-framerate", strconv.Itoa(fps), "-i", "-",
+		"-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2"}
+	args = append(append(args, codec...), rec.path)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec.cancel = cancel
+	s.recordings[rec.id] = rec
+	go rec.capture(ctx, rend, cmd, stdin, stderr)
+	return rec, nil
+}
+
+func (s *recordingStore) get(id uint64) (*recording, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.recordings[id]
+	return rec, ok
+}
+
+func (s *recordingStore) list() []*recording {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make([]*recording, 0, len(s.recordings))
+	for _, rec := range s.recordings {
+		l = append(l, rec)
+	}
+	sort.Slice(l, func(a, b int) bool { return l[a].id < l[b].id })
+	return l
+}
+
+// remove stops rec if it's still recording and deletes its file.
+func (s *recordingStore) remove(rec *recording) {
+	s.mu.Lock()
+	delete(s.recordings, rec.id)
+	s.mu.Unlock()
+	rec.stop()
+	if err := os.Remove(rec.path); err != nil && !os.IsNotExist(err) {
+		logs.Warn("removing recording failed", "recording", rec.id, "err", err)
+	}
+}
+
+// closeAll stops every recording and deletes the temp dir.
+func (s *recordingStore) closeAll() {
+	for _, rec := range s.list() {
+		rec.stop()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+		s.dir = ""
+	}
+}
+
+// recordingsHandler serves the recordings:
+//
+//	GET    /recordings      list every recording's status
+//	GET    /recordings/{id} the video, once it's done
+//	DELETE /recordings/{id} stop and delete a recording
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/recordings"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		l := []recordingStatus{}
+		for _, rec := range recordings.list() {
+			l = append(l, rec.status())
+		}
+		writeJSON(w, http.StatusOK, l)
+		return
+	}
+
+	id, err := strconv.ParseUint(path, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rec, ok := recordings.get(id)
+	if !ok {
+		http.Error(w, errRecordingNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		select {
+		case <-rec.finished:
+		default:
+			writeJSON(w, http.StatusConflict, rec.status())
+			return
+		}
+		if rec.err != nil {
+			http.Error(w, rec.err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "video/"+rec.format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(rec.path)))
+		http.ServeFile(w, r, rec.path)
+	case http.MethodDelete:
+		recordings.remove(rec)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,593 @@
+package tracerserver
+
+import (
+	"context"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+type renderer struct {
+	mu sync.Mutex
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	gen         *generation
+	paused      bool
+	resumed     chan struct{}
+	selected    int
+	hovered     int
+	objects     tracer.HitterList
+	meta        []objectMeta
+	scene       tracer.Hitter
+	camera      tracer.Camera
+	orbitTarget *tracer.Point3
+	highlight   *tracer.AABB
+	lesson      int
+	settings    renderSettings
+	scale       int
+	lastInput   time.Time
+	history     history
+	commands    chan command
+	// lastReset is when accumulation last restarted, resetPending whether
+	// interact put off restarting it again.
+	lastReset    time.Time
+	resetPending bool
+
+	timeline     timeline
+	stopPlayback context.CancelFunc
+	frames       frameHistory
+	compare      *comparison
+	// solo is the one light left on, -1 for all of them.
+	solo int
+	// selection is every selected object in the order they were selected,
+	// selected the last of them and the one edits apply to.
+	selection []int
+	// sceneVersion identifies the objects for the accumulation cache, versions
+	// counts the versions handed out.
+	sceneVersion uint64
+	versions     uint64
+	accum        accumCache
+	// session opened the renderer, events about it carry its ID.
+	session uint64
+	// target is where accumulation stops, targetChanged is closed and
+	// replaced whenever it changes.
+	target        renderTargetPayload
+	targetChanged chan struct{}
+}
+
+func newFrame(s renderSettings) *tracer.Frame {
+	return tracer.NewFrame(s.Width, s.Height, true)
+}
+
+// generation is one run of accumulation: everything between two resets. It
+// owns the frames it accumulates into, so a render that finishes after a
+// reset lands in a frame nobody reads anymore instead of the current one.
+type generation struct {
+	id     uint64
+	key    uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan bool
+	// camera is the renderer's as it was at the reset that started the
+	// generation, what every pass of it renders from.
+	camera tracer.Camera
+	scene  *tracer.Frame
+	gui    *tracer.Frame
+	aovs   map[string]*tracer.Frame
+	passes int
+	// converged is whether EventConverged fired for this generation,
+	// reached what it stopped at if it got to the target.
+	converged bool
+	reached   *targetReachedPayload
+	// samples backs scene while adaptive sampling is on. Otherwise it
+	// holds one entry per pass, for estimating convergence.
+	samples *sampleStats
+
+	started    time.Time
+	rays       int64
+	renderTime time.Duration
+	lastPass   time.Duration
+
+	denoised   *tracer.Frame
+	denoisedAt int
+
+	// compare is the right side while a comparison is on.
+	compare           *tracer.Frame
+	comparePasses     int
+	compareDenoised   *tracer.Frame
+	compareDenoisedAt int
+}
+
+func newGeneration(parent context.Context, id uint64, scene, gui *tracer.Frame) *generation {
+	ctx, cancel := context.WithCancel(parent)
+	return &generation{id: id, ctx: ctx, cancel: cancel, stop: stopChan(ctx), scene: scene, gui: gui, started: time.Now()}
+}
+
+// carry takes over old's accumulation, for generations that continue it
+// rather than starting over.
+func (g *generation) carry(old *generation) {
+	g.camera = old.camera
+	g.passes, g.samples, g.converged, g.reached = old.passes, old.samples, old.converged, old.reached
+	g.started, g.rays, g.renderTime, g.lastPass = old.started, old.rays, old.renderTime, old.lastPass
+	g.compare, g.comparePasses = old.compare, old.comparePasses
+}
+
+// recordPassLocked accounts for a pass of rays camera rays that took
+// elapsed.
+func (g *generation) recordPassLocked(rays int, elapsed time.Duration) {
+	g.passes++
+	g.rays += int64(rays)
+	g.renderTime += elapsed
+	g.lastPass = elapsed
+	renderSeconds.Observe(elapsed.Seconds())
+	samplesTotal.Add(float64(rays))
+}
+
+// stopChan adapts ctx to tracer.Render, which only knows about stop channels.
+func stopChan(ctx context.Context) chan bool {
+	stop := make(chan bool)
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+	return stop
+}
+
+func newRenderer() *renderer {
+	ctx, cancel := context.WithCancel(context.Background())
+	settings := currentDefaults()
+	return &renderer{
+		ctx:           ctx,
+		cancel:        cancel,
+		gen:           newGeneration(ctx, 0, newFrame(settings), newFrame(settings)),
+		settings:      settings,
+		commands:      make(chan command),
+		targetChanged: make(chan struct{}),
+		scale:         1,
+		selected:      -1,
+		hovered:       -1,
+		lesson:        -1,
+		solo:          -1,
+		history:       history{limit: defaultHistoryLimit},
+		accum:         accumCache{limit: defaultAccumCache},
+		frames:        frameHistory{limit: defaultFrameHistory, interval: defaultFrameHistoryInterval},
+	}
+}
+
+func (r *renderer) loadScene(desc sceneDesc) error {
+	objects, err := desc.Objects()
+	if err != nil {
+		return err
+	}
+	bvh, err := buildBVH(objects)
+	if err != nil {
+		return err
+	}
+	cam := desc.Camera.Camera()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The scene decides the framing, the settings decide the resolution.
+	if desc.Camera.AspectRatio != 0 {
+		settings := r.settings.withAspectRatio(cam.AspectRatio)
+		if err := settings.validate(); err != nil {
+			return err
+		}
+		r.settings = settings
+	}
+	cam.AspectRatio = r.settings.aspectRatio()
+
+	r.objects = objects
+	r.meta = desc.meta()
+	r.scene = bvh
+	r.camera = cam
+	r.selectLocked(-1)
+	r.hovered = -1
+	r.solo = -1
+	r.highlight = nil
+	r.history = history{limit: r.history.limit}
+	r.bumpSceneLocked()
+	// Nothing accumulated so far is of this scene.
+	r.resetLocked()
+	r.accum = accumCache{limit: r.accum.limit}
+
+	return nil
+}
+
+func (r *renderer) renderSettings() renderSettings {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.settings
+}
+
+// updateSettings applies p and restarts accumulation, reallocating the
+// frames if the resolution changed.
+func (r *renderer) updateSettings(p settingsPatch) (renderSettings, error) {
+	r.mu.Lock()
+	settings, err := r.settings.apply(p)
+	if err != nil {
+		r.mu.Unlock()
+		return renderSettings{}, err
+	}
+	r.settings = settings
+	r.camera.AspectRatio = settings.aspectRatio()
+	r.resetLocked()
+	r.mu.Unlock()
+
+	return settings, nil
+}
+
+func (r *renderer) start() {
+	go r.runCommands()
+	if r.frames.limit > 0 {
+		go r.recordFrames()
+	}
+	go func() {
+		for {
+			r.mu.Lock()
+			paused, resumed := r.paused, r.resumed
+			r.mu.Unlock()
+
+			if paused {
+				select {
+				case <-resumed:
+				case <-r.ctx.Done():
+					return
+				}
+				continue
+			}
+
+			select {
+			case <-r.ctx.Done():
+				return
+			default:
+			}
+			r.render()
+		}
+	}()
+}
+
+// done is closed once the renderer has been shut down.
+func (r *renderer) done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// close stops the render loop and cancels whatever it is rendering.
+func (r *renderer) close() {
+	r.cancel()
+}
+
+// pause stops rendering without losing what has been accumulated so far. The
+// in-flight render is cancelled and dropped, resume picks up from the last
+// completed pass.
+func (r *renderer) pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.paused {
+		return
+	}
+	r.paused = true
+	r.resumed = make(chan struct{})
+	old := r.gen
+	r.gen = newGeneration(r.ctx, old.id+1, old.scene, old.gui)
+	r.gen.key = old.key
+	r.gen.carry(old)
+	old.cancel()
+}
+
+func (r *renderer) resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.paused {
+		return
+	}
+	r.paused = false
+	close(r.resumed)
+}
+
+func (r *renderer) isPaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+func (r *renderer) render() {
+	r.mu.Lock()
+	if r.resetPending {
+		r.resetLocked()
+	}
+	r.promoteLocked()
+	gen := r.gen
+	if r.targetReachedLocked(gen) {
+		r.mu.Unlock()
+		r.waitTarget(gen)
+		return
+	}
+	settings := r.frameSettings()
+	camera, scene := gen.camera, clipped(r.scene, settings.Clip)
+	rayColorFunc, maxDepth := r.rayColorLocked(camera, settings)
+	r.mu.Unlock()
+
+	rayColorFunc = withLens(rayColorFunc, camera, settings)
+	if settings.Adaptive {
+		r.renderAdaptive(gen, camera, scene, settings, rayColorFunc, maxDepth)
+	} else {
+		r.renderPass(gen, camera, scene, settings, rayColorFunc, maxDepth)
+	}
+	r.renderCompare(gen, camera, scene)
+}
+
+func (r *renderer) renderPass(gen *generation, camera tracer.Camera, scene tracer.Hitter, settings renderSettings, rayColorFunc tracer.RayColorFunc, maxDepth int) {
+	frame := passFrames.get(settings)
+	defer passFrames.put(frame)
+	start := time.Now()
+
+	renderTiles.render(gen.ctx, tileRender{
+		frame:        frame,
+		camera:       camera,
+		scene:        scene,
+		rayColorFunc: rayColorFunc,
+		spp:          settings.SamplesPerPixel,
+		maxDepth:     maxDepth,
+		aggColorFunc: aggColorFor(settings),
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A cancelled pass stopped partway through, its frame is incomplete.
+	if gen.ctx.Err() == nil {
+		gen.scene.Avg(frame)
+		if gen.samples == nil || gen.samples.width != settings.Width || gen.samples.height != settings.Height {
+			gen.samples = newSampleStats(settings.Width, settings.Height)
+		}
+		gen.samples.addFrame(frame)
+		gen.recordPassLocked(settings.Width*settings.Height*settings.SamplesPerPixel, time.Since(start))
+		r.checkConvergedLocked(gen)
+	}
+}
+
+// rayColorLocked is the shading to render with, the active lesson stage
+// overrides the settings. A view mode other than beauty replaces either.
+func (r *renderer) rayColorLocked(camera tracer.Camera, settings renderSettings) (tracer.RayColorFunc, int) {
+	shade, maxDepth := rayColorSolo(settings, r.soloLocked()), settings.MaxDepth
+	if r.lesson >= 0 {
+		shade, maxDepth = lessonStages[r.lesson].RayColorFunc, lessonStages[r.lesson].MaxDepth
+	}
+	return withViewMode(shade, camera, settings, maxDepth), maxDepth
+}
+
+func (r *renderer) renderGUI() {
+	r.mu.Lock()
+	gen, settings, camera := r.gen, r.settings, r.gen.camera
+	var hovered tracer.Hitter
+	if r.hovered >= 0 {
+		hovered = r.objects[r.hovered]
+	}
+	outlines := r.selectionOutlinesLocked()
+	gizmo, hasGizmo := r.gizmoCenterLocked()
+	highlight := r.highlight
+	r.mu.Unlock()
+	lights := r.lights()
+
+	guiFrame := newFrame(settings)
+	pr := newProjector(camera, settings)
+
+	if highlight != nil {
+		pr.box(guiFrame, *highlight, tracer.Color{0, 255, 255})
+	}
+
+	drawLights(guiFrame, pr, lights)
+
+	// An outline that can't be rendered is left out, the rest of the GUI
+	// still is.
+	outline := func(objects tracer.HitterList, color tracer.Color) {
+		edges, err := renderEdges(objects, color, camera, settings, gen.stop)
+		if err != nil {
+			logs.Warn("rendering outline failed", "err", err)
+			return
+		}
+		guiFrame.Blend(edges, 1.0, 1.0)
+	}
+
+	if hovered != nil {
+		outline(tracer.HitterList{hovered}, tracer.Color{255, 255, 0})
+	}
+
+	for _, o := range outlines {
+		outline(o.objects, o.color)
+	}
+
+	if hasGizmo {
+		drawGizmo(guiFrame, pr, gizmo)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if gen.ctx.Err() == nil {
+		gen.gui = guiFrame
+	}
+}
+
+func renderEdges(objects tracer.HitterList, color tracer.Color, camera tracer.Camera, settings renderSettings, stop chan bool) (*tracer.Frame, error) {
+	bvh, err := tracer.NewBVHNode(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	edgesFrame := newFrame(settings)
+	tracer.Render(tracer.RenderSettings{
+		Frame:           edgesFrame,
+		Camera:          camera,
+		Hitter:          bvh,
+		RayColorFunc:    withProjection(tracer.RayBVHID, camera, settings),
+		AggColorFunc:    tracer.EdgeSamples,
+		SamplesPerPixel: 1,
+	}, stop)
+	return tracer.ToEdgesFrame(edgesFrame, color), nil
+}
+
+// pick casts a ray through pixel (x, y) and returns the index of the object
+// hit in r.objects, or -1.
+func (r *renderer) pick(x, y int) int {
+	return r.pickHit(x, y).Object
+}
+
+// pickHit is pick with the details of the hit.
+func (r *renderer) pickHit(x, y int) pickResultPayload {
+	r.mu.Lock()
+	// Pixels are in the frame on screen, which was rendered from the
+	// generation's camera.
+	scene, camera, objects := clipped(r.scene, r.settings.Clip), r.gen.camera, r.objects
+	settings := r.settings
+	r.mu.Unlock()
+
+	ray := pixelRay(camera, settings, x, y)
+	hr := scene.Hit(ray)
+	if !hr.Hit {
+		return pickResultPayload{Object: -1}
+	}
+
+	res := pickResultPayload{
+		Object:   indexOf(objects, hr.BVHNode.Left),
+		Point:    (*[3]float64)(&hr.P),
+		Normal:   (*[3]float64)(&hr.Normal),
+		Distance: hr.P.Vec3().Sub(ray.Origin.Vec3()).Len(),
+	}
+	if m, err := describeMaterial(hr.Material); err == nil {
+		res.Material = &m
+	}
+	return res
+}
+
+// mousemove hovers the object under (x, y) and returns what's there.
+func (r *renderer) mousemove(x, y int) pickResultPayload {
+	res := r.pickHit(x, y)
+
+	r.mu.Lock()
+	r.hovered = res.Object
+	res.Selection = r.selectionLocked()
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return res
+}
+
+// mouseclick selects the object under (x, y) and returns what was hit. With
+// add it's toggled in and out of the selection instead of replacing it.
+func (r *renderer) mouseclick(x, y int, add bool) pickResultPayload {
+	res := r.pickHit(x, y)
+
+	r.mu.Lock()
+	switch {
+	case !add:
+		r.selectLocked(res.Object)
+	case res.Object >= 0:
+		r.toggleSelectedLocked(res.Object)
+	}
+	res.Selection = r.selectionLocked()
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return res
+}
+
+func (r *renderer) lessonStage() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lesson
+}
+
+func (r *renderer) setLessonStage(stage int) {
+	if stage >= len(lessonStages) {
+		stage = len(lessonStages) - 1
+	}
+	if stage < -1 {
+		stage = -1
+	}
+	r.mu.Lock()
+	r.lesson = stage
+	r.mu.Unlock()
+}
+
+// reset starts accumulating over, dropping the accumulation cache too:
+// whoever asks for it knows of a change the state key doesn't cover, like
+// a replaced environment map.
+func (r *renderer) reset() {
+	r.mu.Lock()
+	r.accum = accumCache{limit: r.accum.limit}
+	r.restartLocked(false)
+	r.mu.Unlock()
+}
+
+// resetLocked cancels the current generation and starts a new one, holding
+// background jobs back while the first passes come in. The new one starts
+// with empty frames unless the accumulation cache has the state's. A paused
+// renderer stays paused.
+func (r *renderer) resetLocked() {
+	r.restartLocked(true)
+}
+
+// restartLocked is resetLocked, going through the accumulation cache only
+// if cached. Restarting on the same state is only ever done to start over,
+// so what it accumulated is neither stashed nor restored.
+func (r *renderer) restartLocked(cached bool) {
+	r.lastReset, r.resetPending = time.Now(), false
+	renderTiles.interacted()
+	old := r.gen
+	key := r.stateKeyLocked()
+	cached = cached && key != old.key
+	if cached {
+		r.stashLocked(old)
+	}
+	r.gen = newGeneration(r.ctx, old.id+1, newFrame(r.frameSettings()), newFrame(r.settings))
+	r.gen.key = key
+	r.gen.camera = r.camera
+	if cached {
+		r.restoreAccumLocked(r.gen)
+	}
+	old.cancel()
+}
+
+// Image composites the GUI overlay over the scene frame, denoised if the
+// settings ask for it, and split with the comparison while there is one.
+func (r *renderer) Image() image.Image {
+	return tracer.NewPPM(r.composite(true))
+}
+
+// composite is Image before it's quantized to 8 bits, leaving the GUI
+// overlay out unless gui, for clients that are sent the overlay on its own.
+func (r *renderer) composite(gui bool) *tracer.Frame {
+	denoised := r.denoisedScene()
+	compared, split := r.compareScene()
+
+	r.mu.Lock()
+	scene := r.gen.scene
+	if denoised != nil {
+		scene = denoised
+	}
+	scene = scaleFrame(scene, r.settings.Width, r.settings.Height)
+	if compared != nil {
+		scene = splitFrames(scene, scaleFrame(compared, r.settings.Width, r.settings.Height), split)
+	}
+	frame := newFrame(r.settings)
+	if gui {
+		frame.Blend(r.gen.gui, 1.0, 1.0)
+	}
+	frame.Blend(scene, 1.0, 1.0)
+	r.mu.Unlock()
+
+	return frame
+}
+
+func (r *renderer) Encode(w io.Writer, enc encoder) error {
+	return enc.Encode(w, r.Image())
+}
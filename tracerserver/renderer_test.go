@@ -0,0 +1,29 @@
+package tracerserver
+
+import "testing"
+
+func TestResetStartsOver(t *testing.T) {
+	renderTiles = newTilePool(1)
+	defer renderTiles.stop()
+	r := newRenderer()
+	defer r.cancel()
+	if err := r.loadScene(defaultScene); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	r.gen.recordPassLocked(1000, 1)
+	r.mu.Unlock()
+
+	// Same camera and settings, nothing for the cache to tell apart.
+	r.reset()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gen.passes != 0 || r.gen.rays != 0 {
+		t.Errorf("after reset got %d passes and %d rays, want 0", r.gen.passes, r.gen.rays)
+	}
+	if r.samplesPerPixelLocked(r.gen) != 0 {
+		t.Errorf("after reset got %v samples per pixel, want 0", r.samplesPerPixelLocked(r.gen))
+	}
+}
@@ -0,0 +1,56 @@
+package tracerserver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// renderOnce renders scene at the configured defaults, samples per pixel
+// counting the samples of the whole render rather than of a pass, and
+// writes it to path as a PNG or, linear, as an EXR or HDR depending on its
+// extension.
+func renderOnce(scene sceneDesc, path string) error {
+	var encode func(w io.Writer, frame *tracer.Frame) error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".png":
+		encode = func(w io.Writer, frame *tracer.Frame) error {
+			return (pngEncoder{}).Encode(w, tracer.NewPPM(frame))
+		}
+	case ".exr":
+		encode = encodeEXR
+	case ".hdr":
+		encode = encodeHDR
+	default:
+		return fmt.Errorf("%s: unknown output format %q, want .png, .exr or .hdr", path, ext)
+	}
+
+	j, err := jobRequest{}.job(scene)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	j.run()
+	if j.err != nil {
+		return j.err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, j.frame); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logs.Info("render-once: wrote image", "path", path, "width", j.settings.Width, "height", j.settings.Height, "spp", j.settings.SamplesPerPixel, "took", time.Since(start).Round(time.Millisecond))
+	return nil
+}
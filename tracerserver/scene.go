@@ -0,0 +1,189 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ghostec/tracer"
+)
+
+type sceneDesc struct {
+	Camera    cameraDesc     `json:"camera"`
+	Spheres   []sphereDesc   `json:"spheres"`
+	Triangles []triangleDesc `json:"triangles,omitempty"`
+}
+
+type cameraDesc struct {
+	AspectRatio float64    `json:"aspect_ratio"`
+	VFoV        float64    `json:"vfov"`
+	LookFrom    [3]float64 `json:"look_from"`
+	LookAt      [3]float64 `json:"look_at"`
+	VUp         [3]float64 `json:"vup"`
+}
+
+type sphereDesc struct {
+	objectMeta
+	Center   [3]float64   `json:"center"`
+	Radius   float64      `json:"radius"`
+	Material materialDesc `json:"material"`
+}
+
+// triangleDesc is a triangle, with per vertex normals if it's smooth shaded.
+type triangleDesc struct {
+	objectMeta
+	Vertices [3][3]float64  `json:"vertices"`
+	Normals  *[3][3]float64 `json:"normals,omitempty"`
+	Material materialDesc   `json:"material"`
+}
+
+var defaultScene = sceneDesc{
+	Camera: cameraDesc{
+		AspectRatio: 16.0 / 9.0,
+		VFoV:        90,
+		LookFrom:    [3]float64{-0, 2, 1},
+		LookAt:      [3]float64{0, 0, -1},
+		VUp:         [3]float64{0, 1, 0},
+	},
+	Spheres: []sphereDesc{
+		{Center: [3]float64{0, -100.5, -1}, Radius: 100, Material: materialDesc{Kind: "lambertian", Albedo: [3]float64{0.8, 0.8, 0}}},
+		{Center: [3]float64{0, 0, -1}, Radius: 0.5, Material: materialDesc{Kind: "lambertian", Albedo: [3]float64{0.1, 0.2, 0.5}}},
+		{Center: [3]float64{-1, 0, -1}, Radius: 0.5, Material: materialDesc{Kind: "dielectric", RefractiveIndex: 1.5}},
+		{Center: [3]float64{-1, 0, -1}, Radius: -0.48, Material: materialDesc{Kind: "dielectric", RefractiveIndex: 1.5}},
+		{Center: [3]float64{1, 0, -1}, Radius: 0.5, Material: materialDesc{Kind: "metal", Albedo: [3]float64{0.8, 0.6, 0.2}}},
+	},
+}
+
+func decodeScene(r io.Reader) (sceneDesc, error) {
+	var desc sceneDesc
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&desc); err != nil {
+		return sceneDesc{}, err
+	}
+	return desc, nil
+}
+
+func readSceneFile(path string) (sceneDesc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return sceneDesc{}, err
+	}
+	defer f.Close()
+	return decodeScene(f)
+}
+
+func (d cameraDesc) Camera() tracer.Camera {
+	cam := tracer.Camera{
+		AspectRatio: d.AspectRatio,
+		VFoV:        d.VFoV,
+		LookFrom:    tracer.Point3(d.LookFrom),
+		LookAt:      tracer.Point3(d.LookAt),
+		VUp:         tracer.Vec3(d.VUp),
+	}
+	if cam.AspectRatio == 0 {
+		cam.AspectRatio = 16.0 / 9.0
+	}
+	if cam.VUp == (tracer.Vec3{}) {
+		cam.VUp = tracer.Vec3{0, 1, 0}
+	}
+	return cam
+}
+
+func (d sceneDesc) Objects() (tracer.HitterList, error) {
+	if len(d.Spheres)+len(d.Triangles) == 0 {
+		return nil, errors.New("scene has no objects")
+	}
+
+	l := make(tracer.HitterList, 0, len(d.Spheres)+len(d.Triangles))
+	for i, s := range d.Spheres {
+		h, err := s.Hitter()
+		if err != nil {
+			return nil, fmt.Errorf("sphere %d: %w", i, err)
+		}
+		l = append(l, h)
+	}
+	for i, t := range d.Triangles {
+		h, err := t.Hitter()
+		if err != nil {
+			return nil, fmt.Errorf("triangle %d: %w", i, err)
+		}
+		l = append(l, h)
+	}
+	return l, nil
+}
+
+// meta is the names and tags of the objects, in the order Objects builds
+// them.
+func (d sceneDesc) meta() []objectMeta {
+	meta := make([]objectMeta, 0, len(d.Spheres)+len(d.Triangles))
+	for _, s := range d.Spheres {
+		meta = append(meta, s.objectMeta)
+	}
+	for _, t := range d.Triangles {
+		meta = append(meta, t.objectMeta)
+	}
+	return meta
+}
+
+func (s sphereDesc) Hitter() (tracer.Hitter, error) {
+	if err := s.objectMeta.validate(); err != nil {
+		return nil, err
+	}
+	m, err := s.Material.Material()
+	if err != nil {
+		return nil, err
+	}
+	return tracer.Sphere{Center: tracer.Point3(s.Center), Radius: s.Radius, Material: m}, nil
+}
+
+func (t triangleDesc) Hitter() (tracer.Hitter, error) {
+	if err := t.objectMeta.validate(); err != nil {
+		return nil, err
+	}
+	m, err := t.Material.Material()
+	if err != nil {
+		return nil, err
+	}
+	tr := triangle{Material: m}
+	for i, v := range t.Vertices {
+		tr.V[i] = tracer.Point3(v)
+	}
+	if t.Normals != nil {
+		tr.Smooth = true
+		for i, n := range t.Normals {
+			tr.N[i] = tracer.Vec3(n).Unit()
+		}
+	}
+	return tr, nil
+}
+
+func (d sceneDesc) Build() (*tracer.BVHNode, tracer.Camera, error) {
+	l, err := d.Objects()
+	if err != nil {
+		return nil, tracer.Camera{}, err
+	}
+
+	bvh, err := buildBVH(l)
+	if err != nil {
+		return nil, tracer.Camera{}, err
+	}
+
+	return bvh, d.Camera.Camera(), nil
+}
+
+// buildBVH builds over a copy of objects, NewBVHNode reorders its input.
+func buildBVH(objects tracer.HitterList) (*tracer.BVHNode, error) {
+	return tracer.NewBVHNode(append(tracer.HitterList(nil), objects...))
+}
+
+func indexOf(objects tracer.HitterList, h tracer.Hitter) int {
+	for i, o := range objects {
+		if o == h {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,219 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+var sceneNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func describeCamera(cam tracer.Camera) cameraDesc {
+	return cameraDesc{
+		AspectRatio: cam.AspectRatio,
+		VFoV:        cam.VFoV,
+		LookFrom:    [3]float64(cam.LookFrom),
+		LookAt:      [3]float64(cam.LookAt),
+		VUp:         [3]float64(cam.VUp),
+	}
+}
+
+func describeSphere(s tracer.Sphere) (sphereDesc, error) {
+	m, err := describeMaterial(s.Material)
+	if err != nil {
+		return sphereDesc{}, err
+	}
+	return sphereDesc{Center: [3]float64(s.Center), Radius: s.Radius, Material: m}, nil
+}
+
+func describeTriangle(t triangle) (triangleDesc, error) {
+	m, err := describeMaterial(t.Material)
+	if err != nil {
+		return triangleDesc{}, err
+	}
+	desc := triangleDesc{Material: m}
+	for i, v := range t.V {
+		desc.Vertices[i] = [3]float64(v)
+	}
+	if t.Smooth {
+		var normals [3][3]float64
+		for i, n := range t.N {
+			normals[i] = [3]float64(n)
+		}
+		desc.Normals = &normals
+	}
+	return desc, nil
+}
+
+// sceneDesc describes the renderer's scene as edited so far, in the same
+// form scenes are loaded from.
+func (r *renderer) sceneDesc() (sceneDesc, error) {
+	r.mu.Lock()
+	objects, meta, cam := r.objects, r.meta, r.camera
+	r.mu.Unlock()
+
+	desc := sceneDesc{Camera: describeCamera(cam)}
+	for i, h := range objects {
+		var err error
+		switch o := h.(type) {
+		case tracer.Sphere:
+			var s sphereDesc
+			if s, err = describeSphere(o); err == nil {
+				s.objectMeta = meta[i]
+				desc.Spheres = append(desc.Spheres, s)
+			}
+		case triangle:
+			var t triangleDesc
+			if t, err = describeTriangle(o); err == nil {
+				t.objectMeta = meta[i]
+				desc.Triangles = append(desc.Triangles, t)
+			}
+		default:
+			err = fmt.Errorf("can't describe %T", h)
+		}
+		if err != nil {
+			return sceneDesc{}, fmt.Errorf("object %d: %w", i, err)
+		}
+	}
+	return desc, nil
+}
+
+// sceneStore keeps named scenes as JSON files in dir.
+type sceneStore struct {
+	dir string
+}
+
+func (s sceneStore) path(name string) (string, error) {
+	if !sceneNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid scene name %q", name)
+	}
+	return filepath.Join(s.dir, name+".json"), nil
+}
+
+func (s sceneStore) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if name := strings.TrimSuffix(e.Name(), ".json"); !e.IsDir() && name != e.Name() && sceneNameRe.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// save writes desc next to its final path and renames it into place, so a
+// crash never leaves a half written scene behind.
+func (s sceneStore) save(name string, desc sceneDesc) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(desc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s sceneStore) load(name string) (sceneDesc, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return sceneDesc{}, err
+	}
+	return readSceneFile(path)
+}
+
+var scenes sceneStore
+
+// scenesHandler serves the scene store:
+//
+//	GET  /scenes              list saved scene names
+//	POST /scenes/{name}/save  save the session's scene and camera
+//	POST /scenes/{name}/load  load a saved scene into every session
+func scenesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/scenes"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		names, err := scenes.list()
+		if err != nil {
+			requestLog(r).Error("listing scenes failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || (parts[1] != "save" && parts[1] != "load") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := parts[0]
+	if !sceneNameRe.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid scene name %q", name), http.StatusBadRequest)
+		return
+	}
+
+	switch parts[1] {
+	case "save":
+		rend, ok := requestRenderer(w, r)
+		if !ok {
+			return
+		}
+		desc, err := rend.sceneDesc()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := scenes.save(name, desc); err != nil {
+			requestLog(r).Error("saving scene failed", "scene", name, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "load":
+		desc, err := scenes.load(name)
+		if os.IsNotExist(err) {
+			http.Error(w, "scene not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := sessions.loadScene(desc); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package tracerserver
+
+import (
+	"math"
+
+	"github.com/ghostec/tracer"
+)
+
+// marqueeMaxRays caps the rays a marquee casts, big rectangles are sampled
+// on a coarser grid.
+const marqueeMaxRays = 4096
+
+// selectionColors outline the selected objects, the last one selected in
+// the first color and the others cycling through the rest.
+var selectionColors = []tracer.Color{
+	{255, 0, 0},
+	{255, 128, 0},
+	{255, 0, 255},
+	{0, 255, 0},
+	{0, 128, 255},
+	{128, 0, 255},
+}
+
+// outline is objects to draw the edges of in color.
+type outline struct {
+	objects tracer.HitterList
+	color   tracer.Color
+}
+
+// selectLocked makes i the only selected object, or clears the selection
+// if it's -1.
+func (r *renderer) selectLocked(i int) {
+	r.selected, r.selection = i, nil
+	if i >= 0 {
+		r.selection = []int{i}
+	}
+}
+
+// toggleSelectedLocked adds i to the selection, or takes it out if it was
+// already in it.
+func (r *renderer) toggleSelectedLocked(i int) {
+	for j, s := range r.selection {
+		if s == i {
+			r.selection = append(r.selection[:j:j], r.selection[j+1:]...)
+			r.selected = -1
+			if n := len(r.selection); n > 0 {
+				r.selected = r.selection[n-1]
+			}
+			return
+		}
+	}
+	r.selection = append(r.selection, i)
+	r.selected = i
+}
+
+// selectionLocked is a copy of the selection, empty rather than nil so it
+// encodes as [].
+func (r *renderer) selectionLocked() []int {
+	return append([]int{}, r.selection...)
+}
+
+// selectionOutlinesLocked groups the selected objects by the color they're
+// outlined in, so there's one edge render per color however many objects
+// are selected.
+func (r *renderer) selectionOutlinesLocked() []outline {
+	var outlines []outline
+	for i := len(r.selection) - 1; i >= 0; i-- {
+		c := (len(r.selection) - 1 - i) % len(selectionColors)
+		if c == len(outlines) {
+			outlines = append(outlines, outline{color: selectionColors[c]})
+		}
+		outlines[c].objects = append(outlines[c].objects, r.objects[r.selection[i]])
+	}
+	return outlines
+}
+
+// marquee selects the objects hit by a grid of rays cast inside the
+// rectangle between (x0, y0) and (x1, y1), adding them to the selection
+// with add. It returns the selection with the last object selected as the
+// pick's object.
+func (r *renderer) marquee(x0, y0, x1, y1 int, add bool) pickResultPayload {
+	r.mu.Lock()
+	scene, camera, objects := clipped(r.scene, r.settings.Clip), r.gen.camera, r.objects
+	settings := r.settings
+	r.mu.Unlock()
+
+	clamp := func(v, n int) int {
+		return int(math.Max(0, math.Min(float64(v), float64(n-1))))
+	}
+	x0, x1 = clamp(x0, settings.Width), clamp(x1, settings.Width)
+	y0, y1 = clamp(y0, settings.Height), clamp(y1, settings.Height)
+	if x0 > x1 {
+		x0, x1 = x1, x0
+	}
+	if y0 > y1 {
+		y0, y1 = y1, y0
+	}
+	area := float64((x1 - x0 + 1) * (y1 - y0 + 1))
+	step := int(math.Max(1, math.Ceil(math.Sqrt(area/marqueeMaxRays))))
+
+	var hits []int
+	seen := map[int]bool{}
+	for y := y0; y <= y1; y += step {
+		for x := x0; x <= x1; x += step {
+			hr := scene.Hit(pixelRay(camera, settings, x, y))
+			if !hr.Hit {
+				continue
+			}
+			if i := indexOf(objects, hr.BVHNode.Left); i >= 0 && !seen[i] {
+				seen[i] = true
+				hits = append(hits, i)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	if !add {
+		r.selectLocked(-1)
+	}
+	for _, i := range hits {
+		// An edit may have removed objects since the rays were cast.
+		if i < len(r.objects) && !r.isSelectedLocked(i) {
+			r.toggleSelectedLocked(i)
+		}
+	}
+	res := pickResultPayload{Object: r.selected, Selection: r.selectionLocked()}
+	r.mu.Unlock()
+
+	r.renderGUI()
+	return res
+}
+
+func (r *renderer) isSelectedLocked(i int) bool {
+	for _, s := range r.selection {
+		if s == i {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package tracerserver
+
+import "testing"
+
+func TestMarquee(t *testing.T) {
+	renderTiles = newTilePool(1)
+	defer renderTiles.stop()
+	r := newRenderer()
+	defer r.cancel()
+	if err := r.loadScene(defaultScene); err != nil {
+		t.Fatal(err)
+	}
+	s := r.renderSettings()
+
+	// Corners in either order, and off the frame, are clamped to it. The
+	// middle sphere is in front of the camera.
+	res := r.marquee(s.Width+100, s.Height+100, -50, -50, false)
+	if !contains(res.Selection, 1) {
+		t.Fatalf("marquee over the whole frame selected %v, want the middle sphere 1 among them", res.Selection)
+	}
+
+	r.mu.Lock()
+	r.selectLocked(4)
+	r.mu.Unlock()
+	res = r.marquee(s.Width/2, s.Height/2, s.Width/2, s.Height/2, true)
+	if !contains(res.Selection, 4) || !contains(res.Selection, 1) {
+		t.Errorf("adding the middle sphere to sphere 4 selected %v", res.Selection)
+	}
+	res = r.marquee(s.Width/2, s.Height/2, s.Width/2, s.Height/2, false)
+	if len(res.Selection) != 1 || res.Object != 1 {
+		t.Errorf("replacing the selection with the middle sphere selected %v, object %d", res.Selection, res.Object)
+	}
+}
+
+func contains(l []int, v int) bool {
+	for _, x := range l {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,417 @@
+// Package tracerserver serves an interactive path tracer: a browser viewer
+// streamed over websockets, the scene, frames and render jobs over HTTP and
+// a gRPC service driving the same sessions.
+//
+// A Server keeps its state in package variables, so a process runs one of
+// them at a time. Shutdown puts them back the way they were before
+// NewServer, after which another can be created.
+package tracerserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghostec/tracer"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+)
+
+var errServerRunning = errors.New("tracerserver: a Server already exists in this process")
+
+// Options configure a Server. Start from DefaultOptions, the zero value
+// turns most things off.
+type Options struct {
+	// Scene is the JSON scene description sessions start from, the built
+	// in one if it's empty.
+	Scene []byte
+	// Environment is an equirectangular HDR, PNG or JPEG image to register
+	// as an environment and light new sessions with, if it's set.
+	Environment string
+	// Shared attaches every websocket client to one renderer session.
+	Shared bool
+	// SessionTTL is how long a websocket client can reconnect for with its
+	// session token and carry on where it left off. 0 closes sessions as
+	// soon as their connection drops.
+	SessionTTL time.Duration
+	// ScenesDir is where named scenes are saved to and loaded from.
+	ScenesDir string
+	// History is the undo steps kept per session, FrameHistory the frames
+	// kept to scrub back to, FrameHistoryInterval apart. 0 disables either.
+	History              int
+	FrameHistory         int
+	FrameHistoryInterval time.Duration
+	// JobWorkers is how many render jobs, snapshots included, run at once.
+	// RenderWorkers is how many goroutines render tiles for every session
+	// and job.
+	JobWorkers    int
+	RenderWorkers int
+	// SaveOnExit is the scene name Shutdown saves each session as, nothing
+	// is saved if it's empty.
+	SaveOnExit string
+	// CameraTransition is how long moving to a camera preset animates for,
+	// 0 to jump.
+	CameraTransition time.Duration
+	// RateLimit scales the per connection websocket message rate limits, 0
+	// disables them.
+	RateLimit float64
+	// StaticDir serves the frontend from a directory instead of the one
+	// built in.
+	StaticDir string
+	// Debug serves net/http/pprof and renderer internals under /debug/ to
+	// admins.
+	Debug bool
+	// TrustProxy honours X-Forwarded-Host and -For. AllowedOrigins are the
+	// comma separated websocket origins allowed besides the server's own, *
+	// for any.
+	TrustProxy     bool
+	AllowedOrigins string
+	// AuthTokens is a file of "token role [name]" lines. Anyone is an admin
+	// if it's empty.
+	AuthTokens string
+	// Webhooks are URLs every event is POSTed to as JSON, see Event.
+	Webhooks []string
+	// ConvergedThreshold is the share of converged pixels, between 0 and 1,
+	// a render fires EventConverged at. 0 never fires it.
+	ConvergedThreshold float64
+
+	Reloadable
+}
+
+// Reloadable are the options Server.Reload changes on a running Server.
+// Sessions already open keep their render settings.
+type Reloadable struct {
+	// Width, Height, SamplesPerPixel and MaxDepth are the render settings
+	// new sessions and jobs start with. A positive AspectRatio derives the
+	// height from the width.
+	Width           int
+	Height          int
+	AspectRatio     float64
+	SamplesPerPixel int
+	MaxDepth        int
+	// FrameInterval is the default time between frames sent to clients.
+	FrameInterval time.Duration
+	// MaxConnections caps concurrent websocket connections, 0 for no limit.
+	MaxConnections int
+	// LogLevel is the least severe log line written: debug, info, warn or
+	// error. LogJSON writes them as JSON objects instead of text.
+	LogLevel string
+	LogJSON  bool
+}
+
+// DefaultOptions are the options the tracer-server command starts from.
+func DefaultOptions() Options {
+	return Options{
+		SessionTTL:           time.Minute,
+		ScenesDir:            "scenes",
+		History:              defaultHistoryLimit,
+		FrameHistory:         defaultFrameHistory,
+		FrameHistoryInterval: defaultFrameHistoryInterval,
+		JobWorkers:           1,
+		RenderWorkers:        runtime.NumCPU(),
+		CameraTransition:     time.Second,
+		RateLimit:            1,
+		ConvergedThreshold:   0.99,
+		Reloadable: Reloadable{
+			Width:           defaultSettings.Width,
+			Height:          defaultSettings.Height,
+			SamplesPerPixel: defaultSettings.SamplesPerPixel,
+			MaxDepth:        defaultSettings.MaxDepth,
+			FrameInterval:   defaultFrameInterval,
+			LogLevel:        "info",
+		},
+	}
+}
+
+// options are the running Server's.
+var options Options
+
+var serverCreated int32
+
+// startTracer starts the tracer's renderer with the first Server. It has
+// no way to stop, later Servers share it.
+var startTracer sync.Once
+
+// Server is the tracer server. Its handlers are mounted on an HTTP server
+// with Mount or Handler, Shutdown stops it.
+type Server struct {
+	grpc *grpc.Server
+}
+
+// NewServer validates opts and sets a Server up with them. Nothing renders
+// until the first client connects. If opts don't validate nothing is set
+// up.
+func NewServer(opts Options) (*Server, error) {
+	if !atomic.CompareAndSwapInt32(&serverCreated, 0, 1) {
+		return nil, errServerRunning
+	}
+	s, err := newServer(opts)
+	if err != nil {
+		atomic.StoreInt32(&serverCreated, 0)
+	}
+	return s, err
+}
+
+func newServer(opts Options) (*Server, error) {
+	switch {
+	case opts.RenderWorkers < 1:
+		return nil, errors.New("render workers must be at least 1")
+	case opts.JobWorkers < 1:
+		return nil, errors.New("job workers must be at least 1")
+	case opts.FrameHistory > 0 && opts.FrameHistoryInterval <= 0:
+		return nil, errors.New("frame history interval must be positive")
+	case opts.SaveOnExit != "" && !sceneNameRe.MatchString(opts.SaveOnExit):
+		return nil, fmt.Errorf("save on exit: invalid scene name %q", opts.SaveOnExit)
+	case opts.ConvergedThreshold < 0 || opts.ConvergedThreshold > 1:
+		return nil, errors.New("converged threshold must be between 0 and 1")
+	}
+	if opts.StaticDir != "" {
+		if fi, err := os.Stat(opts.StaticDir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("static dir: %s is not a directory", opts.StaticDir)
+		}
+	}
+
+	desc := defaultScene
+	if len(opts.Scene) > 0 {
+		var err error
+		if desc, err = decodeScene(bytes.NewReader(opts.Scene)); err != nil {
+			return nil, fmt.Errorf("scene: %w", err)
+		}
+	}
+	if _, _, err := desc.Build(); err != nil {
+		return nil, fmt.Errorf("scene: %w", err)
+	}
+	base := defaultSettings
+	var env *envMap
+	if opts.Environment != "" {
+		name, m, err := readEnvironmentFile(opts.Environment)
+		if err != nil {
+			return nil, fmt.Errorf("environment: %w", err)
+		}
+		base.Environment, env = name, m
+	}
+	defaults, level, err := opts.Reloadable.check(base)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []*webhook
+	for _, u := range opts.Webhooks {
+		w, err := newWebhook(u)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks: %w", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	var a *authenticator
+	if opts.AuthTokens != "" {
+		if a, err = loadTokens(opts.AuthTokens); err != nil {
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	// Every option checked out, nothing global changes before here.
+	startTracer.Do(func() { tracer.DefaultRenderer.Start() })
+	if env != nil {
+		environments.set(base.Environment, env)
+	}
+	clients.reopen()
+	opts.Reloadable.apply(defaults, level)
+	options = opts
+	auth = a
+	renderTiles = newTilePool(opts.RenderWorkers)
+	proxy = newProxyConfig(opts.TrustProxy, opts.AllowedOrigins)
+	sessions = newSessionManager(opts.Shared, opts.History, opts.FrameHistory, opts.FrameHistoryInterval, opts.SessionTTL, desc)
+	jobs = newJobQueue(opts.JobWorkers)
+	scenes = sceneStore{dir: opts.ScenesDir}
+	for _, w := range webhooks {
+		hooks.addWebhook(w)
+	}
+	return &Server{grpc: newGRPCServer()}, nil
+}
+
+// Reload puts r into effect.
+func (s *Server) Reload(r Reloadable) error {
+	defaults, level, err := r.check(currentDefaults())
+	if err != nil {
+		return err
+	}
+	r.apply(defaults, level)
+	return nil
+}
+
+// check validates r, returning the defaults it makes of base and its log
+// level.
+func (r Reloadable) check(base renderSettings) (renderSettings, logLevel, error) {
+	defaults := base
+	defaults.Width, defaults.Height, defaults.SamplesPerPixel, defaults.MaxDepth = r.Width, r.Height, r.SamplesPerPixel, r.MaxDepth
+	switch {
+	case r.AspectRatio < 0:
+		return renderSettings{}, 0, errors.New("aspect ratio must not be negative")
+	case r.AspectRatio > 0:
+		defaults = defaults.withAspectRatio(r.AspectRatio)
+	}
+	if err := defaults.validate(); err != nil {
+		return renderSettings{}, 0, err
+	}
+	if min := time.Second / maxFPS; r.FrameInterval < min || r.FrameInterval > time.Second {
+		return renderSettings{}, 0, fmt.Errorf("frame interval must be between %v and 1s, got %v", min, r.FrameInterval)
+	}
+	if r.MaxConnections < 0 {
+		return renderSettings{}, 0, fmt.Errorf("max connections must not be negative, got %d", r.MaxConnections)
+	}
+	level, err := parseLogLevel(r.LogLevel)
+	if err != nil {
+		return renderSettings{}, 0, err
+	}
+	return defaults, level, nil
+}
+
+// apply puts r into effect, with the defaults and log level check made of
+// it.
+func (r Reloadable) apply(defaults renderSettings, level logLevel) {
+	setDefaults(defaults)
+	setFrameInterval(r.FrameInterval)
+	clients.setMax(r.MaxConnections)
+	configureLogs(level, r.LogJSON)
+}
+
+// Mount serves the Server's handlers from mux under prefix, "" for the
+// root.
+func (s *Server) Mount(mux *http.ServeMux, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		s.mount(mux)
+		return
+	}
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, s.Handler()))
+}
+
+// Handler serves the Server's handlers from the root.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.mount(mux)
+	return mux
+}
+
+func (s *Server) mount(mux *http.ServeMux) {
+	mux.HandleFunc("/ws", ws)
+	mux.HandleFunc("/scene", requireRole(roleEditor, roleEditor, scene))
+	mux.HandleFunc("/scene/tree", requireRole(roleViewer, roleEditor, sceneTree))
+	mux.HandleFunc("/scene/objects", requireRole(roleViewer, roleEditor, sceneObjects))
+	mux.HandleFunc("/scene/meshes", requireRole(roleEditor, roleEditor, meshes))
+	mux.HandleFunc("/scene/generate", requireRole(roleEditor, roleEditor, generate))
+	mux.HandleFunc("/scenes", requireRole(roleViewer, roleEditor, scenesHandler))
+	mux.HandleFunc("/scenes/", requireRole(roleViewer, roleEditor, scenesHandler))
+	mux.HandleFunc("/environments", requireRole(roleViewer, roleEditor, environmentsHandler))
+	mux.HandleFunc("/environments/", requireRole(roleViewer, roleEditor, environmentsHandler))
+	mux.HandleFunc("/assets", requireRole(roleViewer, roleEditor, assetsHandler))
+	mux.HandleFunc("/assets/", requireRole(roleViewer, roleEditor, assetsHandler))
+	mux.HandleFunc("/settings", requireRole(roleViewer, roleAdmin, settings))
+	mux.HandleFunc("/frame.png", requireRole(roleViewer, roleViewer, frame))
+	mux.HandleFunc("/frame.exr", requireRole(roleViewer, roleViewer, linearFrame("exr")))
+	mux.HandleFunc("/frame.hdr", requireRole(roleViewer, roleViewer, linearFrame("hdr")))
+	mux.HandleFunc("/export", requireRole(roleViewer, roleViewer, export))
+	mux.HandleFunc("/stream.mjpeg", requireRole(roleViewer, roleViewer, mjpeg))
+	mux.HandleFunc("/snapshot", requireRole(roleAdmin, roleAdmin, snapshot))
+	mux.HandleFunc("/turntable", requireRole(roleAdmin, roleAdmin, turntable))
+	mux.HandleFunc("/recordings", requireRole(roleViewer, roleEditor, recordingsHandler))
+	mux.HandleFunc("/recordings/", requireRole(roleViewer, roleEditor, recordingsHandler))
+	mux.HandleFunc("/cameras", requireRole(roleViewer, roleEditor, camerasHandler))
+	mux.HandleFunc("/cameras/", requireRole(roleViewer, roleEditor, camerasHandler))
+	mux.HandleFunc("/jobs", requireRole(roleAdmin, roleAdmin, jobsHandler))
+	mux.HandleFunc("/jobs/", requireRole(roleAdmin, roleAdmin, jobsHandler))
+	mux.HandleFunc("/webrtc/offer", requireRole(roleViewer, roleViewer, webrtcOffer))
+	mux.HandleFunc("/benchmark", requireRole(roleAdmin, roleAdmin, benchmark))
+	mux.HandleFunc("/status", requireRole(roleAdmin, roleAdmin, statusHandler))
+	mux.HandleFunc("/metrics", requireRole(roleAdmin, roleAdmin, promhttp.Handler().ServeHTTP))
+	mountDebug(mux)
+	mux.Handle("/", frontend())
+}
+
+// ServeGRPC serves the gRPC service on addr until Shutdown.
+func (s *Server) ServeGRPC(addr string) error {
+	return serveGRPC(s.grpc, addr)
+}
+
+// RegisterScene saves the JSON scene description read from r as name, for
+// clients to load from the scene store.
+func (s *Server) RegisterScene(name string, r io.Reader) error {
+	desc, err := decodeScene(r)
+	if err != nil {
+		return err
+	}
+	if _, _, err := desc.Build(); err != nil {
+		return err
+	}
+	return scenes.save(name, desc)
+}
+
+// LoadScene loads the JSON scene description read from r into every
+// session, and new sessions start from it.
+func (s *Server) LoadScene(r io.Reader) error {
+	desc, err := decodeScene(r)
+	if err != nil {
+		return err
+	}
+	return sessions.loadScene(desc)
+}
+
+// RenderOnce renders the scene new sessions start from at the default
+// settings, SamplesPerPixel counting the samples of the whole render, to
+// path as a PNG, EXR or HDR depending on its extension.
+func (s *Server) RenderOnce(path string) error {
+	return renderOnce(sessions.currentScene(), path)
+}
+
+// Benchmark runs the benchmark GET /benchmark runs with its defaults and
+// writes its JSON result to w.
+func (s *Server) Benchmark(ctx context.Context, w io.Writer) error {
+	res, err := runBenchmark(ctx, runtime.GOMAXPROCS(0), defaultBenchSamples)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
+
+// Shutdown closes the websockets, stops the scene watches, sessions, jobs,
+// recordings and gRPC service, saving the sessions first with Options.SaveOnExit.
+// The HTTP server serving the handlers is the caller's to shut down: it
+// doesn't know about the websockets, they're hijacked. Everything NewServer
+// set up goes with it, the hooks registered with On and the environments
+// included, and NewServer can set up another Server afterwards.
+func (s *Server) Shutdown(ctx context.Context) {
+	closeSceneWatchers()
+	shutdown(ctx, s.grpc, options.SaveOnExit)
+	s.reset()
+	atomic.StoreInt32(&serverCreated, 0)
+}
+
+// reset puts back what newServer set, once shutdown stopped everything
+// using it. The sessions and jobs are kept for the handlers still
+// returning, stopped.
+func (s *Server) reset() {
+	renderTiles.stop()
+	jobs.stop()
+	hooks.clear()
+	environments.clear()
+	setDefaults(defaultSettings)
+	setFrameInterval(defaultFrameInterval)
+	clients.setMax(0)
+	configureLogs(levelInfo, false)
+	options = Options{}
+	auth = nil
+	proxy = proxyConfig{}
+	scenes = sceneStore{}
+}
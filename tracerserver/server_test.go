@@ -0,0 +1,88 @@
+package tracerserver
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewServerFailureChangesNothing(t *testing.T) {
+	before := currentDefaults()
+	opts := DefaultOptions()
+	opts.Width = before.Width + 1
+	opts.LogLevel = "loud"
+	if _, err := NewServer(opts); err == nil {
+		t.Fatal("NewServer with an unknown log level succeeded")
+	}
+	if got := currentDefaults(); !reflect.DeepEqual(got, before) {
+		t.Errorf("failed NewServer changed the defaults to %+v, want %+v", got, before)
+	}
+
+	s, err := NewServer(DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewServer after a failed one: %v", err)
+	}
+	s.Shutdown(context.Background())
+}
+
+func TestShutdownResets(t *testing.T) {
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(tokens, []byte("secret viewer\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.AuthTokens = tokens
+	opts.Width = defaultSettings.Width / 2
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(DefaultOptions()); err != errServerRunning {
+		t.Errorf("second NewServer got %v, want %v", err, errServerRunning)
+	}
+	s.Shutdown(context.Background())
+
+	if auth != nil {
+		t.Error("auth tokens outlived Shutdown")
+	}
+	if got := currentDefaults(); !reflect.DeepEqual(got, defaultSettings) {
+		t.Errorf("defaults after Shutdown are %+v, want %+v", got, defaultSettings)
+	}
+
+	s, err = NewServer(DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewServer after Shutdown: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+	if auth != nil {
+		t.Error("new Server without tokens kept the last one's")
+	}
+}
+
+func TestReload(t *testing.T) {
+	s, err := NewServer(DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	r := DefaultOptions().Reloadable
+	r.SamplesPerPixel = defaultSettings.SamplesPerPixel + 1
+	r.LogLevel = "loud"
+	if err := s.Reload(r); err == nil {
+		t.Fatal("reload with an unknown log level succeeded")
+	}
+	if got := currentDefaults().SamplesPerPixel; got != defaultSettings.SamplesPerPixel {
+		t.Errorf("failed reload changed samples per pixel to %d", got)
+	}
+
+	r.LogLevel = "warn"
+	if err := s.Reload(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentDefaults().SamplesPerPixel; got != r.SamplesPerPixel {
+		t.Errorf("reload set samples per pixel to %d, want %d", got, r.SamplesPerPixel)
+	}
+}
@@ -0,0 +1,282 @@
+package tracerserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+type session struct {
+	id       uint64
+	renderer *renderer
+	// token lets user resume the session after its connection drops.
+	token string
+	user  string
+	// expiry closes the session while it's detached, it's nil while a
+	// connection is attached.
+	expiry *time.Timer
+}
+
+// sessionManager hands out a renderer per websocket connection. In shared
+// mode every connection is attached to the same renderer instead, so all
+// clients see and drive one camera and selection.
+type sessionManager struct {
+	mu sync.Mutex
+
+	shared        bool
+	history       int
+	frames        int
+	frameInterval time.Duration
+	// ttl is how long a detached session can be resumed for.
+	ttl      time.Duration
+	scene    sceneDesc
+	common   *renderer
+	sessions map[uint64]*session
+	tokens   map[string]*session
+	// parked are the renderers detaching paused, for resuming to unpause.
+	parked map[*renderer]bool
+	nextID uint64
+}
+
+var sessions *sessionManager
+
+func newSessionManager(shared bool, history, frames int, frameInterval, ttl time.Duration, scene sceneDesc) *sessionManager {
+	return &sessionManager{
+		shared:        shared,
+		history:       history,
+		frames:        frames,
+		frameInterval: frameInterval,
+		ttl:           ttl,
+		scene:         scene,
+		sessions:      map[uint64]*session{},
+		tokens:        map[string]*session{},
+		parked:        map[*renderer]bool{},
+	}
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *sessionManager) open() (*session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	s := &session{id: m.nextID}
+
+	switch {
+	case m.shared && m.common != nil:
+		s.renderer = m.common
+	default:
+		r := newRenderer()
+		r.session = s.id
+		r.history.limit = m.history
+		r.frames = frameHistory{limit: m.frames, interval: m.frameInterval}
+		if err := r.loadScene(m.scene); err != nil {
+			return nil, err
+		}
+		r.start()
+		s.renderer = r
+		if m.shared {
+			m.common = r
+		}
+	}
+
+	m.sessions[s.id] = s
+	hooks.emit(Event{Type: EventSessionOpened, Session: s.id})
+	return s, nil
+}
+
+// openFor opens a session user can resume with its token after detaching
+// from it.
+func (m *sessionManager) openFor(user string) (*session, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	s, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	s.token, s.user = token, user
+	m.tokens[token] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// resume reattaches the detached session token belongs to, if user opened
+// it and it hasn't expired.
+func (m *sessionManager) resume(token, user string) (*session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.tokens[token]
+	if !ok || s.user != user || s.expiry == nil {
+		return nil, false
+	}
+	s.expiry.Stop()
+	s.expiry = nil
+	if m.parked[s.renderer] {
+		delete(m.parked, s.renderer)
+		s.renderer.resume()
+	}
+	return s, true
+}
+
+// detach keeps s for the TTL after its connection drops, for resume to
+// pick it up again, and closes it if nothing does. Its renderer is paused
+// in the meantime unless another connection is using it.
+func (m *sessionManager) detach(s *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ttl <= 0 || s.token == "" {
+		m.closeLocked(s)
+		return
+	}
+	var expiry *time.Timer
+	expiry = time.AfterFunc(m.ttl, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// A resume and another detach may have replaced the timer.
+		if s.expiry == expiry {
+			m.closeLocked(s)
+		}
+	})
+	s.expiry = expiry
+	for _, other := range m.sessions {
+		if other.renderer == s.renderer && other.expiry == nil {
+			return
+		}
+	}
+	if !s.renderer.isPaused() {
+		s.renderer.pause()
+		m.parked[s.renderer] = true
+	}
+}
+
+func (m *sessionManager) close(s *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeLocked(s)
+}
+
+func (m *sessionManager) closeLocked(s *session) {
+	delete(m.sessions, s.id)
+	delete(m.tokens, s.token)
+	hooks.emit(Event{Type: EventSessionClosed, Session: s.id})
+
+	if m.shared {
+		for _, other := range m.sessions {
+			if other.renderer == s.renderer {
+				return
+			}
+		}
+		m.common = nil
+	}
+	delete(m.parked, s.renderer)
+	s.renderer.close()
+}
+
+func (m *sessionManager) get(id uint64) (*session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// any returns an arbitrary live session, used by endpoints that were called
+// without a session id while only one renderer exists.
+func (m *sessionManager) any() (*session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.shared && len(m.sessions) != 1 {
+		return nil, false
+	}
+	for _, s := range m.sessions {
+		return s, true
+	}
+	return nil, false
+}
+
+// list returns the live sessions ordered by id.
+func (m *sessionManager) list() []*session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		l = append(l, s)
+	}
+	sort.Slice(l, func(a, b int) bool { return l[a].id < l[b].id })
+	return l
+}
+
+// renderers returns every live renderer once, shared or not.
+func (m *sessionManager) renderers() []*renderer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[*renderer]bool{}
+	var l []*renderer
+	for _, s := range m.sessions {
+		if !seen[s.renderer] {
+			seen[s.renderer] = true
+			l = append(l, s.renderer)
+		}
+	}
+	return l
+}
+
+// currentScene is the scene new sessions start from.
+func (m *sessionManager) currentScene() sceneDesc {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.scene
+}
+
+// loadScene validates desc and pushes it to every live renderer. New
+// sessions start from it too.
+func (m *sessionManager) loadScene(desc sceneDesc) error {
+	return m.pushScene(desc, false)
+}
+
+// reloadScene is loadScene keeping each renderer's camera, for a scene
+// edited under a live preview.
+func (m *sessionManager) reloadScene(desc sceneDesc) error {
+	return m.pushScene(desc, true)
+}
+
+func (m *sessionManager) pushScene(desc sceneDesc, keepCamera bool) error {
+	if _, _, err := desc.Build(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.scene = desc
+	seen := map[*renderer]bool{}
+	for _, s := range m.sessions {
+		if seen[s.renderer] {
+			continue
+		}
+		seen[s.renderer] = true
+		d := desc
+		if keepCamera {
+			d.Camera = s.renderer.cameraDesc()
+		}
+		if err := s.renderer.loadScene(d); err != nil {
+			return err
+		}
+		s.renderer.reset()
+	}
+	hooks.emit(Event{Type: EventSceneLoaded})
+	return nil
+}
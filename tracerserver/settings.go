@@ -0,0 +1,256 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+type renderSettings struct {
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	SamplesPerPixel int     `json:"samples_per_pixel"`
+	MaxDepth        int     `json:"max_depth"`
+	PreviewScale    int     `json:"preview_scale"`
+	PreviewIdleMS   int     `json:"preview_idle_ms"`
+	MoveStep        float64 `json:"move_step"`
+	FastMultiplier  float64 `json:"fast_multiplier"`
+	Environment     string  `json:"environment"`
+	Exposure        float64 `json:"exposure"`
+	Denoise         string  `json:"denoise"`
+	Adaptive        bool    `json:"adaptive"`
+	// Aperture is the lens diameter, 0 for a pinhole with everything in
+	// focus. FocusDistance 0 focuses on the camera's LookAt.
+	Aperture      float64 `json:"aperture"`
+	FocusDistance float64 `json:"focus_distance"`
+	// Projection is perspective, the default when empty, or orthographic.
+	Projection string `json:"projection"`
+	// Stereo renders a left and a right eye side by side, each half the
+	// frame wide, InterocularDistance apart. It needs the perspective
+	// projection.
+	Stereo              bool    `json:"stereo"`
+	InterocularDistance float64 `json:"interocular_distance"`
+	// Clip cuts the scene open along a plane.
+	Clip clipPlane `json:"clip"`
+	// ViewMode is beauty, the default when empty, or one of viewModes.
+	ViewMode string `json:"view_mode"`
+	// RayColor and AggColor name registered functions to shade and to
+	// aggregate samples with, the server's own when empty. Adaptive sampling
+	// always averages.
+	RayColor string `json:"ray_color"`
+	AggColor string `json:"agg_color"`
+}
+
+var defaultSettings = renderSettings{
+	Width:           500,
+	Height:          281,
+	SamplesPerPixel: 1,
+	MaxDepth:        50,
+	PreviewScale:    4,
+	PreviewIdleMS:   300,
+	MoveStep:        0.5,
+	FastMultiplier:  4,
+	Exposure:        1,
+	// About a person's, in the meters scenes are usually modelled in.
+	InterocularDistance: 0.064,
+}
+
+var (
+	defaultsMu sync.Mutex
+	defaults   = defaultSettings
+)
+
+// currentDefaults are the settings new sessions and jobs start from:
+// defaultSettings with the configuration applied.
+func currentDefaults() renderSettings {
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	return defaults
+}
+
+func setDefaults(s renderSettings) {
+	defaultsMu.Lock()
+	defaults = s
+	defaultsMu.Unlock()
+}
+
+// settingsPatch is a partial update, only the fields present are applied.
+type settingsPatch struct {
+	Width               *int       `json:"width,omitempty"`
+	Height              *int       `json:"height,omitempty"`
+	SamplesPerPixel     *int       `json:"samples_per_pixel,omitempty"`
+	MaxDepth            *int       `json:"max_depth,omitempty"`
+	PreviewScale        *int       `json:"preview_scale,omitempty"`
+	PreviewIdleMS       *int       `json:"preview_idle_ms,omitempty"`
+	MoveStep            *float64   `json:"move_step,omitempty"`
+	FastMultiplier      *float64   `json:"fast_multiplier,omitempty"`
+	Environment         *string    `json:"environment,omitempty"`
+	Exposure            *float64   `json:"exposure,omitempty"`
+	Denoise             *string    `json:"denoise,omitempty"`
+	Adaptive            *bool      `json:"adaptive,omitempty"`
+	Aperture            *float64   `json:"aperture,omitempty"`
+	FocusDistance       *float64   `json:"focus_distance,omitempty"`
+	Projection          *string    `json:"projection,omitempty"`
+	Stereo              *bool      `json:"stereo,omitempty"`
+	InterocularDistance *float64   `json:"interocular_distance,omitempty"`
+	Clip                *clipPlane `json:"clip,omitempty"`
+	ViewMode            *string    `json:"view_mode,omitempty"`
+	RayColor            *string    `json:"ray_color,omitempty"`
+	AggColor            *string    `json:"agg_color,omitempty"`
+}
+
+func decodeSettingsPatch(r io.Reader) (settingsPatch, error) {
+	var p settingsPatch
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return settingsPatch{}, err
+	}
+	return p, nil
+}
+
+func (s renderSettings) apply(p settingsPatch) (renderSettings, error) {
+	if p.Width != nil {
+		s.Width = *p.Width
+	}
+	if p.Height != nil {
+		s.Height = *p.Height
+	}
+	if p.SamplesPerPixel != nil {
+		s.SamplesPerPixel = *p.SamplesPerPixel
+	}
+	if p.MaxDepth != nil {
+		s.MaxDepth = *p.MaxDepth
+	}
+	if p.PreviewScale != nil {
+		s.PreviewScale = *p.PreviewScale
+	}
+	if p.PreviewIdleMS != nil {
+		s.PreviewIdleMS = *p.PreviewIdleMS
+	}
+	if p.MoveStep != nil {
+		s.MoveStep = *p.MoveStep
+	}
+	if p.FastMultiplier != nil {
+		s.FastMultiplier = *p.FastMultiplier
+	}
+	if p.Environment != nil {
+		s.Environment = *p.Environment
+	}
+	if p.Exposure != nil {
+		s.Exposure = *p.Exposure
+	}
+	if p.Denoise != nil {
+		s.Denoise = *p.Denoise
+	}
+	if p.Adaptive != nil {
+		s.Adaptive = *p.Adaptive
+	}
+	if p.Aperture != nil {
+		s.Aperture = *p.Aperture
+	}
+	if p.FocusDistance != nil {
+		s.FocusDistance = *p.FocusDistance
+	}
+	if p.Projection != nil {
+		s.Projection = *p.Projection
+	}
+	if p.Stereo != nil {
+		s.Stereo = *p.Stereo
+	}
+	if p.InterocularDistance != nil {
+		s.InterocularDistance = *p.InterocularDistance
+	}
+	if p.Clip != nil {
+		s.Clip = *p.Clip
+	}
+	if p.ViewMode != nil {
+		s.ViewMode = *p.ViewMode
+	}
+	if p.RayColor != nil {
+		s.RayColor = *p.RayColor
+	}
+	if p.AggColor != nil {
+		s.AggColor = *p.AggColor
+	}
+	return s, s.validate()
+}
+
+func (s renderSettings) validate() error {
+	switch {
+	case s.Width < 16 || s.Width > 4096:
+		return fmt.Errorf("width must be between 16 and 4096, got %d", s.Width)
+	case s.Height < 16 || s.Height > 4096:
+		return fmt.Errorf("height must be between 16 and 4096, got %d", s.Height)
+	case s.SamplesPerPixel < 1 || s.SamplesPerPixel > 1024:
+		return fmt.Errorf("samples_per_pixel must be between 1 and 1024, got %d", s.SamplesPerPixel)
+	case s.MaxDepth < 1 || s.MaxDepth > 1000:
+		return fmt.Errorf("max_depth must be between 1 and 1000, got %d", s.MaxDepth)
+	case s.PreviewScale < 1 || s.PreviewScale > 16:
+		return fmt.Errorf("preview_scale must be between 1 and 16, got %d", s.PreviewScale)
+	case s.PreviewIdleMS < 0 || s.PreviewIdleMS > 10000:
+		return fmt.Errorf("preview_idle_ms must be between 0 and 10000, got %d", s.PreviewIdleMS)
+	case s.MoveStep <= 0 || s.MoveStep > 100:
+		return fmt.Errorf("move_step must be in (0, 100], got %v", s.MoveStep)
+	case s.FastMultiplier < 1 || s.FastMultiplier > 100:
+		return fmt.Errorf("fast_multiplier must be between 1 and 100, got %v", s.FastMultiplier)
+	case s.Exposure <= 0 || s.Exposure > 1000:
+		return fmt.Errorf("exposure must be in (0, 1000], got %v", s.Exposure)
+	case s.Aperture < 0 || s.Aperture > 100:
+		return fmt.Errorf("aperture must be between 0 and 100, got %v", s.Aperture)
+	case s.FocusDistance < 0 || s.FocusDistance > 1e6:
+		return fmt.Errorf("focus_distance must be between 0 and 1e6, got %v", s.FocusDistance)
+	case s.InterocularDistance < 0 || s.InterocularDistance > 1e3:
+		return fmt.Errorf("interocular_distance must be between 0 and 1e3, got %v", s.InterocularDistance)
+	case s.Stereo && s.Projection == projectionOrthographic:
+		return fmt.Errorf("stereo needs the %s projection", projectionPerspective)
+	}
+	if s.Projection != "" && s.Projection != projectionPerspective && s.Projection != projectionOrthographic {
+		return fmt.Errorf("projection must be %s or %s, got %q", projectionPerspective, projectionOrthographic, s.Projection)
+	}
+	if err := s.Clip.validate(); err != nil {
+		return err
+	}
+	if err := validViewMode(s.ViewMode); err != nil {
+		return err
+	}
+	if _, ok := registeredRayColor(s.RayColor); s.RayColor != "" && !ok {
+		return fmt.Errorf("ray_color must be empty or one of %v, got %q", rayColorNames(), s.RayColor)
+	}
+	if _, ok := registeredAggColor(s.AggColor); !ok {
+		return fmt.Errorf("agg_color must be empty or one of %v, got %q", aggColorNames(), s.AggColor)
+	}
+	if _, ok := environments.get(s.Environment); s.Environment != "" && !ok {
+		return fmt.Errorf("%w %q", errUnknownEnvironment, s.Environment)
+	}
+	if _, ok := denoisers[s.Denoise]; s.Denoise != "" && !ok {
+		return fmt.Errorf("denoise must be empty or one of %v, got %q", denoiserNames(), s.Denoise)
+	}
+	return nil
+}
+
+func (s renderSettings) aspectRatio() float64 {
+	return float64(s.Width) / float64(s.Height)
+}
+
+// scaled returns the settings for rendering at 1/div of the resolution.
+func (s renderSettings) scaled(div int) renderSettings {
+	s.Width = maxInt(1, s.Width/div)
+	s.Height = maxInt(1, s.Height/div)
+	return s
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// withAspectRatio keeps the width and derives the height from aspect.
+func (s renderSettings) withAspectRatio(aspect float64) renderSettings {
+	s.Height = int(math.Round(float64(s.Width) / aspect))
+	return s
+}
@@ -0,0 +1,69 @@
+package tracerserver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// saveSessions saves each live renderer's scene and camera as name, or
+// name-{session} when there is more than one.
+func saveSessions(name string) {
+	seen := map[*renderer]bool{}
+	var l []*session
+	for _, s := range sessions.list() {
+		if !seen[s.renderer] {
+			seen[s.renderer] = true
+			l = append(l, s)
+		}
+	}
+	for _, s := range l {
+		n := name
+		if len(l) > 1 {
+			n = fmt.Sprintf("%s-%d", name, s.id)
+		}
+		desc, err := s.renderer.sceneDesc()
+		if err == nil {
+			err = scenes.save(n, desc)
+		}
+		if err != nil {
+			logs.Error("saving session failed", "session", s.id, "scene", n, "err", err)
+			continue
+		}
+		logs.Info("saved session", "session", s.id, "scene", n)
+	}
+}
+
+// shutdown stops everything but the HTTP server serving the handlers,
+// within ctx. Websockets are hijacked, so http.Server.Shutdown doesn't know
+// about them: they get a close frame instead, and the render loops and jobs
+// are stopped so nothing is left rendering into a connection that's going
+// away.
+func shutdown(ctx context.Context, grpcSrv *grpc.Server, saveAs string) {
+	if saveAs != "" {
+		saveSessions(saveAs)
+	}
+
+	if err := clients.closeAll(ctx); err != nil {
+		logs.Warn("shutdown: closing websockets failed", "err", err)
+	}
+	jobs.cancelAll()
+	for _, r := range sessions.renderers() {
+		r.close()
+	}
+	recordings.closeAll()
+
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcSrv.Stop()
+		}
+	}
+}
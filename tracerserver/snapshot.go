@@ -0,0 +1,140 @@
+package tracerserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// snapshotSettings derives the snapshot's settings from the renderer's
+// current ones and the width, height, spp and depth query parameters. A
+// width without a height keeps the current aspect ratio.
+func snapshotSettings(base renderSettings, query url.Values) (renderSettings, error) {
+	var p settingsPatch
+	for key, dst := range map[string]**int{
+		"width":  &p.Width,
+		"height": &p.Height,
+		"spp":    &p.SamplesPerPixel,
+		"depth":  &p.MaxDepth,
+	} {
+		v := query.Get(key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return renderSettings{}, fmt.Errorf("%s: %w", key, err)
+		}
+		*dst = &n
+	}
+	if p.Width != nil && p.Height == nil {
+		scaled := base
+		scaled.Width = *p.Width
+		height := scaled.withAspectRatio(base.aspectRatio()).Height
+		p.Height = &height
+	}
+	return base.apply(p)
+}
+
+// snapshot serves GET /snapshot. By default the request blocks until the
+// render is done and responds with the PNG, 16 bits per channel with
+// bit_depth=16. With async=1 it responds with the job's status instead, to
+// be polled with GET /snapshot?id=.
+func snapshot(w http.ResponseWriter, r *http.Request) {
+	serveRendererJob(w, r, func(rend *renderer, settings renderSettings, query url.Values) (*renderJob, error) {
+		depth, err := parseBitDepth(query.Get("bit_depth"))
+		if err != nil {
+			return nil, err
+		}
+		j := rend.snapshotJob(settings)
+		if depth == 16 {
+			j.output = "png16"
+		}
+		return j, nil
+	})
+}
+
+// serveRendererJob runs the job newJob makes of a session's renderer the
+// way snapshot does, and also answers the ?id= polls.
+func serveRendererJob(w http.ResponseWriter, r *http.Request, newJob func(rend *renderer, settings renderSettings, query url.Values) (*renderJob, error)) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if v := query.Get("id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		j, ok := jobs.get(id)
+		if !ok {
+			http.Error(w, errJobNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeSnapshot(w, r, j)
+		return
+	}
+
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+	settings, err := snapshotSettings(rend.renderSettings(), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j, err := newJob(rend, settings, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := jobs.submit(j); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if query.Get("async") == "1" {
+		writeSnapshot(w, r, j)
+		return
+	}
+
+	select {
+	case <-j.finished:
+		writeSnapshot(w, r, j)
+	case <-r.Context().Done():
+		jobs.remove(j)
+	}
+}
+
+// writeSnapshot responds with j's result once it's done, which also
+// forgets it, and with its status while it isn't.
+func writeSnapshot(w http.ResponseWriter, r *http.Request, j *renderJob) {
+	select {
+	case <-j.finished:
+	default:
+		writeJSON(w, http.StatusAccepted, j.status())
+		return
+	}
+
+	jobs.remove(j)
+	if j.cameras != nil {
+		writeAnimationResult(w, r, j)
+		return
+	}
+	writeJobResult(w, j)
+}
+
+// snapshotJob is a job rendering the renderer's scene and camera as they
+// are now, at settings instead of its own.
+func (r *renderer) snapshotJob(settings renderSettings) *renderJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rayColorFunc, maxDepth := r.rayColorLocked(r.camera, settings)
+	settings.MaxDepth = maxDepth
+	return newRenderJob(r.scene, r.camera, rayColorFunc, settings)
+}
@@ -0,0 +1,713 @@
+"use strict";
+
+// The websocket protocol is described in protocol.go, the envelope binary
+// messages come in in envelope.go, the dirty tiles in tiles.go and the GUI
+// overlay's in overlay.go.
+
+const wsParams = new URLSearchParams(location.search);
+wsParams.set("overlay", "1");
+wsParams.set("envelope", "1");
+// How long to wait before reconnecting a dropped websocket, well inside
+// the server's session TTL so the session resumes.
+const reconnectDelay = 1000;
+var resumeToken = sessionStorage.getItem("resume");
+var ws = null;
+// camera is the last camera state the server sent.
+var camera = null;
+connect();
+
+function connect() {
+	const params = new URLSearchParams(wsParams);
+	if (resumeToken) {
+		params.set("resume", resumeToken);
+	}
+	// Relative to the page, for servers mounted under a prefix.
+	const url = new URL("ws?" + params, location.href);
+	url.protocol = location.protocol === "https:" ? "wss:" : "ws:";
+	ws = new WebSocket(url);
+	ws.binaryType = "arraybuffer";
+	ws.onclose = function () {
+		ws = null;
+		setTimeout(connect, reconnectDelay);
+	};
+	ws.onerror = function (evt) {
+		console.log("ERROR: " + evt.data);
+	};
+	ws.onmessage = onSocketMessage;
+}
+
+function send(type, payload) {
+	if (ws && ws.readyState === WebSocket.OPEN) {
+		ws.send(JSON.stringify({v: 1, type: type, payload: payload}));
+	}
+}
+
+var lesson = {stage: -1, stages: 0};
+var contentType = "image/png";
+var session;
+var paused = false;
+var passes = ["beauty", "albedo", "bvh_id", "depth", "normal"];
+var pass = 0;
+var viewModes = ["beauty", "bvh_id", "normal", "depth", "cost"];
+var viewMode = 0;
+var denoise = "";
+var adaptive = false;
+var orthographic = false;
+var solo = -1;
+var selected = -1;
+var frameScale = 1;
+var playing = false;
+var recording = false;
+var compare = false;
+var split = 0.5;
+
+const canvas = document.getElementById("canvas");
+const overlay = document.getElementById("overlay");
+const video = document.getElementById("video");
+const viewport = document.getElementById("viewport");
+
+document.addEventListener("keydown", onKey);
+
+const envelopeVersion = 1;
+const envelopeFrame = 0, envelopeTiles = 1, envelopeOverlay = 2;
+// generation is the newest the server streamed, frames of older ones are
+// from before a reset and dropped.
+var generation = 0;
+
+function onSocketMessage(evt) {
+	if (typeof evt.data === "string") {
+		onMessage(JSON.parse(evt.data));
+		return;
+	}
+	const env = openEnvelope(evt.data);
+	if (!env) {
+		return;
+	}
+	if (env.pass !== "history") {
+		if (env.generation < generation) {
+			return;
+		}
+		generation = env.generation;
+	}
+	switch (env.kind) {
+	case envelopeOverlay:
+		drawOverlay(env.payload);
+		break;
+	case envelopeTiles:
+		drawTiles(env.payload);
+		break;
+	case envelopeFrame:
+		createImageBitmap(new Blob([env.payload], {type: contentType})).then(function (bmp) {
+			resizeCanvas(bmp.width, bmp.height);
+			context().drawImage(bmp, 0, 0);
+		});
+		break;
+	}
+}
+
+// openEnvelope reads an envelope's header and checks its payload, null if
+// it isn't one this viewer understands or it arrived corrupted.
+function openEnvelope(buf) {
+	const view = new DataView(buf);
+	if (buf.byteLength < 20 || view.getUint8(0) !== "E".charCodeAt(0) || view.getUint8(1) !== envelopeVersion) {
+		console.log("ERROR: unknown binary message");
+		return null;
+	}
+	const passLen = view.getUint8(19);
+	const env = {
+		kind: view.getUint8(2),
+		generation: Number(view.getBigUint64(3)),
+		samplesPerPixel: view.getFloat32(11),
+		pass: new TextDecoder().decode(buf.slice(20, 20 + passLen)),
+		payload: buf.slice(20 + passLen),
+	};
+	if (crc32(new Uint8Array(env.payload)) !== view.getUint32(15)) {
+		console.log("ERROR: corrupted " + env.pass + " frame");
+		return null;
+	}
+	return env;
+}
+
+var crcTable = null;
+
+function crc32(bytes) {
+	if (!crcTable) {
+		crcTable = new Uint32Array(256);
+		for (let n = 0; n < 256; n++) {
+			let c = n;
+			for (let k = 0; k < 8; k++) {
+				c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+			}
+			crcTable[n] = c;
+		}
+	}
+	let crc = 0xffffffff;
+	for (let i = 0; i < bytes.length; i++) {
+		crc = crcTable[(crc ^ bytes[i]) & 0xff] ^ (crc >>> 8);
+	}
+	return (crc ^ 0xffffffff) >>> 0;
+}
+
+function onMessage(msg) {
+	const p = msg.payload;
+	switch (msg.type) {
+	case "session":
+		session = p.id;
+		if (!p.resumed) {
+			generation = 0;
+		}
+		resumeToken = p.token;
+		sessionStorage.setItem("resume", p.token);
+		if (new URLSearchParams(location.search).get("transport") === "webrtc") {
+			startWebRTC();
+		}
+		break;
+	case "lesson":
+		lesson = p;
+		text("lesson", lesson.stage >= 0 ? (lesson.stage + 1) + "/" + lesson.stages + " " + lesson.name + ": " + lesson.annotation : "");
+		break;
+	case "pause":
+		paused = p.paused;
+		break;
+	case "pick":
+		selected = p.object;
+		text("inspector", p.object >= 0 ? JSON.stringify(p, null, 2) : "");
+		break;
+	case "inspect":
+		text("inspector", p.object >= 0 ? JSON.stringify(p, null, 2) : "");
+		break;
+	case "hover":
+		drawTooltip(p);
+		break;
+	case "gizmo_pick":
+		if (pointers.size === 1) {
+			gizmoAxis = p.axis;
+		}
+		break;
+	case "stats":
+		text("stats", p.samples_per_pixel.toFixed(1) + " spp, " + (p.rays_per_sec / 1e6).toFixed(2) + " Mrays/s, " + (p.since_reset_ms / 1000).toFixed(1) + "s, " + p.render_ms.toFixed(0) + " ms/pass, " + (100 * p.convergence).toFixed(1) + "% converged" +
+			(p.eta_ms !== undefined ? ", done in " + (p.eta_ms / 1000).toFixed(0) + "s (" + p.eta_by + ")" : ""));
+		break;
+	case "convergence":
+		text("convergence", (100 * p.converged).toFixed(1) + "% converged, " + p.mean_samples.toFixed(1) + " spp");
+		break;
+	case "target_reached":
+		text("target", "done at " + p.samples_per_pixel.toFixed(0) + " spp, " + (p.render_ms / 1000).toFixed(1) + "s" + (p.snapshot ? ", saved as snapshot " + p.snapshot : ""));
+		break;
+	case "camera":
+		camera = p;
+		text("camera", "from " + p.look_from.map(v => v.toFixed(2)).join(", ") + " at " + p.look_at.map(v => v.toFixed(2)).join(", ") + ", vfov " + p.vfov.toFixed(1));
+		break;
+	case "presence":
+		drawPresence(p);
+		break;
+	case "presence_leave":
+		const cursor = document.getElementById("cursor-" + p.session);
+		if (cursor) {
+			cursor.remove();
+		}
+		break;
+	case "timeline":
+		playing = p.playing;
+		text("timeline", p.keyframes.length + " keyframes, " + p.duration.toFixed(1) + "s" + (playing ? ", playing" : ""));
+		break;
+	case "recording":
+		recording = p.state === "recording";
+		const link = document.getElementById("recording");
+		link.textContent = "";
+		if (recording) {
+			link.textContent = "recording...";
+		} else {
+			const a = document.createElement("a");
+			a.href = p.url + location.search;
+			a.textContent = "recording " + p.id;
+			link.append(a, ", " + p.frames + " frames");
+		}
+		break;
+	case "compare":
+		compare = p.enabled;
+		if (compare) {
+			split = p.split;
+		}
+		break;
+	case "lights":
+		solo = p.solo;
+		text("lights", p.lights.length + " lights" + (solo >= 0 ? ", object " + solo + " soloed" : ""));
+		break;
+	case "camera_presets":
+		drawPresets(p);
+		break;
+	case "scrub":
+		const f = p.frame;
+		text("scrub-label", p.live ? "live" : (f.ago_ms / 1000).toFixed(0) + "s ago, " + f.samples_per_pixel.toFixed(1) + " spp");
+		break;
+	case "job":
+		text("timeline", "animation job " + p.id + ": " + p.frames + " frames, see /jobs/" + p.id);
+		break;
+	case "stream_quality":
+		frameScale = p.scale;
+		break;
+	case "stream_format":
+		contentType = p.content_type;
+		break;
+	case "error":
+		console.log("ERROR: " + p.code + ": " + p.message);
+		break;
+	}
+}
+
+function text(id, s) {
+	document.getElementById(id).textContent = s;
+}
+
+const cameraKeys = {
+	w: "forward", s: "back", a: "left", d: "right", q: "up", e: "down",
+	z: "fov_in", x: "fov_out", ",": "roll_left", ".": "roll_right",
+};
+
+function onKey(e) {
+	if (e.target instanceof HTMLInputElement || e.ctrlKey || e.metaKey || e.altKey) {
+		return;
+	}
+	const key = e.key;
+	if (key === "Delete") {
+		send("delete_object", {});
+		return;
+	}
+	if (cameraKeys[key.toLowerCase()]) {
+		send("camera_key", {action: cameraKeys[key.toLowerCase()], fast: e.shiftKey});
+		return;
+	}
+	switch (key) {
+	case "t":
+		send("lesson", {stage: lesson.stage >= 0 ? -1 : 0});
+		break;
+	case "n":
+		send("lesson", {stage: Math.min(lesson.stage + 1, lesson.stages - 1)});
+		break;
+	case "p":
+		send("lesson", {stage: Math.max(lesson.stage - 1, 0)});
+		break;
+	case "i":
+		send("transform", {translate: [0, 0, -0.1]});
+		break;
+	case "k":
+		send("transform", {translate: [0, 0, 0.1]});
+		break;
+	case "j":
+		send("transform", {translate: [-0.1, 0, 0]});
+		break;
+	case "l":
+		send("transform", {translate: [0.1, 0, 0]});
+		break;
+	case " ":
+		e.preventDefault();
+		send("pause", {paused: !paused});
+		break;
+	case "u":
+		send("undo", {});
+		break;
+	case "r":
+		send("redo", {});
+		break;
+	case "v":
+		pass = (pass + 1) % passes.length;
+		send("view_pass", {pass: passes[pass]});
+		break;
+	case "b":
+		denoise = denoise ? "" : "bilateral";
+		send("settings", {denoise: denoise});
+		break;
+	case "m":
+		adaptive = !adaptive;
+		send("settings", {adaptive: adaptive});
+		if (!adaptive) {
+			text("convergence", "");
+		}
+		break;
+	case "c":
+		send("duplicate_object", {});
+		break;
+	case "f":
+		send("keyframe", {});
+		break;
+	case "g":
+		send("timeline_play", {playing: !playing, loop: true});
+		break;
+	case "h":
+		send("timeline_render", {});
+		break;
+	case "y":
+		if (compare) {
+			send("compare", {enabled: false});
+		} else {
+			send("compare", {enabled: true, settings: {denoise: denoise ? "" : "bilateral"}});
+		}
+		break;
+	case "[":
+	case "]":
+		if (compare) {
+			split = Math.min(1, Math.max(0, split + (key === "[" ? -0.05 : 0.05)));
+			send("compare_split", {split: split});
+		}
+		break;
+	case "o":
+		send("record", {recording: !recording});
+		break;
+	case "1":
+	case "2":
+	case "3":
+	case "4":
+		send("view", {name: ["top", "front", "right", "isometric"][key - 1]});
+		break;
+	case "5":
+		orthographic = !orthographic;
+		send("settings", {projection: orthographic ? "orthographic" : "perspective"});
+		break;
+	case "6":
+		send("add_light", {});
+		break;
+	case "7":
+		send("solo_light", {solo: solo < 0});
+		break;
+	case "8":
+		viewMode = (viewMode + 1) % viewModes.length;
+		send("settings", {view_mode: viewModes[viewMode]});
+		break;
+	case "+":
+		send("transform", {scale: 1.1});
+		break;
+	case "-":
+		send("transform", {scale: 1 / 1.1});
+		break;
+	}
+}
+
+// startWebRTC moves the frame stream onto a WebRTC video track, the
+// websocket is then only used for input and metadata.
+function startWebRTC() {
+	const pc = new RTCPeerConnection();
+	pc.addTransceiver("video", {direction: "recvonly"});
+	pc.ontrack = function (evt) {
+		video.srcObject = evt.streams[0];
+		video.hidden = false;
+		canvas.hidden = true;
+		send("stream_format", {format: "none"});
+	};
+	pc.createOffer().then(function (offer) {
+		return pc.setLocalDescription(offer);
+	}).then(function () {
+		return new Promise(function (resolve) {
+			if (pc.iceGatheringState === "complete") {
+				return resolve();
+			}
+			pc.onicegatheringstatechange = function () {
+				if (pc.iceGatheringState === "complete") {
+					resolve();
+				}
+			};
+		});
+	}).then(function () {
+		const params = new URLSearchParams(location.search);
+		params.set("session", session);
+		return fetch("webrtc/offer?" + params, {method: "POST", body: JSON.stringify(pc.localDescription)});
+	}).then(function (resp) {
+		return resp.json();
+	}).then(function (answer) {
+		return pc.setRemoteDescription(answer);
+	}).catch(function (err) {
+		console.log("ERROR: webrtc: " + err);
+	});
+}
+
+function context() {
+	return canvas.getContext("2d");
+}
+
+function resizeCanvas(width, height) {
+	if (canvas.width !== width || canvas.height !== height) {
+		canvas.width = width;
+		canvas.height = height;
+		// Keep the frame the same size on the page while backpressure
+		// shrinks it.
+		canvas.style.width = width * frameScale + "px";
+	}
+}
+
+// drawOverlay replaces the GUI overlay drawn over the frame.
+function drawOverlay(png) {
+	createImageBitmap(new Blob([png], {type: "image/png"})).then(function (bmp) {
+		overlay.width = bmp.width;
+		overlay.height = bmp.height;
+		const ctx = overlay.getContext("2d");
+		ctx.clearRect(0, 0, bmp.width, bmp.height);
+		ctx.drawImage(bmp, 0, 0);
+	});
+}
+
+function drawTiles(buf) {
+	const view = new DataView(buf);
+	if (view.getUint8(0) !== "T".charCodeAt(0)) {
+		return;
+	}
+	resizeCanvas(view.getUint16(1), view.getUint16(3));
+	const count = view.getUint16(5);
+	let offset = 7;
+	for (let i = 0; i < count; i++) {
+		const x = view.getUint16(offset), y = view.getUint16(offset + 2);
+		const len = view.getUint32(offset + 8);
+		const data = buf.slice(offset + 12, offset + 12 + len);
+		offset += 12 + len;
+		createImageBitmap(new Blob([data], {type: contentType})).then(function (bmp) {
+			context().drawImage(bmp, x, y);
+		});
+	}
+}
+
+// frameWidth is the full resolution frame's width, what pointer
+// coordinates are sent in.
+function frameWidth() {
+	return video.hidden ? canvas.width * frameScale : video.videoWidth;
+}
+
+// toFrame turns a point on the page into full resolution frame pixels,
+// however the frame is scaled to fit.
+function toFrame(clientX, clientY) {
+	const rect = viewport.getBoundingClientRect();
+	const scale = rect.width > 0 ? frameWidth() / rect.width : 1;
+	return {x: (clientX - rect.left) * scale, y: (clientY - rect.top) * scale};
+}
+
+// drawPresence places a peer's cursor, labelled with its user and
+// selection, over the frame.
+function drawPresence(p) {
+	let el = document.getElementById("cursor-" + p.session);
+	if (!el) {
+		el = document.createElement("span");
+		el.id = "cursor-" + p.session;
+		el.className = "cursor";
+		document.getElementById("cursors").appendChild(el);
+	}
+	el.textContent = "▲ " + p.user + (p.selected >= 0 ? " #" + p.selected : "");
+	el.hidden = !p.cursor;
+	if (p.cursor) {
+		const scale = viewport.getBoundingClientRect().width / (frameWidth() || 1);
+		el.style.left = p.cursor[0] * scale + "px";
+		el.style.top = p.cursor[1] * scale + "px";
+	}
+}
+
+// hoveredAt is the last position sent to hover, where its reply's tooltip
+// goes.
+var hoveredAt = {x: 0, y: 0};
+
+// drawTooltip labels the hovered object with its index, distance and
+// material next to the pointer.
+function drawTooltip(p) {
+	const el = document.getElementById("tooltip");
+	el.hidden = p.object < 0;
+	if (p.object < 0) {
+		return;
+	}
+	el.textContent = "#" + p.object + " " + p.distance.toFixed(2) + (p.material ? " " + p.material.kind : "");
+	const scale = viewport.getBoundingClientRect().width / (frameWidth() || 1);
+	el.style.left = hoveredAt.x * scale + 12 + "px";
+	el.style.top = hoveredAt.y * scale + 12 + "px";
+}
+
+function throttle(func, delay) {
+	let timerId;
+	return function () {
+		if (timerId) {
+			return;
+		}
+		func.apply(this, arguments);
+		timerId = setTimeout(function () { timerId = undefined; }, delay);
+	};
+}
+
+const hover = throttle(function (pt) {
+	hoveredAt = {x: Math.round(pt.x), y: Math.round(pt.y)};
+	send("hover", hoveredAt);
+}, 50);
+
+// Pointer input. The mouse drags: the left button orbits, the middle
+// button or shift pans, the right button, ctrl or alt dolly, and so does
+// the wheel. One finger orbits, two pan and pinch to dolly, and a long
+// press inspects what's under it. A click or tap that doesn't move
+// selects, with shift it's added to the selection and with alt it focuses
+// instead. A mouse drag starting on an arm of the selected object's gizmo
+// moves the object along it.
+
+// tapSlop is how far, in page pixels, a press may move and still select.
+const tapSlop = 4;
+// longPressMS is how long a finger has to rest to inspect.
+const longPressMS = 500;
+// touchDegreesPerPixel is how far a page pixel of a finger orbits.
+const touchDegreesPerPixel = 0.3;
+
+const pointers = new Map();
+var tap = null;
+var longPress;
+// gizmoAxis is the gizmo arm being dragged, "" for none.
+var gizmoAxis = "";
+
+function centroid() {
+	let x = 0, y = 0;
+	for (const p of pointers.values()) {
+		x += p.x;
+		y += p.y;
+	}
+	return {x: x / pointers.size, y: y / pointers.size};
+}
+
+function spread() {
+	const [a, b] = Array.from(pointers.values());
+	return Math.hypot(a.x - b.x, a.y - b.y);
+}
+
+viewport.addEventListener("pointerdown", function (e) {
+	viewport.setPointerCapture(e.pointerId);
+	pointers.set(e.pointerId, {x: e.clientX, y: e.clientY});
+	tap = pointers.size === 1 && e.button === 0 ? {x: e.clientX, y: e.clientY, shift: e.shiftKey, alt: e.altKey} : null;
+	clearTimeout(longPress);
+	gizmoAxis = "";
+	if (tap && e.pointerType === "mouse" && selected >= 0) {
+		const pt = toFrame(e.clientX, e.clientY);
+		send("gizmo_pick", {x: Math.round(pt.x), y: Math.round(pt.y)});
+	}
+	if (tap && e.pointerType !== "mouse") {
+		longPress = setTimeout(function () {
+			if (tap) {
+				const pt = toFrame(tap.x, tap.y);
+				send("inspect", {x: Math.round(pt.x), y: Math.round(pt.y)});
+				tap = null;
+			}
+		}, longPressMS);
+	}
+});
+
+viewport.addEventListener("pointermove", function (e) {
+	const prev = pointers.get(e.pointerId);
+	if (!prev) {
+		if (e.pointerType === "mouse") {
+			hover(toFrame(e.clientX, e.clientY));
+		}
+		return;
+	}
+	if (tap && Math.hypot(e.clientX - tap.x, e.clientY - tap.y) > tapSlop) {
+		tap = null;
+		clearTimeout(longPress);
+	}
+	if (tap) {
+		return;
+	}
+
+	if (pointers.size === 1 && e.pointerType !== "mouse") {
+		pointers.set(e.pointerId, {x: e.clientX, y: e.clientY});
+		send("orbit", {yaw: -(e.clientX - prev.x) * touchDegreesPerPixel, pitch: (e.clientY - prev.y) * touchDegreesPerPixel});
+		return;
+	}
+	if (pointers.size === 1) {
+		const a = toFrame(prev.x, prev.y), b = toFrame(e.clientX, e.clientY);
+		pointers.set(e.pointerId, {x: e.clientX, y: e.clientY});
+		if (gizmoAxis) {
+			send("gizmo_drag", {axis: gizmoAxis, x: b.x, y: b.y, dx: b.x - a.x, dy: b.y - a.y});
+			return;
+		}
+		send("drag", {
+			dx: b.x - a.x,
+			dy: b.y - a.y,
+			button: e.buttons & 4 ? 1 : e.buttons & 2 ? 2 : 0,
+			shift: e.shiftKey,
+			ctrl: e.ctrlKey,
+			alt: e.altKey,
+		});
+		return;
+	}
+	if (pointers.size === 2) {
+		const c0 = centroid(), s0 = spread();
+		pointers.set(e.pointerId, {x: e.clientX, y: e.clientY});
+		const c1 = centroid(), s1 = spread();
+		const a = toFrame(c0.x, c0.y), b = toFrame(c1.x, c1.y);
+		if (a.x !== b.x || a.y !== b.y) {
+			send("pan", {dx: b.x - a.x, dy: b.y - a.y});
+		}
+		if (s0 > 0 && s1 > 0 && s0 !== s1) {
+			send("dolly", {amount: Math.log(s1 / s0)});
+		}
+		return;
+	}
+	pointers.set(e.pointerId, {x: e.clientX, y: e.clientY});
+});
+
+function onPointerUp(e) {
+	if (!pointers.delete(e.pointerId)) {
+		return;
+	}
+	clearTimeout(longPress);
+	if (tap && e.type === "pointerup") {
+		const pt = toFrame(e.clientX, e.clientY);
+		if (tap.alt) {
+			send("focus", {x: Math.round(pt.x), y: Math.round(pt.y)});
+		} else {
+			send("select", {x: Math.round(pt.x), y: Math.round(pt.y), add: tap.shift});
+		}
+	}
+	tap = null;
+	gizmoAxis = "";
+}
+
+viewport.addEventListener("pointerup", onPointerUp);
+viewport.addEventListener("pointercancel", onPointerUp);
+
+viewport.addEventListener("wheel", function (e) {
+	e.preventDefault();
+	// Lines and pages, from some mice, count as 16 and 400 pixels.
+	const unit = [1, 16, 400][e.deltaMode];
+	send("wheel", {delta: e.deltaY * unit});
+}, {passive: false});
+
+viewport.addEventListener("contextmenu", function (e) {
+	e.preventDefault();
+});
+
+// scrub streams the frame history from seconds ago, back to live at 0.
+document.getElementById("scrub").addEventListener("input", function () {
+	const seconds = Number(this.value);
+	send("scrub", seconds < 0 ? {ago_ms: -seconds * 1000} : {});
+});
+
+// clip cuts away everything nearer than the slider's distance from the
+// camera, facing it, and turns clipping off at 0.
+document.getElementById("clip").addEventListener("input", function () {
+	const distance = Number(this.value);
+	if (!camera || distance === 0) {
+		send("clip_plane", {point: [0, 0, 0], normal: [0, 0, 0]});
+		return;
+	}
+	const dir = camera.look_at.map((v, i) => v - camera.look_from[i]);
+	const len = Math.hypot(...dir);
+	send("clip_plane", {
+		point: camera.look_from.map((v, i) => v + dir[i] / len * distance),
+		normal: dir.map(v => -v / len),
+	});
+});
+
+document.getElementById("save-camera").addEventListener("click", function () {
+	const name = prompt("preset name");
+	if (name) {
+		send("save_camera", {name: name});
+	}
+});
+
+function drawPresets(presets) {
+	const list = document.getElementById("presets");
+	list.textContent = "";
+	for (const p of presets) {
+		const button = document.createElement("button");
+		button.textContent = p.name;
+		button.onclick = () => send("camera_preset", {name: p.name});
+		list.appendChild(button);
+	}
+}
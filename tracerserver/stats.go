@@ -0,0 +1,35 @@
+package tracerserver
+
+import "time"
+
+// statsInterval is how often clients get a stats message.
+const statsInterval = time.Second
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (r *renderer) stats() statsPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	gen, settings := r.gen, r.frameSettings()
+	s := statsPayload{
+		Passes:          gen.passes,
+		Rays:            gen.rays,
+		SamplesPerPixel: float64(gen.rays) / float64(settings.Width*settings.Height),
+		SinceResetMS:    millis(time.Since(gen.started)),
+		RenderMS:        millis(gen.lastPass),
+	}
+	if gen.renderTime > 0 {
+		s.RaysPerSec = float64(gen.rays) / gen.renderTime.Seconds()
+	}
+	if gen.samples != nil {
+		s.Convergence = gen.samples.convergence().Converged
+	}
+	if eta, by, ok := r.etaLocked(gen); ok {
+		ms := millis(eta)
+		s.ETAMS, s.ETABy = &ms, by
+	}
+	return s
+}
@@ -0,0 +1,313 @@
+package tracerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxFPS = 60
+
+	// A client is slow once delivering a frame took longer than its
+	// interval for slowFrames frames in a row, and recovers a level after
+	// fastFrames frames delivered in under half of it.
+	slowFrames = 10
+	fastFrames = 50
+	maxDegrade = 3
+	// lagSmoothing is the weight of the latest frame in the lag average.
+	lagSmoothing       = 0.2
+	minDegradedQuality = 20
+)
+
+// stream paces a client's frames and backs off when it can't keep up:
+// frames are skipped while the previous one is still being written, and
+// sustained slowness lowers the quality and then the resolution.
+type stream struct {
+	mu       sync.Mutex
+	fps      int
+	inFlight bool
+	lag      time.Duration
+	sent     int64
+	skipped  int64
+	level    int
+	slow     int
+	fast     int
+}
+
+// defaultFPS is the rate clients get unless they ask for another one.
+func defaultFPS() int {
+	return maxInt(1, int(time.Second/frameInterval()))
+}
+
+func newStream(fps int) *stream {
+	return &stream{fps: fps}
+}
+
+func validateFPS(fps int) error {
+	if fps < 1 || fps > maxFPS {
+		return fmt.Errorf("fps must be between 1 and %d, got %d", maxFPS, fps)
+	}
+	return nil
+}
+
+func (s *stream) setFPS(fps int) {
+	s.mu.Lock()
+	s.fps = fps
+	s.mu.Unlock()
+}
+
+func (s *stream) interval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Second / time.Duration(s.fps)
+}
+
+// begin reports whether a frame should be produced, counting it as skipped
+// while the previous one is still being written.
+func (s *stream) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight {
+		s.skipped++
+		return false
+	}
+	s.inFlight = true
+	return true
+}
+
+// done ends the frame begin started, which took d to encode and write.
+func (s *stream) done(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight = false
+	s.sent++
+	if s.lag == 0 {
+		s.lag = d
+	} else {
+		s.lag += time.Duration(lagSmoothing * float64(d-s.lag))
+	}
+
+	interval := time.Second / time.Duration(s.fps)
+	switch {
+	case d > interval:
+		s.slow, s.fast = s.slow+1, 0
+	case d < interval/2:
+		s.slow, s.fast = 0, s.fast+1
+	default:
+		s.slow, s.fast = 0, 0
+	}
+	if s.slow >= slowFrames && s.level < maxDegrade {
+		s.level, s.slow = s.level+1, 0
+	}
+	if s.fast >= fastFrames && s.level > 0 {
+		s.level, s.fast = s.level-1, 0
+	}
+}
+
+// streamQualityPayload is sent whenever backpressure changes the level.
+// Frames are downscaled by Scale, and lossy formats encoded at Quality.
+type streamQualityPayload struct {
+	Level   int `json:"level"`
+	Scale   int `json:"scale"`
+	Quality int `json:"quality,omitempty"`
+}
+
+// degradedQuality is what frames are encoded at for level, given the
+// quality the client asked for. The first level only lowers the quality,
+// the next ones halve the resolution too.
+func degradedQuality(level, quality int) streamQualityPayload {
+	if quality == 0 {
+		quality = defaultQuality
+	}
+	p := streamQualityPayload{Level: level, Scale: 1, Quality: quality}
+	if level > 0 {
+		p.Quality = maxInt(minDegradedQuality, quality/2)
+	}
+	if level > 1 {
+		p.Scale = 1 << (level - 1)
+	}
+	return p
+}
+
+func (s *stream) degradeLevel() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.level
+}
+
+// downscale shrinks img by div with nearest neighbour filtering.
+func downscale(img image.Image, div int) image.Image {
+	if div <= 1 {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, maxInt(1, b.Dx()/div), maxInt(1, b.Dy()/div)))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*div, b.Min.Y+y*div))
+		}
+	}
+	return dst
+}
+
+type clientStatus struct {
+	Session  uint64  `json:"session"`
+	Remote   string  `json:"remote"`
+	User     string  `json:"user"`
+	Format   string  `json:"format"`
+	FPS      int     `json:"fps"`
+	LagMS    float64 `json:"lag_ms"`
+	Sent     int64   `json:"sent"`
+	Skipped  int64   `json:"skipped"`
+	Level    int     `json:"level"`
+	Scale    int     `json:"scale"`
+	InFlight bool    `json:"in_flight"`
+}
+
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+	max     int
+	closing bool
+	// open counts the ws handlers still running, closeAll waits for them.
+	open sync.WaitGroup
+}
+
+var clients = &clientRegistry{clients: map[*client]bool{}}
+
+var (
+	errShuttingDown   = errors.New("server shutting down")
+	errTooManyClients = errors.New("too many connections")
+)
+
+// add registers c, unless the server is shutting down or already has
+// max clients.
+func (r *clientRegistry) add(c *client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.closing:
+		return errShuttingDown
+	case r.max > 0 && len(r.clients) >= r.max:
+		return errTooManyClients
+	}
+	r.clients[c] = true
+	r.open.Add(1)
+	return nil
+}
+
+// setMax limits how many clients add accepts, 0 for no limit. Clients over
+// a lowered limit stay connected.
+func (r *clientRegistry) setMax(max int) {
+	r.mu.Lock()
+	r.max = max
+	r.mu.Unlock()
+}
+
+// reopen accepts clients again after closeAll, with no limit, for the
+// next Server.
+func (r *clientRegistry) reopen() {
+	r.mu.Lock()
+	r.closing, r.max = false, 0
+	r.mu.Unlock()
+}
+
+func (r *clientRegistry) remove(c *client) {
+	r.mu.Lock()
+	delete(r.clients, c)
+	r.open.Done()
+	r.mu.Unlock()
+}
+
+// closeAll sends every client a going away close frame and waits until
+// their handlers returned or ctx is done.
+func (r *clientRegistry) closeAll(ctx context.Context) error {
+	r.mu.Lock()
+	r.closing = true
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, errShuttingDown.Error())
+	for c := range r.clients {
+		if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+			c.log.Warn("sending close failed", "err", err)
+			c.conn.Close()
+		}
+	}
+	r.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		r.open.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *clientRegistry) status() []clientStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := []clientStatus{}
+	for c := range r.clients {
+		l = append(l, c.status())
+	}
+	sort.Slice(l, func(a, b int) bool { return l[a].Session < l[b].Session })
+	return l
+}
+
+func (c *client) status() clientStatus {
+	c.emu.Lock()
+	format := c.format
+	c.emu.Unlock()
+
+	s := c.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return clientStatus{
+		Session:  c.session.id,
+		Remote:   c.remoteAddr,
+		User:     c.user.name,
+		Format:   format.Format,
+		FPS:      s.fps,
+		LagMS:    millis(s.lag),
+		Sent:     s.sent,
+		Skipped:  s.skipped,
+		Level:    s.level,
+		Scale:    degradedQuality(s.level, format.Quality).Scale,
+		InFlight: s.inFlight,
+	}
+}
+
+// sessionStatus is how far a session's render got, with its ETA.
+type sessionStatus struct {
+	ID uint64 `json:"id"`
+	statsPayload
+}
+
+func sessionsStatus() []sessionStatus {
+	l := []sessionStatus{}
+	for _, s := range sessions.list() {
+		l = append(l, sessionStatus{ID: s.id, statsPayload: s.renderer.stats()})
+	}
+	return l
+}
+
+// statusHandler serves GET /status, the connected clients and how well their
+// streams keep up, and the sessions and when their renders finish.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Clients  []clientStatus  `json:"clients"`
+		Sessions []sessionStatus `json:"sessions"`
+	}{clients.status(), sessionsStatus()})
+}
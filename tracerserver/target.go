@@ -0,0 +1,129 @@
+package tracerserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+// renderTargetPayload stops accumulating once SamplesPerPixel samples per
+// pixel or Seconds of render time went into the frame, whichever comes
+// first. 0 leaves either out, both 0 renders on forever. Save keeps the
+// finished frame as a snapshot, for GET /snapshot?id= to download once.
+type renderTargetPayload struct {
+	SamplesPerPixel int     `json:"samples_per_pixel"`
+	Seconds         float64 `json:"seconds"`
+	Save            bool    `json:"save"`
+}
+
+// targetReachedPayload tells clients accumulation stopped at the target.
+// Snapshot is the saved frame's job ID, 0 unless the target asked for it.
+type targetReachedPayload struct {
+	Generation      uint64  `json:"generation"`
+	SamplesPerPixel float64 `json:"samples_per_pixel"`
+	RenderMS        float64 `json:"render_ms"`
+	Snapshot        uint64  `json:"snapshot,omitempty"`
+}
+
+func (t renderTargetPayload) validate() error {
+	switch {
+	case t.SamplesPerPixel < 0 || t.SamplesPerPixel > 1<<20:
+		return fmt.Errorf("samples_per_pixel must be between 0 and %d, got %d", 1<<20, t.SamplesPerPixel)
+	case t.Seconds < 0 || t.Seconds > 7*24*3600:
+		return fmt.Errorf("seconds must be between 0 and a week, got %v", t.Seconds)
+	}
+	return nil
+}
+
+// setTarget replaces the target. Raising it past what the current
+// generation reached carries on accumulating.
+func (r *renderer) setTarget(t renderTargetPayload) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.target = t
+	r.gen.reached = nil
+	close(r.targetChanged)
+	r.targetChanged = make(chan struct{})
+	return nil
+}
+
+// samplesPerPixelLocked is how many camera rays per pixel went into gen,
+// at the resolution it's rendered at.
+func (r *renderer) samplesPerPixelLocked(gen *generation) float64 {
+	s := r.frameSettings()
+	return float64(gen.rays) / float64(s.Width*s.Height)
+}
+
+// targetReachedLocked is whether gen got to the target. Preview generations
+// never do, they're promoted to full resolution first.
+func (r *renderer) targetReachedLocked(gen *generation) bool {
+	t := r.target
+	if r.scale > 1 || (t.SamplesPerPixel <= 0 && t.Seconds <= 0) {
+		return false
+	}
+	return (t.SamplesPerPixel > 0 && r.samplesPerPixelLocked(gen) >= float64(t.SamplesPerPixel)) ||
+		(t.Seconds > 0 && gen.renderTime >= time.Duration(t.Seconds*float64(time.Second)))
+}
+
+// waitTarget blocks the render loop while gen is at the target, until a
+// reset or a new target. The first time it notes gen reached it, it saves
+// the frame if the target asks for it and fires EventTargetReached.
+func (r *renderer) waitTarget(gen *generation) {
+	r.mu.Lock()
+	if !r.targetReachedLocked(gen) {
+		r.mu.Unlock()
+		return
+	}
+	changed, save, settings := r.targetChanged, r.target.Save, r.settings
+	first := gen.reached == nil
+	reached := targetReachedPayload{
+		Generation:      gen.id,
+		SamplesPerPixel: r.samplesPerPixelLocked(gen),
+		RenderMS:        millis(gen.renderTime),
+	}
+	r.mu.Unlock()
+
+	// Only the render loop gets here, reached is published once the
+	// snapshot it names exists.
+	if first {
+		if save {
+			j := finishedJob(r.composite(false), settings)
+			jobs.add(j)
+			reached.Snapshot = j.id
+		}
+		r.mu.Lock()
+		gen.reached = &reached
+		r.mu.Unlock()
+		hooks.emit(Event{Type: EventTargetReached, Session: r.session, Job: reached.Snapshot})
+	}
+
+	select {
+	case <-gen.ctx.Done():
+	case <-changed:
+	}
+}
+
+// targetReached is what the current generation reached, false while it
+// hasn't stopped at the target.
+func (r *renderer) targetReached() (targetReachedPayload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gen.reached == nil {
+		return targetReachedPayload{}, false
+	}
+	return *r.gen.reached, true
+}
+
+// finishedJob is a job whose result is frame, for keeping frames rendered
+// elsewhere where snapshots are kept.
+func finishedJob(frame *tracer.Frame, settings renderSettings) *renderJob {
+	j := newRenderJob(nil, tracer.Camera{}, nil, settings)
+	j.cancel()
+	j.frame, j.done = frame, j.passes
+	j.finish()
+	return j
+}
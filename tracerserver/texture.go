@@ -0,0 +1,125 @@
+package tracerserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/ghostec/tracer"
+)
+
+const maxAssetUpload = 64 << 20
+
+// textureDesc varies a lambertian's albedo over its surface. An image
+// texture is the asset uploaded to POST /assets/{Asset}, wrapped around by
+// the direction of the surface normal, which fits spheres, or with
+// "mapping": "planar" laid flat on the XZ plane Scale units wide. A
+// checker alternates the material's albedo and Odd every Scale units.
+type textureDesc struct {
+	Kind    string     `json:"kind"`
+	Asset   string     `json:"asset,omitempty"`
+	Mapping string     `json:"mapping,omitempty"`
+	Odd     [3]float64 `json:"odd,omitempty"`
+	Scale   float64    `json:"scale,omitempty"`
+}
+
+func (d textureDesc) validate() error {
+	switch d.Kind {
+	case "image":
+		if d.Mapping != "" && d.Mapping != "spherical" && d.Mapping != "planar" {
+			return fmt.Errorf("texture mapping must be spherical or planar, got %q", d.Mapping)
+		}
+	case "checker":
+		for _, c := range d.Odd {
+			if c < 0 || c > 1 {
+				return fmt.Errorf("texture odd components must be between 0 and 1, got %v", d.Odd)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown texture kind %q, want image or checker", d.Kind)
+	}
+	if d.Scale < 0 {
+		return fmt.Errorf("texture scale must not be negative, got %v", d.Scale)
+	}
+	return nil
+}
+
+// material is a lambertian of albedo textured by d.
+func (d textureDesc) material(albedo tracer.Color) (tracer.Material, error) {
+	t := textured{desc: d, albedo: albedo, scale: d.Scale}
+	if t.scale == 0 {
+		t.scale = 1
+	}
+	if d.Kind == "image" {
+		img, ok := assets.get(d.Asset)
+		if !ok {
+			return nil, fmt.Errorf("unknown texture asset %q", d.Asset)
+		}
+		t.image = img
+	}
+	return t, nil
+}
+
+// textured is a lambertian whose albedo depends on where it's hit.
+type textured struct {
+	desc   textureDesc
+	albedo tracer.Color
+	scale  float64
+	image  *envMap
+}
+
+func (t textured) Scatter(r tracer.Ray, hr tracer.HitRecord) tracer.ScatterRecord {
+	return tracer.Lambertian{Albedo: t.albedoAt(hr)}.Scatter(r, hr)
+}
+
+func (t textured) albedoAt(hr tracer.HitRecord) tracer.Color {
+	p := hr.P.Vec3().MulFloat(1 / t.scale)
+	if t.image == nil {
+		// Cells are offset by half so axis aligned surfaces through the
+		// origin, like a ground plane, don't sit on a cell boundary.
+		cell := int(math.Floor(p[0]+0.5)) + int(math.Floor(p[1]+0.5)) + int(math.Floor(p[2]+0.5))
+		if cell%2 == 0 {
+			return t.albedo
+		}
+		return tracer.Color(t.desc.Odd)
+	}
+	var u, v float64
+	if t.desc.Mapping == "planar" {
+		u, v = p[0]-math.Floor(p[0]), p[2]-math.Floor(p[2])
+	} else {
+		n := hr.Normal.Unit()
+		u = 0.5 + math.Atan2(n[0], -n[2])/(2*math.Pi)
+		v = math.Acos(tracer.Clamp(n[1], -1, 1)) / math.Pi
+	}
+	return t.image.at(u, v)
+}
+
+// assets are the images textures use, kept like environments as linear
+// RGB.
+var assets = &environmentRegistry{maps: map[string]*envMap{}}
+
+// assetsHandler serves GET /assets, the IDs textures can use, and POST
+// /assets/{id} with an HDR, PNG or JPEG body. Replacing an asset textures
+// scenes loaded after it, not those already rendering.
+func assetsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/assets"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, assets.names())
+	case id != "" && r.Method == http.MethodPost:
+		if !sceneNameRe.MatchString(id) {
+			http.Error(w, fmt.Sprintf("invalid asset id %q", id), http.StatusBadRequest)
+			return
+		}
+		img, err := decodeEnvMap(http.MaxBytesReader(w, r.Body, maxAssetUpload))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		assets.set(id, img)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
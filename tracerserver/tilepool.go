@@ -0,0 +1,255 @@
+package tracerserver
+
+import (
+	"context"
+	"image"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// renderTileSize is the side of the square tiles passes are split into.
+	renderTileSize = 32
+	// backgroundShare is how often a worker picks a background tile over an
+	// interactive one when both are waiting: once every backgroundShare
+	// tiles.
+	backgroundShare = 4
+	// backgroundYield is how long after an interactive reset background
+	// tiles are held back, for the first passes after it to come in fast.
+	backgroundYield = 250 * time.Millisecond
+)
+
+// tileQueue is which of the pool's queues tiles wait in.
+type tileQueue int
+
+const (
+	// interactiveTiles are the sessions' passes.
+	interactiveTiles tileQueue = iota
+	// backgroundTiles are the job queue's renders.
+	backgroundTiles
+)
+
+func (q tileQueue) String() string {
+	if q == backgroundTiles {
+		return "background"
+	}
+	return "interactive"
+}
+
+// renderTiles runs every session's passes and the jobs'. It's set up by
+// NewServer from Options.RenderWorkers.
+var renderTiles *tilePool
+
+// tilePool is a fixed set of workers rendering tiles. Everything that
+// renders a frame piece by piece, the interactive passes, adaptive
+// sampling, a region of interest or the background jobs, splits it into
+// tiles and queues them here, so they all share the workers rather than
+// each starting its own.
+//
+// Interactive tiles go first, but background ones still get one tile in
+// backgroundShare so jobs finish while sessions accumulate forever. Right
+// after an interactive reset background tiles yield entirely for
+// backgroundYield.
+type tilePool struct {
+	workers int
+	queues  [2]chan tileTask
+	quit    chan struct{}
+
+	mu        sync.Mutex
+	lastReset time.Time
+}
+
+type tileTask struct {
+	ctx   context.Context
+	queue tileQueue
+	rect  image.Rectangle
+	fn    func(image.Rectangle)
+	done  *sync.WaitGroup
+}
+
+func newTilePool(workers int) *tilePool {
+	p := &tilePool{workers: workers, queues: [2]chan tileTask{make(chan tileTask), make(chan tileTask)}, quit: make(chan struct{})}
+	renderWorkersGauge.Set(float64(workers))
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *tilePool) work() {
+	for n := 1; ; n++ {
+		first, second := p.queues[interactiveTiles], p.queues[backgroundTiles]
+		if n%backgroundShare == 0 {
+			first, second = second, first
+		}
+		var t tileTask
+		select {
+		case t = <-first:
+		default:
+			select {
+			case t = <-first:
+			case t = <-second:
+			case <-p.quit:
+				return
+			}
+		}
+
+		// Tiles queued before a cancellation are skipped, not rendered.
+		if t.ctx.Err() == nil {
+			start := time.Now()
+			t.fn(t.rect)
+			tileBusySeconds.WithLabelValues(t.queue.String()).Add(time.Since(start).Seconds())
+		}
+		t.done.Done()
+	}
+}
+
+// stop ends the workers once they're done with their tiles. Whatever
+// still renders on p must have been cancelled.
+func (p *tilePool) stop() {
+	close(p.quit)
+}
+
+// interacted holds background tiles back for backgroundYield, called when
+// a session resets its accumulation.
+func (p *tilePool) interacted() {
+	p.mu.Lock()
+	p.lastReset = time.Now()
+	p.mu.Unlock()
+}
+
+// yield waits until backgroundYield has passed since the last interactive
+// reset, or ctx is done.
+func (p *tilePool) yield(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		wait := backgroundYield - time.Since(p.lastReset)
+		p.mu.Unlock()
+		if wait <= 0 {
+			return
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// run calls fn on the workers for each tile of rect, queued in q, and
+// waits for them all. It returns ctx's error if ctx was cancelled on the
+// way, fn having been skipped for some tiles.
+func (p *tilePool) run(ctx context.Context, q tileQueue, rect image.Rectangle, fn func(tile image.Rectangle)) error {
+	var done sync.WaitGroup
+	for y := rect.Min.Y; y < rect.Max.Y; y += renderTileSize {
+		for x := rect.Min.X; x < rect.Max.X; x += renderTileSize {
+			if q == backgroundTiles {
+				p.yield(ctx)
+			}
+			tile := image.Rect(x, y, x+renderTileSize, y+renderTileSize).Intersect(rect)
+			done.Add(1)
+			select {
+			case p.queues[q] <- tileTask{ctx: ctx, queue: q, rect: tile, fn: fn, done: &done}:
+			case <-ctx.Done():
+				done.Done()
+			}
+		}
+	}
+	done.Wait()
+	return ctx.Err()
+}
+
+// tileRender is what a pass renders, spp samples averaged per pixel, and
+// which queue its tiles wait in.
+type tileRender struct {
+	queue        tileQueue
+	frame        *tracer.Frame
+	camera       tracer.Camera
+	scene        tracer.Hitter
+	rayColorFunc tracer.RayColorFunc
+	spp          int
+	maxDepth     int
+	// aggColorFunc replaces averaging the samples if it's set.
+	aggColorFunc tracer.AggColorFunc
+}
+
+// pixelSampler casts camera rays jittered within the pixels of a w by h
+// frame and shades them.
+type pixelSampler struct {
+	camera       tracer.Camera
+	scene        tracer.Hitter
+	rayColorFunc tracer.RayColorFunc
+	maxDepth     int
+	w, h         int
+	// du and dv are the step between neighbouring pixels, the range to
+	// jitter samples over. CameraCoordinatesFromPixel is linear, so it's the
+	// same everywhere.
+	du, dv float64
+}
+
+func newPixelSampler(camera tracer.Camera, scene tracer.Hitter, rayColorFunc tracer.RayColorFunc, maxDepth, w, h int) pixelSampler {
+	u0, v0 := tracer.CameraCoordinatesFromPixel(0, 0, w, h)
+	u1, _ := tracer.CameraCoordinatesFromPixel(0, 1, w, h)
+	_, v1 := tracer.CameraCoordinatesFromPixel(1, 0, w, h)
+	return pixelSampler{
+		camera:       camera,
+		scene:        scene,
+		rayColorFunc: rayColorFunc,
+		maxDepth:     maxDepth,
+		w:            w,
+		h:            h,
+		du:           u1 - u0,
+		dv:           v1 - v0,
+	}
+}
+
+// samplePixel shades n samples of the pixel at row, col, jittered with rnd,
+// and calls add with each.
+func (s pixelSampler) samplePixel(row, col, n int, rnd *rand.Rand, add func(tracer.Color)) {
+	u, v := tracer.CameraCoordinatesFromPixel(row, col, s.w, s.h)
+	for k := 0; k < n; k++ {
+		ray := s.camera.GetRay(u+(rnd.Float64()-0.5)*s.du, v+(rnd.Float64()-0.5)*s.dv)
+		add(s.rayColorFunc(ray, s.scene, s.maxDepth))
+	}
+}
+
+// tileRand is the RNG a tile jitters its samples with, its own so workers
+// don't contend on the global source's lock.
+func tileRand() *rand.Rand {
+	return rand.New(rand.NewSource(rand.Int63()))
+}
+
+// renderRect renders the pixels of rect, x being the column and y the row,
+// into t.frame on p's workers. Pixels outside rect are left alone.
+func (p *tilePool) renderRect(ctx context.Context, t tileRender, rect image.Rectangle) error {
+	w, h := t.frame.Width(), t.frame.Height()
+	rect = rect.Intersect(image.Rect(0, 0, w, h))
+	sampler := newPixelSampler(t.camera, t.scene, t.rayColorFunc, t.maxDepth, w, h)
+
+	return p.run(ctx, t.queue, rect, func(tile image.Rectangle) {
+		rnd := tileRand()
+		var sum tracer.Vec3
+		add := func(c tracer.Color) { sum = sum.Add(c.Vec3()) }
+		for row := tile.Min.Y; row < tile.Max.Y; row++ {
+			for col := tile.Min.X; col < tile.Max.X; col++ {
+				sum = tracer.Vec3{}
+				sampler.samplePixel(row, col, t.spp, rnd, add)
+				t.frame.Set(row, col, tracer.Color(sum.MulFloat(1/float64(t.spp))))
+			}
+		}
+	})
+}
+
+// render renders the whole of t.frame, on p's workers unless it takes a
+// custom aggregation.
+func (p *tilePool) render(ctx context.Context, t tileRender) error {
+	if t.aggColorFunc != nil {
+		return renderAggregated(ctx, t, t.aggColorFunc)
+	}
+	return p.renderRect(ctx, t, image.Rect(0, 0, t.frame.Width(), t.frame.Height()))
+}
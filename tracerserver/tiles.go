@@ -0,0 +1,101 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+const (
+	defaultTileSize = 64
+	// tileThreshold is how far a channel may drift from what the client last
+	// received before the tile is resent. Comparing against the last sent
+	// tile rather than the last frame keeps slow convergence from being
+	// dropped forever.
+	tileThreshold = 2
+)
+
+// tileStreamer tracks, per connection, what the client has on its canvas and
+// encodes only the tiles that changed since.
+//
+// Each message is big endian:
+//
+//	'T' | width u16 | height u16 | count u16 | count * (x u16 | y u16 | w u16 | h u16 | len u32 | data)
+type tileStreamer struct {
+	size int
+	last *image.RGBA
+	// cur is scratch space for the frame being encoded.
+	cur *image.RGBA
+}
+
+func newTileStreamer(size int) *tileStreamer {
+	if size <= 0 {
+		size = defaultTileSize
+	}
+	return &tileStreamer{size: size}
+}
+
+// encode writes the envelope for img's dirty tiles to w and returns how
+// many there were.
+func (t *tileStreamer) encode(w *bytes.Buffer, img image.Image, enc encoder) (int, error) {
+	b := img.Bounds()
+	if t.cur == nil || t.cur.Bounds().Size() != b.Size() {
+		t.cur = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	}
+	cur := t.cur
+	draw.Draw(cur, cur.Bounds(), img, b.Min, draw.Src)
+
+	full := t.last == nil || t.last.Bounds() != cur.Bounds()
+	if full {
+		t.last = image.NewRGBA(cur.Bounds())
+	}
+
+	// The count is filled in once the tiles are written.
+	start := w.Len()
+	w.WriteByte('T')
+	for _, v := range []uint16{uint16(b.Dx()), uint16(b.Dy()), 0} {
+		binary.Write(w, binary.BigEndian, v)
+	}
+
+	data := encodeBuffers.get()
+	defer encodeBuffers.put(data)
+	count := 0
+	for y := 0; y < b.Dy(); y += t.size {
+		for x := 0; x < b.Dx(); x += t.size {
+			r := image.Rect(x, y, x+t.size, y+t.size).Intersect(cur.Bounds())
+			if !full && !tileChanged(t.last, cur, r) {
+				continue
+			}
+
+			data.Reset()
+			if err := enc.Encode(data, cur.SubImage(r)); err != nil {
+				return 0, err
+			}
+			for _, v := range []uint16{uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())} {
+				binary.Write(w, binary.BigEndian, v)
+			}
+			binary.Write(w, binary.BigEndian, uint32(data.Len()))
+			w.Write(data.Bytes())
+
+			draw.Draw(t.last, r, cur, r.Min, draw.Src)
+			count++
+		}
+	}
+	binary.BigEndian.PutUint16(w.Bytes()[start+5:], uint16(count))
+	return count, nil
+}
+
+func tileChanged(prev, cur *image.RGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		p := prev.Pix[prev.PixOffset(r.Min.X, y):prev.PixOffset(r.Max.X, y)]
+		c := cur.Pix[cur.PixOffset(r.Min.X, y):cur.PixOffset(r.Max.X, y)]
+		for i := range c {
+			d := int(c[i]) - int(p[i])
+			if d > tileThreshold || d < -tileThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package tracerserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ghostec/tracer"
+)
+
+const (
+	// keyframeSpacing is how far after the last keyframe one recorded
+	// without a time goes, in seconds.
+	keyframeSpacing = 1
+	playbackFPS     = 30
+	defaultAnimFPS  = 24
+	maxAnimFPS      = 120
+	maxAnimFrames   = 3600
+)
+
+var errTooFewKeyframes = errors.New("an animation needs at least 2 keyframes")
+
+// keyframe is the camera at Time seconds into the animation.
+type keyframe struct {
+	Time   float64    `json:"time"`
+	Camera cameraDesc `json:"camera"`
+}
+
+// timeline is a renderer's keyframes, ordered by time.
+type timeline struct {
+	keyframes []keyframe
+}
+
+// set inserts k, replacing a keyframe at the same time.
+func (t *timeline) set(k keyframe) {
+	i := sort.Search(len(t.keyframes), func(i int) bool { return t.keyframes[i].Time >= k.Time })
+	if i < len(t.keyframes) && t.keyframes[i].Time == k.Time {
+		t.keyframes[i] = k
+		return
+	}
+	t.keyframes = append(t.keyframes, keyframe{})
+	copy(t.keyframes[i+1:], t.keyframes[i:])
+	t.keyframes[i] = k
+}
+
+func (t *timeline) remove(i int) error {
+	if i < 0 || i >= len(t.keyframes) {
+		return fmt.Errorf("no keyframe %d", i)
+	}
+	t.keyframes = append(t.keyframes[:i], t.keyframes[i+1:]...)
+	return nil
+}
+
+func (t timeline) duration() float64 {
+	if len(t.keyframes) < 2 {
+		return 0
+	}
+	return t.keyframes[len(t.keyframes)-1].Time - t.keyframes[0].Time
+}
+
+// at interpolates the camera s seconds after the first keyframe, holding
+// the first and last keyframes outside of the timeline.
+func (t timeline) at(s float64) cameraDesc {
+	ks := t.keyframes
+	s += ks[0].Time
+	i := sort.Search(len(ks), func(i int) bool { return ks[i].Time > s })
+	switch {
+	case i == 0:
+		return ks[0].Camera
+	case i == len(ks):
+		return ks[len(ks)-1].Camera
+	}
+	a, b := ks[i-1], ks[i]
+	return interpolateCamera(a.Camera, b.Camera, (s-a.Time)/(b.Time-a.Time))
+}
+
+// frames samples the timeline at fps, from the first keyframe to the last.
+func (t timeline) frames(fps int) ([]cameraDesc, error) {
+	if len(t.keyframes) < 2 {
+		return nil, errTooFewKeyframes
+	}
+	if fps < 1 || fps > maxAnimFPS {
+		return nil, fmt.Errorf("fps must be between 1 and %d", maxAnimFPS)
+	}
+	n := int(math.Floor(t.duration()*float64(fps))) + 1
+	if n > maxAnimFrames {
+		return nil, fmt.Errorf("%d frames, at most %d are allowed", n, maxAnimFrames)
+	}
+	cams := make([]cameraDesc, n)
+	for i := range cams {
+		cams[i] = t.at(float64(i) / float64(fps))
+	}
+	return cams, nil
+}
+
+// newTimeline checks keyframes given by a client and orders them.
+func newTimeline(keyframes []keyframe) (timeline, error) {
+	t := timeline{keyframes: append([]keyframe(nil), keyframes...)}
+	sort.SliceStable(t.keyframes, func(a, b int) bool { return t.keyframes[a].Time < t.keyframes[b].Time })
+	for i, k := range t.keyframes {
+		if math.IsNaN(k.Time) || math.IsInf(k.Time, 0) {
+			return timeline{}, fmt.Errorf("keyframe %d: invalid time", i)
+		}
+		if i > 0 && k.Time == t.keyframes[i-1].Time {
+			return timeline{}, fmt.Errorf("two keyframes at %gs", k.Time)
+		}
+	}
+	return t, nil
+}
+
+// interpolateCamera blends from a to b by u in [0, 1]. The eye moves in a
+// straight line while the look direction and up vector turn at a constant
+// rate, so pans don't speed up or bulge through the middle.
+func interpolateCamera(a, b cameraDesc, u float64) cameraDesc {
+	from := lerp(tracer.Vec3(a.LookFrom), tracer.Vec3(b.LookFrom), u)
+	dirA := tracer.Vec3(a.LookAt).Sub(tracer.Vec3(a.LookFrom))
+	dirB := tracer.Vec3(b.LookAt).Sub(tracer.Vec3(b.LookFrom))
+	dist := dirA.Len() + (dirB.Len()-dirA.Len())*u
+	dir := slerp(dirA.Unit(), dirB.Unit(), u).MulFloat(dist)
+
+	upA, upB := tracer.Vec3(a.VUp), tracer.Vec3(b.VUp)
+	if upA == (tracer.Vec3{}) {
+		upA = tracer.Vec3{0, 1, 0}
+	}
+	if upB == (tracer.Vec3{}) {
+		upB = tracer.Vec3{0, 1, 0}
+	}
+
+	return cameraDesc{
+		AspectRatio: a.AspectRatio + (b.AspectRatio-a.AspectRatio)*u,
+		VFoV:        a.VFoV + (b.VFoV-a.VFoV)*u,
+		LookFrom:    [3]float64(from),
+		LookAt:      [3]float64(from.Add(dir)),
+		VUp:         [3]float64(slerp(upA.Unit(), upB.Unit(), u)),
+	}
+}
+
+func lerp(a, b tracer.Vec3, u float64) tracer.Vec3 {
+	return a.Add(b.Sub(a).MulFloat(u))
+}
+
+// slerp turns unit vector a towards b. Nearly parallel, or opposite,
+// vectors fall back to a normalized lerp.
+func slerp(a, b tracer.Vec3, u float64) tracer.Vec3 {
+	theta := math.Acos(tracer.Clamp(a.Dot(b), -1, 1))
+	sin := math.Sin(theta)
+	if sin < 1e-6 {
+		v := lerp(a, b, u)
+		if v.Len() < 1e-6 {
+			return a
+		}
+		return v.Unit()
+	}
+	return a.MulFloat(math.Sin((1-u)*theta) / sin).Add(b.MulFloat(math.Sin(u*theta) / sin))
+}
+
+type timelinePayload struct {
+	Keyframes []keyframe `json:"keyframes"`
+	Duration  float64    `json:"duration"`
+	Playing   bool       `json:"playing"`
+}
+
+func (r *renderer) timelinePayload() timelinePayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timelinePayloadLocked()
+}
+
+func (r *renderer) timelinePayloadLocked() timelinePayload {
+	return timelinePayload{
+		Keyframes: append([]keyframe{}, r.timeline.keyframes...),
+		Duration:  r.timeline.duration(),
+		Playing:   r.stopPlayback != nil,
+	}
+}
+
+// addKeyframe records the current camera at s seconds, or keyframeSpacing
+// after the last keyframe if s is nil.
+func (r *renderer) addKeyframe(s *float64) (timelinePayload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := keyframe{Camera: describeCamera(r.camera)}
+	switch {
+	case s != nil:
+		if math.IsNaN(*s) || math.IsInf(*s, 0) {
+			return timelinePayload{}, errors.New("invalid time")
+		}
+		k.Time = *s
+	case len(r.timeline.keyframes) > 0:
+		k.Time = r.timeline.keyframes[len(r.timeline.keyframes)-1].Time + keyframeSpacing
+	}
+	r.timeline.set(k)
+	return r.timelinePayloadLocked(), nil
+}
+
+func (r *renderer) deleteKeyframe(i int) (timelinePayload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.timeline.remove(i); err != nil {
+		return timelinePayload{}, err
+	}
+	return r.timelinePayloadLocked(), nil
+}
+
+// play moves the camera along the timeline in real time, from the start,
+// until it ends, or forever with loop. stopped is called once playback
+// ends on its own.
+func (r *renderer) play(loop bool, stopped func()) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.timeline.keyframes) < 2 {
+		return errTooFewKeyframes
+	}
+	t := timeline{keyframes: append([]keyframe(nil), r.timeline.keyframes...)}
+	r.playLocked(t, loop, nil, stopped)
+	return nil
+}
+
+// playLocked moves the camera along t, replacing whatever was playing.
+// ease, if set, reshapes the progress through t over its duration.
+func (r *renderer) playLocked(t timeline, loop bool, ease func(float64) float64, stopped func()) {
+	r.stopPlaybackLocked()
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.stopPlayback = cancel
+	duration := t.duration()
+
+	go func() {
+		ticker := time.NewTicker(time.Second / playbackFPS)
+		defer ticker.Stop()
+		start := time.Now()
+		for {
+			s := time.Since(start).Seconds()
+			if loop {
+				s = math.Mod(s, duration)
+			}
+			at := s
+			if ease != nil {
+				at = ease(math.Min(s/duration, 1)) * duration
+			}
+			cam := t.at(at)
+			err := r.do(func() error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				r.setCamera(cam)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			if !loop && s >= duration {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		r.mu.Lock()
+		ended := ctx.Err() == nil
+		if ended {
+			r.stopPlaybackLocked()
+		}
+		r.mu.Unlock()
+		if ended && stopped != nil {
+			stopped()
+		}
+	}()
+}
+
+func (r *renderer) stopPlaying() {
+	r.mu.Lock()
+	r.stopPlaybackLocked()
+	r.mu.Unlock()
+}
+
+func (r *renderer) stopPlaybackLocked() {
+	if r.stopPlayback != nil {
+		r.stopPlayback()
+		r.stopPlayback = nil
+	}
+}
+
+// setCamera moves the camera to cam, keeping the frame's aspect ratio.
+func (r *renderer) setCamera(desc cameraDesc) {
+	r.updateCamera(func(cam tracer.Camera) (tracer.Camera, error) {
+		aspect := cam.AspectRatio
+		cam = desc.Camera()
+		cam.AspectRatio = aspect
+		return cam, nil
+	})
+}
+
+// animationJob is a job rendering the renderer's scene along its timeline
+// at fps, at settings instead of its own.
+func (r *renderer) animationJob(settings renderSettings, fps int) (*renderJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	descs, err := r.timeline.frames(fps)
+	if err != nil {
+		return nil, err
+	}
+	rayColorFunc, maxDepth := r.rayColorLocked(r.camera, settings)
+	settings.MaxDepth = maxDepth
+	return newAnimationJob(r.scene, cameras(descs), rayColorFunc, settings, fps), nil
+}
+
+func cameras(descs []cameraDesc) []tracer.Camera {
+	cams := make([]tracer.Camera, len(descs))
+	for i, d := range descs {
+		cams[i] = d.Camera()
+	}
+	return cams
+}
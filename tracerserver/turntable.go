@@ -0,0 +1,59 @@
+package tracerserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ghostec/tracer"
+)
+
+const defaultTurntableFrames = 36
+
+// turntable serves GET /turntable, a job orbiting the camera once around
+// the selected object, or the scene's centroid, over ?frames= frames. It
+// takes snapshot's parameters and responds with writeAnimationResult's
+// formats, ?fps= setting a video's frame rate.
+func turntable(w http.ResponseWriter, r *http.Request) {
+	serveRendererJob(w, r, func(rend *renderer, settings renderSettings, query url.Values) (*renderJob, error) {
+		frames, fps := defaultTurntableFrames, defaultAnimFPS
+		for key, dst := range map[string]*int{"frames": &frames, "fps": &fps} {
+			if v := query.Get(key); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+				*dst = n
+			}
+		}
+		if frames < 1 || frames > maxAnimFrames {
+			return nil, fmt.Errorf("frames must be between 1 and %d", maxAnimFrames)
+		}
+		if fps < 1 || fps > maxAnimFPS {
+			return nil, fmt.Errorf("fps must be between 1 and %d", maxAnimFPS)
+		}
+		return rend.turntableJob(settings, frames, fps), nil
+	})
+}
+
+// turntableJob is a job rendering frames views of the renderer's scene,
+// each turned 360/frames degrees further around the vertical axis through
+// the target. The camera keeps its distance and height.
+func (r *renderer) turntableJob(settings renderSettings, frames, fps int) *renderJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	target := centroid(r.scene)
+	if r.selected >= 0 {
+		target = centroid(r.objects[r.selected])
+	}
+	cams := make([]tracer.Camera, frames)
+	for i := range cams {
+		cams[i] = orbit(r.camera, target, 360*float64(i)/float64(frames), 0)
+	}
+
+	rayColorFunc, maxDepth := r.rayColorLocked(r.camera, settings)
+	settings.MaxDepth = maxDepth
+	return newAnimationJob(r.scene, cams, rayColorFunc, settings, fps)
+}
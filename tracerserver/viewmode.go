@@ -0,0 +1,99 @@
+package tracerserver
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ghostec/tracer"
+)
+
+// viewModes are the debug views the view_mode setting swaps the shading
+// for. Unlike the AOV passes they replace what every client is streamed
+// and accumulate like the beauty pass does. Each is given the shading it
+// replaces.
+var viewModes = map[string]func(shade tracer.RayColorFunc, camera tracer.Camera, settings renderSettings, maxDepth int) tracer.RayColorFunc{
+	"bvh_id": func(tracer.RayColorFunc, tracer.Camera, renderSettings, int) tracer.RayColorFunc {
+		return tracer.RayBVHID
+	},
+	"normal": func(tracer.RayColorFunc, tracer.Camera, renderSettings, int) tracer.RayColorFunc {
+		return aovNormal
+	},
+	"depth": func(_ tracer.RayColorFunc, camera tracer.Camera, settings renderSettings, _ int) tracer.RayColorFunc {
+		return depthHeat(2 * focusDistance(camera, settings))
+	},
+	"cost": func(shade tracer.RayColorFunc, _ tracer.Camera, _ renderSettings, maxDepth int) tracer.RayColorFunc {
+		return costHeat(shade, maxDepth)
+	},
+}
+
+func viewModeNames() []string {
+	names := []string{beautyPass}
+	for name := range viewModes {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+func validViewMode(mode string) error {
+	if _, ok := viewModes[mode]; mode != "" && mode != beautyPass && !ok {
+		return fmt.Errorf("view_mode must be one of %v, got %q", viewModeNames(), mode)
+	}
+	return nil
+}
+
+// withViewMode is shade, or the debug view settings ask for in its place.
+func withViewMode(shade tracer.RayColorFunc, camera tracer.Camera, settings renderSettings, maxDepth int) tracer.RayColorFunc {
+	view, ok := viewModes[settings.ViewMode]
+	if !ok {
+		return shade
+	}
+	return view(shade, camera, settings, maxDepth)
+}
+
+// depthHeat colors the hit distance from near to far, far being anything
+// past far. A miss is left black.
+func depthHeat(far float64) tracer.RayColorFunc {
+	return func(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+		hr := n.Hit(r)
+		if !hr.Hit {
+			return tracer.Color{}
+		}
+		return heat(hr.P.Vec3().Sub(r.Origin.Vec3()).Len() / far)
+	}
+}
+
+// costHeat shades with shade, but colors the pixel by how many rays that
+// took, bounces included, out of the most maxDepth allows.
+func costHeat(shade tracer.RayColorFunc, maxDepth int) tracer.RayColorFunc {
+	return func(r tracer.Ray, n tracer.Hitter, depth int) tracer.Color {
+		c := &countingHitter{Hitter: n}
+		shade(r, c, depth)
+		return heat(float64(c.rays) / float64(maxDepth))
+	}
+}
+
+// countingHitter counts the rays cast at the scene.
+type countingHitter struct {
+	tracer.Hitter
+	rays int
+}
+
+func (c *countingHitter) Hit(r tracer.Ray) tracer.HitRecord {
+	c.rays++
+	return c.Hitter.Hit(r)
+}
+
+// heatStops run from blue at 0 through cyan, green and yellow to red at 1.
+var heatStops = []tracer.Color{{0, 0, 1}, {0, 1, 1}, {0, 1, 0}, {1, 1, 0}, {1, 0, 0}}
+
+// heat maps t in [0, 1] onto heatStops. The colors are squared so they
+// come out as they are through the gamma 2 frames are encoded with.
+func heat(t float64) tracer.Color {
+	t = tracer.Clamp(t, 0, 1) * float64(len(heatStops)-1)
+	i := int(math.Min(t, float64(len(heatStops)-2)))
+	a, b := heatStops[i].Vec3(), heatStops[i+1].Vec3()
+	c := a.MulFloat(1 - (t - float64(i))).Add(b.MulFloat(t - float64(i)))
+	return tracer.Color(c.MulVec3(c))
+}
@@ -0,0 +1,96 @@
+package tracerserver
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// sceneWatchDelay lets an editor finish saving before the scene is read,
+// the changes of one save arrive as several events.
+const sceneWatchDelay = 100 * time.Millisecond
+
+// sceneWatchers are closed by Shutdown.
+var sceneWatchers struct {
+	mu sync.Mutex
+	l  []*fsnotify.Watcher
+}
+
+// WatchScene reloads the JSON scene description at path into every
+// session whenever the file changes, keeping their cameras, until
+// Shutdown. A change that doesn't parse or build is logged and the scene
+// left as it was.
+func (s *Server) WatchScene(path string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Editors that save by renaming a new file over the old one end a
+	// watch on the file itself, the directory's outlives them.
+	path = filepath.Clean(path)
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+	sceneWatchers.mu.Lock()
+	sceneWatchers.l = append(sceneWatchers.l, w)
+	sceneWatchers.mu.Unlock()
+	go watchScene(w, path)
+	return nil
+}
+
+func watchScene(w *fsnotify.Watcher, path string) {
+	var pending *time.Timer
+	for {
+		select {
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) != path || e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if pending != nil {
+				pending.Stop()
+			}
+			pending = time.AfterFunc(sceneWatchDelay, func() {
+				reloadSceneFile(path)
+			})
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logs.Warn("watching scene failed", "path", path, "err", err)
+		}
+	}
+}
+
+func reloadSceneFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		logs.Warn("reloading scene failed", "path", path, "err", err)
+		return
+	}
+	defer f.Close()
+	desc, err := decodeScene(f)
+	if err == nil {
+		err = sessions.reloadScene(desc)
+	}
+	if err != nil {
+		logs.Warn("reloading scene failed", "path", path, "err", err)
+		return
+	}
+	logs.Info("scene reloaded", "path", path)
+}
+
+func closeSceneWatchers() {
+	sceneWatchers.mu.Lock()
+	defer sceneWatchers.mu.Unlock()
+	for _, w := range sceneWatchers.l {
+		w.Close()
+	}
+	sceneWatchers.l = nil
+}
@@ -0,0 +1,226 @@
+package tracerserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// vp8Pipeline feeds raw RGBA frames to ffmpeg and forwards the VP8 frames it
+// writes back, as IVF, to a WebRTC track. Go has no VP8 encoder of its own.
+type vp8Pipeline struct {
+	cmd           *exec.Cmd
+	stdin         io.WriteCloser
+	width, height int
+}
+
+func newVP8Pipeline(width, height int, track *webrtc.TrackLocalStaticSample) (*vp8Pipeline, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("%w: ffmpeg not found in PATH", errEncoderUnavailable)
+	}
+
+	interval := frameInterval()
+	fps := strconv.Itoa(int(time.Second / interval))
+	cmd := exec.Command(ffmpeg,
+		"-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "rgba", "-s", fmt.Sprintf("%dx%d", width, height), "-framerate", fps, "-i", "-",
+		"-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8", "-b:v", "2M", "-g", fps, "-auto-alt-ref", "0",
+		"-f", "ivf", "-",
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ivf, _, err := ivfreader.NewWith(stdout)
+		if err != nil {
+			logs.Error("webrtc: reading ivf failed", "err", err)
+			return
+		}
+		for {
+			frame, _, err := ivf.ParseNextFrame()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					logs.Error("webrtc: reading ivf failed", "err", err)
+				}
+				return
+			}
+			if err := track.WriteSample(media.Sample{Data: frame, Duration: interval}); err != nil {
+				logs.Warn("webrtc: writing sample failed", "err", err)
+				return
+			}
+		}
+	}()
+
+	return &vp8Pipeline{cmd: cmd, stdin: stdin, width: width, height: height}, nil
+}
+
+func (p *vp8Pipeline) write(img *image.RGBA) error {
+	_, err := p.stdin.Write(img.Pix)
+	return err
+}
+
+func (p *vp8Pipeline) close() {
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+// streamWebRTC pushes the renderer's frames to track until done is closed or
+// the renderer shuts down. The ffmpeg pipeline is restarted whenever the
+// resolution changes.
+func streamWebRTC(rend *renderer, track *webrtc.TrackLocalStaticSample, done <-chan struct{}) {
+	var pipeline *vp8Pipeline
+	defer func() {
+		if pipeline != nil {
+			pipeline.close()
+		}
+	}()
+
+	ticker := time.NewTicker(frameInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-rend.done():
+			return
+		case <-ticker.C:
+		}
+
+		src := rend.Image()
+		b := src.Bounds()
+		img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+
+		if pipeline != nil && (pipeline.width != b.Dx() || pipeline.height != b.Dy()) {
+			pipeline.close()
+			pipeline = nil
+		}
+		if pipeline == nil {
+			var err error
+			if pipeline, err = newVP8Pipeline(b.Dx(), b.Dy(), track); err != nil {
+				logs.Error("webrtc: starting encoder failed", "err", err)
+				return
+			}
+		}
+		if err := pipeline.write(img); err != nil {
+			logs.Error("webrtc: encoding failed", "err", err)
+			return
+		}
+	}
+}
+
+// webrtcOffer answers an SDP offer with a peer connection carrying a single
+// VP8 track of the session's frames. Input still goes over the websocket.
+func webrtcOffer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rend, ok := requestRenderer(w, r)
+	if !ok {
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := newWebRTCPeer(rend, offer)
+	if err != nil {
+		requestLog(r).Error("webrtc: answering offer failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(answer); err != nil {
+		requestLog(r).Warn("webrtc: writing answer failed", "err", err)
+	}
+}
+
+func newWebRTCPeer(rend *renderer, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "tracer")
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() {
+		// RTCP has to be drained for interceptors (NACK etc.) to work.
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		done            = make(chan struct{})
+		started, closed sync.Once
+	)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		switch s {
+		case webrtc.PeerConnectionStateConnected:
+			started.Do(func() { go streamWebRTC(rend, track, done) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			closed.Do(func() {
+				close(done)
+				pc.Close()
+			})
+		}
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	<-gathered
+
+	return pc.LocalDescription(), nil
+}
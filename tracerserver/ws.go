@@ -0,0 +1,1285 @@
+package tracerserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghostec/tracer"
+	"github.com/gorilla/websocket"
+)
+
+// defaultFrameInterval is the time between frames until Options set it.
+const defaultFrameInterval = 200 * time.Millisecond
+
+// frameIntervalNS is the default time between frames, reloadable, see
+// frameInterval.
+var frameIntervalNS = int64(defaultFrameInterval)
+
+func frameInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&frameIntervalNS))
+}
+
+func setFrameInterval(d time.Duration) {
+	atomic.StoreInt64(&frameIntervalNS, int64(d))
+}
+
+const (
+	writeWait = 10 * time.Second
+	// pongWait is how long a connection may stay silent, pings go out
+	// often enough that a live client always answers in time.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+)
+
+type client struct {
+	conn    *websocket.Conn
+	session *session
+	// resumed is whether the connection picked a detached session up again.
+	resumed bool
+
+	wmu sync.Mutex
+
+	emu     sync.Mutex
+	format  streamFormatPayload
+	encoder encoder
+	tiles   *tileStreamer
+	pass    string
+	// scrub is the history frame streamed instead of the live one.
+	scrub image.Image
+	// overlay is the GUI frame last sent on its own.
+	overlay *tracer.Frame
+
+	stream     *stream
+	remoteAddr string
+	user       principal
+	// log tags every line with the connection, its session's ID, and who's
+	// on the other end.
+	log *logger
+
+	pmu     sync.Mutex
+	present presencePayload
+
+	rmu sync.Mutex
+	rec *recording
+
+	lmu      sync.Mutex
+	limits   map[string]*tokenBucket
+	deferred map[string]*deferredMessage
+
+	// hoverAt is the latest hover position, waiting for hoverLoop.
+	hmu       sync.Mutex
+	hoverAt   *pointerPayload
+	hoverWake chan struct{}
+}
+
+// setFormat switches the stream encoding. Format "none" stops frames from
+// being sent at all, for clients that receive them over WebRTC.
+func (c *client) setFormat(p streamFormatPayload) error {
+	var (
+		enc encoder
+		err error
+	)
+	if p.Format != "none" {
+		if enc, err = newStreamEncoder(p.Format, p.Quality); err != nil {
+			return err
+		}
+	}
+	if p.TileSize < 0 || p.TileSize > 1024 {
+		return fmt.Errorf("tile_size must be between 1 and 1024, or 0 for the default %d, got %d", defaultTileSize, p.TileSize)
+	}
+	var tiles *tileStreamer
+	if p.Tiles && enc != nil {
+		tiles = newTileStreamer(p.TileSize)
+		p.TileSize = tiles.size
+	}
+	c.emu.Lock()
+	c.format, c.encoder, c.tiles, c.overlay = p, enc, tiles, nil
+	c.emu.Unlock()
+	return nil
+}
+
+func (c *client) formatInfo() streamFormatInfoPayload {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	info := streamFormatInfoPayload{
+		Format:   c.format.Format,
+		Quality:  c.format.Quality,
+		Tiles:    c.tiles != nil,
+		TileSize: c.format.TileSize,
+		Overlay:  c.format.Overlay,
+		Envelope: c.format.Envelope,
+	}
+	if c.encoder != nil {
+		info.ContentType = c.encoder.ContentType()
+	}
+	return info
+}
+
+// encodeFrame encodes the renderer's current image as a whole frame, or as
+// a dirty tile envelope in tiled mode, into a buffer from encodeBuffers,
+// wrapped in an envelope if the client asked for one. It returns no buffer
+// when streaming is off.
+func (c *client) encodeFrame(rend *renderer) (*bytes.Buffer, frameInfoPayload, error) {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+
+	if c.encoder == nil {
+		return nil, frameInfoPayload{}, nil
+	}
+
+	start := time.Now()
+	info := frameInfoPayload{ContentType: c.encoder.ContentType()}
+
+	img := c.scrub
+	stamp, pass := frameStamp{}, historyPass
+	var err error
+	if img == nil {
+		// Stamped before it's read, a reset in between only makes a fresh
+		// frame look stale.
+		stamp, pass = rend.frameStamp(), c.pass
+		if pass == "" {
+			pass = beautyPass
+		}
+		if img, err = rend.passImage(c.pass, !c.format.Overlay); err != nil {
+			return nil, info, err
+		}
+	}
+
+	enc := c.encoder
+	if level := c.stream.degradeLevel(); level > 0 {
+		q := degradedQuality(level, c.format.Quality)
+		if enc, err = newStreamEncoder(c.format.Format, q.Quality); err != nil {
+			return nil, info, err
+		}
+		img = downscale(img, q.Scale)
+	}
+
+	buf := encodeBuffers.get()
+	var env *envelope
+	if c.format.Envelope {
+		kind := envelopeFrame
+		if c.tiles != nil {
+			kind = envelopeTiles
+		}
+		env = beginEnvelope(buf, kind, stamp, pass)
+	}
+	switch c.tiles {
+	case nil:
+		err = enc.Encode(buf, img)
+	default:
+		info.Tiles, err = c.tiles.encode(buf, img, enc)
+	}
+	if err != nil {
+		encodeBuffers.put(buf)
+		return nil, info, err
+	}
+	if env != nil {
+		env.end()
+	}
+
+	elapsed := time.Since(start)
+	encodeSeconds.WithLabelValues(info.ContentType).Observe(elapsed.Seconds())
+	info.Bytes = buf.Len()
+	info.EncodeMS = float64(elapsed.Microseconds()) / 1000
+	return buf, info, nil
+}
+
+func (c *client) write(messageType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	start := time.Now()
+	c.conn.SetWriteDeadline(start.Add(writeWait))
+	if err := c.conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	wsSendSeconds.Observe(time.Since(start).Seconds())
+	wsBytesSent.WithLabelValues(sessionLabel(c.session)).Add(float64(len(data)))
+	return nil
+}
+
+func (c *client) send(typ, id string, payload interface{}) error {
+	data, err := encodeMessage(typ, id, payload)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, data)
+}
+
+type handlerFunc func(c *client, payload json.RawMessage) error
+
+var handlers = map[string]handlerFunc{
+	"camera_move":      handleCameraMove,
+	"hover":            handleHover,
+	"select":           handleSelect,
+	"marquee":          handleMarquee,
+	"select_object":    handleSelectObject,
+	"name_object":      handleNameObject,
+	"gizmo_pick":       handleGizmoPick,
+	"gizmo_drag":       handleGizmoDrag,
+	"lesson":           handleLesson,
+	"reset":            handleReset,
+	"settings":         handleSettings,
+	"transform":        handleTransform,
+	"set_material":     handleSetMaterial,
+	"stream_format":    handleStreamFormat,
+	"drag":             handleDrag,
+	"wheel":            handleWheel,
+	"orbit":            handleOrbit,
+	"pan":              handlePan,
+	"dolly":            handleDolly,
+	"inspect":          handleInspect,
+	"orbit_target":     handleOrbitTarget,
+	"camera_key":       handleCameraKey,
+	"pause":            handlePause,
+	"highlight_node":   handleHighlightNode,
+	"add_object":       handleAddObject,
+	"delete_object":    handleDeleteObject,
+	"duplicate_object": handleDuplicateObject,
+	"undo":             handleUndo,
+	"redo":             handleRedo,
+	"view_pass":        handleViewPass,
+	"frame_rate":       handleFrameRate,
+	"keyframe":         handleKeyframe,
+	"delete_keyframe":  handleDeleteKeyframe,
+	"timeline_play":    handleTimelinePlay,
+	"timeline_render":  handleTimelineRender,
+	"record":           handleRecord,
+	"frame_history":    handleFrameHistory,
+	"scrub":            handleScrub,
+	"save_camera":      handleSaveCamera,
+	"camera_preset":    handleCameraPreset,
+	"focus":            handleFocus,
+	"view":             handleView,
+	"add_light":        handleAddLight,
+	"edit_light":       handleEditLight,
+	"solo_light":       handleSoloLight,
+	"lights":           handleLights,
+	"compare":          handleCompare,
+	"compare_split":    handleCompareSplit,
+	"render_target":    handleRenderTarget,
+	"clip_plane":       handleClipPlane,
+}
+
+func handleCameraMove(c *client, raw json.RawMessage) error {
+	var p cameraMovePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.session.renderer.moveCamera(tracer.Vec3(p.Delta))
+	c.cameraMoved()
+	return nil
+}
+
+const (
+	dollyPerPixel      = 0.01
+	dollyPerWheelDelta = 0.001
+)
+
+func handleDrag(c *client, raw json.RawMessage) error {
+	var p dragPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	rend := c.session.renderer
+	switch {
+	case p.Button == 2 || p.Ctrl || p.Alt:
+		rend.dollyCamera(-p.DY * dollyPerPixel)
+	case p.Button == 1 || p.Shift:
+		rend.panCamera(p.DX, p.DY)
+	default:
+		rend.orbitCamera(p.DX, p.DY)
+	}
+	c.cameraMoved()
+	return nil
+}
+
+func handleWheel(c *client, raw json.RawMessage) error {
+	var p wheelPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.session.renderer.dollyCamera(-p.Delta * dollyPerWheelDelta)
+	c.cameraMoved()
+	return nil
+}
+
+func handleOrbit(c *client, raw json.RawMessage) error {
+	var p orbitPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.session.renderer.orbitCameraDegrees(p.Yaw, p.Pitch)
+	c.cameraMoved()
+	return nil
+}
+
+func handlePan(c *client, raw json.RawMessage) error {
+	var p panPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.session.renderer.panCamera(p.DX, p.DY)
+	c.cameraMoved()
+	return nil
+}
+
+func handleDolly(c *client, raw json.RawMessage) error {
+	var p dollyPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.session.renderer.dollyCamera(p.Amount)
+	c.cameraMoved()
+	return nil
+}
+
+func handleOrbitTarget(c *client, raw json.RawMessage) error {
+	var p orbitTargetPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	var target *tracer.Point3
+	if p.Target != nil {
+		t := tracer.Point3(*p.Target)
+		target = &t
+	}
+	c.session.renderer.setOrbitTarget(target)
+	return nil
+}
+
+func handleCameraKey(c *client, raw json.RawMessage) error {
+	var p cameraKeyPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.session.renderer.keyCamera(p.Action, p.Fast); err != nil {
+		return errBadPayload(fmt.Errorf("%v %q", err, p.Action))
+	}
+	c.cameraMoved()
+	return nil
+}
+
+// handleHover hands the position to c's hover worker, which replies with
+// a hover message once it has cast the ray and redrawn the overlay.
+func handleHover(c *client, raw json.RawMessage) error {
+	var p pointerPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	c.hover(p)
+	c.updatePresence(func(pr *presencePayload) {
+		pr.Cursor = &[2]int{p.X, p.Y}
+	})
+	return nil
+}
+
+// handleInspect is hover for touch: a long press highlights what's under
+// it and replies with what handleSelect would, without selecting it.
+func handleInspect(c *client, raw json.RawMessage) error {
+	var p pointerPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	pick := c.session.renderer.mousemove(p.X, p.Y)
+	c.updatePresence(func(pr *presencePayload) {
+		pr.Cursor = &[2]int{p.X, p.Y}
+	})
+	return c.send("inspect", "", pick)
+}
+
+func handleSelect(c *client, raw json.RawMessage) error {
+	var p selectPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	pick := c.session.renderer.mouseclick(p.X, p.Y, p.Add)
+	c.updatePresence(func(pr *presencePayload) {
+		pr.Selected = pick.Object
+	})
+	hooks.emit(Event{Type: EventObjectSelected, Session: c.session.id, Selection: pick.Selection})
+	return c.send("pick", "", pick)
+}
+
+func handleMarquee(c *client, raw json.RawMessage) error {
+	var p marqueePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	pick := c.session.renderer.marquee(p.X0, p.Y0, p.X1, p.Y1, p.Add)
+	c.updatePresence(func(pr *presencePayload) {
+		pr.Selected = pick.Object
+	})
+	hooks.emit(Event{Type: EventObjectSelected, Session: c.session.id, Selection: pick.Selection})
+	return c.send("pick", "", pick)
+}
+
+// handleGizmoPick tells the client which arm of the translation gizmo is
+// under the pointer, for it to send gizmo_drag rather than drag while the
+// pointer moves.
+func handleGizmoPick(c *client, raw json.RawMessage) error {
+	var p pointerPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	axis := c.session.renderer.pickGizmo(float64(p.X), float64(p.Y))
+	return c.send("gizmo_pick", "", gizmoPickPayload{Axis: axis})
+}
+
+func handleGizmoDrag(c *client, raw json.RawMessage) error {
+	var p gizmoDragPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if _, err := gizmoAxis(p.Axis); err != nil {
+		return errBadPayload(err)
+	}
+	if err := editError(c.session.renderer.dragGizmo(p.Axis, p.X, p.Y, p.DX, p.DY)); err != nil {
+		return err
+	}
+	c.session.renderer.interact()
+	return nil
+}
+
+// handleFocus moves the focal plane to the hit under the pointer.
+func handleFocus(c *client, raw json.RawMessage) error {
+	var p pointerPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	settings, err := c.session.renderer.focusAt(p.X, p.Y)
+	switch {
+	case errors.Is(err, errNothingToFocus):
+		return &protocolError{Code: "no_hit", Message: err.Error()}
+	case err != nil:
+		return errBadPayload(err)
+	}
+	return c.send("settings", "", settings)
+}
+
+func handleLesson(c *client, raw json.RawMessage) error {
+	var p lessonPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if p.Stage < -1 || p.Stage >= len(lessonStages) {
+		return &protocolError{Code: "bad_payload", Message: fmt.Sprintf("stage must be between -1 and %d", len(lessonStages)-1)}
+	}
+	c.session.renderer.setLessonStage(p.Stage)
+	c.session.renderer.reset()
+	return nil
+}
+
+func handleSettings(c *client, raw json.RawMessage) error {
+	var p settingsPatch
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	settings, err := c.session.renderer.updateSettings(p)
+	if err != nil {
+		return &protocolError{Code: "bad_payload", Message: err.Error()}
+	}
+	return c.send("settings", "", settings)
+}
+
+func handleCompare(c *client, raw json.RawMessage) error {
+	var p comparePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	res, err := c.session.renderer.setCompare(p)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	c.broadcast("compare", res)
+	return c.send("compare", "", res)
+}
+
+func handleRenderTarget(c *client, raw json.RawMessage) error {
+	var p renderTargetPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.session.renderer.setTarget(p); err != nil {
+		return errBadPayload(err)
+	}
+	c.broadcast("render_target", p)
+	return c.send("render_target", "", p)
+}
+
+func handleCompareSplit(c *client, raw json.RawMessage) error {
+	var p compareSplitPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	res, err := c.session.renderer.setCompareSplit(p.Split)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	c.broadcast("compare", res)
+	return c.send("compare", "", res)
+}
+
+func handleTransform(c *client, raw json.RawMessage) error {
+	var p transformPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	scale := 1.0
+	if p.Scale != nil {
+		scale = *p.Scale
+	}
+	return editError(c.session.renderer.transformSelected(tracer.Vec3(p.Translate), scale))
+}
+
+func handleSetMaterial(c *client, raw json.RawMessage) error {
+	var p setMaterialPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	m, err := p.Material.Material()
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return editError(c.session.renderer.setSelectedMaterial(m))
+}
+
+func handleAddObject(c *client, raw json.RawMessage) error {
+	var p addObjectPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	h, err := p.Sphere.Hitter()
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return editError(c.session.renderer.addObject(h))
+}
+
+// handleAddLight adds a light, newLight's defaults filling in what the
+// payload leaves out, and selects it.
+func handleAddLight(c *client, raw json.RawMessage) error {
+	var p lightPatch
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	rend := c.session.renderer
+	h, err := rend.newLight(p).Hitter()
+	if err != nil {
+		return errBadPayload(err)
+	}
+	if err := editError(rend.addObject(h)); err != nil {
+		return err
+	}
+	return c.shareLights()
+}
+
+func handleEditLight(c *client, raw json.RawMessage) error {
+	var p lightPatch
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := editError(c.session.renderer.editSelectedLight(p)); err != nil {
+		return err
+	}
+	return c.shareLights()
+}
+
+// handleSoloLight turns every light but the selected one off, or all of
+// them back on.
+func handleSoloLight(c *client, raw json.RawMessage) error {
+	var p soloLightPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := editError(c.session.renderer.soloSelectedLight(p.Solo)); err != nil {
+		return err
+	}
+	return c.shareLights()
+}
+
+func handleLights(c *client, raw json.RawMessage) error {
+	return c.send("lights", "", c.session.renderer.lights())
+}
+
+func handleDeleteObject(c *client, raw json.RawMessage) error {
+	return editError(c.session.renderer.deleteSelected())
+}
+
+func handleDuplicateObject(c *client, raw json.RawMessage) error {
+	var p duplicateObjectPayload
+	if len(raw) > 0 {
+		if err := decodePayload(raw, &p); err != nil {
+			return err
+		}
+	}
+	return editError(c.session.renderer.duplicateSelected((*tracer.Vec3)(p.Offset)))
+}
+
+func handleViewPass(c *client, raw json.RawMessage) error {
+	var p viewPassPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if _, ok := aovPasses[p.Pass]; !ok && p.Pass != beautyPass {
+		return &protocolError{Code: "bad_payload", Message: fmt.Sprintf("unknown pass %q, want one of %v", p.Pass, aovNames())}
+	}
+	c.emu.Lock()
+	c.pass = p.Pass
+	c.emu.Unlock()
+	return nil
+}
+
+func handleFrameRate(c *client, raw json.RawMessage) error {
+	var p frameRatePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := validateFPS(p.FPS); err != nil {
+		return errBadPayload(err)
+	}
+	c.stream.setFPS(p.FPS)
+	return c.send("frame_rate", "", p)
+}
+
+func handleKeyframe(c *client, raw json.RawMessage) error {
+	var p keyframePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	tl, err := c.session.renderer.addKeyframe(p.Time)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return c.shareTimeline(tl)
+}
+
+func handleDeleteKeyframe(c *client, raw json.RawMessage) error {
+	var p deleteKeyframePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	tl, err := c.session.renderer.deleteKeyframe(p.Index)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return c.shareTimeline(tl)
+}
+
+func handleTimelinePlay(c *client, raw json.RawMessage) error {
+	var p timelinePlayPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	rend := c.session.renderer
+	if !p.Playing {
+		rend.stopPlaying()
+		return c.shareTimeline(rend.timelinePayload())
+	}
+	err := rend.play(p.Loop, func() {
+		if err := c.shareTimeline(rend.timelinePayload()); err != nil {
+			c.log.Warn("sharing timeline failed", "err", err)
+		}
+	})
+	if err != nil {
+		return errBadPayload(err)
+	}
+	return c.shareTimeline(rend.timelinePayload())
+}
+
+func handleTimelineRender(c *client, raw json.RawMessage) error {
+	var p timelineRenderPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	rend := c.session.renderer
+	settings, err := rend.renderSettings().apply(p.Settings)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	if p.FPS == 0 {
+		p.FPS = defaultAnimFPS
+	}
+	j, err := rend.animationJob(settings, p.FPS)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	if err := jobs.submit(j); err != nil {
+		return &protocolError{Code: "unavailable", Message: err.Error()}
+	}
+	return c.send("job", "", j.status())
+}
+
+func handleRecord(c *client, raw json.RawMessage) error {
+	var p recordPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if !p.Recording {
+		rec := c.stopRecording()
+		if rec == nil {
+			return &protocolError{Code: "not_recording", Message: "not recording"}
+		}
+		return c.send("recording", "", rec.status())
+	}
+
+	if p.Format == "" {
+		p.Format = "mp4"
+	}
+	if p.FPS == 0 {
+		p.FPS = defaultRecordingFPS
+	}
+	if err := validateFPS(p.FPS); err != nil {
+		return errBadPayload(err)
+	}
+	interval := time.Second / time.Duration(p.FPS)
+	if p.IntervalMS < 0 {
+		return errBadPayload(errors.New("interval_ms must not be negative"))
+	}
+	if p.IntervalMS > 0 {
+		interval = time.Duration(p.IntervalMS) * time.Millisecond
+	}
+
+	c.stopRecording()
+	rec, err := recordings.start(c.session.renderer, p.Format, p.FPS, interval)
+	switch {
+	case errors.Is(err, errEncoderUnavailable):
+		return &protocolError{Code: "unavailable", Message: err.Error()}
+	case err != nil:
+		return errBadPayload(err)
+	}
+	c.rmu.Lock()
+	c.rec = rec
+	c.rmu.Unlock()
+	return c.send("recording", "", rec.status())
+}
+
+func handleFrameHistory(c *client, raw json.RawMessage) error {
+	return c.send("frame_history", "", c.session.renderer.frameHistory())
+}
+
+// handleScrub streams the history frame from AgoMS milliseconds ago in
+// place of the live one, or the live frames again if AgoMS is omitted.
+func handleScrub(c *client, raw json.RawMessage) error {
+	var p scrubPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if p.AgoMS == nil {
+		c.emu.Lock()
+		c.scrub = nil
+		c.emu.Unlock()
+		return c.send("scrub", "", scrubResultPayload{Live: true})
+	}
+	f, err := c.session.renderer.historyFrameAgo(time.Duration(math.Abs(*p.AgoMS) * float64(time.Millisecond)))
+	if err != nil {
+		return &protocolError{Code: "no_frame", Message: err.Error()}
+	}
+	c.emu.Lock()
+	c.scrub = f.img
+	c.emu.Unlock()
+	frame := f.payload()
+	return c.send("scrub", "", scrubResultPayload{Frame: &frame})
+}
+
+func handleSaveCamera(c *client, raw json.RawMessage) error {
+	var p saveCameraPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if !sceneNameRe.MatchString(p.Name) {
+		return errBadPayload(fmt.Errorf("invalid preset name %q", p.Name))
+	}
+	cameraPresets.save(cameraPreset{Name: p.Name, Camera: c.session.renderer.cameraDesc()})
+	l := cameraPresets.list()
+	c.broadcast("camera_presets", l)
+	return c.send("camera_presets", "", l)
+}
+
+func handleCameraPreset(c *client, raw json.RawMessage) error {
+	var p cameraPresetPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	preset, ok := cameraPresets.get(p.Name)
+	if !ok {
+		return &protocolError{Code: "no_preset", Message: fmt.Sprintf("%v: %q", errPresetNotFound, p.Name)}
+	}
+	d := options.CameraTransition
+	if p.DurationMS != nil {
+		d = time.Duration(*p.DurationMS * float64(time.Millisecond))
+		if d < 0 || d > maxCameraTransition {
+			return errBadPayload(fmt.Errorf("duration_ms must be between 0 and %d", maxCameraTransition.Milliseconds()))
+		}
+	}
+	c.session.renderer.transitionCamera(preset.Camera, d)
+	return nil
+}
+
+func handleView(c *client, raw json.RawMessage) error {
+	var p viewPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	rend := c.session.renderer
+	cam, err := rend.viewCamera(p.Name)
+	if err != nil {
+		return errBadPayload(err)
+	}
+	rend.transitionCamera(cam, options.CameraTransition)
+	return nil
+}
+
+// stopRecording finishes the recording c started, if any, and returns it.
+func (c *client) stopRecording() *recording {
+	c.rmu.Lock()
+	rec := c.rec
+	c.rec = nil
+	c.rmu.Unlock()
+	if rec != nil {
+		rec.stop()
+	}
+	return rec
+}
+
+// shareLights sends the lights to c and the clients sharing its renderer.
+func (c *client) shareLights() error {
+	l := c.session.renderer.lights()
+	c.broadcast("lights", l)
+	return c.send("lights", "", l)
+}
+
+// shareTimeline sends tl to c and the clients sharing its renderer.
+func (c *client) shareTimeline(tl timelinePayload) error {
+	c.broadcast("timeline", tl)
+	return c.send("timeline", "", tl)
+}
+
+func handleUndo(c *client, raw json.RawMessage) error {
+	return editError(c.session.renderer.undo())
+}
+
+func handleRedo(c *client, raw json.RawMessage) error {
+	return editError(c.session.renderer.redo())
+}
+
+func editError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case errNoSelection:
+		return &protocolError{Code: "no_selection", Message: err.Error()}
+	case errNothingToUndo, errNothingToRedo:
+		return &protocolError{Code: "no_history", Message: err.Error()}
+	case errNotALight:
+		return &protocolError{Code: "not_a_light", Message: err.Error()}
+	default:
+		return &protocolError{Code: "bad_payload", Message: err.Error()}
+	}
+}
+
+func handleStreamFormat(c *client, raw json.RawMessage) error {
+	var p streamFormatPayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.setFormat(p); err != nil {
+		return errBadPayload(err)
+	}
+	return c.send("stream_format", "", c.formatInfo())
+}
+
+func handleReset(c *client, raw json.RawMessage) error {
+	c.session.renderer.reset()
+	return nil
+}
+
+func handleHighlightNode(c *client, raw json.RawMessage) error {
+	var p highlightNodePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if err := c.session.renderer.highlightNode(p.ID); err != nil {
+		return errBadPayload(err)
+	}
+	return nil
+}
+
+func handlePause(c *client, raw json.RawMessage) error {
+	var p pausePayload
+	if err := decodePayload(raw, &p); err != nil {
+		return err
+	}
+	if p.Paused {
+		c.session.renderer.pause()
+	} else {
+		c.session.renderer.resume()
+	}
+	return c.send("pause", "", pausePayload{Paused: c.session.renderer.isPaused()})
+}
+
+func (c *client) handle(data []byte, legacyWarned *bool) (string, error) {
+	var (
+		m   message
+		err error
+	)
+	switch isLegacyMessage(data) {
+	case true:
+		if !*legacyWarned {
+			c.log.Warn("client is using the deprecated text protocol")
+			*legacyWarned = true
+		}
+		m, err = legacyMessage(string(data), c.session.renderer.lessonStage())
+	default:
+		m, err = decodeMessage(data)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.log.Debug("message", "type", m.Type, "id", m.ID)
+
+	if _, ok := handlers[m.Type]; !ok {
+		return m.ID, &protocolError{Code: "unknown_type", Message: fmt.Sprintf("unknown message type %q", m.Type)}
+	}
+	if ok, err := c.throttle(m); !ok {
+		c.log.Debug("message throttled", "type", m.Type, "id", m.ID)
+		return m.ID, err
+	}
+	return m.ID, c.dispatch(m)
+}
+
+// dispatch runs m's handler, if c's role allows it.
+func (c *client) dispatch(m message) error {
+	h := handlers[m.Type]
+	if need := messageRole(m.Type); c.user.role < need {
+		return &protocolError{Code: "forbidden", Message: fmt.Sprintf("%s: %s role required", m.Type, need)}
+	}
+	run := func() error { return h(c, m.Payload) }
+	if messageRole(m.Type) >= roleEditor {
+		// Edits from every client of a shared renderer take turns.
+		edit := run
+		run = func() error { return c.session.renderer.do(edit) }
+	}
+	if err := run(); err != nil {
+		if perr, ok := err.(*protocolError); ok {
+			return &protocolError{Code: perr.Code, Message: m.Type + ": " + perr.Message}
+		}
+		c.log.Error("message failed", "type", m.Type, "id", m.ID, "err", err)
+		return err
+	}
+	return nil
+}
+
+// sendError replies to message id with err, as an internal error unless
+// it's a protocolError.
+func (c *client) sendError(id string, err error) error {
+	perr, ok := err.(*protocolError)
+	if !ok {
+		perr = &protocolError{Code: "internal", Message: err.Error()}
+	}
+	return c.send("error", id, perr)
+}
+
+func ws(w http.ResponseWriter, r *http.Request) {
+	user, ok := auth.authenticate(r)
+	if !ok || user.role < roleViewer {
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	clog := logs.With("remote", proxy.remoteAddr(r), "user", user.name)
+	upgrader := websocket.Upgrader{CheckOrigin: proxy.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		clog.Warn("upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.EnableWriteCompression(true)
+
+	sess, resumed := sessions.resume(r.URL.Query().Get("resume"), user.name)
+	if !resumed {
+		if sess, err = sessions.openFor(user.name); err != nil {
+			clog.Error("opening session failed", "err", err)
+			return
+		}
+	}
+	defer sessions.detach(sess)
+	// Every connection opens its own session, so its ID tells connections
+	// apart even when they share a renderer.
+	clog = clog.With("conn", sess.id)
+
+	fps := defaultFPS()
+	if q := r.URL.Query().Get("fps"); q != "" {
+		if fps, err = strconv.Atoi(q); err == nil {
+			err = validateFPS(fps)
+		}
+		if err != nil {
+			clog.Warn("bad fps, using the default", "err", err)
+			fps = defaultFPS()
+		}
+	}
+
+	c := &client{conn: conn, session: sess, resumed: resumed, stream: newStream(fps), remoteAddr: proxy.remoteAddr(r), user: user, log: clog,
+		limits: map[string]*tokenBucket{}, deferred: map[string]*deferredMessage{}, hoverWake: make(chan struct{}, 1)}
+	c.present = presencePayload{Session: sess.id, User: user.name, Selected: -1}
+	if err := clients.add(c); err != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		c.log.Warn("connection refused", "err", err)
+		return
+	}
+	defer clients.remove(c)
+	defer c.stopDeferred()
+	c.log.Info("connected", "fps", fps, "resumed", resumed)
+	defer c.log.Info("disconnected")
+	hooks.emit(Event{Type: EventClientConnected, Session: sess.id, User: user.name, Remote: c.remoteAddr})
+	defer hooks.emit(Event{Type: EventClientDisconnected, Session: sess.id, User: user.name, Remote: c.remoteAddr})
+	defer c.stopRecording()
+	defer c.broadcast("presence_leave", presenceLeavePayload{Session: sess.id})
+	wsConnections.Inc()
+	defer wsConnections.Dec()
+	defer wsBytesSent.DeleteLabelValues(sessionLabel(sess))
+
+	format := streamFormatPayload{Format: r.URL.Query().Get("format"), Tiles: r.URL.Query().Get("tiles") == "1", Overlay: r.URL.Query().Get("overlay") == "1", Envelope: r.URL.Query().Get("envelope") == "1"}
+	if q := r.URL.Query().Get("quality"); q != "" {
+		format.Quality, err = strconv.Atoi(q)
+	}
+	if err == nil {
+		err = c.setFormat(format)
+	}
+	if err != nil {
+		c.log.Warn("bad stream format, falling back to png", "err", err)
+		c.setFormat(streamFormatPayload{Format: "png"})
+	}
+
+	done := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		if err := c.writeLoop(done); err != nil && err != errClientGone {
+			c.log.Error("write loop failed", "err", err)
+			// Unblocks the reader below.
+			conn.Close()
+		}
+	}()
+	hoverDone := make(chan struct{})
+	go func() {
+		defer close(hoverDone)
+		c.hoverLoop(done)
+	}()
+	defer func() {
+		close(done)
+		<-writerDone
+		<-hoverDone
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	legacyWarned := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.log.Warn("read failed", "err", err)
+			}
+			break
+		}
+
+		id, err := c.handle(data, &legacyWarned)
+		if err == nil {
+			continue
+		}
+		if err := c.sendError(id, err); err != nil {
+			c.log.Warn("writing error failed", "err", err)
+			break
+		}
+	}
+}
+
+// writeLoop streams frames and metadata to c until done is closed or a
+// write fails. It waits for the frame in flight before returning, so
+// nothing writes to the connection after it.
+func (c *client) writeLoop(done <-chan struct{}) error {
+	rend := c.session.renderer
+	failed := make(chan error, 1)
+	var frames sync.WaitGroup
+	defer frames.Wait()
+
+	wait := func(d time.Duration) error {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-done:
+			return errClientGone
+		case err := <-failed:
+			return err
+		case <-t.C:
+			return nil
+		}
+	}
+
+	if err := c.send("session", "", sessionPayload{ID: c.session.id, Token: c.session.token, Resumed: c.resumed}); err != nil {
+		return err
+	}
+	if err := c.send("settings", "", rend.renderSettings()); err != nil {
+		return err
+	}
+	camera := rend.cameraState()
+	if err := c.send("camera", "", camera); err != nil {
+		return err
+	}
+	if err := c.send("stream_format", "", c.formatInfo()); err != nil {
+		return err
+	}
+	if err := c.sendPeers(); err != nil {
+		return err
+	}
+	if cmp := rend.comparePayload(); cmp.Enabled {
+		if err := c.send("compare", "", cmp); err != nil {
+			return err
+		}
+	}
+	if tl := rend.timelinePayload(); len(tl.Keyframes) > 0 {
+		if err := c.send("timeline", "", tl); err != nil {
+			return err
+		}
+	}
+	if l := rend.lights(); len(l.Lights) > 0 {
+		if err := c.send("lights", "", l); err != nil {
+			return err
+		}
+	}
+	if l := cameraPresets.list(); len(l) > 0 {
+		if err := c.send("camera_presets", "", l); err != nil {
+			return err
+		}
+	}
+
+	lesson := -2
+	var convergence convergencePayload
+	var reached targetReachedPayload
+	var lastStats, lastPing time.Time
+	level := 0
+	for {
+		start := time.Now()
+		if time.Since(lastPing) >= pingPeriod {
+			lastPing = start
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, start.Add(writeWait)); err != nil {
+				return err
+			}
+		}
+		// Everything below waits on the connection, so the whole tick is
+		// skipped while the last frame is still being written.
+		if !c.stream.begin() {
+			if err := wait(c.stream.interval()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.sendMetadata(&lesson, &convergence, &camera, &reached, &lastStats, &level); err != nil {
+			c.stream.done(time.Since(start))
+			return err
+		}
+		overlay, err := c.encodeOverlay(rend)
+		if err != nil {
+			c.stream.done(time.Since(start))
+			return err
+		}
+		data, info, err := c.encodeFrame(rend)
+		if err != nil {
+			c.stream.done(time.Since(start))
+			return err
+		}
+		frames.Add(1)
+		go func() {
+			defer frames.Done()
+			defer func() { c.stream.done(time.Since(start)) }()
+			defer encodeBuffers.put(overlay)
+			defer encodeBuffers.put(data)
+			if data == nil {
+				return
+			}
+			var err error
+			if overlay != nil {
+				err = c.write(websocket.BinaryMessage, overlay.Bytes())
+			}
+			if err == nil {
+				err = c.write(websocket.BinaryMessage, data.Bytes())
+			}
+			if err == nil {
+				err = c.send("frame_info", "", info)
+			}
+			if err != nil {
+				select {
+				case failed <- err:
+				default:
+				}
+			}
+		}()
+		if err := wait(c.stream.interval() - time.Since(start)); err != nil {
+			return err
+		}
+	}
+}
+
+// sendMetadata sends whatever of the stream quality, lesson, convergence,
+// camera, target and stats changed since the last tick. reached is the
+// last generation target_reached was sent for.
+func (c *client) sendMetadata(lesson *int, convergence *convergencePayload, camera *cameraStatePayload, reached *targetReachedPayload, lastStats *time.Time, level *int) error {
+	rend := c.session.renderer
+	if l := c.stream.degradeLevel(); l != *level {
+		*level = l
+		if err := c.send("stream_quality", "", degradedQuality(l, c.formatInfo().Quality)); err != nil {
+			return err
+		}
+	}
+	if stage := rend.lessonStage(); stage != *lesson {
+		*lesson = stage
+		if err := c.send("lesson", "", lessonInfo(stage)); err != nil {
+			return err
+		}
+	}
+	if p, ok := rend.convergence(); ok && p != *convergence {
+		*convergence = p
+		if err := c.send("convergence", "", p); err != nil {
+			return err
+		}
+	}
+	if p, ok := rend.targetReached(); ok && p != *reached {
+		*reached = p
+		if err := c.send("target_reached", "", p); err != nil {
+			return err
+		}
+	}
+	if cam := rend.cameraState(); cam != *camera {
+		*camera = cam
+		if err := c.send("camera", "", cam); err != nil {
+			return err
+		}
+	}
+	if time.Since(*lastStats) >= statsInterval {
+		*lastStats = time.Now()
+		if err := c.send("stats", "", rend.stats()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errClientGone ends the write loop once the reader is done with the
+// connection, it's not a failure.
+var errClientGone = errors.New("client gone")